@@ -1,11 +1,14 @@
 package dnsstub
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"fmt"
 	"github.com/miekg/dns"
 	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,8 +16,9 @@ import (
 
 type query struct {
 	handle int // identifier to match answer with question
-	qname  string
-	rtype  uint16
+	msg    *dns.Msg
+	// which server to try first, so queries are spread across them
+	first_server int
 }
 
 type answer struct {
@@ -27,11 +31,15 @@ type answer struct {
 }
 
 type StubResolver struct {
+	ctx              context.Context
 	lock             sync.Mutex
 	cond             *sync.Cond
 	next_handle      int
+	next_server      int
 	queries          chan *query
 	finished_answers []*answer
+	// the goroutines sending queries, which Close() waits for
+	workers sync.WaitGroup
 }
 
 func RandUint16() (uint16, error) {
@@ -44,12 +52,217 @@ func RandUint16() (uint16, error) {
 	return uint16(id.Uint64()), nil
 }
 
+// Transport to send a query over.
+type Transport int
+
+const (
+	// UDP, falling back to TCP for truncated answers or timeouts
+	TransportAuto Transport = iota
+	// UDP only, returning truncated answers as they are
+	TransportUDPOnly
+	// TCP only
+	TransportTCPOnly
+)
+
+// names of the transports, as used in configuration
+var transport_names = map[string]Transport{
+	"auto": TransportAuto,
+	"udp":  TransportUDPOnly,
+	"tcp":  TransportTCPOnly,
+}
+
+// Get a transport from its name, one of "auto", "udp", or "tcp".
+func ParseTransport(name string) (Transport, error) {
+	transport, found := transport_names[name]
+	if !found {
+		return TransportAuto, fmt.Errorf("Unknown transport '%s', must be auto, udp, or tcp", name)
+	}
+	return transport, nil
+}
+
+// Options for sending a query. The zero value uses the defaults of
+// the DNS library.
+type DnsQueryOpts struct {
+	// how long to wait for each attempt as a whole, overriding the
+	// dial and read timeouts if set
+	Timeout time.Duration
+	// how long to wait to connect to the server
+	DialTimeout time.Duration
+	// how long to wait for an answer once we have sent the query
+	ReadTimeout time.Duration
+	// which transport to use
+	Transport Transport
+	// IP address family to use, either 4 or 6, or 0 for any
+	Family int
+	// how many times to try UDP before giving up or falling back to
+	// TCP, or 0 for the default of 3
+	UDPTries int
+}
+
+// default number of times to try a query over UDP
+const default_udp_tries = 3
+
+// Get the network name for the DNS library for a protocol, like "udp4"
+// for "udp" when we are only using IPv4.
+func (opts *DnsQueryOpts) network(protocol string) string {
+	if (opts.Family == 4) || (opts.Family == 6) {
+		return protocol + strconv.Itoa(opts.Family)
+	}
+	return protocol
+}
+
+// Function used to do the actual exchange, replaced in tests.
+var exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	return client_exchange(client, query, server)
+}
+
+// Function used to connect to a server, replaced in tests. The network
+// is as for the DNS library, so ends with "-tls" for DNS over TLS.
+var dial = func(dialer *net.Dialer, network string, server string, tls_config *tls.Config) (net.Conn, error) {
+	if strings.HasSuffix(network, "-tls") {
+		return tls.DialWithDialer(dialer, strings.TrimSuffix(network, "-tls"), server, tls_config)
+	}
+	return dialer.Dial(network, server)
+}
+
+// how long the DNS library waits for each step of an exchange by default
+const default_timeout = 2 * time.Second
+
+/*
+   Send a query and read the answer, using the settings of the client.
+
+   The DNS library connects using the write timeout of the client, and
+   never uses the dial timeout, so we connect ourselves and then do the
+   rest of the exchange on that connection. Each of the dial, write, and
+   read timeouts defaults to 2 seconds, and the client Timeout overrides
+   all of them if it is set, as in the library.
+*/
+func client_exchange(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	timeout := func(t time.Duration) time.Duration {
+		if client.Timeout != 0 {
+			return client.Timeout
+		}
+		if t != 0 {
+			return t
+		}
+		return default_timeout
+	}
+	network := client.Net
+	if network == "" {
+		network = "udp"
+	}
+	conn, err := dial(&net.Dialer{Timeout: timeout(client.DialTimeout)}, network, server, client.TLSConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+	// use a buffer big enough for the answer size we asked for
+	if opt := query.IsEdns0(); (opt != nil) && (opt.UDPSize() >= dns.MinMsgSize) {
+		co.UDPSize = opt.UDPSize()
+	}
+	start := time.Now()
+	co.SetWriteDeadline(start.Add(timeout(client.WriteTimeout)))
+	err = co.WriteMsg(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	co.SetReadDeadline(time.Now().Add(timeout(client.ReadTimeout)))
+	r, err := co.ReadMsg()
+	rtt := time.Since(start)
+	if (err == nil) && (r.Id != query.Id) {
+		err = dns.ErrId
+	}
+	return r, rtt, err
+}
+
+// Do an exchange, giving up when the context is done. The DNS library
+// does not stop an exchange when the context is cancelled, so instead
+// we stop waiting for it, and it finishes on its own when it times out.
+func exchange_context(ctx context.Context, client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	// a context that is never cancelled needs no goroutine
+	if ctx.Done() == nil {
+		return exchange(client, query, server)
+	}
+	if ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+	type result struct {
+		r   *dns.Msg
+		rtt time.Duration
+		err error
+	}
+	// the exchange may outlive us, so give it its own query to send,
+	// since the caller may change theirs
+	query_copy := query.Copy()
+	do_exchange := exchange
+	done := make(chan result, 1)
+	go func() {
+		r, rtt, err := do_exchange(client, query_copy, server)
+		done <- result{r, rtt, err}
+	}()
+	select {
+	case res := <-done:
+		return res.r, res.rtt, res.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
 /*
    Send a query to a DNS server, retrying and handling truncation.
 */
 func DnsQuery(server string, query *dns.Msg) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := DnsQueryWithOpts(server, query, nil)
+	// never return an answer that might be spoofed
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, rtt, nil
+}
+
+/*
+   Send a query to a DNS server like DnsQuery(), giving up if the context
+   is cancelled or its deadline passes, in which case the error is the
+   one from the context.
+*/
+func DnsQueryContext(ctx context.Context, server string, query *dns.Msg) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := DnsQueryWithOptsContext(ctx, server, query, nil)
+	// never return an answer that might be spoofed
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, rtt, nil
+}
+
+/*
+   Send a query to a DNS server using the given options, which may be
+   nil to use the defaults.
+
+   The query ID is set to a random value. An answer with a different ID
+   is returned along with dns.ErrId, so that callers can report it.
+*/
+func DnsQueryWithOpts(server string, query *dns.Msg, opts *DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+	return DnsQueryWithOptsContext(context.Background(), server, query, opts)
+}
+
+/*
+   Send a query to a DNS server using the given options, like
+   DnsQueryWithOpts(), giving up if the context is cancelled or its
+   deadline passes.
+*/
+func DnsQueryWithOptsContext(ctx context.Context, server string, query *dns.Msg, opts *DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+	if opts == nil {
+		opts = new(DnsQueryOpts)
+	}
 	// try to query first in UDP
 	dnsClient := new(dns.Client)
+	dnsClient.Timeout = opts.Timeout
+	dnsClient.DialTimeout = opts.DialTimeout
+	dnsClient.ReadTimeout = opts.ReadTimeout
+	if opts.Family != 0 {
+		dnsClient.Net = opts.network("udp")
+	}
 	id, err := RandUint16()
 	if err != nil {
 		return nil, 0, err
@@ -58,13 +271,25 @@ func DnsQuery(server string, query *dns.Msg) (*dns.Msg, time.Duration, error) {
 	var r *dns.Msg
 	var rtt time.Duration
 	// try a few times with UDP
-	for i := 0; i < 3; i++ {
-		r, rtt, err = dnsClient.Exchange(query, server)
+	udp_tries := opts.UDPTries
+	if udp_tries <= 0 {
+		udp_tries = default_udp_tries
+	}
+	for i := 0; (i < udp_tries) && (opts.Transport != TransportTCPOnly); i++ {
+		r, rtt, err = exchange_context(ctx, dnsClient, query, server)
 		if err != nil {
+			// stop if we have been cancelled
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
 			// no need to retry if we get a truncated answer
 			if err == dns.ErrTruncated {
 				break
 			}
+			// an answer that is not for our query may be spoofed
+			if err == dns.ErrId {
+				return r, rtt, err
+			}
 			// if we have a non-timeout error return it
 			nerr, ok := err.(net.Error)
 			if !(ok && nerr.Timeout()) {
@@ -78,9 +303,19 @@ func DnsQuery(server string, query *dns.Msg) (*dns.Msg, time.Duration, error) {
 			return r, rtt, nil
 		}
 	}
+	// without TCP we return whatever we got, even if truncated
+	if opts.Transport == TransportUDPOnly {
+		if r == nil {
+			return nil, 0, err
+		}
+		return r, rtt, nil
+	}
 	// if we got a truncation or timeouts, try again in TCP
-	dnsClient.Net = "tcp"
-	r, rtt, err = dnsClient.Exchange(query, server)
+	dnsClient.Net = opts.network("tcp")
+	r, rtt, err = exchange_context(ctx, dnsClient, query, server)
+	if err == dns.ErrId {
+		return r, rtt, err
+	}
 	if err != nil {
 		return nil, 0, err
 	}
@@ -88,26 +323,72 @@ func DnsQuery(server string, query *dns.Msg) (*dns.Msg, time.Duration, error) {
 	return r, rtt, nil
 }
 
+/*
+   Send a query to a DNS server over TLS (RFC 7858), usually on port 853.
+
+   The server certificate is verified against the ServerName in the TLS
+   configuration, or against the host in the server address if that is
+   empty. Setting InsecureSkipVerify accepts any certificate, which is
+   useful for servers with self-signed certificates. A nil configuration
+   uses the defaults.
+
+   The timeouts and address family in the options are used as in
+   DnsQueryWithOpts(); the transport and UDP tries do not apply. A nil
+   set of options uses the defaults.
+
+   As with DnsQueryWithOpts(), an answer with a different ID is returned
+   along with dns.ErrId.
+*/
+func DnsQueryTLS(server string, query *dns.Msg, tls_config *tls.Config, opts *DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+	if opts == nil {
+		opts = new(DnsQueryOpts)
+	}
+	dnsClient := new(dns.Client)
+	dnsClient.Timeout = opts.Timeout
+	dnsClient.DialTimeout = opts.DialTimeout
+	dnsClient.ReadTimeout = opts.ReadTimeout
+	dnsClient.Net = opts.network("tcp") + "-tls"
+	dnsClient.TLSConfig = tls_config
+	id, err := RandUint16()
+	if err != nil {
+		return nil, 0, err
+	}
+	query.Id = id
+	r, rtt, err := exchange(dnsClient, query, server)
+	if err == dns.ErrId {
+		return r, rtt, err
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, rtt, nil
+}
+
+// Get a TLS configuration for DnsQueryTLS(), checking the certificate
+// for the given server name (or the server address if empty), unless
+// insecure is set.
+func NewTLSConfig(server_name string, insecure bool) *tls.Config {
+	return &tls.Config{ServerName: server_name, InsecureSkipVerify: insecure}
+}
+
+// Send the queries for a stub resolver to its servers, each of which is
+// an address with a port, until the resolver is closed. Each query goes
+// to the next server in turn, and to the ones after it if that fails.
 func stub_resolve(resolver *StubResolver, servers []string) {
+	defer resolver.workers.Done()
 	for q := range resolver.queries {
-		dns_query := new(dns.Msg)
-		dns_query.RecursionDesired = true
-		dns_query.SetQuestion(q.qname, q.rtype)
 		a := new(answer)
 		a.handle = q.handle
-		a.qname = q.qname
-		a.rtype = q.rtype
+		if len(q.msg.Question) > 0 {
+			a.qname = q.msg.Question[0].Name
+			a.rtype = q.msg.Question[0].Qtype
+		}
 		a.answer = nil
-		for _, server := range servers {
-			// look for ':' because that indicates an IPv6 address
-			var resolver string
-			if strings.ContainsRune(server, ':') {
-				resolver = "[" + server + "]:53"
-			} else {
-				resolver = server + ":53"
-			}
-			a.answer, a.rtt, a.err = DnsQuery(resolver, dns_query)
-			if a.answer != nil {
+		for n := range servers {
+			server := servers[(q.first_server+n)%len(servers)]
+			a.answer, a.rtt, a.err = DnsQueryContext(resolver.ctx, server, q.msg)
+			// no other server will do any better once we are cancelled
+			if (a.answer != nil) || (resolver.ctx.Err() != nil) {
 				break
 			}
 		}
@@ -119,10 +400,23 @@ func stub_resolve(resolver *StubResolver, servers []string) {
 }
 
 func Init(concurrency int, server_ips []net.IP) (resolver *StubResolver, err error) {
+	return InitContext(context.Background(), concurrency, server_ips, 0)
+}
+
+// Set up a stub resolver like Init(), where cancelling the context
+// aborts any lookups that are pending, which then get the error from
+// the context. The queries go to the given port of the servers, where 0
+// means port 53. Without any servers, the servers and port in
+// /etc/resolv.conf are used.
+func InitContext(ctx context.Context, concurrency int, server_ips []net.IP, port uint16) (resolver *StubResolver, err error) {
 	stub := new(StubResolver)
+	stub.ctx = ctx
+	if port == 0 {
+		port = 53
+	}
 	var servers []string
 	for _, ip := range server_ips {
-		servers = append(servers, ip.String())
+		servers = append(servers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
 	}
 	if len(servers) == 0 {
 		resolv_conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
@@ -130,9 +424,12 @@ func Init(concurrency int, server_ips []net.IP) (resolver *StubResolver, err err
 			newerr := fmt.Errorf("error reading resolver configuration from '/etc/resolv.conf'; %s", err)
 			return nil, newerr
 		}
-		servers = resolv_conf.Servers
+		for _, server := range resolv_conf.Servers {
+			servers = append(servers, net.JoinHostPort(server, resolv_conf.Port))
+		}
 	}
 	stub.queries = make(chan *query, concurrency*4)
+	stub.workers.Add(concurrency)
 	for i := 0; i < concurrency; i++ {
 		go stub_resolve(stub, servers)
 	}
@@ -140,19 +437,54 @@ func Init(concurrency int, server_ips []net.IP) (resolver *StubResolver, err err
 	return stub, nil
 }
 
+// Send a query, asking for recursion, without waiting for the answer.
 func (resolver *StubResolver) AsyncQuery(qname string, rtype uint16) (handle int) {
+	msg := new(dns.Msg)
+	msg.RecursionDesired = true
+	msg.SetQuestion(qname, rtype)
+	return resolver.QueryMsg(msg)
+}
+
+// Send a query message as it is, so the caller can set the flags, EDNS
+// options, and class, without waiting for the answer. Only the message
+// ID is changed, in a copy, since each query gets a random ID.
+func (resolver *StubResolver) QueryMsg(msg *dns.Msg) (handle int) {
 	q := new(query)
 	resolver.lock.Lock()
 	resolver.next_handle += 1
 	q.handle = resolver.next_handle
+	q.first_server = resolver.next_server
+	resolver.next_server += 1
 	resolver.lock.Unlock()
-	q.qname = qname
-	q.rtype = rtype
+	q.msg = msg.Copy()
 	resolver.queries <- q
 	return q.handle
 }
 
-func (resolver *StubResolver) Wait() (*dns.Msg, time.Duration, string, uint16, error) {
+// The answer to a query sent with AsyncQuery() or QueryMsg(), as
+// returned by WaitResult() and WaitResultByHandle().
+type Result struct {
+	Handle int      // the handle returned by AsyncQuery() or QueryMsg()
+	Qname  string   // the name queried for
+	Rtype  uint16   // the type queried for
+	Msg    *dns.Msg // the answer, or nil if no server answered
+	Rtt    time.Duration
+	Err    error
+}
+
+func (a *answer) result() *Result {
+	return &Result{
+		Handle: a.handle,
+		Qname:  a.qname,
+		Rtype:  a.rtype,
+		Msg:    a.answer,
+		Rtt:    a.rtt,
+		Err:    a.err,
+	}
+}
+
+// Wait for the next answer to any query.
+func (resolver *StubResolver) WaitResult() *Result {
 	resolver.lock.Lock()
 	defer resolver.lock.Unlock()
 
@@ -162,15 +494,14 @@ func (resolver *StubResolver) Wait() (*dns.Msg, time.Duration, string, uint16, e
 
 	a := resolver.finished_answers[0]
 	resolver.finished_answers = resolver.finished_answers[1:]
-	return a.answer, a.rtt, a.qname, a.rtype, a.err
+	return a.result()
 }
 
-// Wait for a specific handle.
-// Note that mixing Wait() and WaitByHandle() is dangerous because
-// a Wait() may read a result before the WaitByHandle() gets it, so
-// it may wait forever.
-func (resolver *StubResolver) WaitByHandle(handle int) (*dns.Msg, time.Duration, string, uint16, error) {
-
+// Wait for the answer to a specific handle.
+// Note that mixing WaitResult() and WaitResultByHandle() is dangerous
+// because a WaitResult() may read a result before the
+// WaitResultByHandle() gets it, so it may wait forever.
+func (resolver *StubResolver) WaitResultByHandle(handle int) *Result {
 	resolver.lock.Lock()
 	defer resolver.lock.Unlock()
 
@@ -179,19 +510,36 @@ func (resolver *StubResolver) WaitByHandle(handle int) (*dns.Msg, time.Duration,
 			if a.handle == handle {
 				resolver.finished_answers = append(resolver.finished_answers[:n],
 					resolver.finished_answers[n+1:]...)
-				return a.answer, a.rtt, a.qname, a.rtype, a.err
+				return a.result()
 			}
 		}
 		resolver.cond.Wait()
 	}
 }
 
+// Like WaitResult(), with the answer as separate values.
+func (resolver *StubResolver) Wait() (*dns.Msg, time.Duration, string, uint16, error) {
+	r := resolver.WaitResult()
+	return r.Msg, r.Rtt, r.Qname, r.Rtype, r.Err
+}
+
+// Like WaitResultByHandle(), with the answer as separate values.
+// The same caution about mixing with Wait() applies.
+func (resolver *StubResolver) WaitByHandle(handle int) (*dns.Msg, time.Duration, string, uint16, error) {
+	r := resolver.WaitResultByHandle(handle)
+	return r.Msg, r.Rtt, r.Qname, r.Rtype, r.Err
+}
+
 func (resolver *StubResolver) SyncQuery(qname string, rtype uint16) (*dns.Msg, time.Duration, error) {
 	handle := resolver.AsyncQuery(qname, rtype)
 	answer, rtt, _, _, err := resolver.WaitByHandle(handle)
 	return answer, rtt, err
 }
 
+// Stop sending queries, once the ones already sent have been answered.
+// This waits for any queries in progress, and their answers can still be
+// read afterwards. No more queries may be sent after this.
 func (resolver *StubResolver) Close() {
 	close(resolver.queries)
+	resolver.workers.Wait()
 }
@@ -1,12 +1,22 @@
 package dnsstub
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"github.com/miekg/dns"
 	"io"
+	"math/big"
 	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRandUint16(t *testing.T) {
@@ -292,3 +302,714 @@ func TestDnsQuery(t *testing.T) {
 		t.Fatalf("Answer not expected answer:\n%s\n%s\n", answer, expected_answer)
 	}
 }
+
+func TestDnsQueryReadTimeout(t *testing.T) {
+	// a UDP server that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer conn.Close()
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	opts := DnsQueryOpts{ReadTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, _, err = DnsQueryWithOpts(conn.LocalAddr().String(), &question, &opts)
+	if err == nil {
+		t.Fatalf("Expected error from server that does not answer")
+	}
+	// three UDP tries, then a TCP try that is refused
+	if time.Since(start) > time.Second {
+		t.Errorf("Query took %s with read timeout of %s", time.Since(start), opts.ReadTimeout)
+	}
+}
+
+func TestDnsQueryUDPTries(t *testing.T) {
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	for _, tries := range []int{0, 1, 5} {
+		// a UDP server that never answers, counting the queries it gets
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %s", err)
+		}
+		received := make(chan int)
+		go func() {
+			count := 0
+			buffer := make([]byte, 65536)
+			for {
+				_, _, err := conn.ReadFrom(buffer)
+				if err != nil {
+					received <- count
+					return
+				}
+				count += 1
+			}
+		}()
+
+		opts := DnsQueryOpts{Timeout: 50 * time.Millisecond, UDPTries: tries,
+			Transport: TransportUDPOnly}
+		start := time.Now()
+		_, _, err = DnsQueryWithOpts(conn.LocalAddr().String(), &question, &opts)
+		elapsed := time.Since(start)
+		conn.Close()
+		count := <-received
+		if err == nil {
+			t.Fatalf("Expected error from server that does not answer")
+		}
+		nerr, ok := err.(net.Error)
+		if !ok || !nerr.Timeout() {
+			t.Errorf("DnsQueryWithOpts(%+v) error %v, expected a timeout", opts, err)
+		}
+		want := tries
+		if want == 0 {
+			want = default_udp_tries
+		}
+		if count != want {
+			t.Errorf("DnsQueryWithOpts(%+v) sent %d queries, expected %d", opts, count, want)
+		}
+		if elapsed > time.Duration(want)*opts.Timeout+time.Second {
+			t.Errorf("Query took %s with %d tries of %s", elapsed, want, opts.Timeout)
+		}
+	}
+}
+
+// Start a UDP server on the loopback address that takes answer_delay
+// to answer, and replace the dial function with one that takes
+// connect_delay to connect, failing as net.Dialer does when its timeout
+// is shorter. The exchange itself is done as usual.
+func slow_server(t *testing.T, connect_delay time.Duration, answer_delay time.Duration) (addr string, restore func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(answer_delay)
+		answer := new(dns.Msg)
+		answer.SetReply(r)
+		w.WriteMsg(answer)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(handler)}
+	go server.ActivateAndServe()
+
+	orig := dial
+	dial = func(dialer *net.Dialer, network string, server string, tls_config *tls.Config) (net.Conn, error) {
+		if dialer.Timeout < connect_delay {
+			time.Sleep(dialer.Timeout)
+			timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: timeout}
+		}
+		time.Sleep(connect_delay)
+		return orig(dialer, network, server, tls_config)
+	}
+	return conn.LocalAddr().String(), func() {
+		dial = orig
+		server.Shutdown()
+	}
+}
+
+func TestDnsQueryDialVsReadTimeout(t *testing.T) {
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	short := 100 * time.Millisecond
+	long := time.Second
+	cases := []struct {
+		connect_delay time.Duration
+		answer_delay  time.Duration
+		opts          DnsQueryOpts
+		want_op       string
+	}{
+		// slow to connect, but we wait long enough
+		{300 * time.Millisecond, 0, DnsQueryOpts{DialTimeout: long, ReadTimeout: short}, ""},
+		// slow to connect
+		{300 * time.Millisecond, 0, DnsQueryOpts{DialTimeout: short, ReadTimeout: long}, "dial"},
+		// slow to answer
+		{0, 300 * time.Millisecond, DnsQueryOpts{DialTimeout: long, ReadTimeout: short}, "read"},
+		// slow to answer, but we wait long enough
+		{0, 300 * time.Millisecond, DnsQueryOpts{DialTimeout: short, ReadTimeout: long}, ""},
+	}
+	for _, c := range cases {
+		addr, restore := slow_server(t, c.connect_delay, c.answer_delay)
+		c.opts.Transport = TransportUDPOnly
+		c.opts.UDPTries = 1
+		_, _, err := DnsQueryWithOpts(addr, &question, &c.opts)
+		restore()
+		if c.want_op == "" {
+			if err != nil {
+				t.Errorf("DnsQueryWithOpts(%+v) error: %s", c.opts, err)
+			}
+			continue
+		}
+		operr, ok := err.(*net.OpError)
+		if !ok || !operr.Timeout() || (operr.Op != c.want_op) {
+			t.Errorf("DnsQueryWithOpts(%+v) error %v, want %s timeout", c.opts, err, c.want_op)
+		}
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	cases := []struct {
+		name      string
+		transport Transport
+		ok        bool
+	}{
+		{"auto", TransportAuto, true},
+		{"udp", TransportUDPOnly, true},
+		{"tcp", TransportTCPOnly, true},
+		{"sctp", TransportAuto, false},
+		{"", TransportAuto, false},
+	}
+	for _, c := range cases {
+		transport, err := ParseTransport(c.name)
+		if (transport != c.transport) || ((err == nil) != c.ok) {
+			t.Errorf("ParseTransport(%q) == %d, %v", c.name, transport, err)
+		}
+	}
+}
+
+func TestDnsQueryTCPOnly(t *testing.T) {
+	var nets []string
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		nets = append(nets, client.Net)
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	_, _, err := DnsQueryWithOpts("192.0.2.1:53", &question, &DnsQueryOpts{Transport: TransportTCPOnly})
+	if err != nil {
+		t.Fatalf("DnsQueryWithOpts() error: %s", err)
+	}
+	if (len(nets) != 1) || (nets[0] != "tcp") {
+		t.Errorf("TCP-only query sent over %q, expected only tcp", nets)
+	}
+}
+
+func TestDnsQueryUDPOnly(t *testing.T) {
+	var nets []string
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		nets = append(nets, client.Net)
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		answer.Truncated = true
+		return answer, time.Millisecond, nil
+	}
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	r, _, err := DnsQueryWithOpts("192.0.2.1:53", &question, &DnsQueryOpts{Transport: TransportUDPOnly})
+	if err != nil {
+		t.Fatalf("DnsQueryWithOpts() error: %s", err)
+	}
+	if (r == nil) || !r.Truncated {
+		t.Errorf("UDP-only query returned %v, expected the truncated answer", r)
+	}
+	if (len(nets) != 1) || (nets[0] != "") {
+		t.Errorf("UDP-only query sent over %q, expected one UDP query", nets)
+	}
+}
+
+func TestDnsQueryTruncatedNil(t *testing.T) {
+	var nets []string
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		nets = append(nets, client.Net)
+		// a truncation error over UDP, without any answer
+		if client.Net != "tcp" {
+			return nil, 0, dns.ErrTruncated
+		}
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	r, _, err := DnsQueryWithOpts("192.0.2.1:53", &question, nil)
+	if (err != nil) || (r == nil) {
+		t.Fatalf("DnsQueryWithOpts() == %v, %v, expected the TCP answer", r, err)
+	}
+	if (len(nets) != 2) || (nets[0] != "") || (nets[1] != "tcp") {
+		t.Errorf("query sent over %q, expected UDP then tcp", nets)
+	}
+	// without TCP there is nothing to return but the error
+	r, _, err = DnsQueryWithOpts("192.0.2.1:53", &question, &DnsQueryOpts{Transport: TransportUDPOnly})
+	if (err != dns.ErrTruncated) || (r != nil) {
+		t.Errorf("UDP-only DnsQueryWithOpts() == %v, %v, expected %v", r, err, dns.ErrTruncated)
+	}
+}
+
+func TestDnsQueryWrongID(t *testing.T) {
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		answer.Id = query.Id + 1
+		return answer, time.Millisecond, dns.ErrId
+	}
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	r, _, err := DnsQueryWithOpts("192.0.2.1:53", &question, nil)
+	if err != dns.ErrId {
+		t.Fatalf("DnsQueryWithOpts() with wrong ID returned error %v, expected %v", err, dns.ErrId)
+	}
+	if (r == nil) || (r.Id == question.Id) {
+		t.Errorf("DnsQueryWithOpts() with wrong ID did not return the answer")
+	}
+	// the simple interface does not return the answer at all
+	r, _, err = DnsQuery("192.0.2.1:53", &question)
+	if (err != dns.ErrId) || (r != nil) {
+		t.Errorf("DnsQuery() with wrong ID == %v, %v, expected no answer", r, err)
+	}
+}
+
+func TestDnsQueryFamily(t *testing.T) {
+	var nets []string
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		nets = append(nets, client.Net)
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		// make the UDP answer truncated, so we also try TCP
+		answer.Truncated = !strings.HasPrefix(client.Net, "tcp")
+		return answer, time.Millisecond, nil
+	}
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	for _, family := range []int{4, 6} {
+		nets = nil
+		_, _, err := DnsQueryWithOpts("192.0.2.1:53", &question, &DnsQueryOpts{Family: family})
+		if err != nil {
+			t.Fatalf("DnsQueryWithOpts() error: %s", err)
+		}
+		want := []string{fmt.Sprintf("udp%d", family), fmt.Sprintf("tcp%d", family)}
+		if (len(nets) != 2) || (nets[0] != want[0]) || (nets[1] != want[1]) {
+			t.Errorf("IPv%d query sent over %q, expected %q", family, nets, want)
+		}
+	}
+}
+
+// Start a DNS over TLS server on the loopback address, with a
+// self-signed certificate for the given name, which answers every query
+// with an empty answer.
+func SetupDotServer(t *testing.T, name string) (addr string, roots *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %s", err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+
+	config := tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &config)
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	handler := func(w dns.ResponseWriter, query *dns.Msg) {
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		w.WriteMsg(answer)
+	}
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(handler)}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String(), roots
+}
+
+func TestDnsQueryTLS(t *testing.T) {
+	addr, roots := SetupDotServer(t, "dot.example")
+
+	verified := NewTLSConfig("dot.example", false)
+	verified.RootCAs = roots
+	wrong_name := NewTLSConfig("other.example", false)
+	wrong_name.RootCAs = roots
+	cases := []struct {
+		desc   string
+		config *tls.Config
+		ok     bool
+	}{
+		{"trusted certificate", verified, true},
+		{"certificate for another name", wrong_name, false},
+		{"untrusted certificate", NewTLSConfig("dot.example", false), false},
+		{"untrusted certificate, skipping verification", NewTLSConfig("", true), true},
+	}
+	for _, c := range cases {
+		var question dns.Msg
+		question.SetQuestion("example.", dns.TypeNS)
+		answer, _, err := DnsQueryTLS(addr, &question, c.config, nil)
+		if !c.ok {
+			if (err == nil) || (answer != nil) {
+				t.Errorf("DnsQueryTLS() with %s == %v, %v, expected an error", c.desc, answer, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("DnsQueryTLS() with %s error: %s", c.desc, err)
+			continue
+		}
+		if (answer.Id != question.Id) || !answer.Response || (answer.Question[0] != question.Question[0]) {
+			t.Errorf("DnsQueryTLS() with %s answer not for question:\n%s", c.desc, answer)
+		}
+	}
+}
+
+func TestDnsQueryTLSOpts(t *testing.T) {
+	var clients []*dns.Client
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		clients = append(clients, client)
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	var question dns.Msg
+	question.SetQuestion("example.", dns.TypeNS)
+	cases := []struct {
+		opts *DnsQueryOpts
+		net  string
+	}{
+		{nil, "tcp-tls"},
+		{&DnsQueryOpts{DialTimeout: time.Second, ReadTimeout: 2 * time.Second}, "tcp-tls"},
+		{&DnsQueryOpts{Family: 4}, "tcp4-tls"},
+		{&DnsQueryOpts{Family: 6}, "tcp6-tls"},
+	}
+	for _, c := range cases {
+		clients = nil
+		_, _, err := DnsQueryTLS("192.0.2.1:853", &question, nil, c.opts)
+		if err != nil {
+			t.Fatalf("DnsQueryTLS() error: %s", err)
+		}
+		if len(clients) != 1 {
+			t.Fatalf("DnsQueryTLS() sent %d queries, expected 1", len(clients))
+		}
+		want := c.opts
+		if want == nil {
+			want = new(DnsQueryOpts)
+		}
+		client := clients[0]
+		if client.Net != c.net {
+			t.Errorf("DnsQueryTLS() with %+v sent over %q, expected %q", want, client.Net, c.net)
+		}
+		if (client.DialTimeout != want.DialTimeout) || (client.ReadTimeout != want.ReadTimeout) {
+			t.Errorf("DnsQueryTLS() with %+v used timeouts %s and %s", want, client.DialTimeout, client.ReadTimeout)
+		}
+	}
+}
+
+func TestDnsQueryContext(t *testing.T) {
+	// a server that never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Error listening on UDP: %s", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeSOA)
+	start := time.Now()
+	_, _, err = DnsQueryContext(ctx, conn.LocalAddr().String(), query)
+	if err != context.Canceled {
+		t.Errorf("DnsQueryContext() error %v, expected %v", err, context.Canceled)
+	}
+	// without the context we would wait for several read timeouts
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DnsQueryContext() took %s to return after being cancelled", elapsed)
+	}
+
+	// an already cancelled context sends nothing
+	_, _, err = DnsQueryContext(ctx, conn.LocalAddr().String(), query)
+	if err != context.Canceled {
+		t.Errorf("DnsQueryContext() with a cancelled context error %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestStubResolverCancel(t *testing.T) {
+	// every server is black-holed, so queries wait until we are done
+	black_hole := make(chan bool)
+	defer close(black_hole)
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		<-black_hole
+		return nil, 0, &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resolver, err := InitContext(ctx, 2, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, 0)
+	if err != nil {
+		t.Fatalf("InitContext() error: %s", err)
+	}
+	defer resolver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := resolver.SyncQuery("example.", dns.TypeSOA)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("SyncQuery() returned %v before being cancelled", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("SyncQuery() error %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("SyncQuery() did not return after being cancelled")
+	}
+}
+
+func TestStubResolverPort(t *testing.T) {
+	sent := make(chan string, 4)
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		sent <- server
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	ips := []net.IP{net.ParseIP("2001:db8::1")}
+	for _, c := range []struct {
+		port uint16
+		want string
+	}{
+		{0, "[2001:db8::1]:53"},
+		{5353, "[2001:db8::1]:5353"},
+	} {
+		resolver, err := InitContext(context.Background(), 1, ips, c.port)
+		if err != nil {
+			t.Fatalf("InitContext() error: %s", err)
+		}
+		_, _, err = resolver.SyncQuery("example.", dns.TypeSOA)
+		resolver.Close()
+		if err != nil {
+			t.Fatalf("SyncQuery() error: %s", err)
+		}
+		if server := <-sent; server != c.want {
+			t.Errorf("port %d sent query to %s, expected %s", c.port, server, c.want)
+		}
+	}
+}
+
+func TestStubResolverWaitResult(t *testing.T) {
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		if query.Question[0].Name == "fail.example." {
+			return nil, 0, &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+		}
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, 5 * time.Millisecond, nil
+	}
+
+	resolver, err := InitContext(context.Background(), 2, []net.IP{net.ParseIP("192.0.2.1")}, 0)
+	if err != nil {
+		t.Fatalf("InitContext() error: %s", err)
+	}
+	defer resolver.Close()
+
+	ok_handle := resolver.AsyncQuery("example.", dns.TypeSOA)
+	fail_handle := resolver.AsyncQuery("fail.example.", dns.TypeAAAA)
+
+	r := resolver.WaitResultByHandle(fail_handle)
+	if (r.Handle != fail_handle) || (r.Qname != "fail.example.") || (r.Rtype != dns.TypeAAAA) {
+		t.Errorf("WaitResultByHandle() got %d '%s' %d, expected %d 'fail.example.' %d",
+			r.Handle, r.Qname, r.Rtype, fail_handle, dns.TypeAAAA)
+	}
+	if (r.Msg != nil) || (r.Err == nil) {
+		t.Errorf("WaitResultByHandle() got answer %v and error %v, expected only an error", r.Msg, r.Err)
+	}
+
+	r = resolver.WaitResult()
+	if (r.Handle != ok_handle) || (r.Qname != "example.") || (r.Rtype != dns.TypeSOA) {
+		t.Errorf("WaitResult() got %d '%s' %d, expected %d 'example.' %d",
+			r.Handle, r.Qname, r.Rtype, ok_handle, dns.TypeSOA)
+	}
+	if (r.Msg == nil) || (r.Err != nil) || (r.Rtt != 5*time.Millisecond) {
+		t.Errorf("WaitResult() got answer %v, RTT %s, error %v", r.Msg, r.Rtt, r.Err)
+	}
+}
+
+func TestStubResolverQueryMsg(t *testing.T) {
+	sent := make(chan *dns.Msg, 2)
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		sent <- query.Copy()
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	resolver, err := InitContext(context.Background(), 1, []net.IP{net.ParseIP("192.0.2.1")}, 0)
+	if err != nil {
+		t.Fatalf("InitContext() error: %s", err)
+	}
+	defer resolver.Close()
+
+	// a query without recursion, in the CHAOS class, with the DO bit
+	msg := new(dns.Msg)
+	msg.SetQuestion("version.bind.", dns.TypeTXT)
+	msg.Question[0].Qclass = dns.ClassCHAOS
+	msg.RecursionDesired = false
+	msg.CheckingDisabled = true
+	msg.SetEdns0(1232, true)
+	r := resolver.WaitResultByHandle(resolver.QueryMsg(msg))
+	if r.Err != nil {
+		t.Fatalf("QueryMsg() error: %s", r.Err)
+	}
+	if (r.Qname != "version.bind.") || (r.Rtype != dns.TypeTXT) {
+		t.Errorf("QueryMsg() answered '%s' %d, expected 'version.bind.' %d", r.Qname, r.Rtype, dns.TypeTXT)
+	}
+	query := <-sent
+	if query.RecursionDesired || !query.CheckingDisabled || (query.Question[0].Qclass != dns.ClassCHAOS) {
+		t.Errorf("QueryMsg() sent RD %v, CD %v, class %d, expected RD false, CD true, class %d",
+			query.RecursionDesired, query.CheckingDisabled, query.Question[0].Qclass, dns.ClassCHAOS)
+	}
+	if opt := query.IsEdns0(); (opt == nil) || !opt.Do() || (opt.UDPSize() != 1232) {
+		t.Errorf("QueryMsg() sent OPT %v, expected DO and size 1232", opt)
+	}
+
+	// the simple query still asks for recursion
+	if _, _, err := resolver.SyncQuery("example.", dns.TypeSOA); err != nil {
+		t.Fatalf("SyncQuery() error: %s", err)
+	}
+	if query := <-sent; !query.RecursionDesired {
+		t.Errorf("SyncQuery() sent a query without RD")
+	}
+}
+
+func TestStubResolverClose(t *testing.T) {
+	// the query is in progress until we let it finish
+	started := make(chan bool, 1)
+	finish := make(chan bool)
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		started <- true
+		<-finish
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	resolver, err := InitContext(context.Background(), 2, []net.IP{net.ParseIP("192.0.2.1")}, 0)
+	if err != nil {
+		t.Fatalf("InitContext() error: %s", err)
+	}
+	handle := resolver.AsyncQuery("example.", dns.TypeSOA)
+	<-started
+
+	closed := make(chan bool)
+	go func() {
+		resolver.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Close() returned with a query in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close() did not return after the query finished")
+	}
+
+	// the answer is still there after closing
+	r := resolver.WaitResultByHandle(handle)
+	if (r.Err != nil) || (r.Msg == nil) || (r.Qname != "example.") {
+		t.Errorf("WaitResultByHandle() after Close() got answer %v for '%s', error %v", r.Msg, r.Qname, r.Err)
+	}
+}
+
+func TestStubResolverRoundRobin(t *testing.T) {
+	var lock sync.Mutex
+	answered := make(map[string]int)
+	orig := exchange
+	defer func() { exchange = orig }()
+	exchange = func(client *dns.Client, query *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+		// the second server is broken for one name, so the first answers those
+		if (server == "192.0.2.2:53") && (query.Question[0].Name == "fail.example.") {
+			return nil, 0, &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+		}
+		lock.Lock()
+		answered[server] += 1
+		lock.Unlock()
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		return answer, time.Millisecond, nil
+	}
+
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	resolver, err := InitContext(context.Background(), 4, ips, 0)
+	if err != nil {
+		t.Fatalf("InitContext() error: %s", err)
+	}
+	defer resolver.Close()
+
+	var handles []int
+	for n := 0; n < 100; n++ {
+		handles = append(handles, resolver.AsyncQuery(fmt.Sprintf("%d.example.", n), dns.TypeA))
+	}
+	for _, handle := range handles {
+		if r := resolver.WaitResultByHandle(handle); r.Err != nil {
+			t.Fatalf("WaitResultByHandle() error: %s", r.Err)
+		}
+	}
+	if (answered["192.0.2.1:53"] != 50) || (answered["192.0.2.2:53"] != 50) {
+		t.Errorf("queries answered by servers %v, expected 50 by each", answered)
+	}
+
+	// failing over to the other server still works
+	for n := 0; n < 2; n++ {
+		if _, _, err := resolver.SyncQuery("fail.example.", dns.TypeA); err != nil {
+			t.Errorf("SyncQuery() error: %s", err)
+		}
+	}
+	if (answered["192.0.2.1:53"] != 52) || (answered["192.0.2.2:53"] != 50) {
+		t.Errorf("queries answered by servers %v, expected 52 and 50 after failing over", answered)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// how important a log message is
+type log_level int
+
+const (
+	LOG_DEBUG log_level = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var log_level_names = []string{
+	LOG_DEBUG: "DEBUG",
+	LOG_INFO:  "INFO",
+	LOG_WARN:  "WARN",
+	LOG_ERROR: "ERROR",
+}
+
+var (
+	// Only messages at this level or above are logged.
+	min_log_level = LOG_INFO
+
+	// Where log messages go. Standard output is for the ymmv records.
+	log_out io.Writer = os.Stderr
+
+	// How we get the time for log messages, which tests can replace.
+	log_now = time.Now
+)
+
+// Parse a log level name, like "debug" or "WARN".
+func parse_log_level(name string) (log_level, error) {
+	for level, level_name := range log_level_names {
+		if strings.EqualFold(name, level_name) {
+			return log_level(level), nil
+		}
+	}
+	return LOG_INFO, fmt.Errorf("Unknown log level '%s', must be debug, info, warn, or error", name)
+}
+
+// Write a log message, if it is at our log level or above. Each line has
+// the UTC time to the microsecond and the level.
+func logf(level log_level, format string, a ...interface{}) {
+	if level < min_log_level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+	fmt.Fprintf(log_out, "%s %s pcap2ymmv %s\n",
+		log_now().UTC().Format("2006-01-02 15:04:05.000000"), log_level_names[level], msg)
+}
+
+func debugf(format string, a ...interface{}) {
+	logf(LOG_DEBUG, format, a...)
+}
+
+func infof(format string, a ...interface{}) {
+	logf(LOG_INFO, format, a...)
+}
+
+func warnf(format string, a ...interface{}) {
+	logf(LOG_WARN, format, a...)
+}
+
+func errorf(format string, a ...interface{}) {
+	logf(LOG_ERROR, format, a...)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Capture what is logged while running fn at the given log level.
+func capture_log(level log_level, fn func()) string {
+	defer func(level log_level) { min_log_level = level }(min_log_level)
+	defer func(out io.Writer) { log_out = out }(log_out)
+	var buf bytes.Buffer
+	min_log_level = level
+	log_out = &buf
+	fn()
+	return buf.String()
+}
+
+func log_all_levels() {
+	debugf("debug message")
+	infof("info message")
+	warnf("warn message %d", 3)
+	errorf("error message\n")
+}
+
+func TestLogLevels(t *testing.T) {
+	log_now = func() time.Time {
+		return time.Date(2017, 6, 1, 9, 30, 15, 123456789, time.FixedZone("CST", 8*3600))
+	}
+	defer func() { log_now = time.Now }()
+
+	cases := []struct {
+		level string
+		want  []string
+	}{
+		{"debug", []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{"info", []string{"INFO", "WARN", "ERROR"}},
+		{"WARN", []string{"WARN", "ERROR"}},
+		{"error", []string{"ERROR"}},
+	}
+	for _, c := range cases {
+		level, err := parse_log_level(c.level)
+		if err != nil {
+			t.Fatalf("parse_log_level(%q) error: %s", c.level, err)
+		}
+		out := capture_log(level, log_all_levels)
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		if len(lines) != len(c.want) {
+			t.Errorf("level %s logged %q, expected %d lines", c.level, out, len(c.want))
+			continue
+		}
+		for n, line := range lines {
+			prefix := "2017-06-01 01:30:15.123456 " + c.want[n] + " pcap2ymmv "
+			if !strings.HasPrefix(line, prefix) {
+				t.Errorf("level %s logged %q, expected it to start with %q", c.level, line, prefix)
+			}
+		}
+	}
+
+	if _, err := parse_log_level("verbose"); err == nil {
+		t.Errorf("parse_log_level(\"verbose\") succeeded, expected an error")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	defer func(level log_level) { min_log_level = level }(min_log_level)
+	defer func(checksums bool) { write_checksums = checksums }(write_checksums)
+
+	cases := []struct {
+		args      []string
+		level     log_level
+		addrs     int
+		checksums bool
+	}{
+		{[]string{}, LOG_INFO, 0, false},
+		{[]string{"192.5.5.241"}, LOG_INFO, 1, false},
+		{[]string{"-d", "192.5.5.241", "2001:500:2f::f"}, LOG_DEBUG, 2, false},
+		{[]string{"-log-level", "warn"}, LOG_WARN, 0, false},
+		{[]string{"-log-level", "error", "192.5.5.241"}, LOG_ERROR, 1, false},
+		{[]string{"-checksum", "192.5.5.241"}, LOG_INFO, 1, true},
+	}
+	for _, c := range cases {
+		min_log_level = LOG_INFO
+		write_checksums = false
+		addrs, err := parse_options(c.args)
+		if err != nil {
+			t.Errorf("parse_options(%q) error: %s", c.args, err)
+			continue
+		}
+		if (min_log_level != c.level) || (len(addrs) != c.addrs) {
+			t.Errorf("parse_options(%q) set level %d with %d addresses, expected level %d with %d",
+				c.args, min_log_level, len(addrs), c.level, c.addrs)
+		}
+		if write_checksums != c.checksums {
+			t.Errorf("parse_options(%q) set checksums %t, expected %t", c.args, write_checksums, c.checksums)
+		}
+	}
+
+	for _, bad := range [][]string{{"-log-level"}, {"-log-level", "loud"}, {"-x"}} {
+		if _, err := parse_options(bad); err == nil {
+			t.Errorf("parse_options(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestDebugFlag(t *testing.T) {
+	defer func(level log_level) { min_log_level = level }(min_log_level)
+	defer func(out io.Writer) { log_out = out }(log_out)
+
+	for _, c := range []struct {
+		args  []string
+		debug bool
+	}{
+		{[]string{"192.5.5.241"}, false},
+		{[]string{"-d", "192.5.5.241"}, true},
+		{[]string{"-debug", "192.5.5.241"}, true},
+	} {
+		// start from the default level, as when the program starts
+		min_log_level = LOG_INFO
+		addrs, err := parse_options(c.args)
+		if err != nil {
+			t.Fatalf("parse_options(%q) error: %s", c.args, err)
+		}
+		var buf bytes.Buffer
+		log_out = &buf
+		parse_root_server_addresses(addrs)
+		has_debug := strings.Contains(buf.String(), " DEBUG ")
+		if has_debug != c.debug {
+			t.Errorf("with options %q logged %q, expected debugging %t", c.args, buf.String(), c.debug)
+		}
+	}
+}
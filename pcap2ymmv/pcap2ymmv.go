@@ -8,9 +8,12 @@ import (
 	"github.com/google/gopacket/pcapgo"
 	"github.com/miekg/dns"
 	"github.com/shane-kerr/ymmv/dnsstub"
+	"hash/crc32"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -21,16 +24,15 @@ var (
 	// variable for convenience.
 	resolv_conf *dns.ClientConfig
 
-	// Use a global debug flag.
-	debug bool
+	// write version 1 of the ymmv format, with a checksum for each
+	// message
+	write_checksums bool
 )
 
 // If we were passed name server addresses, parse them with this function.
 func parse_root_server_addresses(addrs []string) map[string]bool {
-	if debug {
-		fmt.Fprintf(os.Stderr, "pcap2ymmv parse_root_server_addresses()\n")
-		fmt.Fprintf(os.Stderr, "pcap2ymmv addrs:%s\n", addrs)
-	}
+	debugf("parse_root_server_addresses()")
+	debugf("addrs:%s", addrs)
 	root_addresses := make(map[string]bool)
 	for _, addr := range addrs {
 		ip := net.ParseIP(addr)
@@ -38,9 +40,7 @@ func parse_root_server_addresses(addrs []string) map[string]bool {
 			log.Fatal("Error parsing address '%s'", addr)
 		}
 		root_addresses[ip.String()] = true
-		if debug {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv checking for %s\n", ip.String())
-		}
+		debugf("checking for %s", ip.String())
 	}
 	return root_addresses
 }
@@ -51,9 +51,7 @@ func parse_root_server_addresses(addrs []string) map[string]bool {
 // but it allows us to do quick and easy lookups of the addresses in the
 // pcap later.)
 func lookup_root_server_addresses() map[string]bool {
-	if debug {
-		fmt.Fprintf(os.Stderr, "pcap2ymmv lookup_root_server_addresses()\n")
-	}
+	debugf("lookup_root_server_addresses()")
 
 	// set up a resolver
 	resolver, err := dnsstub.Init(4, nil)
@@ -89,15 +87,11 @@ func lookup_root_server_addresses() map[string]bool {
 			switch root_address.(type) {
 			case *dns.AAAA:
 				aaaa_s := root_address.(*dns.AAAA).AAAA.String()
-				if debug {
-					fmt.Fprintf(os.Stderr, "pcap2ymmv IANA server: %s\n", aaaa_s)
-				}
+				debugf("IANA server: %s", aaaa_s)
 				root_addresses[aaaa_s] = true
 			case *dns.A:
 				a_s := root_address.(*dns.A).A.String()
-				if debug {
-					fmt.Fprintf(os.Stderr, "pcap2ymmv IANA server: %s\n", a_s)
-				}
+				debugf("IANA server: %s", a_s)
 				root_addresses[a_s] = true
 			}
 		}
@@ -107,17 +101,29 @@ func lookup_root_server_addresses() map[string]bool {
 
 func ymmv_write(ip_family int, addr net.IP,
 	query_time time.Time, query *dns.Msg, answer_time time.Time, answer *dns.Msg) {
+	// everything we write goes into the checksum, if we are adding one
+	checksum := crc32.NewIEEE()
+	out := io.MultiWriter(os.Stdout, checksum)
+
 	// output magic value
-	_, err := os.Stdout.Write([]byte("ymmv"))
+	_, err := out.Write([]byte("ymmv"))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// output the format version, if we need one
+	if write_checksums {
+		_, err = out.Write([]byte{1})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// output address family
 	if ip_family == 4 {
-		_, err = os.Stdout.Write([]byte("4"))
+		_, err = out.Write([]byte("4"))
 	} else if ip_family == 6 {
-		_, err = os.Stdout.Write([]byte("6"))
+		_, err = out.Write([]byte("6"))
 	} else {
 		log.Fatalf("Unknown ip_family %d\n", ip_family)
 	}
@@ -126,25 +132,25 @@ func ymmv_write(ip_family int, addr net.IP,
 	}
 
 	// output (U)DP or (T)CP
-	_, err = os.Stdout.Write([]byte("u")) // only support UDP for now...
+	_, err = out.Write([]byte("u")) // only support UDP for now...
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// output actual address
-	_, err = os.Stdout.Write(addr)
+	_, err = out.Write(addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// output when the query happened
 	seconds := uint32(query_time.Unix())
-	err = binary.Write(os.Stdout, binary.BigEndian, seconds)
+	err = binary.Write(out, binary.BigEndian, seconds)
 	if err != nil {
 		log.Fatal(err)
 	}
 	nanoseconds := uint32(query_time.Nanosecond())
-	err = binary.Write(os.Stdout, binary.BigEndian, nanoseconds)
+	err = binary.Write(out, binary.BigEndian, nanoseconds)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -155,25 +161,25 @@ func ymmv_write(ip_family int, addr net.IP,
 		log.Fatal(err)
 	}
 	query_len := uint16(len(query_bytes))
-	err = binary.Write(os.Stdout, binary.BigEndian, query_len)
+	err = binary.Write(out, binary.BigEndian, query_len)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// write our query
-	_, err = os.Stdout.Write(query_bytes)
+	_, err = out.Write(query_bytes)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// output when the answer arrived
 	seconds = uint32(answer_time.Unix())
-	err = binary.Write(os.Stdout, binary.BigEndian, seconds)
+	err = binary.Write(out, binary.BigEndian, seconds)
 	if err != nil {
 		log.Fatal(err)
 	}
 	nanoseconds = uint32(answer_time.Nanosecond())
-	err = binary.Write(os.Stdout, binary.BigEndian, nanoseconds)
+	err = binary.Write(out, binary.BigEndian, nanoseconds)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -184,21 +190,26 @@ func ymmv_write(ip_family int, addr net.IP,
 		log.Fatal(err)
 	}
 	answer_len := uint16(len(answer_bytes))
-	err = binary.Write(os.Stdout, binary.BigEndian, answer_len)
+	err = binary.Write(out, binary.BigEndian, answer_len)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// write our answer
-	_, err = os.Stdout.Write(answer_bytes)
+	_, err = out.Write(answer_bytes)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// output the checksum, which is not part of itself
+	if write_checksums {
+		err = binary.Write(os.Stdout, binary.BigEndian, checksum.Sum32())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	os.Stdout.Sync()
 
-	if debug {
-		fmt.Fprintf(os.Stderr, "pcap2ymmv wrote ymmv record of %d bytes\n", len(answer_bytes))
-	}
+	debugf("wrote ymmv record of %d bytes", len(answer_bytes))
 }
 
 type sent_pkt_info struct {
@@ -243,12 +254,14 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 		// reach each packet
 		pkt_bytes, ci, err := pcap_file.ReadPacketData()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv error reading packet; %s\n", err)
+			if err == io.EOF {
+				infof("finished reading packets")
+			} else {
+				errorf("error reading packet; %s", err)
+			}
 			break
 		}
-		if debug {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv read packet (len:%d)\n", len(pkt_bytes))
-		}
+		debugf("read packet (len:%d)", len(pkt_bytes))
 
 		ip_match := false
 		var ip_family int
@@ -258,7 +271,7 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 		//  parse our packet information
 		packet := gopacket.NewPacket(pkt_bytes, pcap_file.LinkType(), gopacket.Default)
 		if packet == nil {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv unable to parse packet\n")
+			warnf("unable to parse packet")
 			continue
 		}
 
@@ -266,9 +279,7 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 		ipv6, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
 		if ipv6 != nil {
 			ip_family = 6
-			if debug {
-				fmt.Fprintf(os.Stderr, "pcap2ymmv IPv6 %s -> %s\n", ipv6.SrcIP, ipv6.DstIP)
-			}
+			debugf("IPv6 %s -> %s", ipv6.SrcIP, ipv6.DstIP)
 			pkt_info = &sent_pkt_info{when: ci.Timestamp, src_ip: ipv6.SrcIP, dst_ip: ipv6.DstIP}
 			// if the destination IP address is one of our targets, this is a query
 			is_query = true
@@ -281,15 +292,11 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 		} else {
 			ipv4, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 			if ipv4 == nil {
-				if debug {
-					fmt.Fprintf(os.Stderr, "pcap2ymmv packet is neither IPv4 nor IPv6\n")
-				}
+				debugf("packet is neither IPv4 nor IPv6")
 				continue
 			}
 			ip_family = 4
-			if debug {
-				fmt.Fprintf(os.Stderr, "pcap2ymmv IPv4 %s -> %s\n", ipv4.SrcIP.String(), ipv4.DstIP.String())
-			}
+			debugf("IPv4 %s -> %s", ipv4.SrcIP.String(), ipv4.DstIP.String())
 			pkt_info = &sent_pkt_info{when: ci.Timestamp, src_ip: ipv4.SrcIP, dst_ip: ipv4.DstIP}
 			// if the destination IP address is one of our targets, this is a query
 			is_query = true
@@ -300,9 +307,7 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 				_, ip_match = root_addresses[ipv4.SrcIP.String()]
 			}
 		}
-		if debug {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv IP match %t, query %t\n", ip_match, is_query)
-		}
+		debugf("IP match %t, query %t", ip_match, is_query)
 		if !ip_match {
 			continue
 		}
@@ -310,12 +315,10 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 		// filter based on port 53
 		udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
 		if udp == nil {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv unable to parse UDP packet\n")
+			warnf("unable to parse UDP packet")
 			continue
 		}
-		if debug {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv UDP port src:%d, dst:%d\n", udp.SrcPort, udp.DstPort)
-		}
+		debugf("UDP port src:%d, dst:%d", udp.SrcPort, udp.DstPort)
 		if is_query {
 			if udp.DstPort != 53 {
 				continue
@@ -329,15 +332,13 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 		pkt_info.dst_port = uint16(udp.DstPort)
 
 		// if we got a valid IP and UDP packet, process it
-		if debug {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv matched packet, is_query:%t\n", is_query)
-		}
+		debugf("matched packet, is_query:%t", is_query)
 
 		// parse the DNS packet
 		pkt_info.msg = new(dns.Msg)
 		err = pkt_info.msg.Unpack(udp.Payload)
 		if (err != nil) && (err != dns.ErrTruncated) {
-			fmt.Fprintf(os.Stderr, "pcap2ymmv error unpacking DNS message: %s\n", err)
+			warnf("error unpacking DNS message: %s", err)
 			continue
 		}
 
@@ -352,14 +353,14 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 					sent_pkt_info.when, sent_pkt_info.msg, pkt_info.when, pkt_info.msg)
 				delete(pkt_sent, key)
 			} else {
-				fmt.Fprintf(os.Stderr, "reply without sent message %s\n", key)
+				infof("reply without sent message %s", key)
 			}
 		}
 
 		// check packets and delete very old ones
 		for key, value := range pkt_sent {
 			if time.Since(value.when) > REPLY_TIMEOUT {
-				fmt.Fprintf(os.Stderr, "no reply in %s for sent message %s\n", time.Since(value.when), key)
+				infof("no reply in %s for sent message %s", time.Since(value.when), key)
 				delete(pkt_sent, key)
 			}
 		}
@@ -368,18 +369,46 @@ func pcap2ymmv(fname string, root_addresses map[string]bool) {
 	file.Close()
 }
 
+// Handle the options, which come before any root server addresses:
+//
+//	-checksum        write version 1 of the ymmv format, with a CRC-32
+//	                 checksum for each message
+//	-d, -debug       log debugging messages, the same as -log-level debug
+//	-log-level LEVEL log messages at this level or above, one of
+//	                 debug, info, warn, or error (default info)
+func parse_options(args []string) (addrs []string, err error) {
+	for (len(args) > 0) && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-d", "-debug":
+			min_log_level = LOG_DEBUG
+		case "-checksum":
+			write_checksums = true
+		case "-log-level":
+			if len(args) < 2 {
+				return nil, fmt.Errorf("Missing level after -log-level")
+			}
+			min_log_level, err = parse_log_level(args[1])
+			if err != nil {
+				return nil, err
+			}
+			args = args[1:]
+		default:
+			return nil, fmt.Errorf("Unknown option '%s'", args[0])
+		}
+		args = args[1:]
+	}
+	return args, nil
+}
+
 // Main function.
 func main() {
-	// turn on debugging if desired
-	if (len(os.Args) > 1) && (os.Args[1] == "-d") {
-		debug = true
-		os.Args = append(os.Args[:1], os.Args[2:]...)
+	// set our log level, and get any root server addresses
+	addrs, err := parse_options(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// initialize our stub resolver
-	var (
-		err error
-	)
 	resolv_conf, err = dns.ClientConfigFromFile("/etc/resolv.conf")
 	if err != nil {
 		log.Fatal(err)
@@ -387,8 +416,8 @@ func main() {
 
 	// get root server addresses
 	var root_addresses map[string]bool
-	if len(os.Args) > 1 {
-		root_addresses = parse_root_server_addresses(os.Args[1:])
+	if len(addrs) > 0 {
+		root_addresses = parse_root_server_addresses(addrs)
 	} else {
 		root_addresses = lookup_root_server_addresses()
 	}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   DNS cookies.
+
+   With the -cookies flag, each query to the Yeti servers carries a DNS
+   cookie (RFC 7873). The client cookie is random, picked once for the
+   run. Once a server sends us a server cookie, we send it back to that
+   server in later queries, as a client should, so that we exercise the
+   whole exchange and not just the first query.
+
+   An answer with a cookie must echo our client cookie, and any server
+   cookie must be 8 to 32 bytes long; anything else is reported as a
+   difference. An answer without a cookie is fine, since servers need
+   not support them. The IANA answer comes from the capture, so its
+   cookie, if any, has nothing to do with ours and is not compared.
+*/
+type cookie_jar struct {
+	lock   sync.Mutex
+	client []byte
+	// the last server cookie from each server, by address
+	server map[string][]byte
+}
+
+const (
+	client_cookie_len     = 8
+	min_server_cookie_len = 8
+	max_server_cookie_len = 32
+)
+
+// Make a jar with a new random client cookie.
+func new_cookie_jar() (*cookie_jar, error) {
+	client := make([]byte, client_cookie_len)
+	_, err := rand.Read(client)
+	if err != nil {
+		return nil, err
+	}
+	return &cookie_jar{client: client, server: make(map[string][]byte)}, nil
+}
+
+// Add our cookie for a server to a query, with the server cookie from
+// its last answer, if any.
+func (jar *cookie_jar) add(query *dns.Msg, ip net.IP) *dns.Msg {
+	jar.lock.Lock()
+	cookie := append(append([]byte{}, jar.client...), jar.server[ip.String()]...)
+	jar.lock.Unlock()
+	return AddEdnsOption(query, &dns.EDNS0_LOCAL{Code: dns.EDNS0COOKIE, Data: cookie})
+}
+
+// Get the cookie from a response, client and server parts together.
+func response_cookie(resp *dns.Msg) (cookie []byte, ok bool) {
+	if resp == nil {
+		return nil, false
+	}
+	e := resp.IsEdns0()
+	if e == nil {
+		return nil, false
+	}
+	for _, o := range e.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			continue
+		}
+		switch opt := o.(type) {
+		case *dns.EDNS0_COOKIE:
+			cookie, _ = hex.DecodeString(opt.Cookie)
+		case *dns.EDNS0_LOCAL:
+			cookie = opt.Data
+		}
+		return cookie, true
+	}
+	return nil, false
+}
+
+// Check the cookie in the answer from a server, remembering its server
+// cookie for the next query, and return a description of any problem.
+func (jar *cookie_jar) check(ip net.IP, resp *dns.Msg) (diffs []string) {
+	cookie, ok := response_cookie(resp)
+	if !ok {
+		return nil
+	}
+	if len(cookie) < client_cookie_len {
+		return []string{fmt.Sprintf("Yeti cookie too short: %d bytes", len(cookie))}
+	}
+	if !bytes.Equal(cookie[:client_cookie_len], jar.client) {
+		diffs = append(diffs, fmt.Sprintf("Yeti client cookie mismatch: sent %x vs answer %x",
+			jar.client, cookie[:client_cookie_len]))
+	}
+	server := cookie[client_cookie_len:]
+	if len(server) == 0 {
+		return diffs
+	}
+	if (len(server) < min_server_cookie_len) || (len(server) > max_server_cookie_len) {
+		return append(diffs, fmt.Sprintf("Yeti server cookie length %d, expected %d to %d bytes",
+			len(server), min_server_cookie_len, max_server_cookie_len))
+	}
+	// only keep a server cookie that came back with our client cookie
+	if len(diffs) == 0 {
+		jar.lock.Lock()
+		jar.server[ip.String()] = append([]byte{}, server...)
+		jar.lock.Unlock()
+	}
+	return diffs
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// get the cookie we sent in a query
+func query_cookie(t *testing.T, query *dns.Msg) []byte {
+	cookie, ok := response_cookie(query)
+	if !ok {
+		t.Fatalf("query has no cookie:\n%s", query)
+	}
+	return cookie
+}
+
+// answer with the client cookie of the query and the given server cookie,
+// packed and unpacked like a real answer
+func cookie_answer(query *dns.Msg, client []byte, server []byte) *dns.Msg {
+	resp := empty_answer("", query)
+	resp.SetEdns0(4096, false)
+	AddEdnsOption(resp, &dns.EDNS0_LOCAL{Code: dns.EDNS0COOKIE, Data: append(append([]byte{}, client...), server...)})
+	wire, _ := resp.Pack()
+	unpacked := new(dns.Msg)
+	unpacked.Unpack(wire)
+	return unpacked
+}
+
+func TestYetiQueryCookies(t *testing.T) {
+	server_cookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	sent, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		cookie, _ := response_cookie(query)
+		return cookie_answer(query, cookie[:client_cookie_len], server_cookie)
+	})
+	defer restore()
+
+	jar, err := new_cookie_jar()
+	if err != nil {
+		t.Fatalf("new_cookie_jar() error: %s", err)
+	}
+	qcfg := query_conf{clear_names: true, cookies: jar}
+	for n := 0; n < 2; n++ {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		run_yeti_query(&qcfg, query, empty_answer("", query), "2001:db8::1")
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("%d queries sent, expected 2", len(*sent))
+	}
+
+	// the first query only has our client cookie
+	if cookie := query_cookie(t, (*sent)[0]); !bytes.Equal(cookie, jar.client) {
+		t.Errorf("first query cookie %x, expected client cookie %x", cookie, jar.client)
+	}
+	// the second also has the server cookie from the first answer
+	want := append(append([]byte{}, jar.client...), server_cookie...)
+	if cookie := query_cookie(t, (*sent)[1]); !bytes.Equal(cookie, want) {
+		t.Errorf("second query cookie %x, expected %x", cookie, want)
+	}
+}
+
+func TestCookieCheck(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	jar, _ := new_cookie_jar()
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeA)
+	other := []byte("notours!")
+	server := []byte("12345678")
+
+	cases := []struct {
+		resp *dns.Msg
+		diff string
+	}{
+		{empty_answer("", query), ""},
+		{cookie_answer(query, jar.client, nil), ""},
+		{cookie_answer(query, jar.client, server), ""},
+		{cookie_answer(query, jar.client[:4], nil), "Yeti cookie too short: 4 bytes"},
+		{cookie_answer(query, other, server), "Yeti client cookie mismatch: sent "},
+		{cookie_answer(query, jar.client, server[:4]), "Yeti server cookie length 4, expected 8 to 32 bytes"},
+	}
+	for n, c := range cases {
+		diffs := jar.check(ip, c.resp)
+		if c.diff == "" {
+			if len(diffs) != 0 {
+				t.Errorf("case %d: check() == %q, expected no differences", n, diffs)
+			}
+		} else if (len(diffs) != 1) || !strings.HasPrefix(diffs[0], c.diff) {
+			t.Errorf("case %d: check() == %q, expected %q", n, diffs, c.diff)
+		}
+	}
+	// only the good server cookie was kept
+	if !bytes.Equal(jar.server[ip.String()], server) {
+		t.Errorf("server cookie %x kept, expected %x", jar.server[ip.String()], server)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   A directory to write the packets of each mismatch to, so that they
+   can be looked at later with other tools, like dig or Wireshark. For
+   each mismatch we write three files, each holding a single DNS message
+   in wire format:
+
+       example_soa_2001_db8__1_20170601T093015.123456789Z_query.bin
+       example_soa_2001_db8__1_20170601T093015.123456789Z_iana.bin
+       example_soa_2001_db8__1_20170601T093015.123456789Z_yeti.bin
+
+   The query is the one sent to the Yeti server, so it has the obfuscated
+   query name unless we are using clear names. Note that the records in
+   the answers are in the order we compare them in, which may not be the
+   order the servers sent them in.
+*/
+type dump_dir struct {
+	dir string
+}
+
+func open_dump_dir(dir string) (*dump_dir, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &dump_dir{dir: dir}, nil
+}
+
+// Get the base of the file names for the packets of a mismatch.
+func dump_file_base(qname string, qtype string, yeti_ip net.IP, when time.Time) string {
+	return query_file_base(qname, qtype, yeti_ip) + "_" +
+		when.UTC().Format("20060102T150405.000000000Z")
+}
+
+// Write the query and both answers for a mismatch.
+func (dd *dump_dir) write_packets(qname string, qtype string, yeti_ip net.IP, when time.Time,
+	query *dns.Msg, iana *dns.Msg, yeti *dns.Msg) error {
+
+	base := filepath.Join(dd.dir, dump_file_base(qname, qtype, yeti_ip, when))
+	for _, packet := range []struct {
+		suffix string
+		msg    *dns.Msg
+	}{
+		{"_query.bin", query},
+		{"_iana.bin", iana},
+		{"_yeti.bin", yeti},
+	} {
+		wire, err := packet.msg.Pack()
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(base+packet.suffix, wire, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDumpFileBase(t *testing.T) {
+	when := time.Date(2017, 6, 1, 9, 30, 15, 123456789, time.FixedZone("CST", 8*3600))
+	got := dump_file_base("www.Example.", "A", net.ParseIP("2001:db8::1"), when)
+	want := "www.example_a_2001_db8__1_20170601T013015.123456789Z"
+	if got != want {
+		t.Errorf("dump_file_base() == %q, want %q", got, want)
+	}
+}
+
+func TestYetiQueryDumpDir(t *testing.T) {
+	// the first server agrees with IANA, the second adds an extra NS
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		if server == "[2001:db8::2]:53" {
+			rr, _ := dns.NewRR("example. 172800 IN NS ns.other.")
+			resp.Ns = append(resp.Ns, rr)
+		}
+		return resp
+	})
+	defer restore()
+
+	dir := filepath.Join(t.TempDir(), "packets")
+	dd, err := open_dump_dir(dir)
+	if err != nil {
+		t.Fatalf("open_dump_dir() error: %s", err)
+	}
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, "all")
+	qcfg := query_conf{clear_names: true, dump_dir: dd}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+		time.Millisecond, &addr)
+	<-done
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("Error listing packet dump directory: %s", err)
+	}
+	sort.Strings(files)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files for the second server, got %v", files)
+	}
+	for n, suffix := range []string{"_iana.bin", "_query.bin", "_yeti.bin"} {
+		name := filepath.Base(files[n])
+		matched, _ := filepath.Match("www.example_a_2001_db8__2_*"+suffix, name)
+		if !matched {
+			t.Errorf("unexpected packet file name %s", name)
+		}
+		wire, err := os.ReadFile(files[n])
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", name, err)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(wire); err != nil {
+			t.Fatalf("Error unpacking %s: %s", name, err)
+		}
+		if (len(msg.Question) != 1) || (msg.Question[0].Name != "www.example.") {
+			t.Errorf("%s has question %v, expected www.example.", name, msg.Question)
+		}
+		// only the Yeti answer has the extra NS
+		if (suffix == "_yeti.bin") != (len(msg.Ns) == 1) {
+			t.Errorf("%s has authority section %v", name, msg.Ns)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   Extended DNS Errors (EDE, RFC 8914).
+
+   Our DNS library predates this option, so it arrives as an EDNS0_LOCAL
+   option with code 15, holding a 16-bit info code followed by optional
+   UTF-8 text.
+
+   An EDE is allowed with any rcode, but some codes only make sense with
+   a failure, like "DNSSEC Bogus", and others only with an answer, like
+   "Stale Answer". A server that sends one of these with the wrong kind
+   of rcode has a bug, so we check both sides for this.
+*/
+const EDNS0_EDE uint16 = 15
+
+// names of the EDE info codes
+var ede_names = map[uint16]string{
+	0:  "Other",
+	1:  "Unsupported DNSKEY Algorithm",
+	2:  "Unsupported DS Digest Type",
+	3:  "Stale Answer",
+	4:  "Forged Answer",
+	5:  "DNSSEC Indeterminate",
+	6:  "DNSSEC Bogus",
+	7:  "Signature Expired",
+	8:  "Signature Not Yet Valid",
+	9:  "DNSKEY Missing",
+	10: "RRSIGs Missing",
+	11: "No Zone Key Bit Set",
+	12: "NSEC Missing",
+	13: "Cached Error",
+	14: "Not Ready",
+	15: "Blocked",
+	16: "Censored",
+	17: "Filtered",
+	18: "Prohibited",
+	19: "Stale NXDOMAIN Answer",
+	20: "Not Authoritative",
+	21: "Not Supported",
+	22: "No Reachable Authority",
+	23: "Network Error",
+	24: "Invalid Data",
+}
+
+// EDE info codes that say the server failed to answer
+var ede_failure_codes = map[uint16]bool{
+	6: true, 7: true, 8: true, 9: true, 10: true, 11: true, 12: true,
+	13: true, 14: true, 20: true, 21: true, 22: true, 23: true, 24: true,
+}
+
+// EDE info codes that say the server did answer
+var ede_answer_codes = map[uint16]bool{
+	3: true, 4: true, 19: true,
+}
+
+// an extended error from a response
+type extended_error struct {
+	code uint16
+	text string
+}
+
+func (ede extended_error) String() string {
+	name, found := ede_names[ede.code]
+	if !found {
+		name = "unknown"
+	}
+	s := fmt.Sprintf("EDE %d (%s)", ede.code, name)
+	if ede.text != "" {
+		s += fmt.Sprintf(" '%s'", ede.text)
+	}
+	return s
+}
+
+// Get the extended errors from a response. Options too short to hold an
+// info code are ignored.
+func response_edes(resp *dns.Msg) (edes []extended_error) {
+	if resp == nil {
+		return nil
+	}
+	e := resp.IsEdns0()
+	if e == nil {
+		return nil
+	}
+	for _, o := range e.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || (local.Code != EDNS0_EDE) || (len(local.Data) < 2) {
+			continue
+		}
+		edes = append(edes, extended_error{
+			code: binary.BigEndian.Uint16(local.Data),
+			text: string(local.Data[2:]),
+		})
+	}
+	return edes
+}
+
+// Check whether the extended errors in a response agree with the rcode,
+// returning a description of any that do not, or "" if all do.
+func ede_rcode_inconsistency(resp *dns.Msg) string {
+	var bad []string
+	failed := is_error_rcode(resp.Rcode)
+	for _, ede := range response_edes(resp) {
+		if (!failed && ede_failure_codes[ede.code]) || (failed && ede_answer_codes[ede.code]) {
+			bad = append(bad, ede.String())
+		}
+	}
+	if len(bad) == 0 {
+		return ""
+	}
+	return strings.Join(bad, ", ") + " with rcode " + dns.RcodeToString[resp.Rcode]
+}
+
+// Check that the extended errors on each side agree with the rcode. An
+// answer whose extended errors do not fit is a bug in that server, and
+// is described in the notes to log, since when both sides have the same
+// bug the answers still agree. Only a difference between IANA and Yeti
+// in whether their extended errors fit is reported as a difference.
+func compare_ede_consistency(iana *dns.Msg, yeti *dns.Msg) (diffs []string, notes []string) {
+	iana_bad := ede_rcode_inconsistency(iana)
+	yeti_bad := ede_rcode_inconsistency(yeti)
+	if iana_bad != "" {
+		notes = append(notes, "IANA extended error inconsistent with rcode: "+iana_bad)
+	}
+	if yeti_bad != "" {
+		notes = append(notes, "Yeti extended error inconsistent with rcode: "+yeti_bad)
+	}
+	if (iana_bad == "") != (yeti_bad == "") {
+		describe := func(bad string) string {
+			if bad == "" {
+				return "consistent"
+			}
+			return "inconsistent (" + bad + ")"
+		}
+		diffs = append(diffs, fmt.Sprintf("Extended error consistency mismatch: IANA %s vs Yeti %s",
+			describe(iana_bad), describe(yeti_bad)))
+	}
+	return diffs, notes
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// make a response with the given rcode and extended error
+func ede_answer(rcode int, code uint16, text string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.", dns.TypeA)
+	resp.Response = true
+	resp.Rcode = rcode
+	resp.SetEdns0(4096, false)
+	e := resp.IsEdns0()
+	data := append([]byte{byte(code >> 8), byte(code)}, text...)
+	e.Option = append(e.Option, &dns.EDNS0_LOCAL{Code: EDNS0_EDE, Data: data})
+	return resp
+}
+
+func TestResponseEdes(t *testing.T) {
+	edes := response_edes(ede_answer(dns.RcodeServerFailure, 6, "bad signature"))
+	if (len(edes) != 1) || (edes[0].code != 6) || (edes[0].text != "bad signature") {
+		t.Fatalf("response_edes() == %v", edes)
+	}
+	if edes[0].String() != "EDE 6 (DNSSEC Bogus) 'bad signature'" {
+		t.Errorf("extended error String() == %q", edes[0].String())
+	}
+	if len(response_edes(new(dns.Msg))) != 0 {
+		t.Errorf("response_edes() found an extended error without EDNS")
+	}
+}
+
+func TestEdeRcodeInconsistency(t *testing.T) {
+	cases := []struct {
+		resp *dns.Msg
+		bad  bool
+	}{
+		// a failure code with NOERROR is a bug
+		{ede_answer(dns.RcodeSuccess, 6, ""), true},
+		{ede_answer(dns.RcodeServerFailure, 6, ""), false},
+		// and so is a stale answer with SERVFAIL
+		{ede_answer(dns.RcodeServerFailure, 3, ""), true},
+		{ede_answer(dns.RcodeSuccess, 3, ""), false},
+		// other codes can go with anything
+		{ede_answer(dns.RcodeSuccess, 0, "note"), false},
+		{ede_answer(dns.RcodeNameError, 18, ""), false},
+	}
+	for _, c := range cases {
+		bad := ede_rcode_inconsistency(c.resp)
+		if (bad != "") != c.bad {
+			t.Errorf("ede_rcode_inconsistency() for %v with rcode %d == %q",
+				response_edes(c.resp), c.resp.Rcode, bad)
+		}
+	}
+}
+
+func TestCompareEdeConsistency(t *testing.T) {
+	iana := ede_answer(dns.RcodeServerFailure, 6, "")
+	yeti := ede_answer(dns.RcodeSuccess, 6, "")
+	diffs, notes := compare_ede_consistency(iana, yeti)
+	want := "Extended error consistency mismatch: IANA consistent vs Yeti inconsistent" +
+		" (EDE 6 (DNSSEC Bogus) with rcode NOERROR)"
+	if (len(diffs) != 1) || (diffs[0] != want) {
+		t.Errorf("compare_ede_consistency() == %q, want %q", diffs, want)
+	}
+	if (len(notes) != 1) || !strings.HasPrefix(notes[0], "Yeti extended error inconsistent with rcode: ") {
+		t.Errorf("compare_ede_consistency() notes == %q", notes)
+	}
+	// both inconsistent in the same way is not a difference, but each
+	// side is noted
+	diffs, notes = compare_ede_consistency(yeti, yeti.Copy())
+	if (len(diffs) != 0) || (len(notes) != 2) || !strings.HasPrefix(notes[0], "IANA") ||
+		!strings.HasPrefix(notes[1], "Yeti") {
+		t.Errorf("compare_ede_consistency() for two inconsistent answers == %q, %q", diffs, notes)
+	}
+	if diffs, notes := compare_ede_consistency(iana, iana.Copy()); (len(diffs) != 0) || (len(notes) != 0) {
+		t.Errorf("compare_ede_consistency() reported consistent answers: %q, %q", diffs, notes)
+	}
+
+	// the same inconsistent answer from both sides is equivalent
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	_, restore := mock_dns_query(func(server string, q *dns.Msg) *dns.Msg {
+		resp := ede_answer(dns.RcodeSuccess, 6, "")
+		resp.SetReply(q)
+		return resp
+	})
+	defer restore()
+	captured := ede_answer(dns.RcodeSuccess, 6, "")
+	captured.SetReply(query)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	yeti_query(done, new(report_conf), srvs, &query_conf{clear_names: true}, nil, nil, query, captured,
+		time.Millisecond, &addr)
+	<-done
+	if srvs.outcomes[outcome_equivalent] != 1 {
+		t.Errorf("same inconsistent answers gave outcomes %v, expected equivalent", srvs.outcomes)
+	}
+}
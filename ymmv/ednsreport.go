@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+/*
+   EDNS option reporting.
+
+   The OPT pseudo-RR is not compared, but some of the options in it are
+   useful for understanding a difference. The -edns-opts flag takes a
+   comma-separated list of the options to look at:
+
+       nsid    ask the Yeti servers for their name server identifier
+               (NSID, RFC 5001), and log the NSID of both answers
+       ede     report any difference in the extended DNS errors (EDE,
+               RFC 8914) of the answers
+
+   The IANA answer comes from the capture, so it only has an NSID if
+   the original query asked for one.
+*/
+type edns_report struct {
+	nsid bool
+	ede  bool
+}
+
+// Parse the list of EDNS options to report on, like "nsid,ede".
+func parse_edns_report(list string) (report edns_report, err error) {
+	for _, name := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "nsid":
+			report.nsid = true
+		case "ede":
+			report.ede = true
+		default:
+			return edns_report{}, fmt.Errorf("Unknown EDNS option '%s', must be nsid or ede", name)
+		}
+	}
+	return report, nil
+}
+
+// Describe the extended errors in a response, in order.
+func ede_list_string(resp *dns.Msg) string {
+	edes := response_edes(resp)
+	if len(edes) == 0 {
+		return "none"
+	}
+	strs := make([]string, 0, len(edes))
+	for _, ede := range edes {
+		strs = append(strs, ede.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Report on the EDNS options in the IANA and Yeti answers, logging the
+// NSIDs and returning a description of any difference in extended errors.
+func (report edns_report) check(target_ip net.IP, iana *dns.Msg, yeti *dns.Msg) (diffs []string) {
+	if report.nsid {
+		iana_nsid, iana_ok := response_nsid(iana)
+		yeti_nsid, yeti_ok := response_nsid(yeti)
+		if !iana_ok {
+			iana_nsid = "none"
+		}
+		if !yeti_ok {
+			yeti_nsid = "none"
+		}
+		glog.Infof("NSID of answers: IANA '%s', Yeti %s '%s'", iana_nsid, target_ip, yeti_nsid)
+	}
+	if report.ede {
+		iana_edes := ede_list_string(iana)
+		yeti_edes := ede_list_string(yeti)
+		if iana_edes != yeti_edes {
+			diffs = append(diffs,
+				fmt.Sprintf("Extended error mismatch: IANA %s vs Yeti %s", iana_edes, yeti_edes))
+		}
+	}
+	return diffs
+}
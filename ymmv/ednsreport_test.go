@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseEdnsReport(t *testing.T) {
+	cases := []struct {
+		list   string
+		report edns_report
+		ok     bool
+	}{
+		{"nsid", edns_report{nsid: true}, true},
+		{"ede", edns_report{ede: true}, true},
+		{"NSID, ede", edns_report{nsid: true, ede: true}, true},
+		{"nsid,cookie", edns_report{}, false},
+		{"", edns_report{}, false},
+	}
+	for _, c := range cases {
+		report, err := parse_edns_report(c.list)
+		if (report != c.report) || ((err == nil) != c.ok) {
+			t.Errorf("parse_edns_report(%q) == %+v, %v", c.list, report, err)
+		}
+	}
+}
+
+// add an NSID to a response
+func with_nsid(resp *dns.Msg, nsid string) *dns.Msg {
+	resp = resp.Copy()
+	if resp.IsEdns0() == nil {
+		resp.SetEdns0(4096, false)
+	}
+	AddEdnsOption(resp, &dns.EDNS0_LOCAL{Code: dns.EDNS0NSID, Data: []byte(nsid)})
+	return resp
+}
+
+func TestEdnsReportCheck(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.", dns.TypeA)
+	bogus := ede_answer(dns.RcodeServerFailure, 6, "")
+	bogus_nsid := with_nsid(bogus, "yeti-1")
+	unreachable := ede_answer(dns.RcodeServerFailure, 22, "")
+
+	// the NSID is only logged, never a difference
+	both := edns_report{nsid: true, ede: true}
+	if diffs := both.check(ip, with_nsid(plain, "iana-1"), with_nsid(plain, "yeti-1")); len(diffs) != 0 {
+		t.Errorf("check() with different NSIDs == %q", diffs)
+	}
+	if diffs := both.check(ip, bogus, bogus_nsid); len(diffs) != 0 {
+		t.Errorf("check() with the same extended errors == %q", diffs)
+	}
+	want := "Extended error mismatch: IANA EDE 6 (DNSSEC Bogus) vs Yeti EDE 22 (No Reachable Authority)"
+	if diffs := both.check(ip, bogus, unreachable); (len(diffs) != 1) || (diffs[0] != want) {
+		t.Errorf("check() with different extended errors == %q, want %q", diffs, want)
+	}
+	want = "Extended error mismatch: IANA none vs Yeti EDE 22 (No Reachable Authority)"
+	if diffs := both.check(ip, plain, unreachable); (len(diffs) != 1) || (diffs[0] != want) {
+		t.Errorf("check() with only a Yeti extended error == %q, want %q", diffs, want)
+	}
+	// nothing is reported unless asked for
+	if diffs := (edns_report{nsid: true}).check(ip, plain, unreachable); len(diffs) != 0 {
+		t.Errorf("check() without ede == %q", diffs)
+	}
+}
+
+func TestYetiQueryNsidRequest(t *testing.T) {
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	qcfg := query_conf{clear_names: true, edns_report: edns_report{nsid: true}}
+	run_yeti_query(&qcfg, query, empty_answer("", query), "2001:db8::1")
+	if len(*sent) != 1 {
+		t.Fatalf("%d queries sent, expected 1", len(*sent))
+	}
+	e := (*sent)[0].IsEdns0()
+	found := false
+	if e != nil {
+		for _, o := range e.Option {
+			found = found || (o.Option() == dns.EDNS0NSID)
+		}
+	}
+	if !found {
+		t.Errorf("query sent without an NSID request:\n%s", (*sent)[0])
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   Expected rcodes.
+
+   For conformance testing, we may know what the root should answer for
+   some names, for example that anything under "example." does not exist.
+   The rules file has one name pattern per line (see name_pattern),
+   followed by the expected rcode. Empty lines and lines starting with
+   '#' are ignored. For example:
+
+       *.example.     NXDOMAIN
+       example.       NXDOMAIN
+       *.arpa.        NOERROR
+
+   When more than one pattern matches, the longest one is used.
+
+   The answers from both IANA and Yeti are checked against the rules, on
+   top of the usual comparison.
+*/
+type rcode_rule struct {
+	pattern name_pattern
+	rcode   int
+}
+
+type rcode_rules []rcode_rule
+
+// Read the expected rcodes for name patterns from a file.
+func read_rcode_rules(fname string) (rcode_rules, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules rcode_rules
+	scanner := bufio.NewScanner(f)
+	line_num := 0
+	for scanner.Scan() {
+		line_num += 1
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) == 0) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a name pattern and an rcode", fname, line_num)
+		}
+		pattern, err := new_name_pattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", fname, line_num, err)
+		}
+		rcode, found := dns.StringToRcode[strings.ToUpper(fields[1])]
+		if !found {
+			return nil, fmt.Errorf("%s line %d: unknown rcode '%s'", fname, line_num, fields[1])
+		}
+		rules = append(rules, rcode_rule{pattern: pattern, rcode: rcode})
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Find the rule for a name, or nil if there is none.
+func (rules rcode_rules) match(qname string) (best *rcode_rule) {
+	qname = strings.ToLower(qname)
+	for n := range rules {
+		rule := &rules[n]
+		if rule.pattern.match(qname) && ((best == nil) || (len(rule.pattern.name) > len(best.pattern.name))) {
+			best = rule
+		}
+	}
+	return best
+}
+
+// Check the answers from IANA and Yeti against the expected rcode for
+// the query name, if there is one.
+func check_expected_rcode(rules rcode_rules, qname string, iana *dns.Msg, yeti *dns.Msg) (diffs []string) {
+	rule := rules.match(qname)
+	if rule == nil {
+		return nil
+	}
+	for _, side := range []struct {
+		name string
+		resp *dns.Msg
+	}{{"IANA", iana}, {"Yeti", yeti}} {
+		if side.resp.Rcode != rule.rcode {
+			diffs = append(diffs,
+				fmt.Sprintf("Expected rcode %s for %s (rule %s): %s %s",
+					dns.RcodeToString[rule.rcode], qname, rule.pattern,
+					side.name, dns.RcodeToString[side.resp.Rcode]))
+		}
+	}
+	return diffs
+}
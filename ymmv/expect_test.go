@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Get a name pattern that we know is valid.
+func pattern(text string) name_pattern {
+	p, _ := new_name_pattern(text)
+	return p
+}
+
+func TestReadRcodeRules(t *testing.T) {
+	fname := t.TempDir() + "/rcodes"
+	os.WriteFile(fname, []byte(
+		"# conformance expectations\n"+
+			"\n"+
+			"*.example  nxdomain\n"+
+			"example.   NXDOMAIN\n"+
+			"*.arpa.    NOERROR\n"), 0644)
+	rules, err := read_rcode_rules(fname)
+	if err != nil {
+		t.Fatalf("read_rcode_rules() error: %s", err)
+	}
+	if (len(rules) != 3) || (rules[0] != rcode_rule{pattern("*.example."), dns.RcodeNameError}) {
+		t.Errorf("read_rcode_rules() == %v", rules)
+	}
+
+	for _, bad := range []string{"example.\n", "example. NXDOMAIN extra\n",
+		"example. NOTANRCODE\n", "foo.*.example. NXDOMAIN\n", "a..b NXDOMAIN\n", "*. NOERROR\n", "* NOERROR\n"} {
+		os.WriteFile(fname, []byte(bad), 0644)
+		_, err := read_rcode_rules(fname)
+		if err == nil {
+			t.Errorf("read_rcode_rules() should fail for %q", bad)
+		}
+	}
+}
+
+func TestRcodeRulesMatch(t *testing.T) {
+	rules := rcode_rules{
+		{pattern("*.arpa."), dns.RcodeSuccess},
+		{pattern("*.example."), dns.RcodeNameError},
+		{pattern("www.example."), dns.RcodeRefused},
+	}
+	cases := []struct {
+		qname   string
+		pattern string
+	}{
+		{"foo.example.", "*.example."},
+		{"a.b.EXAMPLE.", "*.example."},
+		{"www.example.", "www.example."},
+		{"1.in-addr.arpa.", "*.arpa."},
+		// the suffix pattern does not match the name itself
+		{"arpa.", ""},
+		{"example.", ""},
+		{"notexample.", ""},
+		{".", ""},
+	}
+	for _, c := range cases {
+		rule := rules.match(c.qname)
+		if (c.pattern == "") && (rule != nil) {
+			t.Errorf("match(%q) == %v, want no rule", c.qname, rule.pattern)
+		} else if (c.pattern != "") && ((rule == nil) || (rule.pattern.String() != c.pattern)) {
+			t.Errorf("match(%q) == %v, want %s", c.qname, rule, c.pattern)
+		}
+	}
+}
+
+func TestCheckExpectedRcode(t *testing.T) {
+	rules := rcode_rules{{pattern("*.example."), dns.RcodeNameError}}
+	nxdomain := new(dns.Msg)
+	nxdomain.Rcode = dns.RcodeNameError
+	noerror := new(dns.Msg)
+
+	diffs := check_expected_rcode(rules, "foo.example.", nxdomain, nxdomain)
+	if len(diffs) != 0 {
+		t.Errorf("check_expected_rcode() for matching answers == %q", diffs)
+	}
+	diffs = check_expected_rcode(rules, "foo.example.", nxdomain, noerror)
+	if (len(diffs) != 1) ||
+		(diffs[0] != "Expected rcode NXDOMAIN for foo.example. (rule *.example.): Yeti NOERROR") {
+		t.Errorf("check_expected_rcode() for violating Yeti answer == %q", diffs)
+	}
+	diffs = check_expected_rcode(rules, "foo.example.", noerror, noerror)
+	if len(diffs) != 2 {
+		t.Errorf("check_expected_rcode() for two violating answers == %q", diffs)
+	}
+	// names without a rule are not checked
+	diffs = check_expected_rcode(rules, "foo.test.", noerror, nxdomain)
+	if len(diffs) != 0 {
+		t.Errorf("check_expected_rcode() without a rule == %q", diffs)
+	}
+}
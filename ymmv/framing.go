@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+/*
+   Validate the framing of a ymmv stream, as described in ymmv-format.md.
+
+   This checks only the structure of the stream: the magic value, the
+   format version if there is one, the IP family and protocol, that each
+   message fits in what is left of the stream, and the checksum for the
+   versions that have one. The DNS messages themselves are not parsed,
+   so a stream with broken DNS messages from a buggy capture program can
+   still be checked.
+
+   A line is written for each record, with its offsets and field values,
+   and for each problem found. Problems with the magic value, the IP
+   family, or a message length mean that we do not know where the next
+   record starts, so validation stops there.
+*/
+
+// reader that keeps track of how far into the stream we are
+type offset_reader struct {
+	r      io.Reader
+	offset int64
+	// number of messages started so far
+	messages int
+}
+
+func (in *offset_reader) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+	in.offset += int64(n)
+	return n, err
+}
+
+// read exactly len(buf) bytes, describing any shortfall as a problem
+func (in *offset_reader) read_field(buf []byte, what string) error {
+	start := in.offset
+	n, err := io.ReadFull(in, buf)
+	if err == io.ErrUnexpectedEOF || ((err == io.EOF) && (len(buf) > 0)) {
+		return fmt.Errorf("%s at offset %d truncated, %d of %d bytes", what, start, n, len(buf))
+	}
+	return err
+}
+
+// read a DNS message length and skip over the message, checking that it
+// is all there
+func (in *offset_reader) skip_message(what string) (offset int64, length uint16, err error) {
+	var len_buf [2]byte
+	err = in.read_field(len_buf[:], what+" length")
+	if err != nil {
+		return 0, 0, err
+	}
+	length = binary.BigEndian.Uint16(len_buf[:])
+	offset = in.offset
+	err = in.read_field(make([]byte, length), what)
+	return offset, length, err
+}
+
+// Validate a ymmv stream, returning the number of records and problems.
+func validate_framing(r io.Reader, out io.Writer) (records int, problems int) {
+	stream := &offset_reader{r: r}
+	for {
+		// everything before the checksum goes into the checksum
+		checksum := crc32.NewIEEE()
+		in := &offset_reader{r: io.TeeReader(stream, checksum), offset: stream.offset}
+		start := in.offset
+		magic := make([]byte, 4)
+		n, err := io.ReadFull(in, magic)
+		if (err == io.EOF) && (n == 0) {
+			break
+		}
+		records += 1
+		problem := func(format string, args ...interface{}) {
+			fmt.Fprintf(out, "record %d at offset %d: problem: %s\n",
+				records, start, fmt.Sprintf(format, args...))
+			problems += 1
+		}
+		if err != nil {
+			problem("magic truncated, %d of 4 bytes", n)
+			break
+		}
+		if string(magic) != "ymmv" {
+			problem("magic %q instead of \"ymmv\"", magic)
+			break
+		}
+
+		var family_protocol [2]byte
+		err = in.read_field(family_protocol[:], "IP family and protocol")
+		if err != nil {
+			problem("%s", err)
+			break
+		}
+		// versions 0 and 1 have a version byte before the IP family, and
+		// version 1 has a checksum at the end
+		version := -1
+		if (family_protocol[0] == 0) || (family_protocol[0] == 1) {
+			version = int(family_protocol[0])
+			family_protocol[0] = family_protocol[1]
+			err = in.read_field(family_protocol[1:], "protocol")
+			if err != nil {
+				problem("%s", err)
+				break
+			}
+		}
+		var addr_len int
+		switch family_protocol[0] {
+		case '4':
+			addr_len = net.IPv4len
+		case '6':
+			addr_len = net.IPv6len
+		default:
+			problem("IP family %q is not '4' or '6'", family_protocol[0])
+		}
+		if addr_len == 0 {
+			break
+		}
+		if (family_protocol[1] != 'u') && (family_protocol[1] != 't') {
+			problem("protocol %q is not 'u' or 't'", family_protocol[1])
+		}
+		addr := make([]byte, addr_len)
+		err = in.read_field(addr, "address")
+		if err != nil {
+			problem("%s", err)
+			break
+		}
+		err = in.read_field(make([]byte, 8), "query time")
+		if err != nil {
+			problem("%s", err)
+			break
+		}
+		query_offset, query_len, err := in.skip_message("query")
+		if err != nil {
+			problem("%s", err)
+			break
+		}
+		err = in.read_field(make([]byte, 8), "answer time")
+		if err != nil {
+			problem("%s", err)
+			break
+		}
+		answer_offset, answer_len, err := in.skip_message("answer")
+		if err != nil {
+			problem("%s", err)
+			break
+		}
+		checksum_desc := ""
+		if version == 1 {
+			calculated := checksum.Sum32()
+			var checksum_buf [4]byte
+			err = stream.read_field(checksum_buf[:], "checksum")
+			if err != nil {
+				problem("%s", err)
+				break
+			}
+			checksum_desc = fmt.Sprintf(" checksum %08x", calculated)
+			if binary.BigEndian.Uint32(checksum_buf[:]) != calculated {
+				problem("checksum mismatch, CRC32 in stream %08x, calculated %08x",
+					binary.BigEndian.Uint32(checksum_buf[:]), calculated)
+				continue
+			}
+		}
+		fmt.Fprintf(out, "record %d at offset %d: family %c protocol %c address %s "+
+			"query %d bytes at offset %d answer %d bytes at offset %d%s\n",
+			records, start, family_protocol[0], family_protocol[1], net.IP(addr),
+			query_len, query_offset, answer_len, answer_offset, checksum_desc)
+	}
+	fmt.Fprintf(out, "%d records, %d problems\n", records, problems)
+	return records, problems
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+// build a record in the ymmv format from raw (possibly invalid) DNS messages
+func raw_record(family byte, protocol byte, addr []byte, query []byte, answer []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("ymmv")
+	buf.WriteByte(family)
+	buf.WriteByte(protocol)
+	buf.Write(addr)
+	buf.Write(make([]byte, 8))
+	binary.Write(&buf, binary.BigEndian, uint16(len(query)))
+	buf.Write(query)
+	buf.Write(make([]byte, 8))
+	binary.Write(&buf, binary.BigEndian, uint16(len(answer)))
+	buf.Write(answer)
+	return buf.Bytes()
+}
+
+// turn a record into version 1 of the format, with a checksum
+func checksum_record(record []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("ymmv\x01")
+	buf.Write(record[4:])
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func TestValidateFraming(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1}
+	v6 := make([]byte, 16)
+	// neither of these is a valid DNS message
+	garbage := []byte("not DNS")
+	short := []byte{0xff}
+
+	cases := []struct {
+		name     string
+		stream   []byte
+		records  int
+		problems int
+		want     string
+	}{
+		{"valid framing with invalid DNS",
+			append(raw_record('4', 'u', v4, garbage, short), raw_record('6', 't', v6, short, garbage)...),
+			2, 0, "record 2 at offset 38: family 6 protocol t address :: query 1 bytes at offset 70 answer 7 bytes at offset 81\n"},
+		{"bad protocol",
+			append(raw_record('4', 'x', v4, garbage, garbage), raw_record('4', 'u', v4, garbage, garbage)...),
+			2, 1, "record 1 at offset 0: problem: protocol 'x' is not 'u' or 't'\n"},
+		{"bad family",
+			raw_record('5', 'u', v4, garbage, garbage),
+			1, 1, "record 1 at offset 0: problem: IP family '5' is not '4' or '6'\n"},
+		{"bad magic",
+			append(raw_record('4', 'u', v4, garbage, garbage), []byte("yxmv")...),
+			2, 1, "record 2 at offset 44: problem: magic \"yxmv\" instead of \"ymmv\"\n"},
+		{"answer past end of stream",
+			raw_record('4', 'u', v4, garbage, garbage)[:39],
+			1, 1, "record 1 at offset 0: problem: answer at offset 37 truncated, 2 of 7 bytes\n"},
+		{"valid checksum",
+			checksum_record(raw_record('4', 'u', v4, garbage, short)),
+			1, 0, "record 1 at offset 0: family 4 protocol u address 192.0.2.1 " +
+				"query 7 bytes at offset 21 answer 1 bytes at offset 38 checksum "},
+		{"bad checksum",
+			append(flip_byte(checksum_record(raw_record('4', 'u', v4, garbage, short)), 30),
+				raw_record('4', 'u', v4, garbage, garbage)...),
+			2, 1, "record 1 at offset 0: problem: checksum mismatch, CRC32 in stream "},
+		{"empty stream", nil, 0, 0, "0 records, 0 problems\n"},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		records, problems := validate_framing(bytes.NewReader(c.stream), &out)
+		if (records != c.records) || (problems != c.problems) {
+			t.Errorf("%s: validate_framing() == %d records, %d problems, want %d, %d:\n%s",
+				c.name, records, problems, c.records, c.problems, out.String())
+		}
+		if !strings.Contains(out.String(), c.want) {
+			t.Errorf("%s: validate_framing() output missing %q:\n%s", c.name, c.want, out.String())
+		}
+	}
+}
+
+// change a byte of a record, like a corrupted file would
+func flip_byte(record []byte, n int) []byte {
+	record[n] ^= 0xff
+	return record
+}
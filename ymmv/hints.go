@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+/*
+   Root hints.
+
+   Rather than priming from the built-in list of Yeti servers, the list
+   of servers can come from a root hints file, like the named.root file
+   used by resolvers, or any zone file with the root NS RRset and the
+   addresses of the name servers in it. The file can be local, or it
+   can be fetched from an http or https URL.
+*/
+
+// a name server from a root hints file, with its addresses
+type root_hint struct {
+	name string
+	ips  []net.IP
+}
+
+// Parse a root hints file, getting the addresses of each name server
+// in the root NS RRset, in the order of the names. Name servers without
+// any addresses are left out.
+func parse_root_hints(r io.Reader, source string) (hints []root_hint, err error) {
+	var ns_names []string
+	addrs := make(map[string][]net.IP)
+	for token := range dns.ParseZone(r, ".", source) {
+		// keep reading after an error, so the parser can finish
+		if err != nil {
+			continue
+		}
+		if token.Error != nil {
+			err = token.Error
+			continue
+		}
+		name := strings.ToLower(token.RR.Header().Name)
+		switch rr := token.RR.(type) {
+		case *dns.NS:
+			if name == "." {
+				ns_names = append(ns_names, strings.ToLower(rr.Ns))
+			}
+		case *dns.A:
+			addrs[name] = append(addrs[name], rr.A)
+		case *dns.AAAA:
+			addrs[name] = append(addrs[name], rr.AAAA)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// insure our order is repeatable, as for priming
+	sort.Strings(ns_names)
+	for n, ns_name := range ns_names {
+		if (n > 0) && (ns_name == ns_names[n-1]) {
+			continue
+		}
+		if len(addrs[ns_name]) == 0 {
+			glog.Warningf("%s: no addresses for root name server %s", source, ns_name)
+			continue
+		}
+		hints = append(hints, root_hint{name: ns_name, ips: addrs[ns_name]})
+	}
+	if len(hints) == 0 {
+		return nil, fmt.Errorf("%s: no root name servers with addresses", source)
+	}
+	return hints, nil
+}
+
+// client used to fetch root hints from a URL, so that a server that
+// never answers does not hang us forever; replaced in tests
+var hints_client = &http.Client{Timeout: 30 * time.Second}
+
+// Read a root hints file from a file name or an http or https URL.
+func read_root_hints(source string) ([]root_hint, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := hints_client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Error fetching %s: %s", source, resp.Status)
+		}
+		return parse_root_hints(resp.Body, source)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse_root_hints(f, source)
+}
+
+// Set up a server set with the name servers from root hints, instead of
+// priming.
+func init_yeti_server_set_from_hints(hints []root_hint, algo string) (srvs *yeti_server_set) {
+	srvs = new(yeti_server_set)
+	for _, hint := range hints {
+		ns := &ns_info{name: hint.name, srvs: srvs}
+		ns.set_ips(hint.ips)
+		srvs.ns = append(srvs.ns, ns)
+	}
+	srvs.algorithm = algo
+	return srvs
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const test_hints = `; root hints for testing
+.                        3600000      NS    BII.DNS-LAB.NET.
+.                        3600000      NS    yeti-ns.wide.ad.jp.
+.                        3600000      NS    no-addr.example.
+BII.DNS-LAB.NET.         3600000      AAAA  240c:f:1:22::6
+yeti-ns.wide.ad.jp.      3600000      AAAA  2001:200:1d9::35
+yeti-ns.wide.ad.jp.      3600000      A     203.178.129.35
+; addresses of servers not in the NS RRset are ignored
+other.example.           3600000      A     192.0.2.1
+`
+
+func check_test_hints(t *testing.T, hints []root_hint) {
+	want := []struct {
+		name string
+		ips  string
+	}{
+		{"bii.dns-lab.net.", "[240c:f:1:22::6]"},
+		{"yeti-ns.wide.ad.jp.", "[2001:200:1d9::35 203.178.129.35]"},
+	}
+	if len(hints) != len(want) {
+		t.Fatalf("%d root hints, expected %d: %v", len(hints), len(want), hints)
+	}
+	for n, w := range want {
+		if (hints[n].name != w.name) || (fmt.Sprint(hints[n].ips) != w.ips) {
+			t.Errorf("root hint %d == %s %v, expected %s %s", n, hints[n].name, hints[n].ips, w.name, w.ips)
+		}
+	}
+}
+
+func TestParseRootHints(t *testing.T) {
+	hints, err := parse_root_hints(strings.NewReader(test_hints), "test")
+	if err != nil {
+		t.Fatalf("parse_root_hints() error: %s", err)
+	}
+	check_test_hints(t, hints)
+
+	for _, bad := range []string{
+		"",
+		". 3600000 NS a.example.\n",
+		". 3600000 NS a.example.\na.example. 3600000 AAAA not-an-address\n",
+	} {
+		_, err := parse_root_hints(strings.NewReader(bad), "test")
+		if err == nil {
+			t.Errorf("parse_root_hints(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestReadRootHints(t *testing.T) {
+	fname := t.TempDir() + "/named.root"
+	os.WriteFile(fname, []byte(test_hints), 0644)
+	hints, err := read_root_hints(fname)
+	if err != nil {
+		t.Fatalf("read_root_hints(%s) error: %s", fname, err)
+	}
+	check_test_hints(t, hints)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/named.root" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, test_hints)
+	}))
+	defer server.Close()
+	hints, err = read_root_hints(server.URL + "/named.root")
+	if err != nil {
+		t.Fatalf("read_root_hints(%s) error: %s", server.URL, err)
+	}
+	check_test_hints(t, hints)
+	_, err = read_root_hints(server.URL + "/missing")
+	if err == nil {
+		t.Errorf("read_root_hints() of a missing URL succeeded")
+	}
+
+	// a server that never answers times out
+	defer func(c *http.Client) { hints_client = c }(hints_client)
+	hints_client = &http.Client{Timeout: 50 * time.Millisecond}
+	hang := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	_, err = read_root_hints(slow.URL + "/named.root")
+	if err == nil {
+		t.Errorf("read_root_hints() of a server that never answers succeeded")
+	}
+}
+
+func TestServerSetFromHints(t *testing.T) {
+	hints, _ := parse_root_hints(strings.NewReader(test_hints), "test")
+	srvs := init_yeti_server_set_from_hints(hints, "all")
+	targets := srvs.next()
+	if len(targets) != 3 {
+		t.Fatalf("next() returned %d targets, expected 3", len(targets))
+	}
+	if (targets[0].ns_name != "bii.dns-lab.net.") || !targets[2].ip.Equal(net.ParseIP("203.178.129.35")) {
+		t.Errorf("next() == %s %s, %s %s", targets[0].ns_name, targets[0].ip, targets[2].ns_name, targets[2].ip)
+	}
+	srvs.family = 4
+	if ips := srvs.all_ips(); (len(ips) != 1) || !ips[0].Equal(net.ParseIP("203.178.129.35")) {
+		t.Errorf("all_ips() for IPv4 == %v", ips)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+/*
+   Anycast instance checking.
+
+   Many root servers are anycast, so the address that we send a query to
+   may be answered by any of a number of instances. To verify that
+   queries end up where we expect, we ask for the name server identifier
+   (NSID, RFC 5001) and check it against a list of the NSID values that
+   each server address is expected to answer with.
+
+   The instance file has one server address per line, followed by one or
+   more patterns for the NSID, using shell-style matching as in
+   path.Match. Empty lines and lines starting with '#' are ignored. For
+   example:
+
+       240c:f:1:22::6   yeti-ns.tisf.net   tisf-*
+       2001:6d0:6d06::53   *.example.net
+*/
+type instance_map map[string][]string
+
+// Read the expected NSID patterns for each server address from a file.
+func read_instance_map(fname string) (instance_map, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	instances := make(instance_map)
+	scanner := bufio.NewScanner(f)
+	line_num := 0
+	for scanner.Scan() {
+		line_num += 1
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) == 0) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%s line %d: unrecognized IP address '%s'", fname, line_num, fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s line %d: no NSID for %s", fname, line_num, fields[0])
+		}
+		for _, pattern := range fields[1:] {
+			// check the syntax now, so we don't have to when matching
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: bad NSID pattern '%s'", fname, line_num, pattern)
+			}
+		}
+		instances[ip.String()] = append(instances[ip.String()], fields[1:]...)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// Get the NSID from a response, as text if it is printable and otherwise
+// as hex.
+func response_nsid(resp *dns.Msg) (nsid string, ok bool) {
+	if resp == nil {
+		return "", false
+	}
+	e := resp.IsEdns0()
+	if e == nil {
+		return "", false
+	}
+	for _, o := range e.Option {
+		if o.Option() != dns.EDNS0NSID {
+			continue
+		}
+		var data []byte
+		switch opt := o.(type) {
+		case *dns.EDNS0_NSID:
+			data, _ = hex.DecodeString(opt.Nsid)
+		case *dns.EDNS0_LOCAL:
+			data = opt.Data
+		}
+		for _, c := range data {
+			if (c < ' ') || (c > '~') {
+				return hex.EncodeToString(data), true
+			}
+		}
+		return string(data), true
+	}
+	return "", false
+}
+
+// Add an NSID request to a query.
+func AddNsidRequest(msg *dns.Msg) *dns.Msg {
+	return AddEdnsOption(msg, &dns.EDNS0_LOCAL{Code: dns.EDNS0NSID})
+}
+
+/*
+   Check whether the response from a target came from an instance that we
+   expect for that target address. This returns a description of any
+   unexpected instance, including the address that the original IANA query
+   went to and the NSID that the IANA server sent, if any.
+
+   A target with no entry in the instance map, or a response without an
+   NSID, can't be checked, so these are only logged.
+*/
+func check_instance(instances instance_map, target_ip net.IP, iana_ip *net.IP,
+	iana_resp *dns.Msg, yeti_resp *dns.Msg) (diffs []string) {
+	patterns, found := instances[target_ip.String()]
+	if !found {
+		glog.V(1).Infof("no expected instances for %s", target_ip)
+		return nil
+	}
+	nsid, ok := response_nsid(yeti_resp)
+	if !ok {
+		glog.V(1).Infof("no NSID in answer from %s, unable to check instance", target_ip)
+		return nil
+	}
+	for _, pattern := range patterns {
+		matched, _ := path.Match(pattern, nsid)
+		if matched {
+			glog.V(1).Infof("answer from %s has expected NSID '%s'", target_ip, nsid)
+			return nil
+		}
+	}
+	iana_nsid, ok := response_nsid(iana_resp)
+	if !ok {
+		iana_nsid = "none"
+	} else {
+		iana_nsid = "'" + iana_nsid + "'"
+	}
+	var iana_addr string
+	if iana_ip != nil {
+		iana_addr = iana_ip.String()
+	} else {
+		iana_addr = "unknown"
+	}
+	diffs = append(diffs,
+		fmt.Sprintf("Unexpected instance: Yeti %s answered with NSID '%s' (IANA %s NSID %s)",
+			target_ip, nsid, iana_addr, iana_nsid))
+	return diffs
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// make a response with the given NSID
+func nsid_answer(nsid string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion(".", dns.TypeSOA)
+	resp.Response = true
+	resp.SetEdns0(4096, false)
+	e := resp.IsEdns0()
+	e.Option = append(e.Option,
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(nsid))})
+	return resp
+}
+
+func TestReadInstanceMap(t *testing.T) {
+	fname := t.TempDir() + "/instances"
+	os.WriteFile(fname, []byte(
+		"# Yeti instances\n"+
+			"\n"+
+			"2001:db8::1  ns1.example  site-*\n"+
+			"2001:db8::2  *.example.net\n"), 0644)
+	instances, err := read_instance_map(fname)
+	if err != nil {
+		t.Fatalf("read_instance_map() error: %s", err)
+	}
+	if len(instances) != 2 {
+		t.Errorf("read_instance_map() read %d servers, want 2", len(instances))
+	}
+	patterns := instances["2001:db8::1"]
+	if (len(patterns) != 2) || (patterns[0] != "ns1.example") || (patterns[1] != "site-*") {
+		t.Errorf("read_instance_map() patterns for 2001:db8::1 == %q", patterns)
+	}
+
+	for _, bad := range []string{"not-an-ip foo\n", "2001:db8::1\n", "2001:db8::1 [\n"} {
+		os.WriteFile(fname, []byte(bad), 0644)
+		_, err := read_instance_map(fname)
+		if err == nil {
+			t.Errorf("read_instance_map() should fail for %q", bad)
+		}
+	}
+}
+
+func TestResponseNsid(t *testing.T) {
+	nsid, ok := response_nsid(nsid_answer("site-1"))
+	if !ok || (nsid != "site-1") {
+		t.Errorf("response_nsid() == %q, %t, want \"site-1\"", nsid, ok)
+	}
+	// binary NSID values are shown as hex
+	nsid, ok = response_nsid(nsid_answer("\x01\x02"))
+	if !ok || (nsid != "0102") {
+		t.Errorf("response_nsid() == %q, %t, want \"0102\"", nsid, ok)
+	}
+	_, ok = response_nsid(new(dns.Msg))
+	if ok {
+		t.Errorf("response_nsid() should find no NSID without EDNS")
+	}
+}
+
+func TestCheckInstance(t *testing.T) {
+	instances := instance_map{"2001:db8::1": {"site-*"}}
+	target := net.ParseIP("2001:db8::1")
+	iana_ip := net.ParseIP("192.0.2.1")
+
+	diffs := check_instance(instances, target, &iana_ip, nsid_answer("b1-iad"), nsid_answer("site-3"))
+	if len(diffs) != 0 {
+		t.Errorf("check_instance() for expected instance == %q", diffs)
+	}
+	// no NSID or no entry for the server means we can't tell
+	diffs = check_instance(instances, target, &iana_ip, new(dns.Msg), new(dns.Msg))
+	if len(diffs) != 0 {
+		t.Errorf("check_instance() without NSID == %q", diffs)
+	}
+	diffs = check_instance(instances, net.ParseIP("2001:db8::2"), &iana_ip,
+		new(dns.Msg), nsid_answer("elsewhere"))
+	if len(diffs) != 0 {
+		t.Errorf("check_instance() for unknown server == %q", diffs)
+	}
+
+	diffs = check_instance(instances, target, &iana_ip, nsid_answer("b1-iad"), nsid_answer("elsewhere"))
+	if len(diffs) != 1 {
+		t.Fatalf("check_instance() for unexpected instance == %q", diffs)
+	}
+	for _, want := range []string{"2001:db8::1", "'elsewhere'", "192.0.2.1", "'b1-iad'"} {
+		if !strings.Contains(diffs[0], want) {
+			t.Errorf("check_instance() == %q, missing %s", diffs[0], want)
+		}
+	}
+}
+
+func TestYetiQueryInstances(t *testing.T) {
+	sent, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		resp := nsid_answer("elsewhere")
+		resp.SetReply(query)
+		return resp
+	})
+	defer restore()
+
+	df, err := open_daily_file(t.TempDir()+"/diff", "")
+	if err != nil {
+		t.Fatalf("Error opening differences file: %s", err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	qcfg := query_conf{clear_names: true, instances: instance_map{"2001:db8::1": {"site-*"}}}
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, df, query, empty_answer("", query),
+		time.Millisecond, &addr)
+	<-done
+
+	// we asked for the NSID...
+	if len(*sent) != 1 {
+		t.Fatalf("%d queries sent, expected 1", len(*sent))
+	}
+	_, ok := response_nsid((*sent)[0])
+	if !ok {
+		t.Errorf("query with instance checking has no NSID request")
+	}
+	// ...and reported that it was not what we expected
+	contents, err := os.ReadFile(df.cur_name)
+	if err != nil {
+		t.Fatalf("Error reading differences file: %s", err)
+	}
+	if !strings.Contains(string(contents), "Unexpected instance: Yeti 2001:db8::1 answered with NSID 'elsewhere'") {
+		t.Errorf("unexpected instance not reported:\n%s", contents)
+	}
+}
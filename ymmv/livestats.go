@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+   Live statistics.
+
+   For watching a long run, we can write a line every so often with the
+   rate of queries and mismatches and the RTT quantiles of the Yeti
+   answers since the previous line, like this:
+
+       live 10s: 12.3 queries/s 0.4 mismatches/s RTT p50 23ms p90 45ms p99 120ms
+
+   The exit summary covers the whole run, so this only looks at what
+   changed during each interval.
+*/
+type live_stats struct {
+	srvs *yeti_server_set
+	out  io.Writer
+	// what we had counted at the last line
+	prev_outcomes [num_outcomes]uint
+	prev_rtts     rtt_histogram
+	prev_time     time.Time
+}
+
+// Get the line describing what happened since the last one.
+func (ls *live_stats) line(now time.Time) string {
+	ls.srvs.lock.Lock()
+	outcomes := ls.srvs.outcomes
+	rtts := ls.srvs.rtts
+	ls.srvs.lock.Unlock()
+
+	var queries uint
+	for o := outcome(0); o < num_outcomes; o++ {
+		queries += outcomes[o] - ls.prev_outcomes[o]
+	}
+	mismatches := outcomes[outcome_different] - ls.prev_outcomes[outcome_different]
+	interval_rtts := rtts.since(&ls.prev_rtts)
+	elapsed := now.Sub(ls.prev_time)
+
+	s := fmt.Sprintf("live %s: %.1f queries/s %.1f mismatches/s RTT",
+		elapsed.Round(time.Millisecond),
+		float64(queries)/elapsed.Seconds(), float64(mismatches)/elapsed.Seconds())
+	for _, q := range []struct {
+		name     string
+		fraction float64
+	}{{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}} {
+		rtt, ok := interval_rtts.quantile(q.fraction)
+		if ok {
+			s += fmt.Sprintf(" %s %s", q.name, rtt)
+		} else {
+			s += fmt.Sprintf(" %s -", q.name)
+		}
+	}
+
+	ls.prev_outcomes = outcomes
+	ls.prev_rtts = rtts
+	ls.prev_time = now
+	return s
+}
+
+// Start writing live statistics at the given interval, until the
+// returned function is called.
+func start_live_stats(srvs *yeti_server_set, interval time.Duration, out io.Writer) (stop func()) {
+	ls := &live_stats{srvs: srvs, out: out, prev_time: time.Now()}
+	// start from the counts we have now, in case we already did some work
+	ls.line(ls.prev_time)
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case now := <-ticker.C:
+				fmt.Fprintln(ls.out, ls.line(now))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// buffer that the live statistics goroutine can write to while we read
+type locked_buffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *locked_buffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *locked_buffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestLiveStatsLine(t *testing.T) {
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	start := time.Now()
+	ls := &live_stats{srvs: srvs, prev_time: start}
+	for n := 0; n < 10; n++ {
+		srvs.record_outcome(nil, outcome_equivalent)
+		srvs.record_rtt(nil, 20*time.Millisecond)
+	}
+	srvs.record_outcome(nil, outcome_different)
+	srvs.record_rtt(nil, 200*time.Millisecond)
+	line := ls.line(start.Add(2 * time.Second))
+	want := "live 2s: 5.5 queries/s 0.5 mismatches/s RTT p50 20ms p90 20ms p99 200ms"
+	if line != want {
+		t.Errorf("line() == %q, want %q", line, want)
+	}
+	// the next line only covers what happened since
+	line = ls.line(start.Add(4 * time.Second))
+	want = "live 2s: 0.0 queries/s 0.0 mismatches/s RTT p50 - p90 - p99 -"
+	if line != want {
+		t.Errorf("line() == %q, want %q", line, want)
+	}
+}
+
+func TestLiveStatsPeriodic(t *testing.T) {
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	var out locked_buffer
+	stop := start_live_stats(srvs, 10*time.Millisecond, &out)
+	deadline := time.Now().Add(5 * time.Second)
+	for (strings.Count(out.String(), "\n") < 3) && time.Now().Before(deadline) {
+		srvs.record_outcome(nil, outcome_equivalent)
+		srvs.record_rtt(nil, time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("only %d lines of live statistics written", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "live ") || !strings.Contains(line, "queries/s") {
+			t.Errorf("unexpected live statistics line %q", line)
+		}
+	}
+	// nothing more is written once stopped
+	written := out.String()
+	time.Sleep(30 * time.Millisecond)
+	if out.String() != written {
+		t.Errorf("live statistics written after stop")
+	}
+}
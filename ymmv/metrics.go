@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+   Prometheus metrics.
+
+   With the -metrics-addr flag, we run an HTTP server alongside the
+   comparisons, with the metrics at /metrics for Prometheus to scrape.
+   This is for watching ymmv when it runs continuously, rather than
+   waiting for the summary at the end.
+
+   We use our own registry rather than the default one, so only our
+   metrics are there.
+*/
+var metrics_registry = prometheus.NewRegistry()
+
+var (
+	metric_comparisons = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ymmv_comparisons_total",
+		Help: "Number of IANA and Yeti answers compared.",
+	})
+	metric_mismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ymmv_mismatches_total",
+		Help: "Number of comparisons with differences, by the part of the answer that differs.",
+	}, []string{"section"})
+	metric_server_queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ymmv_server_queries_total",
+		Help: "Number of queries sent to each Yeti server address.",
+	}, []string{"server"})
+	metric_rtt = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ymmv_rtt_seconds",
+		Help:    "Round-trip times of queries to the Yeti servers, with failed queries counted as 0.5 seconds.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+)
+
+func init() {
+	metrics_registry.MustRegister(metric_comparisons, metric_mismatches,
+		metric_server_queries, metric_rtt)
+}
+
+// Get the handler for our metrics.
+func metrics_handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics_registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// Start serving our metrics at the given address, like ":9153". The
+// address is checked here, so that a mistake is reported right away.
+func serve_metrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	glog.Infof("serving metrics at http://%s/metrics", listener.Addr())
+	go func() {
+		err := http.Serve(listener, metrics_handler())
+		glog.Errorf("Error serving metrics: %s", err)
+	}()
+	return nil
+}
+
+// Get the parts of the answers that differ in a comparison. Differences
+// from the other checks, like the EDNS options, are counted as "other".
+func mismatch_sections(result *ComparisonResult, diffs []string) (names []string) {
+	if len(diffs) == 0 {
+		return nil
+	}
+	sections := []struct {
+		name  string
+		diffs []string
+	}{
+		{"question", result.Question},
+		{"flags", result.Flags},
+		{"answer", result.Answer.diffs("", "")},
+		{"authority", result.Authority.diffs("", "")},
+		{"additional", result.Additional.diffs("", "")},
+	}
+	if result.NoQuestion {
+		sections[0].diffs = result.Diffs()
+	}
+	if result.Rcode != "" {
+		names = append(names, "rcode")
+	}
+	for _, section := range sections {
+		if len(section.diffs) > 0 {
+			names = append(names, section.name)
+		}
+	}
+	if len(diffs) > len(result.Diffs()) {
+		names = append(names, "other")
+	}
+	return names
+}
+
+// Count a comparison, along with each part of the answers that differs.
+func record_comparison_metrics(result *ComparisonResult, diffs []string) {
+	metric_comparisons.Inc()
+	for _, section := range mismatch_sections(result, diffs) {
+		metric_mismatches.WithLabelValues(section).Inc()
+	}
+}
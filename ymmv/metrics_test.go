@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Get the value of a metric from the /metrics page, or -1 if it is not
+// there.
+func scrape_metric(t *testing.T, url string, metric string) float64 {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("Error getting metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) == 2) && (fields[0] == metric) {
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Fatalf("Bad value for %s: %s", metric, fields[1])
+			}
+			return value
+		}
+	}
+	return -1
+}
+
+func TestMetrics(t *testing.T) {
+	server := httptest.NewServer(metrics_handler())
+	defer server.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+	answer.Rcode = dns.RcodeNameError
+
+	comparisons := scrape_metric(t, server.URL, "ymmv_comparisons_total")
+	rcode := scrape_metric(t, server.URL, `ymmv_mismatches_total{section="rcode"}`)
+	rtts := scrape_metric(t, server.URL, "ymmv_rtt_seconds_count")
+
+	_, restore := mock_dns_query(empty_answer)
+	qcfg := query_conf{clear_names: true}
+	run_yeti_query(&qcfg, query, answer, "2001:db8::1")
+	restore()
+
+	if got := scrape_metric(t, server.URL, "ymmv_comparisons_total"); got != comparisons+1 {
+		t.Errorf("ymmv_comparisons_total == %g, expected %g", got, comparisons+1)
+	}
+	// a mismatch never seen before has no line until it is counted
+	if rcode < 0 {
+		rcode = 0
+	}
+	if got := scrape_metric(t, server.URL, `ymmv_mismatches_total{section="rcode"}`); got != rcode+1 {
+		t.Errorf("rcode mismatches == %g, expected %g", got, rcode+1)
+	}
+	if got := scrape_metric(t, server.URL, `ymmv_server_queries_total{server="2001:db8::1"}`); got < 1 {
+		t.Errorf("queries to 2001:db8::1 == %g, expected at least 1", got)
+	}
+	if got := scrape_metric(t, server.URL, "ymmv_rtt_seconds_count"); got != rtts+1 {
+		t.Errorf("ymmv_rtt_seconds_count == %g, expected %g", got, rtts+1)
+	}
+
+	resp, err := http.Get(server.URL + "/other")
+	if err != nil {
+		t.Fatalf("Error getting /other: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status for /other == %d, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
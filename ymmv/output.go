@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+   Output of the results.
+
+   Everything that is a result, rather than logging, goes to the output:
+   the JSON lines with -j, the queries with -dry-run, the self-test
+   results, the framing check, and the summary at the end. This is
+   standard output, unless the -o flag names a file to write it to
+   instead.
+
+   Comparisons run at the same time as each other, so writes are done
+   one at a time. Each write is a whole line or more, so lines from
+   different comparisons never get mixed up.
+*/
+type output_writer struct {
+	lock sync.Mutex
+	w    io.Writer
+	// the file we opened, which we need to close (nil for standard output)
+	f *os.File
+}
+
+func (ow *output_writer) Write(p []byte) (int, error) {
+	ow.lock.Lock()
+	defer ow.lock.Unlock()
+	return ow.w.Write(p)
+}
+
+// Close the output, if it is a file that we opened.
+func (ow *output_writer) Close() error {
+	if ow.f == nil {
+		return nil
+	}
+	ow.lock.Lock()
+	defer ow.lock.Unlock()
+	return ow.f.Close()
+}
+
+// Open the output, either the named file, or standard output if the name
+// is "" or "-". An existing file is replaced.
+func open_output(name string) (*output_writer, error) {
+	if (name == "") || (name == "-") {
+		return &output_writer{w: os.Stdout}, nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &output_writer{w: f, f: f}, nil
+}
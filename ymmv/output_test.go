@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestOutputFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "results.txt")
+	output, err := open_output(name)
+	if err != nil {
+		t.Fatalf("open_output() error: %s", err)
+	}
+
+	// comparisons running at the same time all write to the output
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	srvs := init_yeti_server_set(ips, "all")
+	qcfg := query_conf{clear_names: true, dry_run: output}
+	done := make(chan bool, 10)
+	for n := 0; n < 10; n++ {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		addr := net.ParseIP("192.0.2.1")
+		go yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+	}
+	for n := 0; n < 10; n++ {
+		<-done
+	}
+	srvs.write_summary(output)
+	if err := output.Close(); err != nil {
+		t.Fatalf("Close() error: %s", err)
+	}
+
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Error reading output: %s", err)
+	}
+	lines := strings.Split(string(contents), "\n")
+	if (len(lines) < 20) || !strings.Contains(string(contents), "Comparison summary:\n") {
+		t.Fatalf("output has %d lines, expected 20 queries and the summary:\n%s", len(lines), contents)
+	}
+	for _, line := range lines[:20] {
+		if !strings.HasPrefix(line, "dry run: 'www.example.' A as 'www.example.' to ") {
+			t.Errorf("unexpected output line %q", line)
+		}
+	}
+}
+
+func TestOutputStdout(t *testing.T) {
+	for _, name := range []string{"", "-"} {
+		output, err := open_output(name)
+		if err != nil {
+			t.Fatalf("open_output(%q) error: %s", name, err)
+		}
+		if output.w != os.Stdout {
+			t.Errorf("open_output(%q) is not standard output", name)
+		}
+		// closing standard output would be a bad idea
+		if (output.Close() != nil) || (output.f != nil) {
+			t.Errorf("open_output(%q) has a file to close", name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   Name patterns, used by -skip and -name to pick the query names to
+   compare, and by -expect-rcodes to pick the names to check the rcode
+   of.
+
+   A pattern is either a name that must match exactly, like
+   "id.server.", or "*." and a suffix, like "*.root-servers.net.", which
+   matches any name below the suffix but not the suffix itself. A
+   pattern of just "*." is not allowed, since it would match every name.
+   Names are compared without regard to case.
+*/
+type name_pattern struct {
+	// the name, or the suffix including the leading '.' for "*." patterns
+	name     string
+	wildcard bool
+}
+
+// Make a pattern from its text, which may leave off the final '.'.
+func new_name_pattern(pattern string) (name_pattern, error) {
+	name := strings.ToLower(dns.Fqdn(strings.TrimSpace(pattern)))
+	var p name_pattern
+	if strings.HasPrefix(name, "*.") {
+		p = name_pattern{name: name[1:], wildcard: true}
+	} else {
+		p = name_pattern{name: name}
+	}
+	if (p.name == ".") && p.wildcard {
+		return p, fmt.Errorf("Pattern '%s' would match every name", pattern)
+	}
+	if strings.Contains(p.name, "*") || strings.Contains(p.name, "..") {
+		return p, fmt.Errorf("Pattern '%s' must be a name, or '*.' and a name", pattern)
+	}
+	if _, ok := dns.IsDomainName(p.name); !ok {
+		return p, fmt.Errorf("Pattern '%s' is not a valid name", pattern)
+	}
+	return p, nil
+}
+
+// check whether a name, in lower case, matches the pattern
+func (p *name_pattern) match(name string) bool {
+	if p.wildcard {
+		return strings.HasSuffix(name, p.name) && (len(name) > len(p.name))
+	}
+	return name == p.name
+}
+
+// the pattern as it would be written, like "*.example."
+func (p name_pattern) String() string {
+	if p.wildcard {
+		return "*" + p.name
+	}
+	return p.name
+}
+
+// Parse comma-separated patterns, as used by -skip and -name.
+func parse_name_patterns(patterns string) (names []name_pattern, err error) {
+	for _, pattern := range strings.Split(patterns, ",") {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		p, err := new_name_pattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, p)
+	}
+	return names, nil
+}
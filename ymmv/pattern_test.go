@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNamePattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		text    string
+		match   []string
+		differ  []string
+	}{
+		{"Example.COM", "example.com.", []string{"example.com."}, []string{"www.example.com.", "com."}},
+		{" *.test ", "*.test.", []string{"a.test.", "a.b.test."}, []string{"test.", "xtest."}},
+		{".", ".", []string{"."}, []string{"example."}},
+	}
+	for _, c := range cases {
+		p, err := new_name_pattern(c.pattern)
+		if err != nil {
+			t.Errorf("new_name_pattern(%q) error: %s", c.pattern, err)
+			continue
+		}
+		if p.String() != c.text {
+			t.Errorf("new_name_pattern(%q) == %s, want %s", c.pattern, p, c.text)
+		}
+		for _, name := range c.match {
+			if !p.match(name) {
+				t.Errorf("%s does not match %s", p, name)
+			}
+		}
+		for _, name := range c.differ {
+			if p.match(name) {
+				t.Errorf("%s matches %s", p, name)
+			}
+		}
+	}
+
+	for _, bad := range []string{"*", "*.", "a.*.example", "a..example", strings.Repeat("a", 64) + ".example"} {
+		if _, err := new_name_pattern(bad); err == nil {
+			t.Errorf("new_name_pattern(%q) succeeded, expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   Progress reports.
+
+   Processing a big capture can take a long time, so with -progress we
+   write a line to standard error every so often with the totals so far
+   and the query rate since the previous line, like this:
+
+       progress 1m30s: 12345 messages, 11000 queries, 17 mismatches, 120.5 queries/s
+
+   Unlike the live statistics, which come from the comparison results,
+   these are simple counters, updated as each message is read and each
+   query is sent.
+*/
+type progress_counters struct {
+	// 64-bit values first, so they are aligned for atomic access
+	messages   uint64
+	queries    uint64
+	mismatches uint64
+}
+
+// the counters for this run, shared by every comparison
+var progress progress_counters
+
+func (pc *progress_counters) add_message() {
+	atomic.AddUint64(&pc.messages, 1)
+}
+
+func (pc *progress_counters) add_query() {
+	atomic.AddUint64(&pc.queries, 1)
+}
+
+func (pc *progress_counters) add_mismatch() {
+	atomic.AddUint64(&pc.mismatches, 1)
+}
+
+// state for writing progress lines
+type progress_report struct {
+	counters     *progress_counters
+	start        time.Time
+	prev_time    time.Time
+	prev_queries uint64
+}
+
+// Get the progress line for the given time.
+func (pr *progress_report) line(now time.Time) string {
+	messages := atomic.LoadUint64(&pr.counters.messages)
+	queries := atomic.LoadUint64(&pr.counters.queries)
+	mismatches := atomic.LoadUint64(&pr.counters.mismatches)
+	var qps float64
+	if elapsed := now.Sub(pr.prev_time); elapsed > 0 {
+		qps = float64(queries-pr.prev_queries) / elapsed.Seconds()
+	}
+	pr.prev_time = now
+	pr.prev_queries = queries
+	return fmt.Sprintf("progress %s: %d messages, %d queries, %d mismatches, %.1f queries/s",
+		now.Sub(pr.start).Round(time.Second), messages, queries, mismatches, qps)
+}
+
+// Write a progress line for each tick, until done is closed.
+func (pr *progress_report) run(ticks <-chan time.Time, done <-chan bool, out io.Writer) {
+	for {
+		select {
+		case now := <-ticks:
+			fmt.Fprintln(out, pr.line(now))
+		case <-done:
+			return
+		}
+	}
+}
+
+// Start writing progress lines at the given interval, until the
+// returned function is called.
+func start_progress(interval time.Duration, out io.Writer) (stop func()) {
+	now := time.Now()
+	pr := &progress_report{counters: &progress, start: now, prev_time: now,
+		prev_queries: atomic.LoadUint64(&progress.queries)}
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		defer close(finished)
+		pr.run(ticker.C, done, out)
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+	}
+}
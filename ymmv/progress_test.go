@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReport(t *testing.T) {
+	var counters progress_counters
+	start := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	pr := &progress_report{counters: &counters, start: start, prev_time: start}
+
+	// a fake clock, ticking when we say so
+	ticks := make(chan time.Time)
+	done := make(chan bool)
+	finished := make(chan bool)
+	var out locked_buffer
+	go func() {
+		defer close(finished)
+		pr.run(ticks, done, &out)
+	}()
+
+	for n := 0; n < 20; n++ {
+		counters.add_message()
+		counters.add_query()
+	}
+	counters.add_mismatch()
+	ticks <- start.Add(10 * time.Second)
+	for n := 0; n < 5; n++ {
+		counters.add_message()
+		counters.add_query()
+	}
+	ticks <- start.Add(15 * time.Second)
+	close(done)
+	<-finished
+
+	want := "progress 10s: 20 messages, 20 queries, 1 mismatches, 2.0 queries/s\n" +
+		"progress 15s: 25 messages, 25 queries, 1 mismatches, 1.0 queries/s\n"
+	if out.String() != want {
+		t.Errorf("progress reports ==\n%s\nexpected\n%s", out.String(), want)
+	}
+}
+
+func TestStartProgress(t *testing.T) {
+	var out locked_buffer
+	stop := start_progress(10*time.Millisecond, &out)
+	deadline := time.Now().Add(5 * time.Second)
+	for (strings.Count(out.String(), "\n") < 2) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	if !strings.HasPrefix(out.String(), "progress ") {
+		t.Errorf("no progress reports written, only %q", out.String())
+	}
+}
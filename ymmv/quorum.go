@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   Quorum mode.
+
+   Normally each Yeti answer is only compared with the IANA one. With
+   the -quorum flag, each query goes to several different Yeti servers,
+   and their answers are also compared with each other, so that we can
+   see when the Yeti servers disagree among themselves. The answers that
+   are the same as each other are grouped, and the largest group is the
+   majority. Every server outside the majority is reported, along with
+   how its answer differs from the majority answer.
+*/
+
+// an answer from a Yeti server, for comparing with the other servers
+type yeti_answer struct {
+	target *query_target
+	resp   *dns.Msg
+}
+
+// Add more servers to the targets picked by the algorithm, picked at
+// random from those not already used, until we have enough for the
+// quorum or run out. The server set must be locked.
+func (srvs *yeti_server_set) add_quorum_targets(targets []*query_target) []*query_target {
+	used := make(map[*ip_info]bool)
+	for _, target := range targets {
+		used[target.info] = true
+	}
+	var others []*query_target
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			if !used[info] && srvs.available(info) {
+				others = append(others, &query_target{ip: info.ip, ns_name: ns.name, info: info})
+			}
+		}
+	}
+	for _, n := range rand.Perm(len(others)) {
+		if len(targets) >= srvs.quorum {
+			break
+		}
+		targets = append(targets, others[n])
+	}
+	return targets
+}
+
+// Group answers that are the same as each other, with the largest group
+// first. Groups of the same size are in the order of their first answer.
+func group_answers(answers []yeti_answer, ccfg *compare_conf) (groups [][]yeti_answer) {
+	for _, answer := range answers {
+		found := false
+		for n, group := range groups {
+			// comparison sorts and modifies the answers, so use copies
+			result := compare_resp(group[0].resp.Copy(), answer.resp.Copy(), ccfg)
+			if result.Equivalent() {
+				groups[n] = append(group, answer)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []yeti_answer{answer})
+		}
+	}
+	// a stable insertion sort keeps the order of groups the same size
+	for i := 1; i < len(groups); i++ {
+		for j := i; (j > 0) && (len(groups[j]) > len(groups[j-1])); j-- {
+			groups[j], groups[j-1] = groups[j-1], groups[j]
+		}
+	}
+	return groups
+}
+
+// Describe the servers that gave a group of answers.
+func answer_servers(group []yeti_answer) string {
+	servers := make([]string, 0, len(group))
+	for _, answer := range group {
+		servers = append(servers, fmt.Sprintf("%s @ %s", answer.target.ns_name, answer.target.ip))
+	}
+	return strings.Join(servers, ", ")
+}
+
+// Check whether the Yeti servers agree with each other. If they do not,
+// this returns a description of the majority, and the differences from
+// the majority answer for each server outside of it.
+func check_quorum(answers []yeti_answer, ccfg *compare_conf) (majority string, diffs map[*query_target][]string) {
+	groups := group_answers(answers, ccfg)
+	if len(groups) < 2 {
+		return "", nil
+	}
+	if len(groups[0]) > len(groups[1]) {
+		majority = fmt.Sprintf("%d of %d Yeti servers agree: %s",
+			len(groups[0]), len(answers), answer_servers(groups[0]))
+	} else {
+		majority = fmt.Sprintf("no majority of %d Yeti servers, most common answer from %s",
+			len(answers), answer_servers(groups[0]))
+	}
+	diffs = make(map[*query_target][]string)
+	for _, group := range groups[1:] {
+		for _, answer := range group {
+			result := compare_resp(groups[0][0].resp.Copy(), answer.resp.Copy(), ccfg)
+			target_diffs := []string{"Yeti servers disagree, " + majority}
+			// the comparison describes the first answer as IANA, which
+			// here is the majority answer
+			for _, diff := range result.Diffs() {
+				target_diffs = append(target_diffs,
+					"Yeti majority mismatch: "+strings.Replace(diff, "IANA", "majority", -1))
+			}
+			diffs[answer.target] = target_diffs
+		}
+	}
+	return majority, diffs
+}
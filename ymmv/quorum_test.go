@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQuorumTargets(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"), net.ParseIP("2001:db8::4")}
+	for _, algo := range []string{"rtt", "least-rtt", "round-robin", "random", "weighted"} {
+		srvs := init_yeti_server_set(ips, algo)
+		srvs.quorum = 3
+		for n := 0; n < 20; n++ {
+			targets := srvs.next()
+			if len(targets) != 3 {
+				t.Fatalf("%s: next() returned %d targets, expected 3", algo, len(targets))
+			}
+			seen := make(map[string]bool)
+			for _, target := range targets {
+				if seen[target.ip.String()] {
+					t.Errorf("%s: next() returned %s more than once", algo, target.ip)
+				}
+				seen[target.ip.String()] = true
+			}
+		}
+	}
+
+	// with fewer servers than the quorum we use them all
+	srvs := init_yeti_server_set(ips[:2], "rtt")
+	srvs.quorum = 3
+	if targets := srvs.next(); len(targets) != 2 {
+		t.Errorf("next() returned %d targets, expected 2", len(targets))
+	}
+}
+
+func quorum_answer(ip string, rcode int) yeti_answer {
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeSOA)
+	resp := empty_answer("", query)
+	resp.Rcode = rcode
+	target := &query_target{ip: net.ParseIP(ip), ns_name: "yeti.example."}
+	return yeti_answer{target: target, resp: resp}
+}
+
+func TestCheckQuorum(t *testing.T) {
+	var ccfg compare_conf
+	answers := []yeti_answer{
+		quorum_answer("2001:db8::1", dns.RcodeSuccess),
+		quorum_answer("2001:db8::2", dns.RcodeNameError),
+		quorum_answer("2001:db8::3", dns.RcodeSuccess),
+	}
+
+	// all the same
+	majority, diffs := check_quorum([]yeti_answer{answers[0], answers[2]}, &ccfg)
+	if (majority != "") || (diffs != nil) {
+		t.Errorf("check_quorum() of the same answers == %q, %v", majority, diffs)
+	}
+
+	// one server disagrees
+	majority, diffs = check_quorum(answers, &ccfg)
+	want := "2 of 3 Yeti servers agree: yeti.example. @ 2001:db8::1, yeti.example. @ 2001:db8::3"
+	if majority != want {
+		t.Errorf("check_quorum() majority == %q, expected %q", majority, want)
+	}
+	if (len(diffs) != 1) || (diffs[answers[1].target] == nil) {
+		t.Fatalf("check_quorum() diffs == %v, expected only for 2001:db8::2", diffs)
+	}
+	got := strings.Join(diffs[answers[1].target], "\n")
+	want = "Yeti servers disagree, " + want + "\n" +
+		"Yeti majority mismatch: Rcode mismatch: majority NOERROR vs Yeti NXDOMAIN"
+	if got != want {
+		t.Errorf("check_quorum() diffs ==\n%s\nexpected\n%s", got, want)
+	}
+
+	// no majority
+	majority, diffs = check_quorum(answers[:2], &ccfg)
+	if !strings.HasPrefix(majority, "no majority of 2 Yeti servers") || (len(diffs) != 1) {
+		t.Errorf("check_quorum() with a tie == %q, %v", majority, diffs)
+	}
+}
+
+func TestYetiQueryQuorum(t *testing.T) {
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		if server == "[2001:db8::2]:53" {
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		return resp
+	})
+	defer restore()
+
+	dir := t.TempDir()
+	dd, err := open_diff_dir(dir)
+	if err != nil {
+		t.Fatalf("open_diff_dir() error: %s", err)
+	}
+	qcfg := query_conf{clear_names: true, diff_dir: dd}
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	srvs := init_yeti_server_set(ips, "rtt")
+	srvs.quorum = 3
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeSOA)
+	var report report_conf
+	done := make(chan bool, 1)
+	iana_ip := net.ParseIP("192.0.2.1")
+	yeti_query(done, &report, srvs, &qcfg, nil, nil, query, empty_answer("", query), time.Millisecond, &iana_ip)
+	<-done
+
+	// the server that disagrees has both the IANA and quorum differences
+	name := filepath.Join(dir, diff_dir_file_name("example.", "SOA", ips[1]))
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Error reading differences for %s: %s", ips[1], err)
+	}
+	for _, want := range []string{
+		"Rcode mismatch: IANA NOERROR vs Yeti SERVFAIL",
+		"Yeti servers disagree, 2 of 3 Yeti servers agree",
+		"Yeti majority mismatch: Rcode mismatch: majority NOERROR vs Yeti SERVFAIL",
+	} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("differences for %s are missing %q:\n%s", ips[1], want, contents)
+		}
+	}
+	// the others have no differences at all
+	for _, ip := range []net.IP{ips[0], ips[2]} {
+		name := filepath.Join(dir, diff_dir_file_name("example.", "SOA", ip))
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("differences written for %s, which agrees with the majority", ip)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+// differences in one section of the answers
+type SectionDiff struct {
+	// the difference in the number of records, or "" if the same
+	Count string `json:"-"`
+	// records that are only in the IANA or only in the Yeti answer
+	IanaOnly []string `json:"iana_only"`
+	YetiOnly []string `json:"yeti_only"`
+	// records in both answers, but a different number of times
+	Repeats []string `json:"-"`
+	// differences in how the records prove that a name does not exist,
+	// for the authority section
+	Denial []string `json:"-"`
+	// differences in the root SOA, if either section has one
+	Soa []string `json:"-"`
+}
+
+func (sd *SectionDiff) set(iana_only []dns.RR, yeti_only []dns.RR) {
+	sd.IanaOnly = make([]string, 0, len(iana_only))
+	for _, rr := range iana_only {
+		sd.IanaOnly = append(sd.IanaOnly, rr.String())
+	}
+	sd.YetiOnly = make([]string, 0, len(yeti_only))
+	for _, rr := range yeti_only {
+		sd.YetiOnly = append(sd.YetiOnly, rr.String())
+	}
+}
+
+// describe the differences in a section, with how to describe the
+// records only in the IANA answer and only in the Yeti answer
+func (sd *SectionDiff) diffs(iana_only string, yeti_only string) (diffs []string) {
+	if sd.Count != "" {
+		diffs = append(diffs, sd.Count)
+	}
+	for _, rr := range sd.IanaOnly {
+		diffs = append(diffs, iana_only+rr)
+	}
+	for _, rr := range sd.YetiOnly {
+		diffs = append(diffs, yeti_only+rr)
+	}
+	diffs = append(diffs, sd.Repeats...)
+	diffs = append(diffs, sd.Denial...)
+	return append(diffs, sd.Soa...)
+}
+
+/*
+   The result of comparing the IANA and Yeti answers to a query, with the
+   differences of each kind kept separately. Diffs() gets a description
+   of every difference, in the order that we have always reported them,
+   and String() gets the same as text.
+*/
+type ComparisonResult struct {
+	// set if either answer has no question, so nothing was compared
+	NoQuestion bool
+	// differences in the question
+	Question []string
+	// differences in the header flags and opcode
+	Flags []string
+	// the rcode difference, or "" if the rcode is the same
+	Rcode string
+	// set if the Yeti server failed, with SERVFAIL or REFUSED, where IANA
+	// answered; this is an outage rather than a difference in the data
+	ServerError bool
+	// set if the answers differed, but agreed when we asked the Yeti
+	// server again (see -recheck)
+	Transient bool
+	// set if neither IANA nor Yeti answered while following a
+	// redirection (see -follow)
+	BothError bool
+	// the differences in each section
+	Answer     SectionDiff
+	Authority  SectionDiff
+	Additional SectionDiff
+}
+
+// Get a description of each difference.
+func (result *ComparisonResult) Diffs() (diffs []string) {
+	if result.NoQuestion {
+		return []string{"No question present, skipping comparison"}
+	}
+	diffs = append(diffs, result.Question...)
+	diffs = append(diffs, result.Flags...)
+	if result.Rcode != "" {
+		diffs = append(diffs, result.Rcode)
+	}
+	diffs = append(diffs, result.Answer.diffs("Answer section, IANA only: ", "Answer section, Yeti only: ")...)
+	diffs = append(diffs, result.Authority.diffs("Authority section, IANA only: ", "Authority section, Yeti only: ")...)
+	diffs = append(diffs, result.Additional.diffs("Additional section, IANA mismatch: ", "Additional section, Yeti mismatch: ")...)
+	return diffs
+}
+
+// check whether the answers are the same
+func (result *ComparisonResult) Equivalent() bool {
+	return len(result.Diffs()) == 0
+}
+
+// Get the differences as text, one line for each.
+func (result *ComparisonResult) String() string {
+	return strings.Join(result.Diffs(), "\n")
+}
+
+/*
+   JSON output.
+
+   With the -j flag, each comparison is written as a JSON object on a
+   line of its own (JSON Lines), so that the results can be processed
+   with tools like jq. The differences include those from the other
+   checks as well as the comparison of the answers.
+*/
+type json_comparison struct {
+	Qname      string  `json:"qname"`
+	Qtype      string  `json:"qtype"`
+	Server     string  `json:"server"`
+	ServerIP   string  `json:"server_ip"`
+	RttMs      float64 `json:"rtt_ms"`
+	Equivalent bool    `json:"equivalent"`
+	// set if the Yeti server answered SERVFAIL or REFUSED and IANA did not
+	ServerError bool `json:"server_error"`
+	// set if the differences went away when the Yeti server was asked again
+	Transient bool `json:"transient"`
+	// set if neither IANA nor Yeti answered while following a redirection
+	BothError bool `json:"both_error"`
+	// set if the Yeti server did not answer, in which case there is
+	// nothing else
+	Error       string      `json:"error,omitempty"`
+	Answer      SectionDiff `json:"answer"`
+	Authority   SectionDiff `json:"authority"`
+	Additional  SectionDiff `json:"additional"`
+	Differences []string    `json:"differences"`
+}
+
+// writer for JSON Lines, which may be used by several comparisons at once
+type json_writer struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func new_json_writer(w io.Writer) *json_writer {
+	return &json_writer{w: w}
+}
+
+// write the result of a comparison as JSON, if we are doing that
+func (qcfg *query_conf) write_json(qname string, qtype string, target *query_target,
+	rtt time.Duration, result *ComparisonResult, diffs []string, err error) {
+	if qcfg.json_out == nil {
+		return
+	}
+	werr := qcfg.json_out.write_comparison(qname, qtype, target, rtt, result, diffs, err)
+	if werr != nil {
+		glog.Errorf("Error writing JSON result: %s", werr)
+	}
+}
+
+// Write the result of a comparison. The result is nil if the Yeti server
+// did not answer, in which case err says why.
+func (jw *json_writer) write_comparison(qname string, qtype string, target *query_target,
+	rtt time.Duration, result *ComparisonResult, diffs []string, err error) error {
+	jc := json_comparison{
+		Qname:       qname,
+		Qtype:       qtype,
+		Server:      target.ns_name,
+		ServerIP:    target.ip.String(),
+		RttMs:       float64(rtt) / float64(time.Millisecond),
+		Differences: diffs,
+	}
+	if err != nil {
+		jc.Error = err.Error()
+	} else {
+		jc.Equivalent = len(diffs) == 0
+		jc.ServerError = result.ServerError
+		jc.Transient = result.Transient
+		jc.BothError = result.BothError
+		jc.Answer = result.Answer
+		jc.Authority = result.Authority
+		jc.Additional = result.Additional
+	}
+	// always write arrays, even if empty, which is easier to process
+	for _, list := range []*[]string{&jc.Differences,
+		&jc.Answer.IanaOnly, &jc.Answer.YetiOnly,
+		&jc.Authority.IanaOnly, &jc.Authority.YetiOnly,
+		&jc.Additional.IanaOnly, &jc.Additional.YetiOnly} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	line, err := json.Marshal(&jc)
+	if err != nil {
+		return err
+	}
+	jw.lock.Lock()
+	defer jw.lock.Unlock()
+	_, err = jw.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCompareResult(t *testing.T) {
+	iana := new(dns.Msg)
+	iana.SetQuestion("www.example.", dns.TypeA)
+	iana.Rcode = dns.RcodeNameError
+	yeti := iana.Copy()
+	yeti.Authoritative = true
+	yeti.Rcode = dns.RcodeSuccess
+	ns1, _ := dns.NewRR("example. 172800 IN NS ns1.example.")
+	ns2, _ := dns.NewRR("example. 172800 IN NS ns2.example.")
+	iana.Ns = append(iana.Ns, ns1)
+	yeti.Ns = append(yeti.Ns, ns2)
+	iana_glue, _ := dns.NewRR("ns2.example. 3600 IN A 192.0.2.2")
+	yeti_glue, _ := dns.NewRR("ns2.example. 172800 IN A 192.0.2.2")
+	iana.Extra = append(iana.Extra, iana_glue)
+	yeti.Extra = append(yeti.Extra, yeti_glue)
+
+	result := compare_resp(iana, yeti, new(compare_conf))
+	if (len(result.Flags) != 1) || (result.Rcode != "Rcode mismatch: IANA NXDOMAIN vs Yeti NOERROR") {
+		t.Errorf("header differences == %q, %q", result.Flags, result.Rcode)
+	}
+	if (len(result.Authority.IanaOnly) != 1) || (result.Authority.IanaOnly[0] != ns1.String()) {
+		t.Errorf("IANA-only authority records == %q", result.Authority.IanaOnly)
+	}
+	if (len(result.Authority.YetiOnly) != 1) || (result.Authority.YetiOnly[0] != ns2.String()) {
+		t.Errorf("Yeti-only authority records == %q", result.Authority.YetiOnly)
+	}
+	if (len(result.Answer.IanaOnly) != 0) || (len(result.Answer.YetiOnly) != 0) {
+		t.Errorf("answer records differ: %v", result.Answer)
+	}
+	if result.Equivalent() {
+		t.Errorf("different answers are equivalent")
+	}
+	// the text is the same as we always had
+	want := "Authoritative flag mismatch: IANA false vs Yeti true\n" +
+		"Rcode mismatch: IANA NXDOMAIN vs Yeti NOERROR\n" +
+		"Authority section, IANA only: example.\t172800\tIN\tNS\tns1.example.\n" +
+		"Authority section, Yeti only: example.\t172800\tIN\tNS\tns2.example.\n" +
+		"Additional section, IANA mismatch: ns2.example.\t3600\tIN\tA\t192.0.2.2\n" +
+		"Additional section, Yeti mismatch: ns2.example.\t172800\tIN\tA\t192.0.2.2"
+	if result.String() != want {
+		t.Errorf("String() ==\n%s\nwant\n%s", result, want)
+	}
+
+	result = compare_resp(iana, iana.Copy(), new(compare_conf))
+	if !result.Equivalent() || (result.String() != "") {
+		t.Errorf("the same answers have differences: %q", result.Diffs())
+	}
+}
+
+func TestCompareSectionCount(t *testing.T) {
+	iana := new(dns.Msg)
+	iana.SetQuestion("example.", dns.TypeNS)
+	for _, s := range []string{"example. 172800 IN NS ns1.example.", "example. 172800 IN NS ns2.example.",
+		"example. 172800 IN RRSIG NS 8 1 172800 20170701000000 20170601000000 12345 example. AAAA"} {
+		rr, _ := dns.NewRR(s)
+		iana.Answer = append(iana.Answer, rr)
+	}
+
+	// a different record, but the same number of them
+	yeti := iana.Copy()
+	yeti.Answer[1], _ = dns.NewRR("example. 172800 IN NS ns3.example.")
+	result := compare_resp(iana.Copy(), yeti, new(compare_conf))
+	if result.Answer.Count != "" {
+		t.Errorf("count difference with the same number of records: %q", result.Answer.Count)
+	}
+	if len(result.Answer.IanaOnly) != 1 {
+		t.Errorf("IANA-only answer records == %q", result.Answer.IanaOnly)
+	}
+
+	// a missing signature doesn't count, unless we compare signatures
+	yeti = iana.Copy()
+	yeti.Answer = yeti.Answer[:2]
+	result = compare_resp(iana.Copy(), yeti.Copy(), new(compare_conf))
+	if !result.Equivalent() {
+		t.Errorf("missing signature found differences: %q", result.Diffs())
+	}
+	result = compare_resp(iana.Copy(), yeti.Copy(), &compare_conf{dnssec: true})
+	if result.Answer.Count != "Answer section count mismatch: IANA 3 vs Yeti 2" {
+		t.Errorf("count difference with a missing signature == %q", result.Answer.Count)
+	}
+
+	// a missing record, with the count first and the record after
+	yeti = iana.Copy()
+	yeti.Answer = yeti.Answer[1:]
+	result = compare_resp(iana.Copy(), yeti, new(compare_conf))
+	want := []string{
+		"Answer section count mismatch: IANA 2 vs Yeti 1",
+		"Answer section, IANA only: example.\t172800\tIN\tNS\tns1.example.",
+	}
+	if strings.Join(result.Diffs(), "\n") != strings.Join(want, "\n") {
+		t.Errorf("differences with a missing record == %q, want %q", result.Diffs(), want)
+	}
+}
+
+func TestCompareRepeats(t *testing.T) {
+	iana := new(dns.Msg)
+	iana.SetQuestion("example.", dns.TypeNS)
+	for _, s := range []string{"example. 172800 IN NS a.example.", "example. 172800 IN NS a.example.",
+		"example. 172800 IN NS b.example."} {
+		rr, _ := dns.NewRR(s)
+		iana.Answer = append(iana.Answer, rr)
+	}
+	yeti := iana.Copy()
+	yeti.Answer = yeti.Answer[1:]
+	// a different TTL is still the same record, for counting
+	yeti.Answer[0].Header().Ttl = 86400
+
+	result := compare_resp(iana.Copy(), yeti.Copy(), new(compare_conf))
+	want := []string{
+		"Answer section count mismatch: IANA 3 vs Yeti 2",
+		"Answer section, IANA only: example.\t172800\tIN\tNS\ta.example.",
+		"Answer section, IANA only: example.\t172800\tIN\tNS\ta.example.",
+		"Answer section, Yeti only: example.\t86400\tIN\tNS\ta.example.",
+		"Answer section repeat mismatch: IANA 2 vs Yeti 1 of example.\t172800\tIN\tNS\ta.example.",
+	}
+	if strings.Join(result.Diffs(), "\n") != strings.Join(want, "\n") {
+		t.Errorf("differences with a repeated record ==\n%s\nwant\n%s",
+			strings.Join(result.Diffs(), "\n"), strings.Join(want, "\n"))
+	}
+
+	// with the same TTL, only the extra copy is left over
+	yeti.Answer[0].Header().Ttl = 172800
+	result = compare_resp(yeti.Copy(), iana.Copy(), new(compare_conf))
+	want = []string{
+		"Answer section count mismatch: IANA 2 vs Yeti 3",
+		"Answer section, Yeti only: example.\t172800\tIN\tNS\ta.example.",
+		"Answer section repeat mismatch: IANA 1 vs Yeti 2 of example.\t172800\tIN\tNS\ta.example.",
+	}
+	if strings.Join(result.Diffs(), "\n") != strings.Join(want, "\n") {
+		t.Errorf("differences with a repeated record ==\n%s\nwant\n%s",
+			strings.Join(result.Diffs(), "\n"), strings.Join(want, "\n"))
+	}
+
+	// records only in one answer are not repeats
+	result = compare_resp(iana.Copy(), iana.Copy(), new(compare_conf))
+	if (len(result.Answer.Repeats) != 0) || !result.Equivalent() {
+		t.Errorf("the same answers have differences: %q", result.Diffs())
+	}
+	yeti = iana.Copy()
+	yeti.Answer[2], _ = dns.NewRR("example. 172800 IN NS c.example.")
+	result = compare_resp(iana.Copy(), yeti, new(compare_conf))
+	if len(result.Answer.Repeats) != 0 {
+		t.Errorf("repeats for records in only one answer: %q", result.Answer.Repeats)
+	}
+}
+
+func TestCompareQuestion(t *testing.T) {
+	iana := new(dns.Msg)
+	iana.SetQuestion("www.example.", dns.TypeA)
+	obfuscated := new(dns.Msg)
+	obfuscated.SetQuestion("ymmv.0123456789abcdef.example.", dns.TypeA)
+	other_type := new(dns.Msg)
+	other_type.SetQuestion("www.example.", dns.TypeAAAA)
+	other_class := iana.Copy()
+	other_class.Question[0].Qclass = dns.ClassCHAOS
+	upper := new(dns.Msg)
+	upper.SetQuestion("WWW.Example.", dns.TypeA)
+
+	clear := &compare_conf{compare_qname: true}
+	cases := []struct {
+		yeti *dns.Msg
+		ccfg *compare_conf
+		want []string
+	}{
+		{iana, clear, nil},
+		{upper, clear, nil},
+		{obfuscated, new(compare_conf), nil},
+		{obfuscated, clear, []string{"Question name mismatch: IANA www.example. vs Yeti ymmv.0123456789abcdef.example."}},
+		{other_type, new(compare_conf), []string{"Question type mismatch: IANA A vs Yeti AAAA"}},
+		{other_class, clear, []string{"Question class mismatch: IANA IN vs Yeti CH"}},
+	}
+	for _, c := range cases {
+		result := compare_resp(iana.Copy(), c.yeti.Copy(), c.ccfg)
+		if strings.Join(result.Question, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("compare_resp(%s, %+v) question differences == %q, want %q",
+				c.yeti.Question[0].String(), *c.ccfg, result.Question, c.want)
+		}
+		// question differences come first
+		if (len(c.want) > 0) && (result.Diffs()[0] != c.want[0]) {
+			t.Errorf("compare_resp(%s) == %q", c.yeti.Question[0].String(), result.Diffs())
+		}
+	}
+}
+
+func TestYetiQueryJSON(t *testing.T) {
+	ns, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		if server == "[2001:db8::2]:53" {
+			resp.Ns = append(resp.Ns, ns)
+		}
+		return resp
+	})
+	defer restore()
+
+	var out bytes.Buffer
+	qcfg := query_conf{clear_names: true, json_out: new_json_writer(&out)}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	run_yeti_query(&qcfg, query, empty_answer("", query), "2001:db8::1", "2001:db8::2")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines of JSON, expected 2:\n%s", len(lines), out.String())
+	}
+	results := make(map[string]json_comparison)
+	for _, line := range lines {
+		var jc json_comparison
+		err := json.Unmarshal([]byte(line), &jc)
+		if err != nil {
+			t.Fatalf("Error parsing JSON line %q: %s", line, err)
+		}
+		results[jc.ServerIP] = jc
+	}
+	same := results["2001:db8::1"]
+	if !same.Equivalent || (same.Qname != "www.example.") || (same.Qtype != "A") || (same.RttMs != 1) {
+		t.Errorf("JSON for equivalent answer == %+v", same)
+	}
+	// empty lists are written as arrays, not null
+	if !strings.Contains(lines[0], `"differences":[]`) && !strings.Contains(lines[1], `"differences":[]`) {
+		t.Errorf("no empty differences array in JSON:\n%s", out.String())
+	}
+	different := results["2001:db8::2"]
+	if different.Equivalent || (len(different.Authority.YetiOnly) != 1) ||
+		(different.Authority.YetiOnly[0] != ns.String()) || (len(different.Differences) == 0) {
+		t.Errorf("JSON for different answer == %+v", different)
+	}
+}
+
+func TestWriteComparisonError(t *testing.T) {
+	var out bytes.Buffer
+	jw := new_json_writer(&out)
+	target := &query_target{ip: net.ParseIP("2001:db8::1"), ns_name: "bii.dns-lab.net."}
+	err := jw.write_comparison("www.example.", "A", target, time.Second, nil, nil, errors.New("i/o timeout"))
+	if err != nil {
+		t.Fatalf("write_comparison() error: %s", err)
+	}
+	var jc json_comparison
+	json.Unmarshal(out.Bytes(), &jc)
+	if jc.Equivalent || (jc.Error != "i/o timeout") || (jc.Server != "bii.dns-lab.net.") {
+		t.Errorf("JSON for Yeti error == %+v", jc)
+	}
+}
+
+func TestLenientAuthority(t *testing.T) {
+	// NODATA from the Yeti server, with the NS records of the zone too
+	iana := new(dns.Msg)
+	iana.SetQuestion("example.", dns.TypeAAAA)
+	for _, s := range []string{
+		". 86400 IN SOA a.root-servers.net. nstld.verisign-grs.com. 2017060100 1800 900 604800 86400",
+		"example. 86400 IN NSEC examples. NS RRSIG NSEC",
+		"example. 86400 IN RRSIG NSEC 8 1 86400 20170701000000 20170601000000 12345 . AAAA"} {
+		rr, _ := dns.NewRR(s)
+		iana.Ns = append(iana.Ns, rr)
+	}
+	yeti := iana.Copy()
+	for _, s := range []string{"example. 172800 IN NS ns1.example.", "example. 172800 IN NS ns2.example."} {
+		rr, _ := dns.NewRR(s)
+		yeti.Ns = append(yeti.Ns, rr)
+	}
+	nxdomain_iana := iana.Copy()
+	nxdomain_iana.Rcode = dns.RcodeNameError
+	nxdomain_yeti := yeti.Copy()
+	nxdomain_yeti.Rcode = dns.RcodeNameError
+
+	lenient := &compare_conf{lenient_authority: true, dnssec: true}
+	for _, c := range []struct {
+		name string
+		iana *dns.Msg
+		yeti *dns.Msg
+	}{
+		{"NODATA", iana, yeti},
+		{"NXDOMAIN", nxdomain_iana, nxdomain_yeti},
+	} {
+		result := compare_resp(c.iana.Copy(), c.yeti.Copy(), lenient)
+		if !result.Equivalent() {
+			t.Errorf("%s with extra authority records found differences: %q", c.name, result.Diffs())
+		}
+		// the extra records are still different without the flag
+		result = compare_resp(c.iana.Copy(), c.yeti.Copy(), &compare_conf{dnssec: true})
+		if (result.Authority.Count == "") || (len(result.Authority.YetiOnly) != 2) {
+			t.Errorf("%s without -lenient-authority found differences: %q", c.name, result.Diffs())
+		}
+	}
+
+	// the SOA and the proof are still compared
+	other := yeti.Copy()
+	other.Ns[1], _ = dns.NewRR("example. 86400 IN NSEC examples. NS AAAA RRSIG NSEC")
+	result := compare_resp(iana.Copy(), other, lenient)
+	if (len(result.Authority.IanaOnly) != 1) || (len(result.Authority.YetiOnly) != 1) {
+		t.Errorf("different NSEC records found differences: %q", result.Diffs())
+	}
+	other = yeti.Copy()
+	other.Ns[0].(*dns.SOA).Serial = 2017060200
+	if result := compare_resp(iana.Copy(), other, lenient); len(result.Authority.Soa) == 0 {
+		t.Errorf("different SOA serials found differences: %q", result.Diffs())
+	}
+
+	// a referral is not a negative answer, so its NS records matter
+	referral := new(dns.Msg)
+	referral.SetQuestion("www.example.", dns.TypeA)
+	referral_yeti := referral.Copy()
+	referral_yeti.Ns = yeti.Ns[3:]
+	if result := compare_resp(referral, referral_yeti, lenient); result.Equivalent() {
+		t.Errorf("referral with extra NS records found no differences")
+	}
+}
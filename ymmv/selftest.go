@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"time"
+)
+
+// IANA root server we get our self-test answer from, and fresh answers
+// with -refresh-iana (a.root-servers.net)
+const SELFTEST_IANA_SERVER = "198.41.0.4"
+
+// the same IANA root server, used instead with -6
+const SELFTEST_IANA_SERVER6 = "2001:503:ba3e::2:30"
+
+// Get the IANA root server to query from the value of a flag, using the
+// IPv6 address of the default server with -6 unless the flag was set,
+// and making sure that the address is in the family we query over.
+func parse_iana_server(value string, explicit bool, family int) (net.IP, error) {
+	if !explicit && (family == 6) {
+		value = SELFTEST_IANA_SERVER6
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("Unrecognized IP address '%s'", value)
+	}
+	if !in_address_family(family, ip) {
+		return nil, fmt.Errorf("IANA server %s is not an IPv%d address", ip, family)
+	}
+	return ip, nil
+}
+
+/*
+   The self-test checks that the whole pipeline works, without needing
+   any captured input. We query an IANA root server for the root SOA,
+   write the query and answer as a ymmv message, read it back, and then
+   compare the answer with the one from each of the Yeti servers.
+
+   Differences in the answers are reported, but do not cause a failure,
+   since the root SOA serial may legitimately differ. The self-test only
+   fails if some part of the pipeline does not work.
+*/
+func selftest(iana_ip net.IP, srvs *yeti_server_set, qcfg *query_conf, out io.Writer) bool {
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeSOA)
+	if qcfg.edns_size != 0 {
+		SetOrChangeUDPSize(query, qcfg.edns_size, qcfg.do_mode)
+	} else {
+		SetDoBit(query, qcfg.do_mode)
+	}
+
+	// get our answer from the IANA root server
+	fmt.Fprintf(out, "selftest: querying IANA root server %s for . SOA\n", iana_ip)
+	query_time := time.Now()
+	answer, _, err := dns_query(qcfg.iana_addr(iana_ip), query, &qcfg.iana_opts)
+	if err != nil {
+		fmt.Fprintf(out, "selftest: FAIL, error querying IANA root server: %s\n", err)
+		return false
+	}
+	answer_time := time.Now()
+
+	// make sure we can write and read our input format
+	y := &ymmv_message{ip_family: 6, ip_protocol: 'u', addr: &iana_ip,
+		query_time: query_time, query: query, answer_time: answer_time, answer: answer}
+	if iana_ip.To4() != nil {
+		y.ip_family = 4
+	}
+	var buf bytes.Buffer
+	err = WriteMessage(&buf, y)
+	if err != nil {
+		fmt.Fprintf(out, "selftest: FAIL, error writing ymmv message: %s\n", err)
+		return false
+	}
+	nbytes := buf.Len()
+	y, err = read_next_message(&buf)
+	if err != nil {
+		fmt.Fprintf(out, "selftest: FAIL, error reading ymmv message: %s\n", err)
+		return false
+	}
+	fmt.Fprintf(out, "selftest: wrote and read %d byte ymmv message\n", nbytes)
+
+	// compare with each of our Yeti servers
+	passed := true
+	targets := srvs.next()
+	if len(targets) == 0 {
+		fmt.Fprintf(out, "selftest: FAIL, no Yeti servers to query\n")
+		return false
+	}
+	for _, target := range targets {
+		qcfg.wait_rate()
+		yeti_resp, rtt, err := dns_query(srvs.server_addr(target.ip), y.query.Copy(), &qcfg.dns_opts)
+		if err != nil {
+			fmt.Fprintf(out, "selftest: FAIL, error querying Yeti server %s @ %s: %s\n",
+				target.ns_name, target.ip, err)
+			passed = false
+			continue
+		}
+		diffs := compare_resp(y.answer.Copy(), yeti_resp, &qcfg.compare).Diffs()
+		fmt.Fprintf(out, "selftest: Yeti server %s @ %s answered in %s with %d differences\n",
+			target.ns_name, target.ip, rtt, len(diffs))
+		for _, diff := range diffs {
+			fmt.Fprintf(out, "selftest:     %s\n", diff)
+		}
+	}
+
+	if passed {
+		fmt.Fprintf(out, "selftest: PASS\n")
+	} else {
+		fmt.Fprintf(out, "selftest: FAIL\n")
+	}
+	return passed
+}
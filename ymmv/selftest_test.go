@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/shane-kerr/ymmv/dnsstub"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answer with the root SOA, using the given serial
+func root_soa_answer(serial uint32) func(server string, query *dns.Msg) *dns.Msg {
+	return func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		soa := &dns.SOA{
+			Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 86400},
+			Ns:     "a.root-servers.net.",
+			Mbox:   "nstld.verisign-grs.com.",
+			Serial: serial, Refresh: 1800, Retry: 900, Expire: 604800, Minttl: 86400,
+		}
+		resp.Answer = append(resp.Answer, soa)
+		return resp
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	sent, restore := mock_dns_query(root_soa_answer(2016101200))
+	defer restore()
+
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, "all")
+	var out bytes.Buffer
+	qcfg := query_conf{edns_size: 4093}
+	if !selftest(net.ParseIP(SELFTEST_IANA_SERVER), srvs, &qcfg, &out) {
+		t.Errorf("selftest() failed:\n%s", out.String())
+	}
+	if len(*sent) != 3 {
+		t.Errorf("%d queries sent, expected 3", len(*sent))
+	}
+	if !strings.Contains(out.String(), "selftest: PASS\n") {
+		t.Errorf("selftest() output missing PASS:\n%s", out.String())
+	}
+}
+
+func TestSelftestFailure(t *testing.T) {
+	answer := root_soa_answer(2016101200)
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	// the Yeti server does not answer
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		if server == "[2001:db8::1]:53" {
+			return nil, 0, errors.New("timeout")
+		}
+		return answer(server, query), time.Millisecond, nil
+	}
+
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	var out bytes.Buffer
+	if selftest(net.ParseIP(SELFTEST_IANA_SERVER), srvs, new(query_conf), &out) {
+		t.Errorf("selftest() passed with an unresponsive server:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "selftest: FAIL\n") {
+		t.Errorf("selftest() output missing FAIL:\n%s", out.String())
+	}
+}
+
+func TestSelftestIanaPort(t *testing.T) {
+	// the IANA side is a real server on a port other than 53
+	iana_queries := make(chan *dns.Msg, 10)
+	addr, server := start_mock_server(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		iana_queries <- r
+		w.WriteMsg(root_soa_answer(2016101200)("", r))
+	})
+	defer server.Shutdown()
+	host, port, _ := net.SplitHostPort(addr)
+	port_num, _ := strconv.Atoi(port)
+
+	// Yeti queries are answered without the network
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	yeti_answer := root_soa_answer(2016101200)
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		if server == addr {
+			if opts.Transport != dnsstub.TransportUDPOnly {
+				t.Errorf("IANA query sent with transport %d, expected UDP only", opts.Transport)
+			}
+			return orig(server, query, opts)
+		}
+		if server != "[2001:db8::1]:53" {
+			t.Errorf("unexpected query to %s", server)
+		}
+		return yeti_answer(server, query), time.Millisecond, nil
+	}
+
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	qcfg := query_conf{iana_port: uint16(port_num)}
+	qcfg.iana_opts.Transport = dnsstub.TransportUDPOnly
+	var out bytes.Buffer
+	if !selftest(net.ParseIP(host), srvs, &qcfg, &out) {
+		t.Errorf("selftest() failed:\n%s", out.String())
+	}
+	if len(iana_queries) != 1 {
+		t.Errorf("mock IANA server got %d queries, expected 1", len(iana_queries))
+	}
+}
+
+func TestIanaAddr(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	var qcfg query_conf
+	if qcfg.iana_addr(ip) != "[2001:db8::1]:53" {
+		t.Errorf("iana_addr() with default port == %s", qcfg.iana_addr(ip))
+	}
+	qcfg.iana_port = 5353
+	if qcfg.iana_addr(ip) != "[2001:db8::1]:5353" {
+		t.Errorf("iana_addr() with port 5353 == %s", qcfg.iana_addr(ip))
+	}
+}
+
+func TestParseIanaServer(t *testing.T) {
+	cases := []struct {
+		value    string
+		explicit bool
+		family   int
+		want     string
+	}{
+		{SELFTEST_IANA_SERVER, false, 0, SELFTEST_IANA_SERVER},
+		{SELFTEST_IANA_SERVER, false, 4, SELFTEST_IANA_SERVER},
+		{SELFTEST_IANA_SERVER, false, 6, SELFTEST_IANA_SERVER6},
+		{"2001:db8::1", true, 6, "2001:db8::1"},
+		{"2001:db8::1", true, 0, "2001:db8::1"},
+		{"192.0.2.1", true, 4, "192.0.2.1"},
+		// an address of the other family
+		{"192.0.2.1", true, 6, ""},
+		{"2001:db8::1", true, 4, ""},
+		{"not-an-address", true, 0, ""},
+	}
+	for _, c := range cases {
+		ip, err := parse_iana_server(c.value, c.explicit, c.family)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("parse_iana_server(%q, %t, %d) == %s, expected an error", c.value, c.explicit, c.family, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse_iana_server(%q, %t, %d) error: %s", c.value, c.explicit, c.family, err)
+		} else if !ip.Equal(net.ParseIP(c.want)) {
+			t.Errorf("parse_iana_server(%q, %t, %d) == %s, expected %s", c.value, c.explicit, c.family, ip, c.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+/*
+   Rules for which query names not to compare.
+
+   Each rule is a name pattern (see name_pattern) and the reason we skip
+   the names it matches, for the summary.
+
+   The default rules skip names that we expect to differ; see
+   skip_comparison. The -skip flag adds more rules, and the
+   -no-default-skips flag starts without the default ones. The
+   -compare-arpa flag leaves out just the default rules for arpa, for
+   studying reverse DNS. The -name flag uses the same patterns the
+   other way around, to pick the only names to compare.
+*/
+type skip_rule struct {
+	name_pattern
+	// why we skip the names, for the summary
+	reason string
+}
+
+// Make a rule from a pattern. The pattern may leave off the final '.'.
+func new_skip_rule(pattern string, reason string) (skip_rule, error) {
+	p, err := new_name_pattern(pattern)
+	return skip_rule{name_pattern: p, reason: reason}, err
+}
+
+// Get the rules we start with, unless told not to.
+func default_skip_rules() (rules []skip_rule) {
+	for _, d := range []struct {
+		pattern string
+		reason  string
+	}{
+		// of course the root zone itself is different, so skip that
+		{".", SKIP_ROOT_ZONE},
+		// skip queries for server information
+		{"id.server.", SKIP_SERVER_INFO},
+		{"version.server.", SKIP_SERVER_INFO},
+		{"version.bind.", SKIP_SERVER_INFO},
+		{"hostname.bind.", SKIP_SERVER_INFO},
+		// the IANA servers are authoritative for ROOT-SERVERS.NET, we are not
+		{"root-servers.net.", SKIP_ROOT_SERVERS},
+		{"*.root-servers.net.", SKIP_ROOT_SERVERS},
+		// ARPA is tricky, since some of the IANA root servers are
+		// authoritative, so skip these queries unless -compare-arpa
+		{"arpa.", SKIP_ARPA},
+		{"*.arpa.", SKIP_ARPA},
+	} {
+		rule, _ := new_skip_rule(d.pattern, d.reason)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Parse the comma-separated patterns of the -skip flag.
+func parse_skip_patterns(patterns string) (rules []skip_rule, err error) {
+	names, err := parse_name_patterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range names {
+		rules = append(rules, skip_rule{name_pattern: p, reason: SKIP_PATTERN})
+	}
+	return rules, nil
+}
+
+// Get the rules to use from the flags: whether to start without the
+// default rules, whether to compare arpa anyway, and the patterns of the
+// -skip flag, which are used even for arpa.
+func configure_skip_rules(no_defaults bool, compare_arpa bool, patterns string) (rules []skip_rule, err error) {
+	if !no_defaults {
+		for _, rule := range default_skip_rules() {
+			if compare_arpa && (rule.reason == SKIP_ARPA) {
+				continue
+			}
+			rules = append(rules, rule)
+		}
+	}
+	user_rules, err := parse_skip_patterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, user_rules...), nil
+}
+
+// the rules in use, which main sets from the flags before comparing
+var skip_rules = default_skip_rules()
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// result of comparing the answers to a query from IANA and one Yeti server
+type outcome int
+
+const (
+	// both answered, and the answers are the same
+	outcome_equivalent outcome = iota
+	// both answered, and the answers differ
+	outcome_different
+	// IANA answered, but Yeti did not
+	outcome_yeti_error
+	// Yeti answered, but IANA did not (only for live IANA queries)
+	outcome_iana_error
+	// neither answered, which says nothing about whether they agree
+	outcome_both_error
+	// both gave the same error rcode, if counted separately
+	outcome_agreed_error
+	// IANA answered, but Yeti gave SERVFAIL or REFUSED
+	outcome_server_error
+	// the answers differed, but agreed when the Yeti server was asked again
+	outcome_transient
+	num_outcomes
+)
+
+var outcome_names = [num_outcomes]string{
+	outcome_equivalent:   "equivalent",
+	outcome_different:    "different",
+	outcome_yeti_error:   "Yeti error",
+	outcome_iana_error:   "IANA error",
+	outcome_both_error:   "both unreachable",
+	outcome_agreed_error: "agreed error",
+	outcome_server_error: "server error",
+	outcome_transient:    "transient",
+}
+
+// ways to count answers that agree on an error rcode, like both SERVFAIL
+var error_policies = map[string]bool{
+	"equivalent":   true,
+	"agreed-error": true,
+	"skip":         true,
+}
+
+// number of one-millisecond buckets for round-trip times, with one more
+// bucket for anything longer
+const rtt_buckets = 10000
+
+// Count of round-trip times in each millisecond, so that we can estimate
+// quantiles without keeping every time.
+type rtt_histogram [rtt_buckets + 1]uint
+
+func (h *rtt_histogram) add(rtt time.Duration) {
+	bucket := rtt / time.Millisecond
+	if (bucket < 0) || (bucket > rtt_buckets) {
+		bucket = rtt_buckets
+	}
+	h[bucket] += 1
+}
+
+// Get the number of round-trip times counted.
+func (h *rtt_histogram) count() (n uint) {
+	for _, count := range h {
+		n += count
+	}
+	return n
+}
+
+// Estimate a quantile, like 0.9 for the 90th percentile, to the
+// millisecond. This returns false if there are no times counted.
+func (h *rtt_histogram) quantile(q float64) (time.Duration, bool) {
+	n := h.count()
+	if n == 0 {
+		return 0, false
+	}
+	rank := uint(math.Ceil(q * float64(n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint
+	for bucket, count := range h {
+		seen += count
+		if seen >= rank {
+			return time.Duration(bucket) * time.Millisecond, true
+		}
+	}
+	return rtt_buckets * time.Millisecond, true
+}
+
+// Get the round-trip times counted since an earlier copy of the histogram.
+func (h *rtt_histogram) since(prev *rtt_histogram) (diff rtt_histogram) {
+	for bucket := range h {
+		diff[bucket] = h[bucket] - prev[bucket]
+	}
+	return diff
+}
+
+// counts of the comparisons with one server IP address
+type server_stats struct {
+	// number of comparisons with each outcome
+	outcomes [num_outcomes]uint
+	// number of comparisons skipped because both answers had the same error
+	skipped uint
+	// number of answers and their total round-trip time, for the mean
+	answers   uint
+	rtt_total time.Duration
+	// round-trip times of the answers, for the median (nil if none)
+	rtts *rtt_histogram
+}
+
+// Get the number of queries sent to the server.
+func (ss *server_stats) queries() uint {
+	n := ss.skipped
+	for _, count := range ss.outcomes {
+		n += count
+	}
+	return n
+}
+
+// Get the median round-trip time of the answers, to the millisecond,
+// or false if none.
+func (ss *server_stats) median_rtt() (time.Duration, bool) {
+	if ss.rtts == nil {
+		return 0, false
+	}
+	return ss.rtts.quantile(0.5)
+}
+
+// Get the mean round-trip time of the answers, or false if none.
+func (ss *server_stats) mean_rtt() (time.Duration, bool) {
+	if ss.answers == 0 {
+		return 0, false
+	}
+	return ss.rtt_total / time.Duration(ss.answers), true
+}
+
+// check whether an rcode means the server failed to answer the question
+func is_error_rcode(rcode int) bool {
+	return (rcode != dns.RcodeSuccess) && (rcode != dns.RcodeNameError)
+}
+
+// check whether an rcode means the server itself is broken or turning us
+// away, rather than anything to do with the question
+func is_server_error(rcode int) bool {
+	return (rcode == dns.RcodeServerFailure) || (rcode == dns.RcodeRefused)
+}
+
+func (o outcome) String() string {
+	return outcome_names[o]
+}
+
+/*
+   Decide the outcome of a comparison. An error on either side means
+   that there is nothing to compare, so in that case the differences
+   are not used. Captured IANA answers never have an error, but a fresh
+   one from -refresh-iana, or one while following a redirection, may.
+*/
+func classify_outcome(iana_err error, yeti_err error, diffs []string) outcome {
+	if (iana_err != nil) && (yeti_err != nil) {
+		return outcome_both_error
+	}
+	if yeti_err != nil {
+		return outcome_yeti_error
+	}
+	if iana_err != nil {
+		return outcome_iana_error
+	}
+	if len(diffs) > 0 {
+		return outcome_different
+	}
+	return outcome_equivalent
+}
+
+/*
+   Count the outcome of a comparison of two answers. Answers that agree on
+   an error rcode are the same, but agreeing on a failure is not the same
+   as agreeing on an answer, so the error policy decides whether these
+   count as equivalent, as an agreed error, or as skipped. A Yeti server
+   error where IANA answered is counted apart from other differences,
+   since it means the server is down rather than that its data differs.
+*/
+func (srvs *yeti_server_set) record_answers(target *query_target, error_policy string,
+	yeti_resp *dns.Msg, diffs []string, server_error bool) {
+	o := classify_outcome(nil, nil, diffs)
+	if (o == outcome_different) && server_error {
+		o = outcome_server_error
+	}
+	if (o == outcome_equivalent) && is_error_rcode(yeti_resp.Rcode) {
+		if error_policy == "agreed-error" {
+			o = outcome_agreed_error
+		} else if error_policy == "skip" {
+			srvs.record_skip(SKIP_AGREED_ERROR)
+			srvs.lock.Lock()
+			target.info.stats.skipped += 1
+			srvs.lock.Unlock()
+			return
+		}
+	}
+	srvs.record_outcome(target, o)
+}
+
+// Count the outcome of a comparison, both overall and for the server
+// it was with. The target may be nil to only count it overall.
+func (srvs *yeti_server_set) record_outcome(target *query_target, o outcome) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	srvs.outcomes[o] += 1
+	if target != nil {
+		target.info.stats.outcomes[o] += 1
+	}
+}
+
+// count a query that we did not compare
+func (srvs *yeti_server_set) record_skip(reason string) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	if srvs.skips == nil {
+		srvs.skips = make(map[string]uint)
+	}
+	srvs.skips[reason] += 1
+}
+
+// count each part of the answers that differs in a comparison
+func (srvs *yeti_server_set) record_mismatches(result *ComparisonResult, diffs []string) {
+	sections := mismatch_sections(result, diffs)
+	if len(sections) == 0 {
+		return
+	}
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	if srvs.mismatches == nil {
+		srvs.mismatches = make(map[string]uint)
+	}
+	for _, section := range sections {
+		srvs.mismatches[section] += 1
+	}
+}
+
+// count the EDNS UDP size that a server advertised in an answer
+func (srvs *yeti_server_set) record_udp_size(target *query_target, resp *dns.Msg) {
+	var size uint16
+	e := resp.IsEdns0()
+	if e != nil {
+		size = e.UDPSize()
+	}
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	if target.info.udp_sizes == nil {
+		target.info.udp_sizes = make(map[uint16]uint)
+	}
+	target.info.udp_sizes[size] += 1
+}
+
+// Count the round-trip time of an answer from a Yeti server. The target
+// may be nil to only count it overall.
+func (srvs *yeti_server_set) record_rtt(target *query_target, rtt time.Duration) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	srvs.rtts.add(rtt)
+	if target != nil {
+		stats := &target.info.stats
+		stats.answers += 1
+		stats.rtt_total += rtt
+		if stats.rtts == nil {
+			stats.rtts = new(rtt_histogram)
+		}
+		stats.rtts.add(rtt)
+	}
+}
+
+// Describe the EDNS UDP sizes that a server advertised, as the minimum,
+// maximum, and most common (mode) size. Answers without EDNS are
+// counted separately.
+func udp_size_summary(udp_sizes map[uint16]uint) string {
+	var min, max, mode uint16
+	var mode_count, edns_count uint
+	for size, count := range udp_sizes {
+		if size == 0 {
+			continue
+		}
+		if (edns_count == 0) || (size < min) {
+			min = size
+		}
+		if (edns_count == 0) || (size > max) {
+			max = size
+		}
+		// pick the smallest size if there is a tie, so the result is stable
+		if (count > mode_count) || ((count == mode_count) && (size < mode)) {
+			mode = size
+			mode_count = count
+		}
+		edns_count += count
+	}
+	if edns_count == 0 {
+		return fmt.Sprintf("no EDNS (%d answers)", udp_sizes[0])
+	}
+	return fmt.Sprintf("min %d max %d mode %d (%d answers without EDNS)", min, max, mode, udp_sizes[0])
+}
+
+// write a summary of the comparisons done so far
+func (srvs *yeti_server_set) write_summary(w io.Writer) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	fmt.Fprintln(w, "Comparison summary:")
+	for o := outcome(0); o < num_outcomes; o++ {
+		fmt.Fprintf(w, "  %-17s %d\n", o.String()+":", srvs.outcomes[o])
+	}
+	var total uint
+	reasons := make([]string, 0, len(srvs.skips))
+	for reason, count := range srvs.skips {
+		reasons = append(reasons, reason)
+		total += count
+	}
+	sort.Strings(reasons)
+	fmt.Fprintf(w, "Skipped queries: %d\n", total)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %-24s %d\n", reason+":", srvs.skips[reason])
+	}
+	fmt.Fprintln(w, "Comparisons with each server:")
+	fmt.Fprintf(w, "  %-24s %-26s %7s %9s %8s %6s %7s %8s\n",
+		"server", "address", "queries", "different", "failures", "errors", "skipped", "mean RTT")
+	for _, ns := range srvs.ns {
+		name := ns.name
+		if name == "" {
+			name = "-"
+		}
+		for _, info := range ns.ip_info {
+			stats := &info.stats
+			if stats.queries() == 0 {
+				continue
+			}
+			mean := "-"
+			rtt, ok := stats.mean_rtt()
+			if ok {
+				mean = rtt.Round(time.Microsecond).String()
+			}
+			fmt.Fprintf(w, "  %-24s %-26s %7d %9d %8d %6d %7d %8s\n", name, info.ip,
+				stats.queries(), stats.outcomes[outcome_different], stats.outcomes[outcome_server_error],
+				stats.outcomes[outcome_yeti_error], stats.skipped, mean)
+		}
+	}
+	fmt.Fprintln(w, "EDNS UDP size advertised by each server:")
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			if len(info.udp_sizes) > 0 {
+				fmt.Fprintf(w, "  %s: %s\n", info.ip, udp_size_summary(info.udp_sizes))
+			}
+		}
+	}
+}
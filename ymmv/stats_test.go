@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shane-kerr/ymmv/dnsstub"
+)
+
+func TestClassifyOutcome(t *testing.T) {
+	timeout := errors.New("i/o timeout")
+	cases := []struct {
+		iana_err error
+		yeti_err error
+		diffs    []string
+		want     outcome
+	}{
+		{nil, nil, nil, outcome_equivalent},
+		{nil, nil, []string{"Rcode mismatch"}, outcome_different},
+		{nil, timeout, nil, outcome_yeti_error},
+		{timeout, nil, nil, outcome_iana_error},
+		{timeout, timeout, nil, outcome_both_error},
+		// differences don't matter without answers
+		{timeout, timeout, []string{"Rcode mismatch"}, outcome_both_error},
+	}
+	for _, c := range cases {
+		got := classify_outcome(c.iana_err, c.yeti_err, c.diffs)
+		if got != c.want {
+			t.Errorf("classify_outcome(%v, %v, %q) == %s, want %s",
+				c.iana_err, c.yeti_err, c.diffs, got, c.want)
+		}
+	}
+}
+
+func TestYetiQueryOutcomes(t *testing.T) {
+	// the first server times out, the second agrees with IANA
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		if server == "[2001:db8::1]:53" {
+			return nil, 0, errors.New("i/o timeout")
+		}
+		return empty_answer(server, query), time.Millisecond, nil
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	qcfg := query_conf{clear_names: true}
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query), time.Millisecond, &addr)
+	<-done
+
+	if (srvs.outcomes[outcome_yeti_error] != 1) || (srvs.outcomes[outcome_equivalent] != 1) {
+		t.Errorf("unexpected outcomes %v", srvs.outcomes)
+	}
+	var out bytes.Buffer
+	srvs.write_summary(&out)
+	for _, want := range []string{"equivalent:       1\n", "Yeti error:       1\n", "both unreachable: 0\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	// the first server adds an NS, the second agrees with IANA, and the
+	// third times out
+	extra_ns, _ := dns.NewRR("example. 172800 IN NS ns.other.")
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		switch server {
+		case "[2001:db8::1]:53":
+			resp := empty_answer(server, query)
+			resp.Ns = append(resp.Ns, extra_ns)
+			return resp, 10 * time.Millisecond, nil
+		case "[2001:db8::2]:53":
+			return empty_answer(server, query), 30 * time.Millisecond, nil
+		}
+		return nil, 0, errors.New("i/o timeout")
+	}
+
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	srvs := init_yeti_server_set(ips, "all")
+	qcfg := query_conf{clear_names: true}
+	for n := 0; n < 3; n++ {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+		<-done
+	}
+
+	cases := []struct {
+		different uint
+		errors    uint
+		mean      time.Duration
+	}{
+		{3, 0, 10 * time.Millisecond},
+		{0, 0, 30 * time.Millisecond},
+		{0, 3, 0},
+	}
+	for n, target := range srvs.next() {
+		stats := &target.info.stats
+		c := cases[n]
+		mean, ok := stats.mean_rtt()
+		if (stats.queries() != 3) || (stats.outcomes[outcome_different] != c.different) ||
+			(stats.outcomes[outcome_yeti_error] != c.errors) || (mean != c.mean) || (ok != (c.mean != 0)) {
+			t.Errorf("%s: stats %+v, expected %+v", target.ip, *stats, c)
+		}
+	}
+
+	var out bytes.Buffer
+	srvs.write_summary(&out)
+	for _, want := range []string{
+		"  -                        2001:db8::1                      3         3        0      0       0     10ms\n",
+		"  -                        2001:db8::3                      3         0        0      3       0        -\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestFollowRedirectsBothTimeout(t *testing.T) {
+	// the root has a CNAME, but nobody answers for the target
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		return nil, 0, errors.New("i/o timeout")
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.old.", dns.TypeA)
+	resp := empty_answer("", query)
+	cname, _ := dns.NewRR("www.old. 86400 IN CNAME www.new.")
+	resp.Answer = append(resp.Answer, cname)
+	qcfg := query_conf{clear_names: true, follow_redirects: true}
+	diffs, both_error := follow_redirects(&qcfg, "[192.0.2.1]:53", "[2001:db8::1]:53", query, resp, resp.Copy())
+	if (len(diffs) != 0) || !both_error {
+		t.Errorf("follow_redirects() with both sides unreachable == %q, %t, want both unreachable",
+			diffs, both_error)
+	}
+
+	// if only Yeti times out that is a difference
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		if server == "[2001:db8::1]:53" {
+			return nil, 0, errors.New("i/o timeout")
+		}
+		return empty_answer(server, query), time.Millisecond, nil
+	}
+	diffs, both_error = follow_redirects(&qcfg, "[192.0.2.1]:53", "[2001:db8::1]:53", query, resp, resp.Copy())
+	if (len(diffs) != 1) || !strings.Contains(diffs[0], "error querying Yeti") || both_error {
+		t.Errorf("follow_redirects() with Yeti unreachable == %q, %t", diffs, both_error)
+	}
+}
+
+func TestYetiQueryBothTimeout(t *testing.T) {
+	// every query times out, except for the first Yeti query when
+	// following redirections
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		if (server == "[2001:db8::1]:53") && (query.Question[0].Name == "www.old.") {
+			resp := empty_answer(server, query)
+			cname, _ := dns.NewRR("www.old. 86400 IN CNAME www.new.")
+			resp.Answer = append(resp.Answer, cname)
+			return resp, time.Millisecond, nil
+		}
+		return nil, 0, errors.New("i/o timeout")
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.old.", dns.TypeA)
+	captured := empty_answer("", query)
+	cname, _ := dns.NewRR("www.old. 86400 IN CNAME www.new.")
+	captured.Answer = append(captured.Answer, cname)
+	for _, qcfg := range []query_conf{
+		// a fresh IANA answer and the Yeti answer both time out
+		{clear_names: true, iana_server: net.ParseIP("198.51.100.53"), iana_port: 5353},
+		// the follow-up queries for a redirection both time out
+		{clear_names: true, follow_redirects: true},
+	} {
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		q := query.Copy()
+		if qcfg.iana_server != nil {
+			q.Question[0].Name = "www.other."
+		}
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, q, captured, time.Millisecond, &addr)
+		<-done
+
+		var out bytes.Buffer
+		srvs.write_summary(&out)
+		for _, want := range []string{"equivalent:       0\n", "both unreachable: 1\n"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("follow %t, refresh %v: summary missing %q:\n%s",
+					qcfg.follow_redirects, qcfg.iana_server, want, out.String())
+			}
+		}
+	}
+}
+
+func TestSkipSummary(t *testing.T) {
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	qcfg := query_conf{clear_names: true}
+	for _, qname := range []string{".", "id.server.", "version.bind.", "example.arpa.", "www.example."} {
+		query := new(dns.Msg)
+		query.SetQuestion(qname, dns.TypeA)
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+		<-done
+	}
+
+	if len(*sent) != 1 {
+		t.Errorf("%d queries sent, expected 1", len(*sent))
+	}
+	var out bytes.Buffer
+	srvs.write_summary(&out)
+	for _, want := range []string{
+		"Skipped queries: 4\n",
+		"  arpa:                    1\n",
+		"  root zone:               1\n",
+		"  server information:      2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestUdpSizeSummary(t *testing.T) {
+	cases := []struct {
+		sizes map[uint16]uint
+		want  string
+	}{
+		{map[uint16]uint{1232: 3, 4096: 1}, "min 1232 max 4096 mode 1232 (0 answers without EDNS)"},
+		{map[uint16]uint{512: 1, 1232: 2, 4096: 2, 0: 4}, "min 512 max 4096 mode 1232 (4 answers without EDNS)"},
+		{map[uint16]uint{0: 2}, "no EDNS (2 answers)"},
+	}
+	for _, c := range cases {
+		got := udp_size_summary(c.sizes)
+		if got != c.want {
+			t.Errorf("udp_size_summary(%v) == %q, want %q", c.sizes, got, c.want)
+		}
+	}
+}
+
+func TestRecordUdpSize(t *testing.T) {
+	// each server advertises its own size, and the third does not use EDNS
+	sizes := map[string]uint16{"[2001:db8::1]:53": 1232, "[2001:db8::2]:53": 4096}
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		if sizes[server] != 0 {
+			resp.SetEdns0(sizes[server], false)
+		}
+		return resp
+	})
+	defer restore()
+
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	srvs := init_yeti_server_set(ips, "all")
+	qcfg := query_conf{clear_names: true}
+	for n := 0; n < 3; n++ {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+		<-done
+	}
+
+	var out bytes.Buffer
+	srvs.write_summary(&out)
+	for _, want := range []string{
+		"  2001:db8::1: min 1232 max 1232 mode 1232 (0 answers without EDNS)\n",
+		"  2001:db8::2: min 4096 max 4096 mode 4096 (0 answers without EDNS)\n",
+		"  2001:db8::3: no EDNS (3 answers)\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	nxdomain := new(dns.Msg)
+	nxdomain.Rcode = dns.RcodeNameError
+	cases := []struct {
+		policy  string
+		resp    *dns.Msg
+		diffs   []string
+		outcome outcome
+		skipped bool
+	}{
+		{"equivalent", servfail, nil, outcome_equivalent, false},
+		{"agreed-error", servfail, nil, outcome_agreed_error, false},
+		{"skip", servfail, nil, outcome_equivalent, true},
+		// NXDOMAIN is an answer, not an error
+		{"agreed-error", nxdomain, nil, outcome_equivalent, false},
+		{"skip", nxdomain, nil, outcome_equivalent, false},
+		// errors that don't match are still differences
+		{"agreed-error", servfail, []string{"Rcode mismatch"}, outcome_different, false},
+		{"skip", servfail, []string{"Rcode mismatch"}, outcome_different, false},
+	}
+	for _, c := range cases {
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+		srvs.record_answers(srvs.next()[0], c.policy, c.resp, c.diffs, false)
+		if c.skipped {
+			if (srvs.skips[SKIP_AGREED_ERROR] != 1) || (srvs.outcomes != [num_outcomes]uint{}) {
+				t.Errorf("%s, %s: not skipped, outcomes %v", c.policy, dns.RcodeToString[c.resp.Rcode], srvs.outcomes)
+			}
+		} else if (srvs.outcomes[c.outcome] != 1) || (len(srvs.skips) != 0) {
+			t.Errorf("%s, %s: outcomes %v, expected %s", c.policy, dns.RcodeToString[c.resp.Rcode], srvs.outcomes, c.outcome)
+		}
+	}
+}
+
+func TestRttHistogram(t *testing.T) {
+	var h rtt_histogram
+	_, ok := h.quantile(0.5)
+	if ok {
+		t.Errorf("quantile() of an empty histogram should fail")
+	}
+	for ms := 1; ms <= 100; ms++ {
+		h.add(time.Duration(ms)*time.Millisecond + 300*time.Microsecond)
+	}
+	h.add(time.Minute)
+	for _, c := range []struct {
+		q    float64
+		want time.Duration
+	}{{0, time.Millisecond}, {0.5, 51 * time.Millisecond}, {0.9, 91 * time.Millisecond}, {1, rtt_buckets * time.Millisecond}} {
+		got, _ := h.quantile(c.q)
+		if got != c.want {
+			t.Errorf("quantile(%g) == %s, want %s", c.q, got, c.want)
+		}
+	}
+	var prev rtt_histogram = h
+	h.add(7 * time.Millisecond)
+	diff := h.since(&prev)
+	got, _ := diff.quantile(0.5)
+	if (diff.count() != 1) || (got != 7*time.Millisecond) {
+		t.Errorf("since() has %d times with median %s", diff.count(), got)
+	}
+}
+
+func TestServerErrorOutcome(t *testing.T) {
+	cases := []struct {
+		iana_rcode int
+		yeti_rcode int
+		want       outcome
+	}{
+		{dns.RcodeSuccess, dns.RcodeServerFailure, outcome_server_error},
+		{dns.RcodeSuccess, dns.RcodeRefused, outcome_server_error},
+		{dns.RcodeNameError, dns.RcodeServerFailure, outcome_server_error},
+		// other rcodes, or IANA failing too, are just differences
+		{dns.RcodeSuccess, dns.RcodeNameError, outcome_different},
+		{dns.RcodeSuccess, dns.RcodeNotImplemented, outcome_different},
+		{dns.RcodeServerFailure, dns.RcodeRefused, outcome_different},
+	}
+	for _, c := range cases {
+		yeti_rcode := c.yeti_rcode
+		_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+			resp := empty_answer(server, query)
+			resp.Rcode = yeti_rcode
+			return resp
+		})
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		iana_resp := empty_answer("", query)
+		iana_resp.Rcode = c.iana_rcode
+		var out bytes.Buffer
+		qcfg := query_conf{clear_names: true, json_out: new_json_writer(&out)}
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, iana_resp, time.Millisecond, &addr)
+		<-done
+		restore()
+
+		name := dns.RcodeToString[c.iana_rcode] + " vs Yeti " + dns.RcodeToString[c.yeti_rcode]
+		if srvs.outcomes[c.want] != 1 {
+			t.Errorf("%s: outcomes %v, expected %s", name, srvs.outcomes, c.want)
+		}
+		// the rcode difference is still reported as usual
+		want_rcode := "Rcode mismatch: IANA " + name
+		if !strings.Contains(out.String(), want_rcode) {
+			t.Errorf("%s: JSON %s missing %q", name, out.String(), want_rcode)
+		}
+		want_json := fmt.Sprintf(`"server_error":%t`, c.want == outcome_server_error)
+		if !strings.Contains(out.String(), want_json) {
+			t.Errorf("%s: JSON %s missing %s", name, out.String(), want_json)
+		}
+	}
+
+	// the failures are counted for each server in the summary
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	target := srvs.next()[0]
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	srvs.record_answers(target, "equivalent", servfail, []string{"Rcode mismatch"}, true)
+	var out bytes.Buffer
+	srvs.write_summary(&out)
+	for _, want := range []string{
+		"  server error:     1\n",
+		"  -                        2001:db8::1                      1         0        1      0       0        -\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   Run statistics as JSON.
+
+   With the -stats-json flag, we write a summary of the whole run to a
+   file as a JSON document when we are done, so that test harnesses and
+   other programs can check the results without parsing the summary
+   meant for people. Round-trip times are in milliseconds, and are null
+   for a server that never answered.
+*/
+type json_server_stats struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address"`
+	Queries     uint     `json:"queries"`
+	Answers     uint     `json:"answers"`
+	Different   uint     `json:"different"`
+	Failures    uint     `json:"failures"`
+	Errors      uint     `json:"errors"`
+	Skipped     uint     `json:"skipped"`
+	MeanRttMs   *float64 `json:"mean_rtt_ms"`
+	MedianRttMs *float64 `json:"median_rtt_ms"`
+	SrttMs      float64  `json:"srtt_ms"`
+}
+
+type json_run_stats struct {
+	Messages   uint64 `json:"messages"`
+	Queries    uint64 `json:"queries"`
+	Mismatches uint64 `json:"mismatches"`
+	// number of comparisons with each outcome, by the name of the outcome
+	Outcomes map[string]uint `json:"outcomes"`
+	// number of comparisons where each part of the answers differs
+	MismatchSections map[string]uint `json:"mismatch_sections"`
+	// number of queries skipped for each reason
+	Skips   map[string]uint     `json:"skips"`
+	Servers []json_server_stats `json:"servers"`
+}
+
+func duration_ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Get the statistics of the run so far, with the totals from the
+// progress counters.
+func (srvs *yeti_server_set) run_stats(counters *progress_counters) *json_run_stats {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	rs := &json_run_stats{
+		Messages:         atomic.LoadUint64(&counters.messages),
+		Queries:          atomic.LoadUint64(&counters.queries),
+		Mismatches:       atomic.LoadUint64(&counters.mismatches),
+		Outcomes:         make(map[string]uint),
+		MismatchSections: make(map[string]uint),
+		Skips:            make(map[string]uint),
+		Servers:          []json_server_stats{},
+	}
+	for o := outcome(0); o < num_outcomes; o++ {
+		rs.Outcomes[o.String()] = srvs.outcomes[o]
+	}
+	for section, count := range srvs.mismatches {
+		rs.MismatchSections[section] = count
+	}
+	for reason, count := range srvs.skips {
+		rs.Skips[reason] = count
+	}
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			stats := &info.stats
+			if stats.queries() == 0 {
+				continue
+			}
+			ss := json_server_stats{
+				Name:      ns.name,
+				Address:   info.ip.String(),
+				Queries:   stats.queries(),
+				Answers:   stats.answers,
+				Different: stats.outcomes[outcome_different],
+				Failures:  stats.outcomes[outcome_server_error],
+				Errors:    stats.outcomes[outcome_yeti_error],
+				Skipped:   stats.skipped,
+				SrttMs:    duration_ms(info.srtt),
+			}
+			if mean, ok := stats.mean_rtt(); ok {
+				mean_ms := duration_ms(mean)
+				ss.MeanRttMs = &mean_ms
+			}
+			if median, ok := stats.median_rtt(); ok {
+				median_ms := duration_ms(median)
+				ss.MedianRttMs = &median_ms
+			}
+			rs.Servers = append(rs.Servers, ss)
+		}
+	}
+	return rs
+}
+
+// Write the statistics of the run to a file.
+func (srvs *yeti_server_set) write_stats_json(name string, counters *progress_counters) error {
+	doc, err := json.MarshalIndent(srvs.run_stats(counters), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(doc, '\n'), 0644)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shane-kerr/ymmv/dnsstub"
+)
+
+func TestWriteStatsJSON(t *testing.T) {
+	// the first server adds an NS, and the second times out
+	extra_ns, _ := dns.NewRR("example. 172800 IN NS ns.other.")
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		if server == "[2001:db8::1]:53" {
+			resp := empty_answer(server, query)
+			resp.Ns = append(resp.Ns, extra_ns)
+			return resp, 10 * time.Millisecond, nil
+		}
+		return nil, 0, errors.New("i/o timeout")
+	}
+
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	srvs := init_yeti_server_set(ips, "all")
+	srvs.record_skip(SKIP_ARPA)
+	qcfg := query_conf{clear_names: true}
+	for n := 0; n < 2; n++ {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+		<-done
+	}
+
+	counters := progress_counters{messages: 3, queries: 4, mismatches: 2}
+	name := filepath.Join(t.TempDir(), "stats.json")
+	if err := srvs.write_stats_json(name, &counters); err != nil {
+		t.Fatalf("write_stats_json() error: %s", err)
+	}
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Error reading statistics: %s", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(contents, &doc); err != nil {
+		t.Fatalf("Error parsing statistics %q: %s", contents, err)
+	}
+	for _, field := range []string{"messages", "queries", "mismatches", "outcomes",
+		"mismatch_sections", "skips", "servers"} {
+		if _, ok := doc[field]; !ok {
+			t.Errorf("statistics missing %q:\n%s", field, contents)
+		}
+	}
+	if doc["messages"] != 3.0 {
+		t.Errorf("statistics have %v messages, expected 3", doc["messages"])
+	}
+	if sections, _ := doc["mismatch_sections"].(map[string]interface{}); sections["authority"] != 2.0 {
+		t.Errorf("statistics have mismatch sections %v, expected 2 in the authority", sections)
+	}
+	if skips, _ := doc["skips"].(map[string]interface{}); skips[SKIP_ARPA] != 1.0 {
+		t.Errorf("statistics have skips %v, expected 1 for %s", skips, SKIP_ARPA)
+	}
+
+	servers, _ := doc["servers"].([]interface{})
+	if len(servers) != 2 {
+		t.Fatalf("statistics have %d servers, expected 2:\n%s", len(servers), contents)
+	}
+	for n, want := range []struct {
+		address string
+		median  interface{}
+	}{
+		{"2001:db8::1", 10.0},
+		{"2001:db8::2", nil},
+	} {
+		server, _ := servers[n].(map[string]interface{})
+		for _, field := range []string{"name", "address", "queries", "answers", "different",
+			"errors", "skipped", "mean_rtt_ms", "median_rtt_ms", "srtt_ms"} {
+			if _, ok := server[field]; !ok {
+				t.Errorf("server statistics missing %q: %v", field, server)
+			}
+		}
+		if (server["address"] != want.address) || (server["queries"] != 2.0) ||
+			(server["median_rtt_ms"] != want.median) {
+			t.Errorf("server statistics %v, expected %s with median %v", server, want.address, want.median)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+   SVCB and HTTPS records (RFC 9460).
+
+   Our DNS library predates these types, so they arrive as unknown
+   records with hex-encoded RDATA. Comparing that by string is fragile,
+   since the same parameters may be encoded in a different order, so we
+   parse the RDATA and compare the priority, target name, and the set of
+   parameters.
+*/
+const (
+	TYPE_SVCB  uint16 = 64
+	TYPE_HTTPS uint16 = 65
+)
+
+// names of the SvcParamKeys that we know about
+var svc_param_keys = map[uint16]string{
+	0: "mandatory",
+	1: "alpn",
+	2: "no-default-alpn",
+	3: "port",
+	4: "ipv4hint",
+	5: "ech",
+	6: "ipv6hint",
+}
+
+// the contents of an SVCB or HTTPS record
+type svcb_rdata struct {
+	priority uint16
+	target   string
+	// the value of each parameter, by SvcParamKey
+	params map[uint16][]byte
+}
+
+// Parse the RDATA of an SVCB or HTTPS record.
+func parse_svcb(rr *dns.RFC3597) (*svcb_rdata, error) {
+	if (rr.Hdr.Rrtype != TYPE_SVCB) && (rr.Hdr.Rrtype != TYPE_HTTPS) {
+		return nil, fmt.Errorf("Type %s is not SVCB or HTTPS", dns.Type(rr.Hdr.Rrtype))
+	}
+	rdata, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return nil, err
+	}
+	if len(rdata) < 2 {
+		return nil, fmt.Errorf("SVCB RDATA too short")
+	}
+	svcb := &svcb_rdata{params: make(map[uint16][]byte)}
+	svcb.priority = binary.BigEndian.Uint16(rdata)
+	target, off, err := dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return nil, err
+	}
+	svcb.target = target
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return nil, fmt.Errorf("SVCB parameter truncated")
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+length > len(rdata) {
+			return nil, fmt.Errorf("SVCB parameter %s value truncated", svc_param_key_string(key))
+		}
+		_, dup := svcb.params[key]
+		if dup {
+			return nil, fmt.Errorf("SVCB parameter %s repeated", svc_param_key_string(key))
+		}
+		svcb.params[key] = rdata[off : off+length]
+		off += length
+	}
+	return svcb, nil
+}
+
+func svc_param_key_string(key uint16) string {
+	name, found := svc_param_keys[key]
+	if found {
+		return name
+	}
+	return "key" + strconv.Itoa(int(key))
+}
+
+// Describe the value of a parameter, in presentation format for the
+// parameters where that is simple and as hex otherwise.
+func svc_param_value_string(key uint16, value []byte) string {
+	switch key {
+	case 0: // mandatory, which lists keys that may be in any order
+		if len(value)%2 == 0 {
+			keys := make([]uint16, 0, len(value)/2)
+			for n := 0; n < len(value); n += 2 {
+				keys = append(keys, binary.BigEndian.Uint16(value[n:]))
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+			names := make([]string, 0, len(keys))
+			for _, k := range keys {
+				names = append(names, svc_param_key_string(k))
+			}
+			return strings.Join(names, ",")
+		}
+	case 1: // alpn
+		var ids []string
+		for n := 0; n < len(value); {
+			length := int(value[n])
+			if n+1+length > len(value) {
+				return hex.EncodeToString(value)
+			}
+			ids = append(ids, string(value[n+1:n+1+length]))
+			n += 1 + length
+		}
+		return strings.Join(ids, ",")
+	case 3: // port
+		if len(value) == 2 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(value)))
+		}
+	case 4, 6: // ipv4hint, ipv6hint
+		size := net.IPv4len
+		if key == 6 {
+			size = net.IPv6len
+		}
+		if (len(value) > 0) && (len(value)%size == 0) {
+			var addrs []string
+			for n := 0; n < len(value); n += size {
+				addrs = append(addrs, net.IP(value[n:n+size]).String())
+			}
+			return strings.Join(addrs, ",")
+		}
+	}
+	return hex.EncodeToString(value)
+}
+
+// Get the record contents in presentation format, with the parameters
+// sorted by key, so that two records with the same parameters in a
+// different order get the same string.
+func (svcb *svcb_rdata) String() string {
+	keys := make([]uint16, 0, len(svcb.params))
+	for key := range svcb.params {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	s := strconv.Itoa(int(svcb.priority)) + " " + svcb.target
+	for _, key := range keys {
+		s += " " + svc_param_key_string(key)
+		if len(svcb.params[key]) > 0 {
+			s += "=" + svc_param_value_string(key, svcb.params[key])
+		}
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// make an HTTPS record for example. from hex-encoded parameters
+func https_rr(params string) *dns.RFC3597 {
+	rr := new(dns.RFC3597)
+	rr.Hdr = dns.RR_Header{Name: "example.", Rrtype: TYPE_HTTPS, Class: dns.ClassINET, Ttl: 3600}
+	// priority 1, target "svc.example."
+	rr.Rdata = "0001" + "03737663076578616d706c6500" + params
+	return rr
+}
+
+const (
+	// alpn=h2,h3
+	svcb_alpn = "0001" + "0006" + "026832" + "026833"
+	// port=8443
+	svcb_port = "0003" + "0002" + "20fb"
+	// ipv4hint=192.0.2.1
+	svcb_ipv4hint = "0004" + "0004" + "c0000201"
+)
+
+func TestParseSvcb(t *testing.T) {
+	svcb, err := parse_svcb(https_rr(svcb_alpn + svcb_port + svcb_ipv4hint))
+	if err != nil {
+		t.Fatalf("parse_svcb() error: %s", err)
+	}
+	want := "1 svc.example. alpn=h2,h3 port=8443 ipv4hint=192.0.2.1"
+	if svcb.String() != want {
+		t.Errorf("parse_svcb() == %q, want %q", svcb.String(), want)
+	}
+
+	bad := []string{
+		svcb_alpn + svcb_alpn, // repeated key
+		svcb_port[:10],        // truncated value
+		"00",                  // truncated key
+	}
+	for _, params := range bad {
+		_, err := parse_svcb(https_rr(params))
+		if err == nil {
+			t.Errorf("parse_svcb() should fail for parameters %s", params)
+		}
+	}
+}
+
+func TestCompareSvcb(t *testing.T) {
+	iana := https_rr(svcb_alpn + svcb_port + svcb_ipv4hint)
+	yeti := https_rr(svcb_ipv4hint + svcb_alpn + svcb_port)
+	if rr_compare_string(iana) != rr_compare_string(yeti) {
+		t.Errorf("reordered parameters compare differently:\n%s\n%s",
+			rr_compare_string(iana), rr_compare_string(yeti))
+	}
+	iana_only, yeti_only, _, _ := compare_section([]dns.RR{iana}, []dns.RR{yeti}, new(compare_conf))
+	if (len(iana_only) != 0) || (len(yeti_only) != 0) {
+		t.Errorf("compare_section() found differences in reordered parameters")
+	}
+
+	// a different value does not match
+	other := https_rr(svcb_alpn + "0003000201bb" + svcb_ipv4hint)
+	if rr_compare_string(iana) == rr_compare_string(other) {
+		t.Errorf("different port compares the same")
+	}
+	// nor does a different priority
+	other = https_rr(svcb_alpn + svcb_port + svcb_ipv4hint)
+	other.Rdata = "0002" + other.Rdata[4:]
+	if rr_compare_string(iana) == rr_compare_string(other) {
+		t.Errorf("different priority compares the same")
+	}
+	// nor a different target
+	rdata, _ := hex.DecodeString(other.Rdata)
+	rdata[3] = 'x'
+	other.Rdata = "0001" + hex.EncodeToString(rdata[2:])
+	if rr_compare_string(iana) == rr_compare_string(other) {
+		t.Errorf("different target compares the same")
+	}
+}
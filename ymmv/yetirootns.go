@@ -1,12 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/miekg/dns"
 	"github.com/shane-kerr/ymmv/dnsstub"
 	"math/rand"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,8 +27,10 @@ var yeti_root_hints = []string{
 // allowed server-selection algorithms
 var server_algorithms = map[string]bool{
 	"rtt":         true,
+	"least-rtt":   true,
 	"round-robin": true,
 	"random":      true,
+	"weighted":    true,
 	"all":         true,
 }
 
@@ -50,6 +54,18 @@ type ip_info struct {
 	ip net.IP
 	// smoothed round-trip time (SRTT) for this IP address
 	srtt time.Duration
+	// number of round-trip times that went into the SRTT
+	srtt_samples uint
+	// weight for the "weighted" algorithm, where 0 means the default of 1
+	weight uint
+	// port to send queries to, where 0 means the port of the server set
+	port uint16
+	// number of queries sent to this IP address
+	sent uint
+	// number of answers advertising each EDNS UDP size (0 for no EDNS)
+	udp_sizes map[uint16]uint
+	// comparisons with this IP address, for the summary
+	stats server_stats
 }
 
 // information about each Yeti name server
@@ -84,6 +100,31 @@ type yeti_server_set struct {
 	next_server int
 	next_ip     int
 
+	// maximum queries to send to each IP address (0 means no limit)
+	max_per_server uint
+	// set once we have warned that every IP address is used up
+	exhausted bool
+
+	// IP address family to query, either 4 or 6, or 0 for both
+	family int
+
+	// port to send queries to, unless set for an IP address (0 means 53)
+	port uint16
+
+	// number of different servers to send each query to, so that we can
+	// compare their answers with each other (0 means just compare with
+	// IANA)
+	quorum int
+
+	// number of comparisons with each outcome
+	outcomes [num_outcomes]uint
+	// number of queries skipped for each reason
+	skips map[string]uint
+	// number of comparisons where each part of the answers differs
+	mismatches map[string]uint
+	// round-trip times of the answers from Yeti servers
+	rtts rtt_histogram
+
 	// resolver for lookups
 	resolver *dnsstub.StubResolver
 }
@@ -164,7 +205,9 @@ func refresh_ns(srvs *yeti_server_set) {
 	srvs.lock.Unlock()
 
 	// set timer to refresh our NS RRset
+	srvs.lock.Lock()
 	srvs.root_ns_timer = time.AfterFunc(use_ttl(ns_ttl), func() { refresh_ns(srvs) })
+	srvs.lock.Unlock()
 }
 
 // Note that on error we don't use this name server until we can find out
@@ -199,7 +242,20 @@ func refresh_aaaa(ns *ns_info, done chan int) {
 		this_ttl = 300
 	}
 
-	// make a set of IP information, copying old SRTT if present in the old set
+	ns.srvs.lock.Lock()
+	ns.set_ips(new_ip)
+	when := use_ttl(this_ttl)
+	glog.V(1).Infof("scheduling refresh of AAAA for %s in %s\n", ns.name, when)
+	ns.timer = time.AfterFunc(when, func() { refresh_aaaa(ns, nil) })
+	ns.srvs.lock.Unlock()
+
+	done <- len(new_ip)
+}
+
+// Set the IP addresses of a name server, copying the old SRTT for any
+// address that we already had. The SRTT is shared with the queries
+// that are running, so the server set lock must be held.
+func (ns *ns_info) set_ips(new_ip []net.IP) {
 	var new_ip_info []*ip_info
 	for _, ip := range new_ip {
 		found := false
@@ -219,15 +275,7 @@ func refresh_aaaa(ns *ns_info, done chan int) {
 			new_ip_info = append(new_ip_info, &ip_info{ip: ip, srtt: 0})
 		}
 	}
-
-	ns.srvs.lock.Lock()
 	ns.ip_info = new_ip_info
-	when := use_ttl(this_ttl)
-	glog.V(1).Infof("scheduling refresh of AAAA for %s in %s\n", ns.name, when)
-	ns.timer = time.AfterFunc(when, func() { refresh_aaaa(ns, nil) })
-	ns.srvs.lock.Unlock()
-
-	done <- len(new_ip)
 }
 
 // get the list of root servers from known Yeti root servers
@@ -292,53 +340,313 @@ func init_yeti_server_set(ips []net.IP, algo string) (srvs *yeti_server_set) {
 type query_target struct {
 	ip      net.IP
 	ns_name string
+	info    *ip_info
+}
+
+// Get the address family to query from the -4 and -6 flags, either 4 or
+// 6, or 0 for both. Both flags together is the same as neither.
+func address_family(ipv4_only bool, ipv6_only bool) int {
+	if ipv4_only && !ipv6_only {
+		return 4
+	}
+	if ipv6_only && !ipv4_only {
+		return 6
+	}
+	return 0
+}
+
+// check whether an IP address is of an address family, either 4 or 6,
+// or 0 for both
+func in_address_family(family int, ip net.IP) bool {
+	switch family {
+	case 4:
+		return ip.To4() != nil
+	case 6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// check whether an IP address is of the address family we are using
+func (srvs *yeti_server_set) in_family(ip net.IP) bool {
+	return in_address_family(srvs.family, ip)
+}
+
+// check whether an IP address can still be sent queries
+func (srvs *yeti_server_set) available(info *ip_info) bool {
+	if !srvs.in_family(info.ip) {
+		return false
+	}
+	return (srvs.max_per_server == 0) || (info.sent < srvs.max_per_server)
 }
 
 // Get the next set of IP addresses to query.
 // For most algorithms this is a single address, but it may be more (for "all").
+// Each target returned is a separate query, and callers must compare each
+// answer on its own, without sharing any modified messages between targets.
+// IP addresses that have been sent their maximum number of queries are
+// not used, so this returns no targets once every address is used up.
+// Neither are IP addresses of the address family that we are not using.
 func (srvs *yeti_server_set) next() (targets []*query_target) {
 	srvs.lock.Lock()
 	defer srvs.lock.Unlock()
 
 	if srvs.algorithm == "round-robin" {
-		for srvs.next_ip >= len(srvs.ns[srvs.next_server].ip_info) {
-			srvs.next_server = (srvs.next_server + 1) % len(srvs.ns)
-			srvs.next_ip = 0
+		num_ip := 0
+		for _, ns := range srvs.ns {
+			num_ip += len(ns.ip_info)
+		}
+		// look at each IP address at most once to find one we can use
+		for n := 0; (n < num_ip) && (len(targets) == 0); n++ {
+			for srvs.next_ip >= len(srvs.ns[srvs.next_server].ip_info) {
+				srvs.next_server = (srvs.next_server + 1) % len(srvs.ns)
+				srvs.next_ip = 0
+			}
+			ns := srvs.ns[srvs.next_server]
+			info := ns.ip_info[srvs.next_ip]
+			if srvs.available(info) {
+				targets = append(targets, &query_target{ip: info.ip, ns_name: ns.name, info: info})
+			}
+			srvs.next_ip = srvs.next_ip + 1
 		}
-		ns := srvs.ns[srvs.next_server]
-		ip := ns.ip_info[srvs.next_ip].ip
-		targets = append(targets, &query_target{ip: ip, ns_name: ns.name})
-		srvs.next_ip = srvs.next_ip + 1
 	} else if srvs.algorithm == "rtt" {
 		var lowest_ip_info *ip_info = nil
 		var ns_name string
 		for _, ns := range srvs.ns {
 			for _, info := range ns.ip_info {
+				if !srvs.available(info) {
+					continue
+				}
 				if (lowest_ip_info == nil) || (lowest_ip_info.srtt > info.srtt) {
 					lowest_ip_info = info
 					ns_name = ns.name
 				}
 			}
 		}
-		targets = append(targets, &query_target{ip: lowest_ip_info.ip, ns_name: ns_name})
+		if lowest_ip_info != nil {
+			targets = append(targets, &query_target{ip: lowest_ip_info.ip, ns_name: ns_name, info: lowest_ip_info})
+		}
+	} else if srvs.algorithm == "least-rtt" {
+		var best *ip_info = nil
+		var ns_name string
+		for _, ns := range srvs.ns {
+			for _, info := range ns.ip_info {
+				if !srvs.available(info) {
+					continue
+				}
+				if (best == nil) || least_rtt_before(info, best) {
+					best = info
+					ns_name = ns.name
+				}
+			}
+		}
+		if best != nil {
+			targets = append(targets, &query_target{ip: best.ip, ns_name: ns_name, info: best})
+		}
 	} else {
 		var all_targets []*query_target
 		for _, ns := range srvs.ns {
 			for _, info := range ns.ip_info {
-				all_targets = append(all_targets, &query_target{ip: info.ip, ns_name: ns.name})
+				if srvs.available(info) {
+					all_targets = append(all_targets, &query_target{ip: info.ip, ns_name: ns.name, info: info})
+				}
 			}
 		}
 		if srvs.algorithm == "all" {
 			targets = all_targets
-		} else if srvs.algorithm == "random" {
+		} else if (srvs.algorithm == "random") && (len(all_targets) > 0) {
 			targets = append(targets, all_targets[rand.Intn(len(all_targets))])
+		} else if (srvs.algorithm == "weighted") && (len(all_targets) > 0) {
+			var total uint
+			for _, target := range all_targets {
+				total += target.info.selection_weight()
+			}
+			pick := uint(rand.Int63n(int64(total)))
+			for _, target := range all_targets {
+				if pick < target.info.selection_weight() {
+					targets = append(targets, target)
+					break
+				}
+				pick -= target.info.selection_weight()
+			}
+		}
+	}
+
+	// in quorum mode, use more servers if the algorithm did not pick enough
+	if len(targets) < srvs.quorum {
+		targets = srvs.add_quorum_targets(targets)
+	}
+
+	// count the queries we are about to send
+	for _, target := range targets {
+		target.info.sent += 1
+		if (srvs.max_per_server > 0) && (target.info.sent == srvs.max_per_server) {
+			glog.Infof("%s @ %s has been sent %d queries, not using it any more",
+				target.ns_name, target.ip, target.info.sent)
 		}
 	}
+	if (len(targets) == 0) && (srvs.max_per_server > 0) && !srvs.exhausted {
+		glog.Warningf("every Yeti server has been sent %d queries, not sending any more",
+			srvs.max_per_server)
+		srvs.exhausted = true
+	} else if len(targets) > 0 {
+		// we may have learned new addresses for the servers
+		srvs.exhausted = false
+	}
 	return targets
 }
 
+// get the weight of an IP address for the "weighted" algorithm
+func (info *ip_info) selection_weight() uint {
+	if info.weight == 0 {
+		return 1
+	}
+	return info.weight
+}
+
+// Set the weight of an IP address for the "weighted" algorithm.
+func (srvs *yeti_server_set) set_weight(ip net.IP, weight uint) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			if info.ip.Equal(ip) {
+				info.weight = weight
+			}
+		}
+	}
+}
+
+// Set the port to send queries to for an IP address, where 0 means the
+// port of the server set.
+func (srvs *yeti_server_set) set_port(ip net.IP, port uint16) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			if info.ip.Equal(ip) {
+				info.port = port
+			}
+		}
+	}
+}
+
+// Get the address to send queries to for an IP address, with the port
+// set for it if there is one.
+func (srvs *yeti_server_set) server_addr(ip net.IP) string {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			if info.ip.Equal(ip) && (info.port != 0) {
+				return server_addr(ip, info.port)
+			}
+		}
+	}
+	return server_addr(ip, srvs.port)
+}
+
+// Function used to look up the addresses of a server host name, replaced
+// in tests.
+var lookup_ip = net.LookupIP
+
+// Parse a server from the command line, which is an IP address or a host
+// name, optionally with a port, followed by '@' and a weight for the
+// "weighted" algorithm, like "192.0.2.1@3" or "[2001:db8::1]:5353@2".
+// The port is 0 if not given, and the weight is 1. A host name is looked
+// up, and all of its IPv4 and IPv6 addresses are used, with the same
+// port and weight.
+func parse_server_arg(arg string) (ips []net.IP, port uint16, weight uint, err error) {
+	addr := arg
+	weight = 1
+	at := strings.LastIndex(arg, "@")
+	if at >= 0 {
+		addr = arg[:at]
+		n, err := strconv.ParseUint(arg[at+1:], 10, 32)
+		if (err != nil) || (n == 0) {
+			return nil, 0, 0, fmt.Errorf("Bad weight in '%s', must be a positive integer", arg)
+		}
+		weight = uint(n)
+	}
+	// a bare IPv6 address has colons too, so only look for a port if
+	// this is not an address
+	if net.ParseIP(addr) == nil {
+		host, port_str, err := net.SplitHostPort(addr)
+		if err == nil {
+			n, err := strconv.ParseUint(port_str, 10, 16)
+			if (err != nil) || (n == 0) {
+				return nil, 0, 0, fmt.Errorf("Bad port in '%s', must be between 1 and 65535", arg)
+			}
+			addr = host
+			port = uint16(n)
+		} else if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+			addr = addr[1 : len(addr)-1]
+		}
+	}
+	ip := net.ParseIP(addr)
+	if ip != nil {
+		return []net.IP{ip}, port, weight, nil
+	}
+	ips, err = lookup_ip(addr)
+	if (err != nil) || (len(ips) == 0) {
+		return nil, 0, 0, fmt.Errorf("Unable to get any IP address for '%s': %v", addr, err)
+	}
+	glog.V(1).Infof("server %s has addresses %s", addr, ips)
+	return ips, port, weight, nil
+}
+
+// Check whether the "least-rtt" algorithm prefers one IP address to
+// another. Addresses without an SRTT yet come first, taking turns by
+// picking the one sent the fewest queries, and after that the one with
+// the lowest SRTT.
+func least_rtt_before(a *ip_info, b *ip_info) bool {
+	if (a.srtt_samples == 0) != (b.srtt_samples == 0) {
+		return a.srtt_samples == 0
+	}
+	if a.srtt_samples == 0 {
+		return a.sent < b.sent
+	}
+	return a.srtt < b.srtt
+}
+
+// Get all of the IP addresses of all of the servers, in the address
+// family that we are using.
+func (srvs *yeti_server_set) all_ips() (ips []net.IP) {
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	for _, ns := range srvs.ns {
+		for _, info := range ns.ip_info {
+			if srvs.in_family(info.ip) {
+				ips = append(ips, info.ip)
+			}
+		}
+	}
+	return ips
+}
+
+// Send a few probe queries for the root SOA to every server, to set the
+// SRTT before we start comparing answers. Otherwise every server starts
+// with the same SRTT and the first selections are not useful.
+func (srvs *yeti_server_set) warmup(rounds int, qcfg *query_conf) {
+	for round := 0; round < rounds; round++ {
+		for _, ip := range srvs.all_ips() {
+			probe := new(dns.Msg)
+			probe.SetQuestion(".", dns.TypeSOA)
+			qcfg.wait_rate()
+			_, rtt, err := dns_query(srvs.server_addr(ip), probe, &qcfg.dns_opts)
+			if err != nil {
+				glog.Infof("Error probing Yeti root server %s; %s", ip, err)
+				// the same penalty as for a failed query
+				rtt = time.Second / 2
+			}
+			srvs.update_srtt(ip, rtt)
+		}
+	}
+}
+
 func (srvs *yeti_server_set) update_srtt(ip net.IP, rtt time.Duration) {
 	glog.V(3).Infof("update_srtt ip=%s, rtt=%s", ip, rtt)
+	metric_rtt.Observe(rtt.Seconds())
 	srvs.lock.Lock()
 	defer srvs.lock.Unlock()
 
@@ -351,6 +659,7 @@ func (srvs *yeti_server_set) update_srtt(ip net.IP, rtt time.Duration) {
 				} else {
 					ip_info.srtt = ((ip_info.srtt * 7) + (rtt * 3)) / 10
 				}
+				ip_info.srtt_samples += 1
 				glog.V(2).Infof("%s: update SRTT ip=%s, srtt=%s", ns_info.name, ip_info.ip, ip_info.srtt)
 				// all other IP have their time decayed a bit
 			} else {
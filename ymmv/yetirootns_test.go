@@ -1,6 +1,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/shane-kerr/ymmv/dnsstub"
+	"math"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,3 +32,306 @@ func TestUseTTL(t *testing.T) {
 		}
 	}
 }
+
+// Run with "go test -race" to check for unsynchronized access.
+func TestServerSetConcurrency(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	for algo := range server_algorithms {
+		srvs := init_yeti_server_set(ips, algo)
+		var wg sync.WaitGroup
+		for n := 0; n < 20; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					for _, target := range srvs.next() {
+						srvs.update_srtt(target.ip, time.Duration(n+i)*time.Millisecond)
+					}
+					// occasionally change the addresses, like a refresh does
+					if i%50 == 0 {
+						srvs.lock.Lock()
+						srvs.ns[0].set_ips(ips[:1+(n%len(ips))])
+						srvs.lock.Unlock()
+					}
+				}
+			}(n)
+		}
+		wg.Wait()
+		for _, target := range srvs.next() {
+			if target.ip == nil {
+				t.Errorf("%s: next() returned target without an IP", algo)
+			}
+		}
+	}
+}
+
+func TestSetIPsKeepsSRTT(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	srvs := init_yeti_server_set(ips, "rtt")
+	srvs.update_srtt(ips[0], 100*time.Millisecond)
+	srvs.ns[0].set_ips([]net.IP{ips[0], net.ParseIP("2001:db8::3")})
+	info := srvs.ns[0].ip_info
+	if (len(info) != 2) || (info[0].srtt != 100*time.Millisecond) || (info[1].srtt != 0) {
+		t.Errorf("set_ips() did not keep SRTT: %v, %v", info[0], info[1])
+	}
+}
+
+func TestMaxPerServer(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	for algo := range server_algorithms {
+		srvs := init_yeti_server_set(ips, algo)
+		srvs.max_per_server = 3
+		// the first address always looks fastest, so rtt keeps picking it
+		srvs.update_srtt(ips[1], time.Second)
+		counts := make(map[string]uint)
+		for n := 0; n < 20; n++ {
+			for _, target := range srvs.next() {
+				counts[target.ip.String()] += 1
+			}
+		}
+		for _, ip := range ips {
+			if counts[ip.String()] != 3 {
+				t.Errorf("%s: %s selected %d times, want 3", algo, ip, counts[ip.String()])
+			}
+		}
+		if len(srvs.next()) != 0 {
+			t.Errorf("%s: next() returned targets after every budget was used", algo)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	var lock sync.Mutex
+	probes := make(map[string]int)
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		lock.Lock()
+		probes[server] += 1
+		lock.Unlock()
+		if server == "[2001:db8::3]:53" {
+			return nil, 0, errors.New("i/o timeout")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		return resp, 10 * time.Millisecond, nil
+	}
+
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	srvs := init_yeti_server_set(ips, "rtt")
+	srvs.warmup(3, new(query_conf))
+	for _, ip := range ips {
+		if probes[server_addr(ip, 0)] != 3 {
+			t.Errorf("%s got %d probes, expected 3", ip, probes[server_addr(ip, 0)])
+		}
+	}
+	for _, info := range srvs.ns[0].ip_info {
+		if info.srtt == 0 {
+			t.Errorf("%s has no SRTT after warm-up", info.ip)
+		}
+	}
+	// the server that does not answer is not picked
+	if srvs.next()[0].ip.Equal(ips[2]) {
+		t.Errorf("unresponsive server picked after warm-up")
+	}
+}
+
+func TestServerSetFamily(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::2")}
+	for _, c := range []struct {
+		ipv4_only bool
+		ipv6_only bool
+		want      int
+	}{
+		{false, false, 0},
+		{true, false, 4},
+		{false, true, 6},
+		{true, true, 0},
+	} {
+		family := address_family(c.ipv4_only, c.ipv6_only)
+		if family != c.want {
+			t.Errorf("address_family(%t, %t) == %d, expected %d", c.ipv4_only, c.ipv6_only, family, c.want)
+		}
+		srvs := init_yeti_server_set(ips, "all")
+		srvs.family = family
+		want := map[int]int{0: 4, 4: 2, 6: 2}[c.want]
+		if (len(srvs.all_ips()) != want) || (len(srvs.next()) != want) {
+			t.Errorf("-4 %t -6 %t, but all_ips() == %v", c.ipv4_only, c.ipv6_only, srvs.all_ips())
+		}
+	}
+
+	for _, family := range []int{4, 6} {
+		for algo := range server_algorithms {
+			srvs := init_yeti_server_set(ips, algo)
+			srvs.family = family
+			for n := 0; n < 10; n++ {
+				targets := srvs.next()
+				if len(targets) == 0 {
+					t.Fatalf("%s: no IPv%d targets", algo, family)
+				}
+				for _, target := range targets {
+					if (target.ip.To4() != nil) != (family == 4) {
+						t.Errorf("%s: IPv%d only, but %s selected", algo, family, target.ip)
+					}
+				}
+			}
+		}
+		srvs := init_yeti_server_set(ips, "all")
+		srvs.family = family
+		if len(srvs.all_ips()) != 2 {
+			t.Errorf("IPv%d only, but all_ips() == %v", family, srvs.all_ips())
+		}
+	}
+}
+
+func TestLeastRTT(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	srvs := init_yeti_server_set(ips, "least-rtt")
+
+	// servers without an SRTT take turns, even with no answers yet
+	for n := 0; n < 6; n++ {
+		targets := srvs.next()
+		if (len(targets) != 1) || !targets[0].ip.Equal(ips[n%3]) {
+			t.Fatalf("next() without SRTT == %v, expected %s", targets, ips[n%3])
+		}
+	}
+
+	// a server without an SRTT is still tried before the fastest one
+	srvs.update_srtt(ips[0], 30*time.Millisecond)
+	srvs.update_srtt(ips[1], 10*time.Millisecond)
+	if target := srvs.next()[0]; !target.ip.Equal(ips[2]) {
+		t.Errorf("next() == %s, expected %s without an SRTT", target.ip, ips[2])
+	}
+
+	// then the lowest SRTT is picked every time
+	srvs.update_srtt(ips[2], 50*time.Millisecond)
+	for n := 0; n < 3; n++ {
+		if target := srvs.next()[0]; !target.ip.Equal(ips[1]) {
+			t.Errorf("next() == %s, expected %s with the lowest SRTT", target.ip, ips[1])
+		}
+	}
+	srvs.update_srtt(ips[1], 200*time.Millisecond)
+	if target := srvs.next()[0]; !target.ip.Equal(ips[0]) {
+		t.Errorf("next() == %s, expected %s after %s got slower", target.ip, ips[0], ips[1])
+	}
+}
+
+func TestParseServerArg(t *testing.T) {
+	orig := lookup_ip
+	defer func() { lookup_ip = orig }()
+	lookup_ip = func(host string) ([]net.IP, error) {
+		switch host {
+		case "yeti.example":
+			return []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")}, nil
+		case "empty.example":
+			return nil, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	cases := []struct {
+		arg    string
+		ips    string
+		port   uint16
+		weight uint
+		ok     bool
+	}{
+		{"192.0.2.1", "[192.0.2.1]", 0, 1, true},
+		{"2001:db8::1", "[2001:db8::1]", 0, 1, true},
+		{"2001:db8::1@5", "[2001:db8::1]", 0, 5, true},
+		{"192.0.2.1@1", "[192.0.2.1]", 0, 1, true},
+		{"yeti.example", "[192.0.2.53 2001:db8::53]", 0, 1, true},
+		{"yeti.example@2", "[192.0.2.53 2001:db8::53]", 0, 2, true},
+		{"192.0.2.1:5353", "[192.0.2.1]", 5353, 1, true},
+		{"[2001:db8::1]:5353@3", "[2001:db8::1]", 5353, 3, true},
+		{"[2001:db8::1]", "[2001:db8::1]", 0, 1, true},
+		{"yeti.example:5300", "[192.0.2.53 2001:db8::53]", 5300, 1, true},
+		{"192.0.2.1@0", "", 0, 0, false},
+		{"192.0.2.1@-1", "", 0, 0, false},
+		{"192.0.2.1@heavy", "", 0, 0, false},
+		{"192.0.2.1:0", "", 0, 0, false},
+		{"192.0.2.1:65536", "", 0, 0, false},
+		{"[2001:db8::1]:dns", "", 0, 0, false},
+		{"bogus@2", "", 0, 0, false},
+		{"empty.example", "", 0, 0, false},
+	}
+	for _, c := range cases {
+		ips, port, weight, err := parse_server_arg(c.arg)
+		if (err == nil) != c.ok {
+			t.Errorf("parse_server_arg(%q) error %v", c.arg, err)
+			continue
+		}
+		if c.ok && ((fmt.Sprint(ips) != c.ips) || (port != c.port) || (weight != c.weight)) {
+			t.Errorf("parse_server_arg(%q) == %s, %d, %d, expected %s, %d, %d",
+				c.arg, ips, port, weight, c.ips, c.port, c.weight)
+		}
+	}
+}
+
+func TestServerPort(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	srvs := init_yeti_server_set(ips, "all")
+
+	// by default we use port 53
+	want := []string{"[2001:db8::1]:53", "192.0.2.1:53"}
+	for n, ip := range ips {
+		if addr := srvs.server_addr(ip); addr != want[n] {
+			t.Errorf("server_addr(%s) == %s, expected %s", ip, addr, want[n])
+		}
+	}
+
+	// a port for the set applies to every server without its own
+	srvs.port = 5300
+	srvs.set_port(ips[1], 5353)
+	want = []string{"[2001:db8::1]:5300", "192.0.2.1:5353"}
+	for n, ip := range ips {
+		if addr := srvs.server_addr(ip); addr != want[n] {
+			t.Errorf("server_addr(%s) == %s, expected %s", ip, addr, want[n])
+		}
+	}
+
+	// the queries go to those ports
+	sent := make(map[string]bool)
+	var lock sync.Mutex
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		lock.Lock()
+		sent[server] = true
+		lock.Unlock()
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		return resp, time.Millisecond, nil
+	}
+	srvs.warmup(1, new(query_conf))
+	for _, addr := range want {
+		if !sent[addr] {
+			t.Errorf("no query sent to %s, only to %v", addr, sent)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	srvs := init_yeti_server_set(ips, "weighted")
+	// the first server keeps the default weight of 1
+	srvs.set_weight(ips[1], 3)
+	srvs.set_weight(ips[2], 6)
+
+	const draws = 30000
+	counts := make(map[string]int)
+	for n := 0; n < draws; n++ {
+		targets := srvs.next()
+		if len(targets) != 1 {
+			t.Fatalf("next() returned %d targets, expected 1", len(targets))
+		}
+		counts[targets[0].ip.String()] += 1
+	}
+	for n, want := range []float64{0.1, 0.3, 0.6} {
+		got := float64(counts[ips[n].String()]) / draws
+		if math.Abs(got-want) > 0.02 {
+			t.Errorf("%s picked %.3f of the time, expected about %.1f", ips[n], got, want)
+		}
+	}
+}
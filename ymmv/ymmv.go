@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -11,12 +14,16 @@ import (
 	"github.com/golang/glog"
 	"github.com/miekg/dns"
 	"github.com/shane-kerr/ymmv/dnsstub"
+	"golang.org/x/time/rate"
 	"gopkg.in/gomail.v2"
+	"hash/crc32"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
@@ -74,29 +81,123 @@ func (y ymmv_message) print() {
 	fmt.Printf("%s\n", PadRight("", 78, "-"))
 }
 
-// TODO: return more details with err if underlying calls fail
-func read_next_message() (y *ymmv_message, err error) {
+// Error for a message that we read all of, but that has a DNS message
+// that we could not parse. The stream is still fine, so we can go on to
+// the next message.
+type unpack_error struct {
+	err error
+}
+
+func (e *unpack_error) Error() string {
+	return e.err.Error()
+}
+
+// Error for a message whose checksum does not match its contents. Like
+// an unpack_error, we read all of the message, so we can go on to the
+// next one, although if the corruption is in a length then the next one
+// will probably be wrong too.
+type checksum_error struct {
+	// number of the message in the stream, starting at 1
+	message int
+	offset  int64
+	want    uint32
+	got     uint32
+}
+
+func (e *checksum_error) Error() string {
+	return fmt.Sprintf("checksum mismatch at message %d (offset %d): CRC32 in stream %08x, calculated %08x",
+		e.message, e.offset, e.want, e.got)
+}
+
+// Read the next message in the ymmv format. Errors include the offset
+// in the stream of the field that could not be read; to get offsets from
+// the start of the stream, rather than from the start of this message,
+// and message numbers for checksum errors, pass the same offset_reader
+// for each message. The end of the stream before any of the message is
+// read is io.EOF.
+func read_next_message(r io.Reader) (y *ymmv_message, err error) {
+	in, ok := r.(*offset_reader)
+	if !ok {
+		in = &offset_reader{r: r}
+	}
+	start := in.offset
+	// everything up to the checksum goes into the checksum, for the
+	// versions that have one
+	checksum := crc32.NewIEEE()
+	r = io.TeeReader(in, checksum)
+	field := in.offset
+	// add where we were in the stream to an error
+	at := func(err error) error {
+		return fmt.Errorf("offset %d: %s", field, err)
+	}
+	// Read all of a field. A single Read may return less than asked
+	// for, especially from a pipe, so keep reading until we have it all.
+	read_field := func(buf []byte, what string) error {
+		field = in.offset
+		nread, err := io.ReadFull(r, buf)
+		if (err == io.ErrUnexpectedEOF) || (err == io.EOF) {
+			return at(fmt.Errorf("Only read %d of %d bytes of %s", nread, len(buf), what))
+		}
+		if err != nil {
+			return at(fmt.Errorf("Error reading %s: %s", what, err))
+		}
+		return nil
+	}
+	// read a number, as a field of the given size
+	read_uint := func(size int, what string) (uint64, error) {
+		buf := make([]byte, size)
+		err := read_field(buf, what)
+		if err != nil {
+			return 0, err
+		}
+		var n uint64
+		for _, b := range buf {
+			n = (n << 8) | uint64(b)
+		}
+		return n, nil
+	}
+
 	magic := make([]byte, 4, 4)
-	nread, err := os.Stdin.Read(magic)
-	if err != nil {
+	nread, err := io.ReadFull(r, magic)
+	if (err == io.EOF) && (nread == 0) {
 		return nil, err
 	}
-	if nread != 4 {
+	if err == io.ErrUnexpectedEOF {
 		errmsg := fmt.Sprintf("Only read %d of 4 magic bytes", nread)
-		return nil, errors.New(errmsg)
+		return nil, at(errors.New(errmsg))
+	}
+	if err != nil {
+		return nil, at(err)
 	}
 	if string(magic) != "ymmv" {
 		errmsg := fmt.Sprintf("Magic '%s' instead of 'ymmv'", magic)
-		return nil, errors.New(errmsg)
+		return nil, at(errors.New(errmsg))
 	}
+	in.messages += 1
 
+	// The byte after the magic is the format version, except for
+	// captures from before we had versions, where it is the IP family.
+	// These have the same layout as version 0.
 	tmp_ip_family := make([]byte, 1, 1)
-	nread, err = os.Stdin.Read(tmp_ip_family)
+	err = read_field(tmp_ip_family, "format version or IP family")
 	if err != nil {
 		return nil, err
 	}
-	if nread != 1 {
-		return nil, errors.New("Couldn't read IPv4 or IPv6")
+	has_checksum := false
+	if (tmp_ip_family[0] != '4') && (tmp_ip_family[0] != '6') {
+		switch tmp_ip_family[0] {
+		// version 1 is the same as version 0, with a checksum at the end
+		case 0, 1:
+			has_checksum = tmp_ip_family[0] == 1
+			err = read_field(tmp_ip_family, "IP family")
+			if err != nil {
+				return nil, err
+			}
+		// each later version needs its own parser here
+		default:
+			errmsg := fmt.Sprintf("Unsupported ymmv format version %d", tmp_ip_family[0])
+			return nil, at(errors.New(errmsg))
+		}
 	}
 	var ip_family int
 	if tmp_ip_family[0] == '4' {
@@ -105,96 +206,103 @@ func read_next_message() (y *ymmv_message, err error) {
 		ip_family = 6
 	} else {
 		errmsg := fmt.Sprintf("Expecting '4' or '6' for IP family, got '%s'", tmp_ip_family)
-		return nil, errors.New(errmsg)
+		return nil, at(errors.New(errmsg))
 	}
 
 	protocol := make([]byte, 1, 1)
-	nread, err = os.Stdin.Read(protocol)
+	err = read_field(protocol, "protocol")
 	if err != nil {
 		return nil, err
 	}
-	if nread != 1 {
-		return nil, errors.New("Couldn't read TCP or UDP")
-	}
 	if (protocol[0] != 'u') && (protocol[0] != 't') {
 		errmsg := fmt.Sprintf("Expecting 't'cp or 'u'dp for protocol, got '%s'", protocol)
-		return nil, errors.New(errmsg)
+		return nil, at(errors.New(errmsg))
 	}
 
 	var tmp_addr []byte
 	if ip_family == 4 {
 		tmp_addr = make([]byte, 4, 4)
 	} else {
-		// XXX: should we add an assert()-equivalent here?
 		tmp_addr = make([]byte, 16, 16)
 	}
-	nread, err = os.Stdin.Read(tmp_addr)
+	err = read_field(tmp_addr, "address")
 	if err != nil {
 		return nil, err
 	}
-	if nread != cap(tmp_addr) {
-		errmsg := fmt.Sprintf("Only read %d of %d bytes of address", nread, cap(tmp_addr))
-		return nil, errors.New(errmsg)
-	}
 	addr := net.IP(tmp_addr)
 
-	var query_sec uint32
-	err = binary.Read(os.Stdin, binary.BigEndian, &query_sec)
+	query_sec, err := read_uint(4, "query time seconds")
 	if err != nil {
 		return nil, err
 	}
-	var query_nsec uint32
-	err = binary.Read(os.Stdin, binary.BigEndian, &query_nsec)
+	query_nsec, err := read_uint(4, "query time nanoseconds")
 	if err != nil {
 		return nil, err
 	}
 	query_time := time.Unix(int64(query_sec), int64(query_nsec))
 
-	var query_len uint16
-	err = binary.Read(os.Stdin, binary.BigEndian, &query_len)
+	query_len, err := read_uint(2, "query message length")
 	if err != nil {
 		return nil, err
 	}
 	query_raw := make([]byte, query_len, query_len)
-	nread, err = os.Stdin.Read(query_raw)
+	query_offset := in.offset
+	err = read_field(query_raw, "query message")
 	if err != nil {
 		return nil, err
 	}
-	if nread != int(query_len) {
-		errmsg := fmt.Sprintf("Only read %d of %d bytes of query message", nread, query_len)
-		return nil, errors.New(errmsg)
-	}
-	query := new(dns.Msg)
-	query.Unpack(query_raw)
-
-	var answer_sec uint32
-	err = binary.Read(os.Stdin, binary.BigEndian, &answer_sec)
+	answer_sec, err := read_uint(4, "answer time seconds")
 	if err != nil {
 		return nil, err
 	}
-	var answer_nsec uint32
-	err = binary.Read(os.Stdin, binary.BigEndian, &answer_nsec)
+	answer_nsec, err := read_uint(4, "answer time nanoseconds")
 	if err != nil {
 		return nil, err
 	}
 	answer_time := time.Unix(int64(answer_sec), int64(answer_nsec))
 
-	var answer_len uint16
-	err = binary.Read(os.Stdin, binary.BigEndian, &answer_len)
+	answer_len, err := read_uint(2, "answer message length")
 	if err != nil {
 		return nil, err
 	}
 	answer_raw := make([]byte, answer_len, answer_len)
-	nread, err = os.Stdin.Read(answer_raw)
+	answer_offset := in.offset
+	err = read_field(answer_raw, "answer message")
 	if err != nil {
 		return nil, err
 	}
-	if nread != int(answer_len) {
-		errmsg := fmt.Sprintf("Only read %d of %d bytes of answer message", nread, answer_len)
-		return nil, errors.New(errmsg)
+	if has_checksum {
+		got := checksum.Sum32()
+		// the checksum itself is not part of the checksum
+		r = in
+		want, err := read_uint(4, "checksum")
+		if err != nil {
+			return nil, err
+		}
+		if uint32(want) != got {
+			return nil, &checksum_error{message: in.messages, offset: start, want: uint32(want), got: got}
+		}
+	}
+
+	// only parse the messages once we have read the whole record, so
+	// that if we can't the stream is ready for the next one
+	field = query_offset
+	// the DNS library says a message is truncated if it has the TC bit
+	// or is only a header, but still unpacks what there is; we keep
+	// these, so that truncated answers are compared as they always were,
+	// and an answer that is only a header can be reported as missing its
+	// data rather than as a broken message
+	query := new(dns.Msg)
+	err = query.Unpack(query_raw)
+	if (err != nil) && (err != dns.ErrTruncated) {
+		return nil, &unpack_error{at(fmt.Errorf("failed to unpack query message: %s", err))}
 	}
+	field = answer_offset
 	answer := new(dns.Msg)
-	answer.Unpack(answer_raw)
+	err = answer.Unpack(answer_raw)
+	if (err != nil) && (err != dns.ErrTruncated) {
+		return nil, &unpack_error{at(fmt.Errorf("failed to unpack answer message: %s", err))}
+	}
 
 	var result ymmv_message
 	result.ip_family = byte(ip_family)
@@ -209,6 +317,57 @@ func read_next_message() (y *ymmv_message, err error) {
 	return &result, nil
 }
 
+// Write a message in the ymmv format, as described in ymmv-format.md.
+// This uses the layout of version 0 without the version byte, so that
+// versions of ymmv from before the format had a version can read it.
+func WriteMessage(w io.Writer, y *ymmv_message) error {
+	return write_message(w, y, false)
+}
+
+// Write a message in version 1 of the ymmv format, which has a checksum
+// so that readers can tell if it was corrupted.
+func WriteMessageChecksum(w io.Writer, y *ymmv_message) error {
+	return write_message(w, y, true)
+}
+
+func write_message(w io.Writer, y *ymmv_message, with_checksum bool) error {
+	var addr net.IP
+	if y.ip_family == 4 {
+		addr = y.addr.To4()
+	} else if y.ip_family == 6 {
+		addr = y.addr.To16()
+	}
+	if addr == nil {
+		return fmt.Errorf("Unable to write IPv%d address %s", y.ip_family, y.addr)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("ymmv")
+	if with_checksum {
+		buf.WriteByte(1)
+	}
+	buf.WriteByte('0' + y.ip_family)
+	buf.WriteByte(y.ip_protocol)
+	buf.Write(addr)
+	for _, part := range []struct {
+		when time.Time
+		msg  *dns.Msg
+	}{{y.query_time, y.query}, {y.answer_time, y.answer}} {
+		msg_raw, err := part.msg.Pack()
+		if err != nil {
+			return err
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(part.when.Unix()))
+		binary.Write(&buf, binary.BigEndian, uint32(part.when.Nanosecond()))
+		binary.Write(&buf, binary.BigEndian, uint16(len(msg_raw)))
+		buf.Write(msg_raw)
+	}
+	if with_checksum {
+		binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 // RrSort implements functions needed to sort []dns.RR
 type rr_sort []dns.RR
 
@@ -218,7 +377,7 @@ func (a rr_sort) Less(i, j int) bool {
 	// XXX: is there a "cmp" equivalent in Go?
 	// compare name of RR
 	i_name := strings.ToLower(a[i].Header().Name)
-	j_name := strings.ToLower(a[i].Header().Name)
+	j_name := strings.ToLower(a[j].Header().Name)
 	if i_name < j_name {
 		return true
 	} else if i_name > j_name {
@@ -296,6 +455,34 @@ func extract_rrset(rrs []dns.RR) map[string][]dns.RR {
 	return rrsets
 }
 
+// Check whether sorted RRsets from the IANA and Yeti additional sections
+// are the same, allowing for the TTL tolerance. The sort order includes
+// the TTL, so with a tolerance we match each IANA record with any Yeti
+// record that is the same, rather than the one in the same place.
+func rrset_equal(iana_rrset []dns.RR, yeti_rrset []dns.RR, ccfg *compare_conf) bool {
+	if ccfg.ttl_tolerance == 0 {
+		return reflect.DeepEqual(iana_rrset, yeti_rrset)
+	}
+	if len(iana_rrset) != len(yeti_rrset) {
+		return false
+	}
+	matched := make([]bool, len(yeti_rrset))
+	for _, iana_rr := range iana_rrset {
+		found := false
+		for n, yeti_rr := range yeti_rrset {
+			if !matched[n] && reflect.DeepEqual(iana_rr, tolerate_ttl(iana_rr, yeti_rr, ccfg)) {
+				matched[n] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 /*
    Additional section comparison is more difficult than answer or
    authority section comparison.
@@ -307,7 +494,7 @@ func extract_rrset(rrs []dns.RR) map[string][]dns.RR {
    Also, we don't really care about the contents of the OPT pseudo-RR,
    as that doesn't contain actual answer data.
 */
-func compare_additional(iana []dns.RR, yeti []dns.RR) (iana_only []dns.RR, yeti_only []dns.RR) {
+func compare_additional(iana []dns.RR, yeti []dns.RR, ccfg *compare_conf) (iana_only []dns.RR, yeti_only []dns.RR) {
 	iana_only = make([]dns.RR, 0)
 	yeti_only = make([]dns.RR, 0)
 	iana_rr_map := extract_rrset(iana)
@@ -317,13 +504,20 @@ func compare_additional(iana []dns.RR, yeti []dns.RR) (iana_only []dns.RR, yeti_
 		if iana_rrset[0].Header().Rrtype == dns.TypeOPT {
 			continue
 		}
-		// and don't compare signatures
-		if iana_rrset[0].Header().Rrtype == dns.TypeRRSIG {
+		// and don't compare signatures, unless asked to
+		is_rrsig := iana_rrset[0].Header().Rrtype == dns.TypeRRSIG
+		if is_rrsig && !ccfg.dnssec {
 			continue
 		}
 		yeti_rrset, ok := yeti_rr_map[key]
 		if ok {
-			if !reflect.DeepEqual(iana_rrset, yeti_rrset) {
+			var same bool
+			if is_rrsig {
+				same = rrsig_set_string(iana_rrset) == rrsig_set_string(yeti_rrset)
+			} else {
+				same = rrset_equal(iana_rrset, yeti_rrset, ccfg)
+			}
+			if !same {
 				for _, rr := range iana_rrset {
 					iana_only = append(iana_only, rr)
 				}
@@ -336,35 +530,400 @@ func compare_additional(iana []dns.RR, yeti []dns.RR) (iana_only []dns.RR, yeti_
 	return iana_only, yeti_only
 }
 
-func compare_section(iana []dns.RR, yeti []dns.RR) (iana_only []dns.RR, yeti_only []dns.RR,
+// Get a string for an RR in a form that we can compare. The DNS
+// library prints the NSEC and NSEC3 type bitmaps in whatever order it
+// holds them, so we sort them first. SVCB and HTTPS records are parsed
+// so that the order of their parameters does not matter.
+func rr_compare_string(rr dns.RR) string {
+	switch rr.(type) {
+	case *dns.RFC3597:
+		svcb, err := parse_svcb(rr.(*dns.RFC3597))
+		if err == nil {
+			return strings.ToLower(rr.Header().String() + svcb.String())
+		}
+	case *dns.NSEC:
+		nsec := dns.Copy(rr).(*dns.NSEC)
+		sort.Slice(nsec.TypeBitMap, func(i, j int) bool { return nsec.TypeBitMap[i] < nsec.TypeBitMap[j] })
+		rr = nsec
+	case *dns.NSEC3:
+		nsec3 := dns.Copy(rr).(*dns.NSEC3)
+		sort.Slice(nsec3.TypeBitMap, func(i, j int) bool { return nsec3.TypeBitMap[i] < nsec3.TypeBitMap[j] })
+		rr = nsec3
+	}
+	return strings.ToLower(rr.String())
+}
+
+/*
+   Custom comparison rules let the built-in comparison be extended with
+   rules for specific cases, for example to treat records for certain
+   owner names specially.
+
+   Each time compare_section checks whether an IANA record and a Yeti
+   record are the same, the registered rules are asked in the order they
+   were registered. The first rule that returns ok=true decides whether
+   the records are equal. If no rule does, the built-in comparison is
+   used.
+*/
+type CompareRule interface {
+	Equal(iana_rr dns.RR, yeti_rr dns.RR) (equal bool, ok bool)
+}
+
+// Adapter to allow an ordinary function to be used as a CompareRule.
+type CompareRuleFunc func(iana_rr dns.RR, yeti_rr dns.RR) (equal bool, ok bool)
+
+func (f CompareRuleFunc) Equal(iana_rr dns.RR, yeti_rr dns.RR) (equal bool, ok bool) {
+	return f(iana_rr, yeti_rr)
+}
+
+// registered comparison rules, which are only changed before any
+// comparisons start so need no lock
+var compare_rules []CompareRule
+
+// Add a custom comparison rule. This must be done before any queries
+// are compared.
+func RegisterCompareRule(rule CompareRule) {
+	compare_rules = append(compare_rules, rule)
+}
+
+// Check whether an IANA record and a Yeti record are the same, using
+// any custom rules and then the built-in comparison.
+func rr_equal(iana_rr dns.RR, yeti_rr dns.RR) bool {
+	for _, rule := range compare_rules {
+		equal, ok := rule.Equal(iana_rr, yeti_rr)
+		if ok {
+			return equal
+		}
+	}
+	return rr_compare_string(iana_rr) == rr_compare_string(yeti_rr)
+}
+
+// Describe a type bitmap in sorted order.
+func type_bitmap_string(bitmap []uint16) string {
+	sorted := append([]uint16(nil), bitmap...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	types := make([]string, 0, len(sorted))
+	for _, t := range sorted {
+		types = append(types, dns.Type(t).String())
+	}
+	return strings.Join(types, " ")
+}
+
+/*
+   NSEC and NSEC3 records prove that a name does not exist. When both
+   sides have a mismatched proof for the same owner name we report just
+   which parts of the proof differ, which is a lot easier to understand
+   than the full records.
+*/
+func compare_denial(iana_only []dns.RR, yeti_only []dns.RR) (diffs []string) {
+	for _, iana_rr := range iana_only {
+		for _, yeti_rr := range yeti_only {
+			if !strings.EqualFold(iana_rr.Header().Name, yeti_rr.Header().Name) {
+				continue
+			}
+			switch iana := iana_rr.(type) {
+			case *dns.NSEC:
+				yeti, ok := yeti_rr.(*dns.NSEC)
+				if !ok {
+					continue
+				}
+				prefix := "NSEC proof mismatch for " + iana.Hdr.Name
+				if !strings.EqualFold(iana.NextDomain, yeti.NextDomain) {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA next name %s vs Yeti %s",
+						prefix, iana.NextDomain, yeti.NextDomain))
+				}
+				iana_types := type_bitmap_string(iana.TypeBitMap)
+				yeti_types := type_bitmap_string(yeti.TypeBitMap)
+				if iana_types != yeti_types {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA types [%s] vs Yeti [%s]",
+						prefix, iana_types, yeti_types))
+				}
+			case *dns.NSEC3:
+				yeti, ok := yeti_rr.(*dns.NSEC3)
+				if !ok {
+					continue
+				}
+				prefix := "NSEC3 proof mismatch for " + iana.Hdr.Name
+				if iana.Hash != yeti.Hash {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA hash algorithm %d vs Yeti %d",
+						prefix, iana.Hash, yeti.Hash))
+				}
+				if iana.Flags != yeti.Flags {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA flags %d vs Yeti %d",
+						prefix, iana.Flags, yeti.Flags))
+				}
+				if iana.Iterations != yeti.Iterations {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA iterations %d vs Yeti %d",
+						prefix, iana.Iterations, yeti.Iterations))
+				}
+				if !strings.EqualFold(iana.Salt, yeti.Salt) {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA salt '%s' vs Yeti '%s'",
+						prefix, iana.Salt, yeti.Salt))
+				}
+				if !strings.EqualFold(iana.NextDomain, yeti.NextDomain) {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA next hash %s vs Yeti %s",
+						prefix, iana.NextDomain, yeti.NextDomain))
+				}
+				iana_types := type_bitmap_string(iana.TypeBitMap)
+				yeti_types := type_bitmap_string(yeti.TypeBitMap)
+				if iana_types != yeti_types {
+					diffs = append(diffs, fmt.Sprintf("%s: IANA types [%s] vs Yeti [%s]",
+						prefix, iana_types, yeti_types))
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+/*
+   With -dnssec, when both answers are negative we compare what the
+   NSEC and NSEC3 records prove, rather than the records themselves.
+   NSEC3 hashes depend on the salt and iterations, which may differ
+   between IANA and Yeti without the proof being any different, and an
+   NSEC proof may use other records that cover the same names. So we
+   work out what each set of records proves about the query name: for
+   NODATA, whether the name has the type; for NXDOMAIN, the closest
+   encloser and whether a wildcard below it is ruled out. Each side
+   proves this about its own query name, which may be obfuscated, so
+   the name itself is left out. When both prove the same thing, the
+   denial records and their signatures are not compared.
+*/
+func denial_proof(qname string, qtype uint16, rrs []dns.RR) string {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range rrs {
+		switch denial := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, denial)
+		case *dns.NSEC3:
+			// dns.NSEC3.Cover() compares upper-case hashes
+			denial = dns.Copy(denial).(*dns.NSEC3)
+			denial.NextDomain = strings.ToUpper(denial.NextDomain)
+			nsec3s = append(nsec3s, denial)
+		}
+	}
+	if (len(nsecs) == 0) && (len(nsec3s) == 0) {
+		return ""
+	}
+	qname = strings.ToLower(dns.Fqdn(qname))
+
+	// NODATA: the name exists, so say whether it has the type
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, qname) {
+			return type_proof(qtype, nsec.TypeBitMap)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(qname) {
+			return type_proof(qtype, nsec3.TypeBitMap)
+		}
+	}
+
+	// NXDOMAIN: find the closest encloser of the name
+	encloser := ""
+	for _, nsec := range nsecs {
+		if nsec_covers(nsec, qname) {
+			encloser = nsec_closest_encloser(nsec, qname)
+			break
+		}
+	}
+	if (encloser == "") && (len(nsec3s) > 0) {
+		encloser = nsec3_closest_encloser(nsec3s, qname)
+	}
+	if encloser == "" {
+		return "nothing about the name"
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	for _, nsec := range nsecs {
+		if nsec_covers(nsec, wildcard) {
+			return fmt.Sprintf("no name below %s, and no wildcard", encloser)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(wildcard) {
+			return fmt.Sprintf("no name below %s, and no wildcard", encloser)
+		}
+	}
+	return fmt.Sprintf("no name below %s, but not that there is no wildcard", encloser)
+}
+
+// Describe a proof for a difference, where "" means there is none.
+func proof_or_nothing(proof string) string {
+	if proof == "" {
+		return "nothing"
+	}
+	return proof
+}
+
+// Describe what a type bitmap proves about the type of a query.
+func type_proof(qtype uint16, bitmap []uint16) string {
+	for _, t := range bitmap {
+		if (t == qtype) || (t == dns.TypeCNAME) {
+			return fmt.Sprintf("the name has %s", dns.Type(t))
+		}
+	}
+	return fmt.Sprintf("the name exists without %s", dns.Type(qtype))
+}
+
+// Compare two names in the canonical DNS order of RFC 4034 section
+// 6.1, returning -1, 0, or 1.
+func canonical_compare(a string, b string) int {
+	a_labels := dns.SplitDomainName(strings.ToLower(a))
+	b_labels := dns.SplitDomainName(strings.ToLower(b))
+	for n := 1; (n <= len(a_labels)) && (n <= len(b_labels)); n++ {
+		cmp := strings.Compare(a_labels[len(a_labels)-n], b_labels[len(b_labels)-n])
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	if len(a_labels) < len(b_labels) {
+		return -1
+	} else if len(a_labels) > len(b_labels) {
+		return 1
+	}
+	return 0
+}
+
+// Check whether an NSEC record proves that a name does not exist. The
+// last NSEC in a zone points back to the apex, so covers everything
+// after its owner.
+func nsec_covers(nsec *dns.NSEC, name string) bool {
+	after_owner := canonical_compare(nsec.Hdr.Name, name) < 0
+	before_next := canonical_compare(name, nsec.NextDomain) < 0
+	if canonical_compare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return after_owner && before_next
+	}
+	return after_owner || before_next
+}
+
+// Get the closest encloser of a name covered by an NSEC record, which is
+// the longest name that the name has in common with either end.
+func nsec_closest_encloser(nsec *dns.NSEC, name string) string {
+	common := dns.CompareDomainName(name, nsec.Hdr.Name)
+	if next := dns.CompareDomainName(name, nsec.NextDomain); next > common {
+		common = next
+	}
+	return ancestor(name, common)
+}
+
+// Get the closest encloser of a name from NSEC3 records: the longest
+// ancestor that matches a record, where the next closer name below it is
+// covered. This is "" if there is no such name.
+func nsec3_closest_encloser(nsec3s []*dns.NSEC3, name string) string {
+	labels := dns.CountLabel(name)
+	for n := labels - 1; n >= 0; n-- {
+		encloser := ancestor(name, n)
+		matched, covered := false, false
+		for _, nsec3 := range nsec3s {
+			matched = matched || nsec3.Match(encloser)
+			covered = covered || nsec3.Cover(ancestor(name, n+1))
+		}
+		if matched {
+			if covered {
+				return encloser
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// Get the ancestor of a name with the given number of labels.
+func ancestor(name string, labels int) string {
+	all := dns.SplitDomainName(name)
+	if labels <= 0 {
+		return "."
+	}
+	return strings.ToLower(strings.Join(all[len(all)-labels:], ".")) + "."
+}
+
+// Leave the NSEC and NSEC3 records and their signatures out of a section.
+func without_denial(rrs []dns.RR) (kept []dns.RR) {
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrsig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = rrsig.TypeCovered
+		}
+		if (rrtype != dns.TypeNSEC) && (rrtype != dns.TypeNSEC3) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+/*
+   RRSIG records are normally not compared, since the signatures, and
+   their inception and expiration times, change every time the zone is
+   signed. With the -dnssec flag we compare the parts of each RRSIG that
+   say what is signed and how: the owner name, the type covered, the
+   algorithm, and the signer name.
+*/
+func rrsig_string(rrsig *dns.RRSIG) string {
+	return fmt.Sprintf("%s RRSIG %s %d %s", strings.ToLower(rrsig.Hdr.Name),
+		dns.Type(rrsig.TypeCovered), rrsig.Algorithm, strings.ToLower(rrsig.SignerName))
+}
+
+// Get the parts of a set of RRSIG records that we compare, in order.
+func rrsig_set_string(rrs []dns.RR) string {
+	strs := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		strs = append(strs, rrsig_string(rr.(*dns.RRSIG)))
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, "\n")
+}
+
+// Check whether an IANA record and a Yeti record in the answer or
+// authority section are the same.
+func section_rr_equal(iana_rr dns.RR, yeti_rr dns.RR, ccfg *compare_conf) bool {
+	iana_rrsig, iana_ok := iana_rr.(*dns.RRSIG)
+	yeti_rrsig, yeti_ok := yeti_rr.(*dns.RRSIG)
+	if iana_ok || yeti_ok {
+		return iana_ok && yeti_ok && (rrsig_string(iana_rrsig) == rrsig_string(yeti_rrsig))
+	}
+	return rr_equal(iana_rr, tolerate_ttl(iana_rr, yeti_rr, ccfg))
+}
+
+// Compare the records in a section, as a multiset difference: a record
+// that appears twice in one answer and once in the other is left over
+// once. Records are matched one by one rather than by their strings,
+// since the TTL tolerance and custom rules can match different strings.
+func compare_section(iana []dns.RR, yeti []dns.RR, ccfg *compare_conf) (iana_only []dns.RR, yeti_only []dns.RR,
 	iana_root_soa *dns.SOA, yeti_root_soa *dns.SOA) {
 	iana_root_soa = nil
 	yeti_root_soa = nil
 	iana_only = make([]dns.RR, 0)
-	yeti_only = make([]dns.RR, 0, len(yeti))
+	yeti_only = make([]dns.RR, 0)
+	yeti_rrs := make([]dns.RR, 0, len(yeti))
 	for _, yeti_rr := range yeti {
 		if (yeti_rr.Header().Rrtype == dns.TypeSOA) && (yeti_rr.Header().Name == ".") {
 			yeti_root_soa = yeti_rr.(*dns.SOA)
 			continue
 		}
-		if yeti_rr.Header().Rrtype != dns.TypeRRSIG {
-			yeti_only = append(yeti_only, yeti_rr)
+		if (yeti_rr.Header().Rrtype != dns.TypeRRSIG) || ccfg.dnssec {
+			yeti_rrs = append(yeti_rrs, yeti_rr)
 		}
 	}
 	// We use nested loops, which not especially efficient,
-	// but we only expect a small number of RR in a section
+	// but we only expect a small number of RR in a section.
+	// Each Yeti RR can match only one IANA RR, so that if the same
+	// RR appears twice in one answer it must appear twice in the other.
+	matched := make([]bool, len(yeti_rrs))
 	for _, iana_rr := range iana {
 		found := false
-		// don't compare signatures
-		if iana_rr.Header().Rrtype == dns.TypeRRSIG {
+		// don't compare signatures, unless asked to
+		if (iana_rr.Header().Rrtype == dns.TypeRRSIG) && !ccfg.dnssec {
 			continue
 		} else if (iana_rr.Header().Rrtype == dns.TypeSOA) && (iana_rr.Header().Name == ".") {
 			iana_root_soa = iana_rr.(*dns.SOA)
 			continue
 		}
-		for n, yeti_rr := range yeti_only {
-			if strings.ToLower(iana_rr.String()) == strings.ToLower(yeti_rr.String()) {
-				yeti_only = append(yeti_only[:n], yeti_only[n+1:]...)
+		for n, yeti_rr := range yeti_rrs {
+			if !matched[n] && section_rr_equal(iana_rr, yeti_rr, ccfg) {
+				matched[n] = true
 				found = true
 				break
 			}
@@ -373,40 +932,181 @@ func compare_section(iana []dns.RR, yeti []dns.RR) (iana_only []dns.RR, yeti_onl
 			iana_only = append(iana_only, iana_rr)
 		}
 	}
+	for n, yeti_rr := range yeti_rrs {
+		if !matched[n] {
+			yeti_only = append(yeti_only, yeti_rr)
+		}
+	}
 	return iana_only, yeti_only, iana_root_soa, yeti_root_soa
 }
 
-func skip_comparison(query *dns.Msg) bool {
-	name := strings.ToLower(query.Question[0].Name)
-	// of course the root zone itself is different, so skip that
-	if name == "." {
-		return true
+// Get a key for counting how many times a record appears in a section,
+// which ignores the TTL, and for signatures the parts we don't compare.
+func section_rr_key(rr dns.RR) string {
+	rrsig, is_rrsig := rr.(*dns.RRSIG)
+	if is_rrsig {
+		return rrsig_string(rrsig)
 	}
-	// skip queries for server information
-	if name == "id.server." {
-		return true
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return rr_compare_string(rr)
+}
+
+// Count how many times each record appears in a section, leaving out
+// those that compare_section leaves out.
+func section_rr_counts(rrs []dns.RR, ccfg *compare_conf) map[string]int {
+	counts := make(map[string]int)
+	for _, rr := range rrs {
+		if (rr.Header().Rrtype == dns.TypeRRSIG) && !ccfg.dnssec {
+			continue
+		} else if (rr.Header().Rrtype == dns.TypeSOA) && (rr.Header().Name == ".") {
+			continue
+		}
+		counts[section_rr_key(rr)]++
 	}
-	if name == "version.server." {
-		return true
+	return counts
+}
+
+// Report records that appear in both sections, but a different number
+// of times. These are also in the records only in one answer, but
+// without the counts it is easy to miss that the other answer has the
+// same record too.
+func compare_section_repeats(section string, iana []dns.RR, yeti []dns.RR,
+	iana_only []dns.RR, yeti_only []dns.RR, ccfg *compare_conf) (diffs []string) {
+	iana_counts := section_rr_counts(iana, ccfg)
+	yeti_counts := section_rr_counts(yeti, ccfg)
+	reported := make(map[string]bool)
+	for _, rr := range append(append([]dns.RR{}, iana_only...), yeti_only...) {
+		key := section_rr_key(rr)
+		iana_count, yeti_count := iana_counts[key], yeti_counts[key]
+		if reported[key] || (iana_count == 0) || (yeti_count == 0) || (iana_count == yeti_count) {
+			continue
+		}
+		reported[key] = true
+		diffs = append(diffs, fmt.Sprintf("%s section repeat mismatch: IANA %d vs Yeti %d of %s",
+			section, iana_count, yeti_count, rr))
 	}
-	if name == "version.bind." {
-		return true
+	return diffs
+}
+
+// reasons for skipping the comparison of a query
+const (
+	SKIP_ROOT_ZONE    = "root zone"
+	SKIP_SERVER_INFO  = "server information"
+	SKIP_ROOT_SERVERS = "root-servers.net"
+	SKIP_ARPA         = "arpa"
+	SKIP_INVALID_NAME = "invalid obfuscated name"
+	SKIP_NOT_SAMPLED  = "not sampled"
+	SKIP_AGREED_ERROR = "agreed error"
+	SKIP_NO_QUESTION  = "no question"
+	SKIP_PATTERN      = "skip pattern"
+	SKIP_NO_ANSWER    = "capture missing answer data"
+	SKIP_QTYPE        = "query type"
+	SKIP_NAME         = "query name"
+)
+
+// Parse a comma-separated list of query type names, like "NS,DNSKEY".
+func parse_qtypes(list string) (map[uint16]bool, error) {
+	qtypes := make(map[uint16]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		qtype, ok := dns.StringToType[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown query type '%s' in '%s'", name, list)
+		}
+		qtypes[qtype] = true
 	}
-	if name == "hostname.bind." {
+	return qtypes, nil
+}
+
+// Check whether a query has one of the types we compare. A query with
+// no question is left for yeti_query to skip.
+func (qcfg *query_conf) select_qtype(query *dns.Msg) bool {
+	if (qcfg.qtypes == nil) || (len(query.Question) == 0) {
 		return true
 	}
-	// the IANA servers are authoritative for ROOT-SERVERS.NET, we are not
-	if (name == "root-servers.net.") || strings.HasSuffix(name, ".root-servers.net.") {
+	return qcfg.qtypes[query.Question[0].Qtype]
+}
+
+// Check whether a query is for one of the names we compare, matching
+// any of the -name patterns. A query with no question is left for
+// yeti_query to skip.
+func (qcfg *query_conf) select_name(query *dns.Msg) bool {
+	if (qcfg.names == nil) || (len(query.Question) == 0) {
 		return true
 	}
-	// XXX: ARPA is tricky, since some of the IANA root servers
-	// are authoritative. For now, just skip these queries.
-	if (name == "arpa.") || strings.HasSuffix(name, ".arpa.") {
-		return true
+	name := strings.ToLower(dns.Fqdn(query.Question[0].Name))
+	for n := range qcfg.names {
+		if qcfg.names[n].match(name) {
+			return true
+		}
 	}
 	return false
 }
 
+// Decide which messages to compare, when only comparing a random sample.
+// This is only used by the main loop, so needs no lock.
+type sampler struct {
+	fraction float64
+	rng      *rand.Rand
+}
+
+// Make a sampler for the given fraction of messages. A seed of 0 picks
+// a random sample each run, otherwise the same seed picks the same
+// messages from the same input.
+func new_sampler(fraction float64, seed int64) *sampler {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &sampler{fraction: fraction, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Check whether to compare the next message.
+func (s *sampler) sample() bool {
+	if s.fraction >= 1 {
+		return true
+	}
+	return s.rng.Float64() < s.fraction
+}
+
+// Decide whether to skip comparing the answers to a query, returning
+// the reason to skip it, or "" if it should be compared.
+func skip_comparison(query *dns.Msg) string {
+	// a malformed or FORMERR exchange may have no question at all
+	if len(query.Question) == 0 {
+		return SKIP_NO_QUESTION
+	}
+	name := strings.ToLower(query.Question[0].Name)
+	for n := range skip_rules {
+		if skip_rules[n].match(name) {
+			return skip_rules[n].reason
+		}
+	}
+	return ""
+}
+
+// Check whether a captured answer has lost its contents. A tool that
+// could not pack the answer may still write a header with a length, so
+// we get a message with no question and no records at all. A real
+// NOERROR answer from a root server always has at least the question,
+// so comparing with this would report every Yeti record as a
+// difference. A truncated answer may be empty, and an error may have no
+// question, so those are fine.
+func missing_answer_data(answer *dns.Msg) bool {
+	if (answer.Rcode != dns.RcodeSuccess) || answer.Truncated {
+		return false
+	}
+	if (len(answer.Question) > 0) || (len(answer.Answer) > 0) || (len(answer.Ns) > 0) {
+		return false
+	}
+	for _, rr := range answer.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			return false
+		}
+	}
+	return true
+}
+
 func compare_soa(iana_soa *dns.SOA, yeti_soa *dns.SOA) (diffs []string) {
 	if iana_soa == nil {
 		if yeti_soa != nil {
@@ -460,34 +1160,171 @@ func compare_soa(iana_soa *dns.SOA, yeti_soa *dns.SOA) (diffs []string) {
 	return diffs
 }
 
-func compare_resp(iana *dns.Msg, yeti *dns.Msg) (diffs []string) {
-	if iana.Response != yeti.Response {
+// how we compare the IANA and Yeti answers
+type compare_conf struct {
+	// only compare the rcode, ignoring flags and sections
+	rcode_only bool
+	// compare the name in the question, which we only do if the Yeti
+	// query used the same name, rather than an obfuscated one
+	compare_qname bool
+	// compare what the RRSIG records sign, rather than ignoring them
+	dnssec bool
+	// ignore TTL differences of up to this many seconds
+	ttl_tolerance uint32
+	// only compare the records that make up a negative answer in the
+	// authority section, when both answers are negative
+	lenient_authority bool
+}
+
+// If the TTLs of an IANA and a Yeti record differ by no more than the
+// tolerance, get a copy of the Yeti record with the IANA TTL, so that
+// comparing them ignores the difference. Otherwise get the Yeti record.
+func tolerate_ttl(iana_rr dns.RR, yeti_rr dns.RR, ccfg *compare_conf) dns.RR {
+	iana_ttl := iana_rr.Header().Ttl
+	yeti_ttl := yeti_rr.Header().Ttl
+	if (ccfg.ttl_tolerance == 0) || (iana_ttl == yeti_ttl) {
+		return yeti_rr
+	}
+	diff := iana_ttl - yeti_ttl
+	if yeti_ttl > iana_ttl {
+		diff = yeti_ttl - iana_ttl
+	}
+	if diff > ccfg.ttl_tolerance {
+		return yeti_rr
+	}
+	yeti_rr = dns.Copy(yeti_rr)
+	yeti_rr.Header().Ttl = iana_ttl
+	return yeti_rr
+}
+
+// Compare the questions in the answers. The type and class must always
+// match, but the name only when we did not obfuscate it.
+func compare_question(iana dns.Question, yeti dns.Question, ccfg *compare_conf) (diffs []string) {
+	if ccfg.compare_qname && !strings.EqualFold(iana.Name, yeti.Name) {
 		diffs = append(diffs,
-			fmt.Sprintf("Response flag mismatch: IANA %s vs Yeti %s", iana.Response, yeti.Response))
+			fmt.Sprintf("Question name mismatch: IANA %s vs Yeti %s", iana.Name, yeti.Name))
 	}
-	if iana.Opcode != yeti.Opcode {
+	if iana.Qtype != yeti.Qtype {
 		diffs = append(diffs,
-			fmt.Sprintf("Opcode mismatch: IANA %s vs Yeti %s",
-				dns.OpcodeToString[iana.Opcode], dns.OpcodeToString[yeti.Opcode]))
+			fmt.Sprintf("Question type mismatch: IANA %s vs Yeti %s",
+				dns.Type(iana.Qtype), dns.Type(yeti.Qtype)))
 	}
-	if iana.Authoritative != yeti.Authoritative {
+	if iana.Qclass != yeti.Qclass {
 		diffs = append(diffs,
-			fmt.Sprintf("Authoritative flag mismatch: IANA %t vs Yeti %t",
-				iana.Authoritative, yeti.Authoritative))
+			fmt.Sprintf("Question class mismatch: IANA %s vs Yeti %s",
+				dns.Class(iana.Qclass), dns.Class(yeti.Qclass)))
 	}
-	// truncated... hmmm...
-	if iana.RecursionDesired != yeti.RecursionDesired {
-		diffs = append(diffs,
-			fmt.Sprintf("Recursion desired flag mismatch: IANA %t vs Yeti %t",
-				iana.RecursionDesired, yeti.RecursionDesired))
+	return diffs
+}
+
+// Count the records in a section that we compare, which leaves out the
+// OPT pseudo-RR and, unless asked to compare them, signatures.
+func section_count(rrs []dns.RR, ccfg *compare_conf) (count int) {
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if (rrtype == dns.TypeOPT) || ((rrtype == dns.TypeRRSIG) && !ccfg.dnssec) {
+			continue
+		}
+		count++
 	}
-	if iana.RecursionAvailable != yeti.RecursionAvailable {
-		diffs = append(diffs,
-			fmt.Sprintf("Recursion available flag mismatch: IANA %t vs Yeti %t",
-				strconv.FormatBool(iana.RecursionAvailable), strconv.FormatBool(yeti.RecursionAvailable)))
+	return count
+}
+
+// Describe the difference in the number of records in a section, or
+// return "" if there is none. Comparing the counts is cheap, and a
+// difference is a quick sign that records are missing.
+func compare_section_count(section string, iana []dns.RR, yeti []dns.RR, ccfg *compare_conf) string {
+	iana_count := section_count(iana, ccfg)
+	yeti_count := section_count(yeti, ccfg)
+	if iana_count == yeti_count {
+		return ""
 	}
-	if iana.AuthenticatedData != yeti.AuthenticatedData {
-		diffs = append(diffs,
+	return fmt.Sprintf("%s section count mismatch: IANA %d vs Yeti %d", section, iana_count, yeti_count)
+}
+
+/*
+   A negative answer, either NXDOMAIN or NODATA, is made up of the SOA in
+   the authority section, along with any NSEC or NSEC3 records proving
+   it and the signatures of these. Some servers add other records there,
+   like the NS records of the zone, which a server using minimal
+   responses leaves out. These don't change what the answer means, so
+   with -lenient-authority they are ignored when both answers are
+   negative.
+*/
+func is_negative_answer(msg *dns.Msg) bool {
+	if (msg.Rcode != dns.RcodeNameError) && ((msg.Rcode != dns.RcodeSuccess) || (len(msg.Answer) > 0)) {
+		return false
+	}
+	// a referral has no answer either, but also no SOA
+	for _, rr := range msg.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the records of an authority section that make up a negative answer.
+func negative_authority(rrs []dns.RR) []dns.RR {
+	negative := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrsig, is_rrsig := rr.(*dns.RRSIG); is_rrsig {
+			rrtype = rrsig.TypeCovered
+		}
+		if (rrtype == dns.TypeSOA) || (rrtype == dns.TypeNSEC) || (rrtype == dns.TypeNSEC3) {
+			negative = append(negative, rr)
+		}
+	}
+	return negative
+}
+
+// Compare the IANA and Yeti answers. Use the result's Diffs() or String()
+// for a description of each difference.
+func compare_resp(iana *dns.Msg, yeti *dns.Msg, ccfg *compare_conf) *ComparisonResult {
+	result := new(ComparisonResult)
+	// without a question we don't know what the answers are for
+	if (len(iana.Question) == 0) || (len(yeti.Question) == 0) {
+		result.NoQuestion = true
+		return result
+	}
+	if iana.Rcode != yeti.Rcode {
+		result.Rcode = fmt.Sprintf("Rcode mismatch: IANA %s vs Yeti %s",
+			dns.RcodeToString[iana.Rcode], dns.RcodeToString[yeti.Rcode])
+		result.ServerError = is_server_error(yeti.Rcode) && !is_error_rcode(iana.Rcode)
+	}
+	// in rcode-only mode nothing else matters
+	if ccfg.rcode_only {
+		return result
+	}
+	result.Question = compare_question(iana.Question[0], yeti.Question[0], ccfg)
+	if iana.Response != yeti.Response {
+		result.Flags = append(result.Flags,
+			fmt.Sprintf("Response flag mismatch: IANA %s vs Yeti %s", iana.Response, yeti.Response))
+	}
+	if iana.Opcode != yeti.Opcode {
+		result.Flags = append(result.Flags,
+			fmt.Sprintf("Opcode mismatch: IANA %s vs Yeti %s",
+				dns.OpcodeToString[iana.Opcode], dns.OpcodeToString[yeti.Opcode]))
+	}
+	if iana.Authoritative != yeti.Authoritative {
+		result.Flags = append(result.Flags,
+			fmt.Sprintf("Authoritative flag mismatch: IANA %t vs Yeti %t",
+				iana.Authoritative, yeti.Authoritative))
+	}
+	// truncated... hmmm...
+	if iana.RecursionDesired != yeti.RecursionDesired {
+		result.Flags = append(result.Flags,
+			fmt.Sprintf("Recursion desired flag mismatch: IANA %t vs Yeti %t",
+				iana.RecursionDesired, yeti.RecursionDesired))
+	}
+	if iana.RecursionAvailable != yeti.RecursionAvailable {
+		result.Flags = append(result.Flags,
+			fmt.Sprintf("Recursion available flag mismatch: IANA %t vs Yeti %t",
+				strconv.FormatBool(iana.RecursionAvailable), strconv.FormatBool(yeti.RecursionAvailable)))
+	}
+	if iana.AuthenticatedData != yeti.AuthenticatedData {
+		result.Flags = append(result.Flags,
 			fmt.Sprintf("Authenticated data flag mismatch: IANA %t vs Yeti %t",
 				iana.AuthenticatedData, yeti.AuthenticatedData))
 	}
@@ -499,59 +1336,110 @@ func compare_resp(iana *dns.Msg, yeti *dns.Msg) (diffs []string) {
 			equivalent = false
 		}
 	*/
-	if iana.Rcode != yeti.Rcode {
-		diffs = append(diffs,
-			fmt.Sprintf("Rcode mismatch: IANA %s vs Yeti %s",
-				dns.RcodeToString[iana.Rcode], dns.RcodeToString[yeti.Rcode]))
+	// the additional section only compares the RRsets in both answers,
+	// so its count is not compared
+	iana_ns, yeti_ns := iana.Ns, yeti.Ns
+	if ccfg.lenient_authority && is_negative_answer(iana) && is_negative_answer(yeti) {
+		iana_ns = negative_authority(iana.Ns)
+		yeti_ns = negative_authority(yeti.Ns)
+	}
+	var denial_diff string
+	if ccfg.dnssec && is_negative_answer(iana) && is_negative_answer(yeti) {
+		iana_proof := denial_proof(iana.Question[0].Name, iana.Question[0].Qtype, iana_ns)
+		yeti_proof := denial_proof(yeti.Question[0].Name, yeti.Question[0].Qtype, yeti_ns)
+		if (iana_proof != "") && (iana_proof == yeti_proof) {
+			iana_ns = without_denial(iana_ns)
+			yeti_ns = without_denial(yeti_ns)
+		} else if iana_proof != yeti_proof {
+			denial_diff = fmt.Sprintf("Denial of existence mismatch: IANA proves %s vs Yeti proves %s",
+				proof_or_nothing(iana_proof), proof_or_nothing(yeti_proof))
+		}
 	}
+	result.Answer.Count = compare_section_count("Answer", iana.Answer, yeti.Answer, ccfg)
+	result.Authority.Count = compare_section_count("Authority", iana_ns, yeti_ns, ccfg)
 	sort.Sort(rr_sort(iana.Answer))
 	sort.Sort(rr_sort(yeti.Answer))
-	iana_only, yeti_only, iana_root_soa, yeti_root_soa := compare_section(iana.Answer, yeti.Answer)
-	if (len(iana_only) > 0) || (len(yeti_only) > 0) {
-		if len(iana_only) > 0 {
-			for _, rr := range iana_only {
-				diffs = append(diffs, fmt.Sprintf("Answer section, IANA only: %s", rr))
-			}
-		}
-		if len(yeti_only) > 0 {
-			for _, rr := range yeti_only {
-				diffs = append(diffs, fmt.Sprintf("Answer section, Yeti only: %s", rr))
-			}
-		}
-	}
-	diffs = append(diffs, compare_soa(iana_root_soa, yeti_root_soa)...)
-	sort.Sort(rr_sort(iana.Ns))
-	sort.Sort(rr_sort(yeti.Ns))
-	iana_only, yeti_only, iana_root_soa, yeti_root_soa = compare_section(iana.Ns, yeti.Ns)
-	if (len(iana_only) > 0) || (len(yeti_only) > 0) {
-		if len(iana_only) > 0 {
-			for _, rr := range iana_only {
-				diffs = append(diffs, fmt.Sprintf("Authority section, IANA only: %s", rr))
-			}
-		}
-		if len(yeti_only) > 0 {
-			for _, rr := range yeti_only {
-				diffs = append(diffs, fmt.Sprintf("Authority section, Yeti only: %s", rr))
-			}
-		}
-	}
-	diffs = append(diffs, compare_soa(iana_root_soa, yeti_root_soa)...)
+	iana_only, yeti_only, iana_root_soa, yeti_root_soa := compare_section(iana.Answer, yeti.Answer, ccfg)
+	result.Answer.set(iana_only, yeti_only)
+	result.Answer.Repeats = compare_section_repeats("Answer", iana.Answer, yeti.Answer, iana_only, yeti_only, ccfg)
+	result.Answer.Soa = compare_soa(iana_root_soa, yeti_root_soa)
+	sort.Sort(rr_sort(iana_ns))
+	sort.Sort(rr_sort(yeti_ns))
+	iana_only, yeti_only, iana_root_soa, yeti_root_soa = compare_section(iana_ns, yeti_ns, ccfg)
+	result.Authority.set(iana_only, yeti_only)
+	result.Authority.Repeats = compare_section_repeats("Authority", iana_ns, yeti_ns, iana_only, yeti_only, ccfg)
+	result.Authority.Denial = compare_denial(iana_only, yeti_only)
+	if denial_diff != "" {
+		result.Authority.Denial = append([]string{denial_diff}, result.Authority.Denial...)
+	}
+	result.Authority.Soa = compare_soa(iana_root_soa, yeti_root_soa)
 	sort.Sort(rr_sort(iana.Extra))
 	sort.Sort(rr_sort(yeti.Extra))
-	iana_only, yeti_only = compare_additional(iana.Extra, yeti.Extra)
-	if (len(iana_only) > 0) || (len(yeti_only) > 0) {
-		if len(iana_only) > 0 {
-			for _, rr := range iana_only {
-				diffs = append(diffs, fmt.Sprintf("Additional section, IANA mismatch: %s", rr))
+	iana_only, yeti_only = compare_additional(iana.Extra, yeti.Extra, ccfg)
+	result.Additional.set(iana_only, yeti_only)
+
+	return result
+}
+
+// Show the complete IANA and Yeti answers, for when the differences
+// alone are not enough to understand what happened.
+func full_messages(iana *dns.Msg, yeti *dns.Msg) string {
+	return "---[ IANA ]---\n" + strings.TrimRight(iana.String(), "\n") + "\n" +
+		"---[ Yeti ]---\n" + strings.TrimRight(yeti.String(), "\n")
+}
+
+/*
+   The effective cache TTL of a response is how long a resolver would
+   keep it. For a positive answer this is the minimum TTL of the answer
+   section. For a negative answer, RFC 2308 says to use the minimum of
+   the SOA TTL and the SOA MINIMUM field from the authority section.
+
+   Responses without an answer or an SOA are not cached at all, so we
+   return ok=false for them.
+*/
+func effective_cache_ttl(msg *dns.Msg) (ttl uint32, ok bool) {
+	if (msg.Rcode == dns.RcodeSuccess) && (len(msg.Answer) > 0) {
+		for n, rr := range msg.Answer {
+			if (n == 0) || (rr.Header().Ttl < ttl) {
+				ttl = rr.Header().Ttl
 			}
 		}
-		if len(yeti_only) > 0 {
-			for _, rr := range yeti_only {
-				diffs = append(diffs, fmt.Sprintf("Additional section, Yeti mismatch: %s", rr))
+		return ttl, true
+	}
+	for _, rr := range msg.Ns {
+		soa, is_soa := rr.(*dns.SOA)
+		if is_soa {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
 			}
+			return ttl, true
 		}
 	}
+	return 0, false
+}
 
+// Report when the IANA and Yeti answers would be cached for durations
+// that differ by at least min_delta seconds.
+func compare_cache_ttl(iana *dns.Msg, yeti *dns.Msg, min_delta uint32) (diffs []string) {
+	iana_ttl, iana_ok := effective_cache_ttl(iana)
+	yeti_ttl, yeti_ok := effective_cache_ttl(yeti)
+	if iana_ok != yeti_ok {
+		diffs = append(diffs,
+			fmt.Sprintf("Cacheable mismatch: IANA %t vs Yeti %t", iana_ok, yeti_ok))
+		return diffs
+	}
+	var delta uint32
+	if iana_ttl > yeti_ttl {
+		delta = iana_ttl - yeti_ttl
+	} else {
+		delta = yeti_ttl - iana_ttl
+	}
+	if (delta > 0) && (delta >= min_delta) {
+		diffs = append(diffs,
+			fmt.Sprintf("Effective cache TTL mismatch: IANA %d vs Yeti %d (delta %d)",
+				iana_ttl, yeti_ttl, delta))
+	}
 	return diffs
 }
 
@@ -573,98 +1461,931 @@ func compare_resp(iana *dns.Msg, yeti *dns.Msg) (diffs []string) {
 
 var obfuscate_secret []byte
 
-func obfuscate_query(qname_in string) (qname_out string) {
-	// split into labels
-	labels := strings.FieldsFunc(qname_in, func(r rune) bool { return r == '.' })
+// protects obfuscate_secret, which is set the first time it is needed
+var obfuscate_secret_lock sync.Mutex
 
-	// if we only have a TLD or root, then we need to leave the query alone
-	if len(labels) < 2 {
-		return strings.ToLower(strings.Join(labels, ".")) + "."
+// Get the obfuscation secret, generating a random one if there is none.
+// This is called from many goroutines at once, and every one of them
+// needs to get the same secret.
+func get_obfuscate_secret() []byte {
+	obfuscate_secret_lock.Lock()
+	defer obfuscate_secret_lock.Unlock()
+	if obfuscate_secret == nil {
+		var err error
+		obfuscate_secret, err = generate_secret()
+		if err != nil {
+			glog.Fatal(err)
+		}
 	}
+	return obfuscate_secret
+}
 
-	// check to see if we have an obfuscation secret, and populate if not
-	if obfuscate_secret == nil {
-		obfuscate_secret = make([]byte, 8, 8)
-		nread, err := rand.Read(obfuscate_secret)
+// number of hex characters of the hash to use in the obfuscated label
+var obfuscate_hash_len = 16
+
+// most hex characters of the hash to use, the longest whole number of
+// bytes of the hash that fits in a label
+const MAX_HASH_LEN = 62
+
+// Make sure that a number of hex characters for the -hash-len flag is a
+// whole number of bytes of the SHA-256 hash, and fits in a label.
+func check_hash_len(hash_len int) error {
+	if (hash_len < 2) || (hash_len > MAX_HASH_LEN) || (hash_len%2 != 0) {
+		return fmt.Errorf("hash length %d must be an even number from 2 to %d", hash_len, MAX_HASH_LEN)
+	}
+	return nil
+}
+
+// allowed ways to hash the names we obfuscate
+var obfuscate_modes = map[string]bool{
+	"hash": true, // SHA-256 of the secret followed by the name
+	"hmac": true, // HMAC-SHA-256 of the name, keyed with the secret
+}
+
+// how to hash the names we obfuscate, one of obfuscate_modes
+var obfuscate_mode = "hash"
+
+// number of rightmost labels of a query name to leave in the clear
+var obfuscate_keep_labels = 1
+
+// TLDs whose names are not obfuscated at all, in lower case without dots
+var obfuscate_clear_tlds map[string]bool
+
+// Parse a comma-separated list of TLDs to leave in the clear, like
+// "test,example.".
+func parse_clear_tlds(list string) (map[string]bool, error) {
+	tlds := make(map[string]bool)
+	for _, tld := range strings.Split(list, ",") {
+		tld = strings.ToLower(strings.Trim(strings.TrimSpace(tld), "."))
+		if (tld == "") || strings.Contains(tld, ".") {
+			return nil, fmt.Errorf("Bad TLD '%s' in '%s'", tld, list)
+		}
+		tlds[tld] = true
+	}
+	return tlds, nil
+}
+
+// DNS limits on names, see RFC 1035 section 2.3.4
+const MAX_LABEL_LEN = 63
+const MAX_NAME_LEN = 255
+
+// Make sure that a name fits within the DNS limits on label and name
+// length, so that we never send a query that the server must reject.
+func check_name_limits(name string) error {
+	// the wire format has a length octet per label plus the root label
+	wire_len := 1
+	for _, label := range dns.SplitDomainName(name) {
+		if len(label) > MAX_LABEL_LEN {
+			return fmt.Errorf("label '%s' is %d octets, maximum is %d",
+				label, len(label), MAX_LABEL_LEN)
+		}
+		wire_len += len(label) + 1
+	}
+	if wire_len > MAX_NAME_LEN {
+		return fmt.Errorf("name is %d octets, maximum is %d", wire_len, MAX_NAME_LEN)
+	}
+	return nil
+}
+
+// Check that a query name is one that we can obfuscate. A name with an
+// empty label, like "example..com.", can't be sent as it is, and would
+// otherwise be obfuscated the same as "example.com.".
+func check_query_name(name string) error {
+	for _, label := range dns.SplitDomainName(name) {
+		if label == "" {
+			return fmt.Errorf("name '%s' has an empty label", name)
+		}
+	}
+	return check_name_limits(name)
+}
+
+// Obfuscate a query name, making sure that both the name we get and the
+// one we make are legal DNS names.
+func obfuscate_name(qname_in string) (qname_out string, err error) {
+	err = check_query_name(qname_in)
+	if err != nil {
+		return "", err
+	}
+	qname_out = obfuscate_query(qname_in)
+	err = check_name_limits(qname_out)
+	if err != nil {
+		return "", fmt.Errorf("obfuscated name %s is invalid: %s", qname_out, err)
+	}
+	return qname_out, nil
+}
+
+// Generate a random obfuscation secret.
+func generate_secret() ([]byte, error) {
+	secret := make([]byte, 8, 8)
+	nread, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating random obfuscation secret: %s", err)
+	}
+	if nread != 8 {
+		return nil, fmt.Errorf("Read %d bytes for random obfuscation secret, wanted 8", nread)
+	}
+	glog.Infof("generated random obfuscation secret %s", strings.ToUpper(hex.EncodeToString(secret)))
+	return secret, nil
+}
+
+/*
+   Load the obfuscation secret from a file. If the file does not exist,
+   generate a new secret and save it in the file so that later runs (or
+   other machines) can use the same secret. The file contains the secret
+   hex-encoded, the same as the -s flag.
+*/
+func load_or_create_secret(fname string) (secret []byte, created bool, err error) {
+	contents, err := os.ReadFile(fname)
+	if err == nil {
+		secret, err = hex.DecodeString(strings.TrimSpace(string(contents)))
 		if err != nil {
-			glog.Fatalf("Error generating random obfuscation secret: %s", err)
+			return nil, false, fmt.Errorf("Error decoding secret in '%s': %s", fname, err)
 		}
-		if nread != 8 {
-			glog.Fatalf("Read %d bytes for random obfuscation secret, wanted 8", nread)
+		if len(secret) == 0 {
+			return nil, false, fmt.Errorf("No secret in '%s'", fname)
 		}
-		hex_output := make([]byte, 16, 16)
-		hex.Encode(hex_output, obfuscate_secret)
-		glog.Infof("generated random obfuscation secret %s", strings.ToUpper(string(hex_output)))
+		return secret, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	secret, err = generate_secret()
+	if err != nil {
+		return nil, false, err
+	}
+	// only the owner should be able to read the secret
+	err = os.WriteFile(fname, []byte(strings.ToUpper(hex.EncodeToString(secret))+"\n"), 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	return secret, true, nil
+}
+
+// Obfuscate a query name, keeping the rightmost obfuscate_keep_labels
+// labels. The hashed label is the first obfuscate_hash_len hex characters
+// of the SHA-256 of the secret followed by all of the labels, in lower
+// case and joined with '.', without the final '.'. In "hmac" mode it is
+// the HMAC-SHA-256 of the labels instead, with the secret as the key. So
+// the same secret always gives the same name; TestObfuscateQueryFixed
+// makes sure of it.
+func obfuscate_query(qname_in string) (qname_out string) {
+	// split into labels, where an escaped '.' is part of a label
+	labels := dns.SplitDomainName(qname_in)
+
+	// if we only have the labels we keep, then we need to leave the query alone
+	if len(labels) <= obfuscate_keep_labels {
+		return strings.ToLower(strings.Join(labels, ".")) + "."
+	}
+
+	// names in TLDs that we leave in the clear are sent as they are
+	if obfuscate_clear_tlds[strings.ToLower(labels[len(labels)-1])] {
+		return strings.Join(labels, ".") + "."
+	}
+
+	// use a new slice for the hash input, since appending to the secret
+	// could write to memory that other goroutines are reading
+	secret := get_obfuscate_secret()
+	name := []byte(strings.ToLower(strings.Join(labels, ".")))
+	var hashed []byte
+	if obfuscate_mode == "hmac" {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(name)
+		hashed = mac.Sum(nil)
+	} else {
+		hash_input := make([]byte, 0, len(secret)+len(name))
+		hash_input = append(hash_input, secret...)
+		hash_input = append(hash_input, name...)
+		sum := sha256.Sum256(hash_input)
+		hashed = sum[:]
 	}
-	hash_input := append(obfuscate_secret, []byte(strings.ToLower(strings.Join(labels, ".")))...)
-	hashed := sha256.Sum256(hash_input)
 	hashed_hex := make([]byte, 64, 64)
-	hex.Encode(hashed_hex, hashed[:])
-	qname_out = "ymmv." + string(hashed_hex[0:16]) + "."
-	qname_out += strings.ToLower(strings.Join(labels[len(labels)-1:len(labels)], ".")) + "."
+	hex.Encode(hashed_hex, hashed)
+	qname_out = "ymmv." + string(hashed_hex[0:obfuscate_hash_len]) + "."
+	qname_out += strings.ToLower(strings.Join(labels[len(labels)-obfuscate_keep_labels:], ".")) + "."
 
 	glog.V(2).Infof("obfuscated %s to %s", qname_in, qname_out)
 	return qname_out
 }
 
 // If the DNS message already has an OPT record, change the values for UDP buffer size.
-// If the DNS message does not already have an OPT record, add one (with DO=0).
-func SetOrChangeUDPSize(msg *dns.Msg, udpsize uint16) *dns.Msg {
+// If the DNS message does not already have an OPT record, add one.
+// The DO bit is set as the do_mode says, one of do_modes. In "capture"
+// mode an existing OPT record keeps its DO bit, and a new one has DO=0,
+// since a message without an OPT record has no DO bit.
+func SetOrChangeUDPSize(msg *dns.Msg, udpsize uint16, do_mode string) *dns.Msg {
 	e := msg.IsEdns0()
 	if e == nil {
-		msg.SetEdns0(udpsize, false)
+		msg.SetEdns0(udpsize, do_mode == "on")
 	} else {
 		e.SetUDPSize(udpsize)
+		SetDoBit(msg, do_mode)
 	}
 	return msg
 }
 
+// Set the DO bit of a DNS message as the do_mode says, one of do_modes.
+// Setting it on a message without an OPT record adds one, with the
+// default UDP buffer size.
+func SetDoBit(msg *dns.Msg, do_mode string) *dns.Msg {
+	if (do_mode != "on") && (do_mode != "off") {
+		return msg
+	}
+	e := msg.IsEdns0()
+	if e == nil {
+		if do_mode == "on" {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+		}
+	} else {
+		e.SetDo(do_mode == "on")
+	}
+	return msg
+}
+
+// Remove any OPT pseudo-RR from a DNS message, so that it does not use EDNS.
+func StripEdns(msg *dns.Msg) *dns.Msg {
+	extra := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+	return msg
+}
+
+// EDNS option codes that the DNS library decodes into its own types;
+// anything else comes back to us as an EDNS0_LOCAL option
+var edns_known_opts = map[uint16]bool{
+	dns.EDNS0LLQ:         true,
+	dns.EDNS0UL:          true,
+	dns.EDNS0NSID:        true,
+	dns.EDNS0DAU:         true,
+	dns.EDNS0DHU:         true,
+	dns.EDNS0N3U:         true,
+	dns.EDNS0SUBNET:      true,
+	dns.EDNS0COOKIE:      true,
+	dns.EDNS0PADDING:     true,
+	dns.EDNS0SUBNETDRAFT: true,
+}
+
+// Parse an EDNS option in the form "code:hexdata", like "65001:cafe".
+// The data may be empty, like "65001:".
+func parse_edns_opt(s string) (*dns.EDNS0_LOCAL, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("EDNS option '%s' is not in code:hexdata format", s)
+	}
+	code, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad EDNS option code '%s': %s", parts[0], err)
+	}
+	if edns_known_opts[uint16(code)] {
+		return nil, fmt.Errorf("EDNS option code %d is a known option, use an unassigned or local-use code", code)
+	}
+	data, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad EDNS option data '%s': %s", parts[1], err)
+	}
+	return &dns.EDNS0_LOCAL{Code: uint16(code), Data: data}, nil
+}
+
+// Add an EDNS option to the DNS message, replacing any option with the
+// same code. If the DNS message does not have an OPT record, add one.
+func AddEdnsOption(msg *dns.Msg, opt *dns.EDNS0_LOCAL) *dns.Msg {
+	e := msg.IsEdns0()
+	if e == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		e = msg.IsEdns0()
+	}
+	options := make([]dns.EDNS0, 0, len(e.Option)+1)
+	for _, o := range e.Option {
+		if o.Option() != opt.Code {
+			options = append(options, o)
+		}
+	}
+	e.Option = append(options, &dns.EDNS0_LOCAL{Code: opt.Code, Data: opt.Data})
+	return msg
+}
+
+// Describe what a server did with an EDNS option that we sent it: either
+// "echoed" it back, "modified" it, "dropped" it, or returned an "error".
+func edns_opt_handling(sent *dns.EDNS0_LOCAL, resp *dns.Msg) string {
+	if (resp.Rcode != dns.RcodeSuccess) && (resp.Rcode != dns.RcodeNameError) {
+		return "error " + dns.RcodeToString[resp.Rcode]
+	}
+	e := resp.IsEdns0()
+	if e == nil {
+		return "dropped"
+	}
+	for _, o := range e.Option {
+		if o.Option() != sent.Code {
+			continue
+		}
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if ok && bytes.Equal(local.Data, sent.Data) {
+			return "echoed"
+		}
+		return "modified"
+	}
+	return "dropped"
+}
+
+// Compare how the IANA and Yeti servers handled an EDNS option. Note
+// that the IANA answer comes from the capture, so it reflects whatever
+// the original query carried.
+func compare_edns_opt(sent *dns.EDNS0_LOCAL, iana *dns.Msg, yeti *dns.Msg) (diffs []string) {
+	iana_handling := edns_opt_handling(sent, iana)
+	yeti_handling := edns_opt_handling(sent, yeti)
+	if iana_handling != yeti_handling {
+		diffs = append(diffs,
+			fmt.Sprintf("EDNS option %d handling mismatch: IANA %s vs Yeti %s",
+				sent.Code, iana_handling, yeti_handling))
+	}
+	return diffs
+}
+
+// how we send queries to the Yeti servers and compare the answers
+type query_conf struct {
+	// use the original query names, rather than obfuscating them
+	clear_names bool
+	// EDNS buffer size to use (0 means use the original query size)
+	edns_size uint16
+	// EDNS option to add to each query (may be nil)
+	edns_opt *dns.EDNS0_LOCAL
+	// compare effective cache TTLs, reporting differences this large
+	cache_ttl_check bool
+	cache_ttl_delta uint32
+	// how to set the checking disabled (CD) flag, one of cd_modes
+	cd_mode string
+	// how to set the DNSSEC OK (DO) bit, one of do_modes
+	do_mode string
+	// follow CNAME and DNAME redirections, comparing each step
+	follow_redirects bool
+	// expected NSID values for anycast instances (nil if not checking)
+	instances instance_map
+	// EDNS options in the answers to report on
+	edns_report edns_report
+	// DNS cookies to send to each server (nil to send none)
+	cookies *cookie_jar
+	// expected rcodes for query names (nil if not checking)
+	rcode_rules rcode_rules
+	// record the complete answers along with any differences
+	show_full bool
+	// write each comparison as JSON here (nil if not)
+	json_out *json_writer
+	// query each Yeti server again without EDNS and compare the answers
+	edns_compare bool
+	// how to count answers agreeing on an error, one of error_policies
+	error_policy string
+	// write each set of differences to its own file here (may be nil)
+	diff_dir *diff_dir
+	// write the packets of each mismatch here (may be nil)
+	dump_dir *dump_dir
+	// timeouts and such for sending queries
+	dns_opts dnsstub.DnsQueryOpts
+	// port (0 means 53) and options for live queries to the IANA side,
+	// which may be a local mirror
+	iana_port uint16
+	iana_opts dnsstub.DnsQueryOpts
+	// IANA root server to get a fresh answer from, instead of using the
+	// captured one (nil to use the capture)
+	iana_server net.IP
+	// how we compare the answers
+	compare compare_conf
+	// number of times to send a query again when the answer differs,
+	// to see whether the difference is only transient (0 for never)
+	recheck int
+	// the query types to compare, from -qtype (nil for all of them)
+	qtypes map[uint16]bool
+	// the query names to compare, from -name (nil for all of them)
+	names []name_pattern
+	// only log differences and errors, not each query sent or skipped
+	quiet bool
+	// write the queries we would send here, instead of sending them
+	// (nil to send them)
+	dry_run io.Writer
+	// limit on the rate of queries to the Yeti servers, shared by every
+	// comparison (nil for no limit)
+	limiter *rate.Limiter
+}
+
+// Wait until we may send another query to a Yeti server.
+func (qcfg *query_conf) wait_rate() {
+	if qcfg.limiter != nil {
+		qcfg.limiter.Wait(context.Background())
+	}
+}
+
+// Get a round-trip time in milliseconds, to one decimal place.
+func format_rtt(rtt time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(rtt)/float64(time.Millisecond))
+}
+
+// Describe the flags and EDNS settings of a query, like
+// "flags rd cd, EDNS size 4093 do".
+func query_summary(query *dns.Msg) string {
+	var flags []string
+	if query.RecursionDesired {
+		flags = append(flags, "rd")
+	}
+	if query.CheckingDisabled {
+		flags = append(flags, "cd")
+	}
+	if query.AuthenticatedData {
+		flags = append(flags, "ad")
+	}
+	summary := "flags " + strings.Join(flags, " ")
+	if len(flags) == 0 {
+		summary = "no flags"
+	}
+	opt := query.IsEdns0()
+	if opt == nil {
+		return summary + ", no EDNS"
+	}
+	summary += fmt.Sprintf(", EDNS size %d", opt.UDPSize())
+	if opt.Do() {
+		summary += " do"
+	}
+	for _, option := range opt.Option {
+		summary += fmt.Sprintf(" option %d", option.Option())
+	}
+	return summary
+}
+
+// Decide whether to log details of each query at the given verbosity,
+// which we never do in quiet mode.
+func (qcfg *query_conf) verbose(level glog.Level) bool {
+	return !qcfg.quiet && bool(glog.V(level))
+}
+
+// allowed ways to set the CD flag on our queries
+var cd_modes = map[string]bool{
+	"capture": true, // use the flag from the captured query
+	"on":      true,
+	"off":     true,
+}
+
+// allowed ways to set the DO bit on our queries
+var do_modes = map[string]bool{
+	"capture": true, // use the bit from the captured query
+	"on":      true,
+	"off":     true,
+}
+
+// function used to send queries to the Yeti servers, replaced in tests
+var dns_query = dnsstub.DnsQueryWithOpts
+
+/*
+   Some servers answer differently depending on whether a query uses
+   EDNS. To find these, we send the query again without EDNS to the same
+   Yeti server and compare the two answers, independent of IANA. In the
+   differences "IANA" is the answer with EDNS and "Yeti" the one without.
+*/
+func compare_edns_dependence(qcfg *query_conf, server string, query *dns.Msg, edns_resp *dns.Msg) (diffs []string) {
+	if query.IsEdns0() == nil {
+		return nil
+	}
+	plain_query := StripEdns(query.Copy())
+	qcfg.wait_rate()
+	plain_resp, _, err := dns_query(server, plain_query, &qcfg.dns_opts)
+	if err != nil {
+		return []string{fmt.Sprintf("Yeti without EDNS error: %s", err)}
+	}
+	for _, diff := range compare_resp(edns_resp.Copy(), plain_resp, &qcfg.compare).Diffs() {
+		diffs = append(diffs, "Yeti with vs without EDNS: "+diff)
+	}
+	return diffs
+}
+
+/*
+   The IANA answer comes from the capture, so its ID has nothing to do
+   with the ID of our query and the comparison ignores it. However the
+   answer from Yeti must have the ID that we sent; if not, it may be an
+   off-path attacker injecting answers, which we want to know about.
+*/
+func check_response_id(query *dns.Msg, resp *dns.Msg) (diffs []string) {
+	if resp.Id != query.Id {
+		glog.Warningf("Yeti answer for %s has ID %d, but query had ID %d",
+			query.Question[0].Name, resp.Id, query.Id)
+		diffs = append(diffs,
+			fmt.Sprintf("Yeti response ID mismatch, possible spoofed answer: sent %d vs got %d",
+				query.Id, resp.Id))
+	}
+	return diffs
+}
+
+// address to send DNS queries to for an IP
+func server_addr(ip net.IP, port uint16) string {
+	if port == 0 {
+		port = 53
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// address to send live DNS queries to for an IANA-side IP
+func (qcfg *query_conf) iana_addr(ip net.IP) string {
+	return server_addr(ip, qcfg.iana_port)
+}
+
+// maximum number of CNAME or DNAME redirections we follow
+const MAX_REDIRECTS = 8
+
+// Find where a response redirects a query name to, either via a CNAME
+// for the name, or a DNAME for one of the ancestors of the name.
+func redirect_target(resp *dns.Msg, qname string) (target string, ok bool) {
+	qname = strings.ToLower(qname)
+	for _, rr := range resp.Answer {
+		cname, is_cname := rr.(*dns.CNAME)
+		if is_cname && (strings.ToLower(cname.Hdr.Name) == qname) {
+			return cname.Target, true
+		}
+	}
+	for _, rr := range resp.Answer {
+		dname, is_dname := rr.(*dns.DNAME)
+		if !is_dname {
+			continue
+		}
+		owner := strings.ToLower(dname.Hdr.Name)
+		if (owner != qname) && dns.IsSubDomain(owner, qname) {
+			prefix := qname[:len(qname)-len(owner)]
+			if owner == "." {
+				prefix = qname
+			}
+			return prefix + dname.Target, true
+		}
+	}
+	return "", false
+}
+
+/*
+   Follow CNAME and DNAME redirections in the answers, sending the
+   follow-up query to both the IANA server that originally answered and
+   to the Yeti server, and comparing the answers at each step.
+
+   The name in each follow-up query comes from the answer on that side,
+   so this works best with clear query names. If neither side answers a
+   follow-up query, both_error is set, since that is not agreement.
+*/
+func follow_redirects(qcfg *query_conf, iana_server string, yeti_server string,
+	query *dns.Msg, iana_resp *dns.Msg, yeti_resp *dns.Msg) (diffs []string, both_error bool) {
+	iana_qname := query.Question[0].Name
+	yeti_qname := query.Question[0].Name
+	for step := 1; step <= MAX_REDIRECTS; step++ {
+		iana_target, iana_ok := redirect_target(iana_resp, iana_qname)
+		yeti_target, yeti_ok := redirect_target(yeti_resp, yeti_qname)
+		if !iana_ok && !yeti_ok {
+			return diffs, false
+		}
+		if iana_ok != yeti_ok {
+			diffs = append(diffs,
+				fmt.Sprintf("Redirection step %d mismatch: IANA to '%s' vs Yeti to '%s'",
+					step, iana_target, yeti_target))
+			return diffs, false
+		}
+		glog.V(1).Infof("following redirection step %d, IANA to %s, Yeti to %s",
+			step, iana_target, yeti_target)
+		iana_qname = iana_target
+		iana_followup := query.Copy()
+		iana_followup.Question[0].Name = iana_target
+		var iana_err, yeti_err error
+		iana_resp, _, iana_err = dns_query(iana_server, iana_followup, &qcfg.iana_opts)
+		yeti_qname = yeti_target
+		yeti_followup := query.Copy()
+		yeti_followup.Question[0].Name = yeti_target
+		qcfg.wait_rate()
+		yeti_resp, _, yeti_err = dns_query(yeti_server, yeti_followup, &qcfg.dns_opts)
+		// if neither side answers there is nothing to compare
+		if classify_outcome(iana_err, yeti_err, nil) == outcome_both_error {
+			glog.Infof("Redirection step %d, both IANA and Yeti unreachable for %s; %s; %s",
+				step, iana_target, iana_err, yeti_err)
+			return diffs, true
+		}
+		if iana_err != nil {
+			diffs = append(diffs,
+				fmt.Sprintf("Redirection step %d error querying IANA for %s: %s", step, iana_target, iana_err))
+			return diffs, false
+		}
+		if yeti_err != nil {
+			diffs = append(diffs,
+				fmt.Sprintf("Redirection step %d error querying Yeti for %s: %s", step, yeti_target, yeti_err))
+			return diffs, false
+		}
+		for _, diff := range compare_resp(iana_resp.Copy(), yeti_resp.Copy(), &qcfg.compare).Diffs() {
+			diffs = append(diffs, fmt.Sprintf("Redirection step %d (%s): %s", step, iana_target, diff))
+		}
+	}
+	diffs = append(diffs, fmt.Sprintf("Stopped following redirections after %d steps", MAX_REDIRECTS))
+	return diffs, false
+}
+
+/*
+   Compare the answers from IANA and a Yeti server, doing every check that
+   we are configured for, and get the comparison of the answers along
+   with every difference found. Comparing sorts the records of the
+   answers, and some checks send more queries to the server.
+*/
+func (qcfg *query_conf) compare_answers(org_qname string, target *query_target, server string,
+	iana_ip *net.IP, query *dns.Msg, iana_resp *dns.Msg, yeti_resp *dns.Msg) (*ComparisonResult, []string) {
+	diffs := check_response_id(query, yeti_resp)
+	result := compare_resp(iana_resp, yeti_resp, &qcfg.compare)
+	diffs = append(diffs, result.Diffs()...)
+	if qcfg.rcode_rules != nil {
+		diffs = append(diffs, check_expected_rcode(qcfg.rcode_rules, org_qname, iana_resp, yeti_resp)...)
+	}
+	// these checks look at the contents, which rcode-only mode ignores
+	if !qcfg.compare.rcode_only {
+		if qcfg.edns_opt != nil {
+			diffs = append(diffs, compare_edns_opt(qcfg.edns_opt, iana_resp, yeti_resp)...)
+		}
+		if qcfg.cache_ttl_check {
+			diffs = append(diffs, compare_cache_ttl(iana_resp, yeti_resp, qcfg.cache_ttl_delta)...)
+		}
+		ede_diffs, ede_notes := compare_ede_consistency(iana_resp, yeti_resp)
+		diffs = append(diffs, ede_diffs...)
+		for _, note := range ede_notes {
+			glog.Infof("Answers for %s from %s @ %s: %s\n", org_qname, target.ns_name, server, note)
+		}
+		diffs = append(diffs, qcfg.edns_report.check(target.ip, iana_resp, yeti_resp)...)
+	}
+	if qcfg.instances != nil {
+		diffs = append(diffs,
+			check_instance(qcfg.instances, target.ip, iana_ip, iana_resp, yeti_resp)...)
+	}
+	if qcfg.cookies != nil {
+		diffs = append(diffs, qcfg.cookies.check(target.ip, yeti_resp)...)
+	}
+	if qcfg.edns_compare {
+		diffs = append(diffs, compare_edns_dependence(qcfg, server, query, yeti_resp)...)
+	}
+	if qcfg.follow_redirects && !in_address_family(qcfg.iana_opts.Family, *iana_ip) {
+		glog.V(1).Infof("Not following redirections for %s, IANA address %s is not IPv%d\n",
+			org_qname, *iana_ip, qcfg.iana_opts.Family)
+	} else if qcfg.follow_redirects {
+		redirect_diffs, both_error := follow_redirects(qcfg, qcfg.iana_addr(*iana_ip), server,
+			query, iana_resp, yeti_resp)
+		diffs = append(diffs, redirect_diffs...)
+		result.BothError = both_error
+	}
+	return result, diffs
+}
+
+// function used to wait before sending a query again, replaced in tests
+var recheck_sleep = time.Sleep
+
+// time to wait before each recheck, so that a change in progress can finish
+const recheck_delay = 2 * time.Second
+
+/*
+   Some differences are transient, like when a zone is part way through
+   being transferred to the Yeti server. With -recheck, when an answer
+   differs we send the same query to the same server again, up to the
+   given number of times, after a short delay each time. If any of the
+   answers agrees with IANA, this returns the number of the recheck that
+   did, and the difference is only transient. Otherwise this returns 0.
+*/
+func (qcfg *query_conf) recheck_mismatch(org_qname string, target *query_target, server string,
+	iana_ip *net.IP, query *dns.Msg, iana_resp *dns.Msg) int {
+	for n := 1; n <= qcfg.recheck; n++ {
+		recheck_sleep(recheck_delay)
+		// sending the query sets its ID, so use a copy
+		query := query.Copy()
+		qcfg.wait_rate()
+		yeti_resp, _, err := dns_query(server, query, &qcfg.dns_opts)
+		metric_server_queries.WithLabelValues(target.ip.String()).Inc()
+		progress.add_query()
+		if (err == dns.ErrId) && (yeti_resp != nil) {
+			err = nil
+		}
+		if err != nil {
+			glog.Infof("Error rechecking Yeti root server %s @ %s; %s\n", target.ns_name, server, err)
+			continue
+		}
+		_, diffs := qcfg.compare_answers(org_qname, target, server, iana_ip, query, iana_resp.Copy(), yeti_resp)
+		if len(diffs) == 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// Make the query to send for a captured query, using the given name,
+// which may be obfuscated. The query keeps the RD, CD, AD, and DO bits of
+// the captured query, unless we are told to set them.
+func (qcfg *query_conf) make_query(iana_query *dns.Msg, qname string) *dns.Msg {
+	query := iana_query.Copy()
+	// convert to our obfuscated name
+	query.Question[0].Name = qname
+	// set our EDNS buffer size to a magic number, and the DO bit
+	if qcfg.edns_size != 0 {
+		SetOrChangeUDPSize(query, qcfg.edns_size, qcfg.do_mode)
+	} else {
+		SetDoBit(query, qcfg.do_mode)
+	}
+	// add any EDNS option we are testing
+	if qcfg.edns_opt != nil {
+		AddEdnsOption(query, qcfg.edns_opt)
+	}
+	// ask which instance answers, if we are checking or reporting that
+	if (qcfg.instances != nil) || qcfg.edns_report.nsid {
+		AddNsidRequest(query)
+	}
+	// set the checking disabled flag, unless we use the captured one
+	if qcfg.cd_mode == "on" {
+		query.CheckingDisabled = true
+	} else if qcfg.cd_mode == "off" {
+		query.CheckingDisabled = false
+	}
+	return query
+}
+
+/*
+   A capture may be old, and the root zone changes over time, so a
+   difference may be between the capture and the current zone rather
+   than between IANA and Yeti. With -refresh-iana, we send each query to
+   a live IANA root server, given with -iana-server, and compare the Yeti
+   answers with that fresh answer instead of the captured one. The IANA
+   server gets the same query as the Yeti servers, including the same
+   obfuscated name.
+*/
+func (qcfg *query_conf) refresh_iana_answer(iana_query *dns.Msg, qname string) (*dns.Msg, time.Duration, error) {
+	query := qcfg.make_query(iana_query, qname)
+	return dns_query(qcfg.iana_addr(qcfg.iana_server), query, &qcfg.iana_opts)
+}
+
 func yeti_query(sync chan bool, report *report_conf, srvs *yeti_server_set,
-	clear_names bool, edns_size uint16, pf *daily_file, df *daily_file,
+	qcfg *query_conf, pf *daily_file, df *daily_file,
 	iana_query *dns.Msg, iana_resp *dns.Msg, iana_query_time time.Duration,
 	iana_ip *net.IP) {
-	org_qname := iana_query.Question[0].Name
-	qtype := dns.TypeToString[iana_query.Question[0].Qtype]
+	var org_qname, qtype string
+	if len(iana_query.Question) > 0 {
+		org_qname = iana_query.Question[0].Name
+		qtype = dns.TypeToString[iana_query.Question[0].Qtype]
+	}
 
 	// early exit if we are skipping this query
-	if skip_comparison(iana_query) {
-		glog.V(1).Infof("skipping query for %s %s", org_qname, qtype)
+	skip_reason := skip_comparison(iana_query)
+	if skip_reason != "" {
+		if qcfg.verbose(1) {
+			glog.Infof("skipping query for %s %s (%s)", org_qname, qtype, skip_reason)
+		}
+		srvs.record_skip(skip_reason)
+		sync <- true
+		return
+	}
+	// a fresh IANA answer does not need the captured one
+	if (qcfg.iana_server == nil) && missing_answer_data(iana_resp) {
+		if !qcfg.quiet {
+			glog.Warningf("skipping query for %s %s, capture missing answer data", org_qname, qtype)
+		}
+		srvs.record_skip(SKIP_NO_ANSWER)
 		sync <- true
 		return
 	}
 
 	var qname string
-	if clear_names {
+	if qcfg.clear_names {
 		qname = iana_query.Question[0].Name
 	} else {
-		qname = obfuscate_query(iana_query.Question[0].Name)
+		// an invalid name would be rejected and look like a Yeti difference
+		var err error
+		qname, err = obfuscate_name(iana_query.Question[0].Name)
+		if err != nil {
+			if !qcfg.quiet {
+				glog.Warningf("skipping query for %s %s, cannot obfuscate: %s", org_qname, qtype, err)
+			}
+			srvs.record_skip(SKIP_INVALID_NAME)
+			sync <- true
+			return
+		}
 	}
+	// use a fresh IANA answer rather than the captured one, if asked;
+	// if IANA does not answer we still ask Yeti, to know whether both
+	// sides are unreachable
+	var iana_err error
+	if (qcfg.iana_server != nil) && (qcfg.dry_run == nil) {
+		resp, rtt, err := qcfg.refresh_iana_answer(iana_query, qname)
+		if err != nil {
+			glog.Infof("Error querying IANA root server %s for %s %s; %s\n",
+				qcfg.iana_server, org_qname, qtype, err)
+			iana_err = err
+		} else {
+			if qcfg.verbose(1) {
+				glog.Infof("fresh IANA answer for '%s' %s from %s in %s\n",
+					org_qname, qtype, qcfg.iana_server, format_rtt(rtt))
+			}
+			iana_resp = resp
+			iana_query_time = rtt
+			iana_ip = &qcfg.iana_server
+		}
+	}
+	// answers to compare with each other, in quorum mode
+	var answers []yeti_answer
 	for _, target := range srvs.next() {
-		glog.V(2).Infof("using server selection %s @ %s", target.ns_name, target.ip)
-		server := "[" + target.ip.String() + "]:53"
-		glog.V(1).Infof("sending query '%s' %s as '%s' to %s @ %s\n",
-			org_qname, qtype, qname, target.ns_name, server)
-		// convert to our obfuscated name
-		iana_query.Question[0].Name = qname
-		// set our EDNS buffer size to a magic number
-		if edns_size != 0 {
-			SetOrChangeUDPSize(iana_query, edns_size)
+		server := srvs.server_addr(target.ip)
+		if qcfg.verbose(2) {
+			glog.Infof("using server selection %s @ %s", target.ns_name, target.ip)
+		}
+		if qcfg.verbose(1) {
+			glog.Infof("sending query '%s' %s as '%s' to %s @ %s\n",
+				org_qname, qtype, qname, target.ns_name, server)
+		}
+		// each target gets its own copy of the query, since we modify it
+		query := qcfg.make_query(iana_query, qname)
+		// send our DNS cookie, if we are exercising those
+		if qcfg.cookies != nil {
+			qcfg.cookies.add(query, target.ip)
+		}
+		// show what we would send, without sending it
+		if qcfg.dry_run != nil {
+			fmt.Fprintf(qcfg.dry_run, "dry run: '%s' %s as '%s' to %s @ %s, %s\n",
+				org_qname, qtype, qname, target.ns_name, server, query_summary(query))
+			continue
 		}
 		// do the actual query
-		yeti_resp, rtt, err := dnsstub.DnsQuery(server, iana_query)
+		qcfg.wait_rate()
+		yeti_resp, rtt, err := dns_query(server, query, &qcfg.dns_opts)
+		metric_server_queries.WithLabelValues(target.ip.String()).Inc()
+		progress.add_query()
+		// an answer with the wrong ID is still compared, and reported below
+		if (err == dns.ErrId) && (yeti_resp != nil) {
+			err = nil
+		}
 		if err != nil {
 			glog.Infof("Error querying Yeti root server %s @ %s; %s\n", target.ns_name, server, err)
 			// give a big penalty to our smoothed round-trip time (SRTT)
 			srvs.update_srtt(target.ip, time.Second/2)
+			srvs.record_outcome(target, classify_outcome(iana_err, err, nil))
+			qcfg.write_json(org_qname, qtype, target, rtt, nil, nil, err)
+		} else if iana_err != nil {
+			// without an IANA answer there is nothing to compare with
+			if srvs.quorum > 0 {
+				answers = append(answers, yeti_answer{target: target, resp: yeti_resp.Copy()})
+			}
+			srvs.record_outcome(target, classify_outcome(iana_err, nil, nil))
+			srvs.record_rtt(target, rtt)
+			srvs.update_srtt(target.ip, rtt)
+			qcfg.write_json(org_qname, qtype, target, rtt, nil, nil,
+				fmt.Errorf("no IANA answer: %s", iana_err))
 		} else {
 			var rolled bool = false
-			diffs := compare_resp(iana_resp, yeti_resp)
-			if len(diffs) > 0 {
-				glog.Infof("Differences in response for %s %s from %s @ %s\n",
-					org_qname, qtype, target.ns_name, server)
-				if df.write_diffs(org_qname, qtype, iana_ip, &target.ip, diffs) {
+			if srvs.quorum > 0 {
+				answers = append(answers, yeti_answer{target: target, resp: yeti_resp.Copy()})
+			}
+			// comparison sorts and modifies the answer, so use a copy
+			iana_resp := iana_resp.Copy()
+			if qcfg.verbose(1) {
+				glog.Infof("answer from %s @ %s in %s\n", target.ns_name, server, format_rtt(rtt))
+			}
+			result, diffs := qcfg.compare_answers(org_qname, target, server, iana_ip,
+				query, iana_resp, yeti_resp)
+			// see whether the differences go away if we ask again
+			if (len(diffs) > 0) && (qcfg.recheck > 0) {
+				recheck := qcfg.recheck_mismatch(org_qname, target, server, iana_ip, query, iana_resp)
+				if recheck > 0 {
+					glog.Infof("Transient differences in response for %s %s from %s @ %s, gone on recheck %d\n",
+						org_qname, qtype, target.ns_name, server, recheck)
+					result.Transient = true
+				}
+			}
+			// transient differences are logged, but are not a mismatch
+			if result.Transient {
+				srvs.record_outcome(target, outcome_transient)
+				record_comparison_metrics(result, nil)
+			} else if result.BothError && (len(diffs) == 0) {
+				// neither side answered a redirection, which is not agreement
+				srvs.record_outcome(target, outcome_both_error)
+				record_comparison_metrics(result, nil)
+			} else {
+				srvs.record_answers(target, qcfg.error_policy, yeti_resp, diffs, result.ServerError)
+				record_comparison_metrics(result, diffs)
+				srvs.record_mismatches(result, diffs)
+			}
+			srvs.record_udp_size(target, yeti_resp)
+			srvs.record_rtt(target, rtt)
+			qcfg.write_json(org_qname, qtype, target, rtt, result, diffs, nil)
+			if (len(diffs) > 0) && !result.Transient {
+				progress.add_mismatch()
+				glog.Infof("Differences in response for %s %s from %s @ %s, RTT %s\n",
+					org_qname, qtype, target.ns_name, server, format_rtt(rtt))
+				if qcfg.show_full {
+					diffs = append(diffs, full_messages(iana_resp, yeti_resp))
+				}
+				if (df != nil) && df.write_diffs(org_qname, qtype, iana_ip, &target.ip, diffs) {
 					rolled = true
 				}
+				if qcfg.diff_dir != nil {
+					err := qcfg.diff_dir.write_diffs(org_qname, qtype, iana_ip, &target.ip, diffs)
+					if err != nil {
+						glog.Errorf("Error writing differences to %s: %s", qcfg.diff_dir.dir, err)
+					}
+				}
+				if qcfg.dump_dir != nil {
+					err := qcfg.dump_dir.write_packets(org_qname, qtype, target.ip, time.Now(),
+						query, iana_resp, yeti_resp)
+					if err != nil {
+						glog.Errorf("Error writing packets to %s: %s", qcfg.dump_dir.dir, err)
+					}
+				}
 			}
 			// record our performance difference, if desired
 			if pf != nil {
@@ -676,25 +2397,152 @@ func yeti_query(sync chan bool, report *report_conf, srvs *yeti_server_set,
 			srvs.update_srtt(target.ip, rtt)
 			// report the results
 			if rolled {
-				report.send_report(df.old_name, pf.old_name)
+				report.send_report(df.prev_name(), pf.prev_name())
+			}
+		}
+		glog.Flush()
+	}
+
+	// see if the Yeti servers agree with each other
+	majority, quorum_diffs := check_quorum(answers, &qcfg.compare)
+	if majority != "" {
+		glog.Infof("Yeti servers disagree for %s %s, %s\n", org_qname, qtype, majority)
+		for _, answer := range answers {
+			diffs, found := quorum_diffs[answer.target]
+			if !found {
+				continue
+			}
+			if (df != nil) && df.write_diffs(org_qname, qtype, iana_ip, &answer.target.ip, diffs) {
+				report.send_report(df.prev_name(), pf.prev_name())
+			}
+			if qcfg.diff_dir != nil {
+				err := qcfg.diff_dir.write_diffs(org_qname, qtype, iana_ip, &answer.target.ip, diffs)
+				if err != nil {
+					glog.Errorf("Error writing differences to %s: %s", qcfg.diff_dir.dir, err)
+				}
+			}
+		}
+		glog.Flush()
+	}
+
+	sync <- true
+}
+
+// Read every message from an input, sending each to the output channel.
+func read_messages(name string, r io.Reader, output chan *ymmv_message) {
+	in := &offset_reader{r: r}
+	for {
+		y, err := read_next_message(in)
+		_, bad_message := err.(*unpack_error)
+		_, bad_checksum := err.(*checksum_error)
+		if bad_message || bad_checksum {
+			glog.Warningf("%s: skipping message: %s", name, err)
+			continue
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			glog.Fatalf("%s: %s", name, err)
+		}
+		output <- y
+	}
+}
+
+// Read the messages from each of the named files in turn, or from
+// standard input if there are none, and then send a nil message to mark
+// the end of the input.
+func message_reader(file_names []string, output chan *ymmv_message) {
+	if len(file_names) == 0 {
+		read_messages("standard input", os.Stdin, output)
+	}
+	for _, name := range file_names {
+		f, err := os.Open(name)
+		if err != nil {
+			glog.Fatalf("Error opening input: %s", err)
+		}
+		glog.V(1).Infof("reading messages from %s", name)
+		read_messages(name, f, output)
+		f.Close()
+	}
+	output <- nil
+}
+
+// a flag that may be given more than once, like "-f one -f two"
+type string_list []string
+
+func (list *string_list) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *string_list) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+/*
+   Compare the answers to each message read, until the nil message that
+   marks the end of the input. Each comparison runs in its own goroutine,
+   and we wait for all of them to finish before returning.
+
+   At most max_outstanding comparisons run at once (0 means no limit).
+   When that many are running we stop reading messages until one is
+   done, so that a fast input with slow servers does not use up all of
+   our sockets.
+*/
+func compare_messages(messages chan *ymmv_message, max_outstanding int, message_sampler *sampler,
+	report *report_conf, servers *yeti_server_set, qcfg *query_conf,
+	perf_file *daily_file, diff_file *daily_file) {
+	// make a channel for finishing comparisons
+	query_sync := make(chan bool)
+
+	// keep track of number of outstanding queries
+	query_count := 0
+
+	// main loop, gets answers to compare and collects the results
+input:
+	for {
+		glog.Flush()
+		// a nil channel is never ready, so this waits for a comparison
+		// to finish if we are at our limit
+		intake := messages
+		if (max_outstanding > 0) && (query_count >= max_outstanding) {
+			intake = nil
+		}
+		select {
+		// new answer to compare
+		case y := <-intake:
+			// end of input, so stop looking for more
+			if y == nil {
+				break input
 			}
+			progress.add_message()
+			if !qcfg.select_qtype(y.query) {
+				servers.record_skip(SKIP_QTYPE)
+				continue
+			}
+			if !qcfg.select_name(y.query) {
+				servers.record_skip(SKIP_NAME)
+				continue
+			}
+			if !message_sampler.sample() {
+				servers.record_skip(SKIP_NOT_SAMPLED)
+				continue
+			}
+			go yeti_query(query_sync, report, servers, qcfg,
+				perf_file, diff_file, y.query, y.answer, y.answer_time.Sub(y.query_time), y.addr)
+			query_count += 1
+		// comparison done
+		case <-query_sync:
+			query_count -= 1
 		}
-		glog.Flush()
 	}
 
-	sync <- true
-}
-
-func message_reader(output chan *ymmv_message) {
-	for {
-		y, err := read_next_message()
-		if (err != nil) && (err != io.EOF) {
-			glog.Fatal(err)
-		}
-		output <- y
-		if y == nil {
-			break
-		}
+	// wait for any outstanding queries to finish before exiting
+	for query_count > 0 {
+		<-query_sync
+		query_count -= 1
+		glog.Flush()
 	}
 }
 
@@ -853,6 +2701,107 @@ func (cfg *report_conf) send_report(diff_fname string, perf_fname string) {
 	}
 }
 
+// write a set of differences, with information about the query
+func format_diffs(w io.Writer, qname string, qtype string,
+	iana_ip *net.IP, yeti_ip *net.IP, diffs []string) {
+	fmt.Fprintln(w,
+		"================================================================================")
+	fmt.Fprintf(w, "%s\n", time.Now().UTC().Format("2006-01-02T15:04:05"))
+	fmt.Fprintf(w, "qname: %s\n", qname)
+	fmt.Fprintf(w, "qtype: %s\n", qtype)
+	fmt.Fprintf(w, "IANA IP: %s\n", iana_ip)
+	fmt.Fprintf(w, "Yeti IP: %s\n", yeti_ip)
+	fmt.Fprintln(w, "----------------------------------------")
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "%s\n", diff)
+	}
+}
+
+/*
+   A directory to write each set of differences to its own file, named
+   after the query name, query type, and Yeti server, so that they can be
+   looked at one by one. If the same query gets different answers more
+   than once, the differences are added to the end of the file.
+*/
+type diff_dir struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func open_diff_dir(dir string) (*diff_dir, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &diff_dir{dir: dir}, nil
+}
+
+// Get the name of the .diff file for a query.
+func diff_dir_file_name(qname string, qtype string, yeti_ip net.IP) string {
+	return query_file_base(qname, qtype, yeti_ip) + ".diff"
+}
+
+// Longest query name part of a file name. A query name can be up to
+// 253 characters, or several times that with escapes, and together with
+// the query type, the address, and the time stamp and suffix of a dump
+// file, that would be more than the 255 characters most file systems
+// allow.
+const MAX_FILE_QNAME_LEN = 100
+
+/*
+   Get a safe base for the names of files about a query, without any
+   extension. Query names can have any bytes in them, so we keep only
+   letters, digits, '-', and '.', and replace everything else with '_'.
+
+   A query name that is too long is cut short, and ends with the start
+   of a SHA-256 hash of the whole name instead, so that different long
+   names with the same start still go into different files.
+*/
+func query_file_base(qname string, qtype string, yeti_ip net.IP) string {
+	sanitize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if ((r >= 'a') && (r <= 'z')) || ((r >= '0') && (r <= '9')) || (r == '-') || (r == '.') {
+				return r
+			}
+			return '_'
+		}, strings.ToLower(s))
+	}
+	name := strings.TrimSuffix(qname, ".")
+	if name == "" {
+		name = "root"
+	}
+	// don't allow names that look like the current or parent directory
+	name = strings.TrimLeft(sanitize(name), ".")
+	if len(name) > MAX_FILE_QNAME_LEN {
+		sum := sha256.Sum256([]byte(strings.ToLower(qname)))
+		hash := hex.EncodeToString(sum[:8])
+		name = name[:MAX_FILE_QNAME_LEN-len(hash)-1] + "_" + hash
+	}
+	return name + "_" + sanitize(qtype) + "_" + sanitize(yeti_ip.String())
+}
+
+func (dd *diff_dir) write_diffs(qname string, qtype string,
+	iana_ip *net.IP, yeti_ip *net.IP, diffs []string) error {
+
+	var buf bytes.Buffer
+	format_diffs(&buf, qname, qtype, iana_ip, yeti_ip, diffs)
+
+	// one writer at a time, in case two queries use the same file
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	fname := filepath.Join(dd.dir, diff_dir_file_name(qname, qtype, *yeti_ip))
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 type daily_file struct {
 	name     string       // base file name
 	header   string       // header to put at the top of each file
@@ -907,6 +2856,14 @@ func (df *daily_file) roll_daily_file() (bool, error) {
 	}
 }
 
+// name of the file we wrote to before the last roll, if any
+func (df *daily_file) prev_name() string {
+	if df == nil {
+		return ""
+	}
+	return df.old_name
+}
+
 func open_daily_file(name string, header string) (*daily_file, error) {
 	df := new(daily_file)
 	df.name = name
@@ -948,17 +2905,7 @@ func (df *daily_file) write_diffs(qname string, qtype string,
 		glog.Fatalf("Error rolling differences file %s", err)
 	}
 
-	fmt.Fprintln(df.writer,
-		"================================================================================")
-	fmt.Fprintf(df.writer, "%s\n", time.Now().UTC().Format("2006-01-02T15:04:05"))
-	fmt.Fprintf(df.writer, "qname: %s\n", qname)
-	fmt.Fprintf(df.writer, "qtype: %s\n", qtype)
-	fmt.Fprintf(df.writer, "IANA IP: %s\n", iana_ip)
-	fmt.Fprintf(df.writer, "Yeti IP: %s\n", yeti_ip)
-	fmt.Fprintln(df.writer, "----------------------------------------")
-	for _, diff := range diffs {
-		fmt.Fprintf(df.writer, "%s\n", diff)
-	}
+	format_diffs(df.writer, qname, qtype, iana_ip, yeti_ip, diffs)
 	df.writer.Sync()
 
 	return rolled
@@ -966,18 +2913,136 @@ func (df *daily_file) write_diffs(qname string, qtype string,
 
 // Main function.
 func main() {
+	var input_files string_list
+	flag.Var(&input_files, "f",
+		"read messages from this file instead of standard input, may be repeated")
+	ipv4_only := flag.Bool("4", false, "only send queries over IPv4")
+	ipv6_only := flag.Bool("6", false, "only send queries over IPv6")
 	clear_names := flag.Bool("c", false, "use non-obfuscated (clear) query names")
+	quiet := flag.Bool("q", false, "quiet, only log differences and errors")
+	hash_len := flag.Int("hash-len", 16,
+		"number of hex characters of the hash to use in obfuscated query names, even and at most 62")
+	keep_labels := flag.Int("L", 1,
+		"number of rightmost labels to leave intact in obfuscated query names")
+	clear_tlds := flag.String("clear-tld", "",
+		"comma-separated TLDs whose query names are not obfuscated (default none)")
 	secret := flag.String("s", "",
 		"secret for obfuscated query names, hex-encoded (default random-generated)")
+	obf_mode := flag.String("obfuscate-mode", "hash",
+		"how to hash obfuscated query names, either hash (SHA-256 of secret and name) or hmac (HMAC-SHA-256)")
+	secret_file := flag.String("secret-file", "",
+		"file to read the obfuscation secret from, created with a random secret if missing (default none)")
 	edns_size := flag.Uint("e", 4093,
 		"set EDNS0 buffer size (set to 0 to use original query size)")
 	select_alg := flag.String("a", "rtt",
-		"set server-selection algorithm, either rtt, round-robin, random, or all")
+		"set server-selection algorithm, either rtt, least-rtt, round-robin, random, weighted, or all")
 	perf_file_name := flag.String("p", "",
 		"base file name to store performance comparison in (default none)")
 	diff_file_name := flag.String("d", "",
 		"base file name to store difference details in (default none)")
 	daily_report := flag.Bool("r", false, "send daily reports")
+	cache_ttl := flag.Int("cache-ttl", -1,
+		"report effective cache TTLs differing by at least this many seconds (default no check)")
+	cd_mode := flag.String("cd", "capture",
+		"set checking disabled (CD) flag on queries, either capture, on, or off")
+	do_mode := flag.String("do", "capture",
+		"set DNSSEC OK (DO) bit on queries, either capture, on, or off")
+	follow := flag.Bool("follow", false,
+		"follow CNAME and DNAME redirections, querying IANA and Yeti and comparing each step")
+	self_test := flag.Bool("selftest", false,
+		"check that querying and comparing works using the root SOA, then exit")
+	selftest_server := flag.String("selftest-server", SELFTEST_IANA_SERVER,
+		"IANA root server to get the self-test answer from, "+SELFTEST_IANA_SERVER6+" by default with -6")
+	refresh_iana := flag.Bool("refresh-iana", false,
+		"compare the Yeti answers with a fresh answer from an IANA root server, instead of the captured answer")
+	iana_server := flag.String("iana-server", SELFTEST_IANA_SERVER,
+		"IANA root server to get fresh answers from with -refresh-iana, "+SELFTEST_IANA_SERVER6+" by default with -6")
+	dial_timeout := flag.Duration("dial-timeout", 0,
+		"time to wait to connect to a server (default DNS library setting of 2s)")
+	read_timeout := flag.Duration("read-timeout", 0,
+		"time to wait for an answer from a server (default DNS library setting of 2s)")
+	rcode_only := flag.Bool("rcode-only", false,
+		"only compare the rcode of answers, ignoring flags and contents")
+	edns_opt := flag.String("edns-opt", "",
+		"EDNS option to add to queries as code:hexdata, to check how servers handle it (default none)")
+	validate_only := flag.Bool("validate-framing", false,
+		"check the framing of the input without parsing DNS messages, then exit")
+	name_list := flag.String("name", "",
+		"comma-separated query names to compare, each a name or '*.' and a suffix (default all)")
+	qtype_list := flag.String("qtype", "",
+		"comma-separated query types to compare, like NS,DNSKEY (default all)")
+	sample := flag.Float64("sample", 1,
+		"fraction of messages to compare, picked at random, between 0 and 1")
+	seed := flag.Int64("seed", 0,
+		"seed for picking the sample of messages to compare (default random)")
+	skip_list := flag.String("skip", "",
+		"comma-separated names not to compare, with *.name for any name below name (default none)")
+	no_default_skips := flag.Bool("no-default-skips", false,
+		"compare the root zone, server information, root-servers.net, and arpa, unless given with -skip")
+	compare_arpa := flag.Bool("compare-arpa", false,
+		"compare queries for arpa and the names below it, which are skipped by default")
+	max_outstanding := flag.Int("max-outstanding", 20,
+		"maximum number of comparisons to run at once, 0 for no limit")
+	warmup := flag.Int("warmup", 0,
+		"number of rounds of probe queries to send to each server to set the RTT before comparing")
+	query_rate := flag.Float64("rate", 0,
+		"maximum queries per second to send to the Yeti servers, 0 for no limit")
+	quorum := flag.Int("quorum", 0,
+		"number of different Yeti servers to send each query to, reporting when they disagree with each other (default off)")
+	max_per_server := flag.Uint("max-per-server", 0,
+		"maximum number of queries to send to each server address (default no limit)")
+	yeti_port := flag.Uint("port", 53,
+		"port to send queries to the Yeti servers to, unless given with the server address")
+	iana_port := flag.Uint("iana-port", 53,
+		"port to send live queries to the IANA side to, for the self-test, following redirections, and -refresh-iana")
+	iana_transport := flag.String("iana-transport", "auto",
+		"transport for live queries to the IANA side, one of auto, udp, or tcp")
+	hints_source := flag.String("hints", "",
+		"root hints file or http(s) URL to get the Yeti servers from, instead of priming (default none)")
+	dnssec := flag.Bool("dnssec", false,
+		"compare the type covered, algorithm, and signer of RRSIG records, and what NSEC and NSEC3 records prove")
+	recheck := flag.Int("recheck", 0,
+		"number of times to query a Yeti server again when its answer differs, only reporting differences that persist (default off)")
+	ttl_tolerance := flag.Uint("ttl-tolerance", 0,
+		"ignore differences in TTLs of up to this many seconds")
+	lenient_authority := flag.Bool("lenient-authority", false,
+		"for negative answers, only compare the SOA and denial of existence records in the authority section")
+	transport := flag.String("transport", "auto",
+		"transport for queries to the Yeti servers, one of auto, udp, or tcp")
+	live_stats_interval := flag.Duration("live-stats", 0,
+		"write query rates and RTT quantiles at this interval, like 10s (default off)")
+	live_stats_file := flag.String("live-stats-file", "",
+		"file to append live statistics to (default standard error)")
+	progress_interval := flag.Duration("progress", 0,
+		"write messages read, queries sent, and mismatches to standard error at this interval, like 30s (default off)")
+	stats_json := flag.String("stats-json", "",
+		"file to write the statistics of the run to as JSON when done (default none)")
+	metrics_addr := flag.String("metrics-addr", "",
+		"address to serve Prometheus metrics at, like :9153 (default none)")
+	diff_dir_name := flag.String("diff-dir", "",
+		"directory to store the differences for each query in a separate file (default none)")
+	dump_dir_name := flag.String("dump-dir", "",
+		"directory to store the query and answers of each mismatch in wire format (default none)")
+	error_policy := flag.String("error-policy", "equivalent",
+		"how to count answers with the same error rcode, either equivalent, agreed-error, or skip")
+	rcode_rules_file := flag.String("expect-rcodes", "",
+		"file with expected rcodes for query name patterns (default none)")
+	edns_compare := flag.Bool("edns-compare", false,
+		"also query each Yeti server without EDNS, and report if the answer depends on EDNS")
+	json_output := flag.Bool("j", false,
+		"write each comparison as a line of JSON to the output")
+	output_name := flag.String("o", "",
+		"file to write the results to (default standard output)")
+	dry_run := flag.Bool("dry-run", false,
+		"show the query that would be sent to each Yeti server, without sending it or comparing")
+	show_full := flag.Bool("show-full", false,
+		"record the complete IANA and Yeti answers along with any differences")
+	instance_file := flag.String("instances", "",
+		"file of expected NSID values for each server, to check anycast instances (default none)")
+	edns_report_list := flag.String("edns-opts", "",
+		"comma-separated EDNS options in the answers to report on, nsid or ede (default none)")
+	cookies := flag.Bool("cookies", false,
+		"send a DNS cookie with each query to the Yeti servers, and check the cookie in the answers")
 
 	// SMTP parameters
 	mail_server := flag.String("mail-server", "mxbiz1.qq.com", "SMTP server name")
@@ -993,18 +3058,112 @@ func main() {
 	// the e-mail source & destination
 	flag.Parse()
 	var ips []net.IP
+	var ports []uint16
+	var weights []uint
 	args := flag.Args()
 	for _, server := range args {
-		ip := net.ParseIP(server)
-		// TODO: allow host name here
-		if ip == nil {
-			fmt.Printf("Unrecognized IP address '%s'\n", server)
+		server_ips, port, weight, err := parse_server_arg(server)
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
-		ips = append(ips, ip)
+		for _, ip := range server_ips {
+			ips = append(ips, ip)
+			ports = append(ports, port)
+			weights = append(weights, weight)
+		}
 	}
 	glog.V(2).Infof("ips=%s", ips)
+	output, output_err := open_output(*output_name)
+	if output_err != nil {
+		fmt.Printf("Error opening output: %s\n", output_err)
+		os.Exit(1)
+	}
+	var hints []root_hint
+	if *hints_source != "" {
+		if len(ips) > 0 {
+			fmt.Println("Syntax error: use either -hints or server addresses, not both")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		var err error
+		hints, err = read_root_hints(*hints_source)
+		if err != nil {
+			fmt.Printf("Error reading root hints: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	// the servers come from the hints, the command line, or priming
+	new_server_set := func(algo string) (srvs *yeti_server_set) {
+		if hints != nil {
+			srvs = init_yeti_server_set_from_hints(hints, algo)
+		} else {
+			srvs = init_yeti_server_set(ips, algo)
+		}
+		srvs.port = uint16(*yeti_port)
+		for n, ip := range ips {
+			srvs.set_port(ip, ports[n])
+		}
+		return srvs
+	}
+
+	// only check the input, if desired
+	if *validate_only {
+		problems := 0
+		if len(input_files) == 0 {
+			_, problems = validate_framing(bufio.NewReader(os.Stdin), output)
+		}
+		for _, name := range input_files {
+			f, err := os.Open(name)
+			if err != nil {
+				fmt.Printf("Error opening input: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(output, "%s:\n", name)
+			_, file_problems := validate_framing(bufio.NewReader(f), output)
+			f.Close()
+			problems += file_problems
+		}
+		if problems > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
+	if *keep_labels < 1 {
+		fmt.Printf("Syntax error: number of labels to keep %d must be at least 1\n", *keep_labels)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	obfuscate_keep_labels = *keep_labels
+	if err := check_hash_len(*hash_len); err != nil {
+		fmt.Printf("Syntax error: %s\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	obfuscate_hash_len = *hash_len
+	if !obfuscate_modes[*obf_mode] {
+		fmt.Printf("Syntax error: obfuscation mode '%s' is not hash or hmac\n", *obf_mode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	obfuscate_mode = *obf_mode
+	rules, skip_err := configure_skip_rules(*no_default_skips, *compare_arpa, *skip_list)
+	if skip_err != nil {
+		fmt.Printf("Syntax error: %s\n", skip_err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	skip_rules = rules
+	if *clear_tlds != "" {
+		var err error
+		obfuscate_clear_tlds, err = parse_clear_tlds(*clear_tlds)
+		if err != nil {
+			fmt.Printf("Syntax error: %s\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
 	if *secret != "" {
 		var err error
 		obfuscate_secret, err = hex.DecodeString(*secret)
@@ -1014,6 +3173,29 @@ func main() {
 		}
 		glog.Infof("using obfuscation secret %s", strings.ToUpper(*secret))
 	}
+	if *secret_file != "" {
+		if *secret != "" {
+			fmt.Println("Syntax error: use only one of -s and -secret-file")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		var created bool
+		var err error
+		obfuscate_secret, created, err = load_or_create_secret(*secret_file)
+		if err != nil {
+			fmt.Printf("Error with obfuscation secret file: %s\n", err)
+			os.Exit(1)
+		}
+		if created {
+			glog.Infof("saved obfuscation secret in %s", *secret_file)
+		} else {
+			glog.Infof("using obfuscation secret from %s", *secret_file)
+		}
+	}
+	// set up the secret now, before any queries are sent
+	if !*clear_names {
+		get_obfuscate_secret()
+	}
 
 	// verify our EDNS buffer size
 	if *edns_size > 65535 {
@@ -1022,14 +3204,229 @@ func main() {
 		os.Exit(1)
 	}
 
+	// build our query configuration
+	var query_conf query_conf
+	query_conf.clear_names = *clear_names
+	query_conf.quiet = *quiet
+	query_conf.edns_size = uint16(*edns_size)
+	if *edns_opt != "" {
+		var err error
+		query_conf.edns_opt, err = parse_edns_opt(*edns_opt)
+		if err != nil {
+			fmt.Printf("Syntax error: %s\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if !cd_modes[*cd_mode] {
+		fmt.Printf("Syntax error: CD mode '%s' is not capture, on, or off\n", *cd_mode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.cd_mode = *cd_mode
+	if !do_modes[*do_mode] {
+		fmt.Printf("Syntax error: DO mode '%s' is not capture, on, or off\n", *do_mode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.do_mode = *do_mode
+	query_conf.follow_redirects = *follow
+	query_conf.show_full = *show_full
+	if *dry_run {
+		query_conf.dry_run = output
+	}
+	if *json_output {
+		query_conf.json_out = new_json_writer(output)
+	}
+	query_conf.edns_compare = *edns_compare
+	if !error_policies[*error_policy] {
+		fmt.Printf("Syntax error: error policy '%s' is not equivalent, agreed-error, or skip\n", *error_policy)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.error_policy = *error_policy
+	if *query_rate < 0 {
+		fmt.Printf("Syntax error: query rate %g is negative\n", *query_rate)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *query_rate > 0 {
+		// a burst of 1 spaces the queries out evenly
+		query_conf.limiter = rate.NewLimiter(rate.Limit(*query_rate), 1)
+	}
+	if (*quorum < 0) || (*quorum == 1) {
+		fmt.Printf("Syntax error: quorum %d must be at least 2, or 0 for none\n", *quorum)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *diff_dir_name != "" {
+		var err error
+		query_conf.diff_dir, err = open_diff_dir(*diff_dir_name)
+		if err != nil {
+			fmt.Printf("Error creating differences directory: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *dump_dir_name != "" {
+		var err error
+		query_conf.dump_dir, err = open_dump_dir(*dump_dir_name)
+		if err != nil {
+			fmt.Printf("Error creating packet dump directory: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *edns_report_list != "" {
+		var err error
+		query_conf.edns_report, err = parse_edns_report(*edns_report_list)
+		if err != nil {
+			fmt.Printf("Syntax error: %s\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+	if *cookies {
+		var err error
+		query_conf.cookies, err = new_cookie_jar()
+		if err != nil {
+			fmt.Printf("Error making a client cookie: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *instance_file != "" {
+		var err error
+		query_conf.instances, err = read_instance_map(*instance_file)
+		if err != nil {
+			fmt.Printf("Error reading instance file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *rcode_rules_file != "" {
+		var err error
+		query_conf.rcode_rules, err = read_rcode_rules(*rcode_rules_file)
+		if err != nil {
+			fmt.Printf("Error reading expected rcodes file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	query_conf.dns_opts.DialTimeout = *dial_timeout
+	query_conf.dns_opts.ReadTimeout = *read_timeout
+	if (*iana_port == 0) || (*iana_port > 65535) {
+		fmt.Printf("Syntax error: IANA port %d is not between 1 and 65535\n", *iana_port)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.iana_port = uint16(*iana_port)
+	// restrict all of our queries to one address family, if asked
+	family := address_family(*ipv4_only, *ipv6_only)
+	set_flags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set_flags[f.Name] = true })
+	if *refresh_iana {
+		var err error
+		query_conf.iana_server, err = parse_iana_server(*iana_server, set_flags["iana-server"], family)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+	}
+	if (*yeti_port == 0) || (*yeti_port > 65535) {
+		fmt.Printf("Syntax error: port %d is not between 1 and 65535\n", *yeti_port)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.iana_opts = query_conf.dns_opts
+	var err error
+	query_conf.iana_opts.Transport, err = dnsstub.ParseTransport(*iana_transport)
+	if err != nil {
+		fmt.Printf("Syntax error: %s\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.dns_opts.Transport, err = dnsstub.ParseTransport(*transport)
+	if err != nil {
+		fmt.Printf("Syntax error: %s\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.dns_opts.Family = family
+	query_conf.iana_opts.Family = family
+	query_conf.compare.rcode_only = *rcode_only
+	query_conf.compare.compare_qname = *clear_names
+	query_conf.compare.dnssec = *dnssec
+	if *ttl_tolerance > math.MaxUint32 {
+		*ttl_tolerance = math.MaxUint32
+	}
+	query_conf.compare.ttl_tolerance = uint32(*ttl_tolerance)
+	query_conf.compare.lenient_authority = *lenient_authority
+	if *recheck < 0 {
+		fmt.Printf("Syntax error: recheck count must not be negative\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	query_conf.recheck = *recheck
+	if *cache_ttl >= 0 {
+		query_conf.cache_ttl_check = true
+		query_conf.cache_ttl_delta = uint32(*cache_ttl)
+	}
+
+	if (*sample <= 0) || (*sample > 1) {
+		fmt.Printf("Syntax error: sample fraction %g is not more than 0 and at most 1\n", *sample)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	message_sampler := new_sampler(*sample, *seed)
+	if *name_list != "" {
+		var err error
+		query_conf.names, err = parse_name_patterns(*name_list)
+		if (err == nil) && (len(query_conf.names) == 0) {
+			err = fmt.Errorf("No names in '%s'", *name_list)
+		}
+		if err != nil {
+			fmt.Printf("Syntax error: %s\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+	if *qtype_list != "" {
+		var err error
+		query_conf.qtypes, err = parse_qtypes(*qtype_list)
+		if err != nil {
+			fmt.Printf("Syntax error: %s\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+	if *max_outstanding < 0 {
+		fmt.Printf("Syntax error: maximum outstanding comparisons %d is negative\n", *max_outstanding)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
 	// verify our server-selection algorithm
 	_, ok := server_algorithms[*select_alg]
 	if !ok {
-		fmt.Printf("Syntax error: server algorithm '%s' is not rtt, round-robin, random, or all\n", *select_alg)
+		fmt.Printf("Syntax error: server algorithm '%s' is not rtt, least-rtt, round-robin, random, weighted, or all\n", *select_alg)
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	// run our self-test instead of reading input, if desired
+	if *self_test {
+		iana_ip, err := parse_iana_server(*selftest_server, set_flags["selftest-server"], family)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		servers := new_server_set("all")
+		servers.family = family
+		passed := selftest(iana_ip, servers, &query_conf, output)
+		glog.Flush()
+		if !passed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// open our performance file, if specified
 	var perf_file *daily_file
 	if *perf_file_name != "" {
@@ -1081,39 +3478,76 @@ func main() {
 
 	// start a goroutine to read our input
 	messages := make(chan *ymmv_message)
-	go message_reader(messages)
+	go message_reader(input_files, messages)
 
 	// initialize our server set
-	servers := init_yeti_server_set(ips, *select_alg)
-
-	// make a channel for finishing comparisons
-	query_sync := make(chan bool)
+	servers := new_server_set(*select_alg)
+	servers.max_per_server = *max_per_server
+	servers.quorum = *quorum
+	for n, ip := range ips {
+		servers.set_weight(ip, weights[n])
+	}
+	servers.family = family
+	if (family != 0) && (len(servers.all_ips()) == 0) {
+		glog.Fatalf("no Yeti server addresses for IPv%d", family)
+	}
+	// a dry run sends no queries to the Yeti servers, not even probes
+	if (*warmup > 0) && !*dry_run {
+		glog.Infof("warming up with %d rounds of probe queries", *warmup)
+		servers.warmup(*warmup, &query_conf)
+	}
+
+	// write live statistics, if desired
+	stop_live_stats := func() {}
+	if *live_stats_interval > 0 {
+		var out io.Writer = os.Stderr
+		if *live_stats_file != "" {
+			f, err := os.OpenFile(*live_stats_file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Printf("Error opening live statistics file: %s\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+		stop_live_stats = start_live_stats(servers, *live_stats_interval, out)
+	}
 
-	// keep track of number of outstanding queries
-	query_count := 0
+	// write progress reports, if desired; these go to standard error so
+	// that they are kept apart from anything written to standard output
+	stop_progress := func() {}
+	if *progress_interval > 0 {
+		stop_progress = start_progress(*progress_interval, os.Stderr)
+	}
 
-	// main loop, gets answers to compare and collects the results
-	for {
-		glog.Flush()
-		select {
-		// new answer to compare
-		case y := <-messages:
-			if y == nil {
-				break
-			}
-			go yeti_query(query_sync, &report_conf, servers, *clear_names, uint16(*edns_size),
-				perf_file, diff_file, y.query, y.answer, y.answer_time.Sub(y.query_time), y.addr)
-			query_count += 1
-		// comparison done
-		case <-query_sync:
-			query_count -= 1
+	// serve metrics, if desired
+	if *metrics_addr != "" {
+		err := serve_metrics(*metrics_addr)
+		if err != nil {
+			fmt.Printf("Error serving metrics: %s\n", err)
+			os.Exit(1)
 		}
 	}
 
-	// wait for any outstanding queries to finish before exiting
-	for query_count > 0 {
-		<-query_sync
-		query_count -= 1
-		glog.Flush()
+	compare_messages(messages, *max_outstanding, message_sampler, &report_conf, servers, &query_conf,
+		perf_file, diff_file)
+	stop_live_stats()
+	stop_progress()
+	// keep the output for JSON, if we are writing that
+	if *json_output {
+		servers.write_summary(os.Stderr)
+	} else {
+		servers.write_summary(output)
+	}
+	if err := output.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %s\n", err)
+		os.Exit(1)
+	}
+	if *stats_json != "" {
+		err := servers.write_stats_json(*stats_json, &progress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing statistics to %s: %s\n", *stats_json, err)
+			os.Exit(1)
+		}
 	}
 }
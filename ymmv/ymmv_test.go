@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/miekg/dns"
+	"github.com/shane-kerr/ymmv/dnsstub"
+	"golang.org/x/time/rate"
+	"io"
+	"net"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestPadRight(t *testing.T) {
@@ -110,6 +123,191 @@ func TestObfuscateQuery(t *testing.T) {
 	}
 }
 
+// The obfuscated names for a given secret must never change, or results
+// from different runs with the same -s could not be matched up. The
+// expected hashes are the first 16 hex characters of the SHA-256 of the
+// secret followed by the lower-case name without the final '.', or of
+// the HMAC-SHA-256 of the name keyed with the secret.
+func TestObfuscateQueryFixed(t *testing.T) {
+	defer func(secret []byte) { obfuscate_secret = secret }(obfuscate_secret)
+	defer func(n int) { obfuscate_keep_labels = n }(obfuscate_keep_labels)
+	defer func(mode string) { obfuscate_mode = mode }(obfuscate_mode)
+	obfuscate_secret, _ = hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+
+	cases := []struct {
+		keep  int
+		qname string
+		hash  string
+		hmac  string
+	}{
+		{1, "www.example.", "ymmv.d5216e736a9afc6c.example.", "ymmv.d25ac9387b58d2d0.example."},
+		{1, "WWW.Example", "ymmv.d5216e736a9afc6c.example.", "ymmv.d25ac9387b58d2d0.example."},
+		{1, "fugazi.org.", "ymmv.916cc5bbd61b29dc.org.", "ymmv.21dd8d64b3f4352e.org."},
+		{2, "www.test.example.", "ymmv.f6d9639b4859712b.test.example.", "ymmv.e9b6870c12371aa5.test.example."},
+	}
+	for _, c := range cases {
+		obfuscate_keep_labels = c.keep
+		obfuscate_mode = "hash"
+		obf_hash := obfuscate_query(c.qname)
+		if obf_hash != c.hash {
+			t.Errorf("obfuscate_query(%q) with -L %d == %q, want %q", c.qname, c.keep, obf_hash, c.hash)
+		}
+		obfuscate_mode = "hmac"
+		obf_hmac := obfuscate_query(c.qname)
+		if obf_hmac != c.hmac {
+			t.Errorf("obfuscate_query(%q) with -L %d in hmac mode == %q, want %q",
+				c.qname, c.keep, obf_hmac, c.hmac)
+		}
+		// the modes give names of the same form, but not the same names
+		if (len(obf_hash) != len(obf_hmac)) || (obf_hash == obf_hmac) {
+			t.Errorf("obfuscate_query(%q) == %q in hash mode and %q in hmac mode", c.qname, obf_hash, obf_hmac)
+		}
+	}
+}
+
+func TestObfuscateQueryHashLen(t *testing.T) {
+	defer func(n int) { obfuscate_hash_len = n }(obfuscate_hash_len)
+
+	for _, hash_len := range []int{8, 16, 32, 62} {
+		obfuscate_hash_len = hash_len
+		obf := obfuscate_query("www.example.")
+		labels := dns.SplitDomainName(obf)
+		if (len(labels) != 3) || (len(labels[1]) != hash_len) {
+			t.Errorf("-hash-len %d: obfuscate_query() == %q, want a %d character label",
+				hash_len, obf, hash_len)
+		}
+		// a longer hash starts with a shorter one
+		if (len(labels) == 3) && (hash_len > 8) {
+			obfuscate_hash_len = 8
+			short := dns.SplitDomainName(obfuscate_query("www.example."))[1]
+			if !strings.HasPrefix(labels[1], short) {
+				t.Errorf("-hash-len %d: label %q does not start with %q", hash_len, labels[1], short)
+			}
+		}
+	}
+
+	cases := []struct {
+		hash_len int
+		valid    bool
+	}{
+		{0, false},
+		{1, false},
+		{2, true},
+		{15, false},
+		{16, true},
+		{62, true},
+		{63, false},
+		{64, false},
+		{-2, false},
+	}
+	for _, c := range cases {
+		err := check_hash_len(c.hash_len)
+		if (err == nil) != c.valid {
+			t.Errorf("check_hash_len(%d) == %v, want valid %t", c.hash_len, err, c.valid)
+		}
+	}
+}
+
+func TestObfuscateQueryKeepLabels(t *testing.T) {
+	defer func(n int) { obfuscate_keep_labels = n }(obfuscate_keep_labels)
+
+	cases := []struct {
+		keep  int
+		qname string
+		clear string
+	}{
+		{1, "www.example.co.uk.", ".uk."},
+		{2, "www.example.co.uk.", ".co.uk."},
+		{3, "www.example.co.uk.", ".example.co.uk."},
+	}
+	for _, c := range cases {
+		obfuscate_keep_labels = c.keep
+		obf := obfuscate_query(c.qname)
+		if !strings.HasPrefix(obf, "ymmv.") || !strings.HasSuffix(obf, c.clear) {
+			t.Errorf("-L %d: obfuscate_query(%q) == %q, want ymmv.<hash>%s", c.keep, c.qname, obf, c.clear)
+			continue
+		}
+		if len(obf) != len("ymmv.")+obfuscate_hash_len+len(c.clear) {
+			t.Errorf("-L %d: obfuscate_query(%q) == %q, length is wrong", c.keep, c.qname, obf)
+		}
+		// a name with no more labels than we keep is left alone
+		short := strings.TrimPrefix(c.clear, ".")
+		if obf := obfuscate_query(strings.ToUpper(short)); obf != short {
+			t.Errorf("-L %d: obfuscate_query(%q) == %q, want %q", c.keep, short, obf, short)
+		}
+	}
+
+	// the whole name is hashed, so names differing only in the kept
+	// labels get different hashes too
+	obfuscate_keep_labels = 2
+	a := dns.SplitDomainName(obfuscate_query("www.example.co.uk."))
+	b := dns.SplitDomainName(obfuscate_query("www.example.ac.uk."))
+	if a[1] == b[1] {
+		t.Errorf("obfuscate_query() gives the same hash %q for different names", a[1])
+	}
+}
+
+func TestObfuscateQueryClearTLDs(t *testing.T) {
+	defer func(tlds map[string]bool) { obfuscate_clear_tlds = tlds }(obfuscate_clear_tlds)
+
+	var err error
+	obfuscate_clear_tlds, err = parse_clear_tlds("test, EXAMPLE.")
+	if err != nil {
+		t.Fatalf("parse_clear_tlds() error: %s", err)
+	}
+	for _, qname := range []string{"www.example.", "www.Example.", "a.b.test.", "www.example"} {
+		want := strings.TrimSuffix(qname, ".") + "."
+		if obf := obfuscate_query(qname); obf != want {
+			t.Errorf("obfuscate_query(%q) == %q, want it unchanged", qname, obf)
+		}
+	}
+	for _, qname := range []string{"www.examples.", "example.org.", "test.net."} {
+		if obf := obfuscate_query(qname); !strings.HasPrefix(obf, "ymmv.") {
+			t.Errorf("obfuscate_query(%q) == %q, want it obfuscated", qname, obf)
+		}
+	}
+
+	for _, bad := range []string{"", "test,", "example.com"} {
+		if _, err := parse_clear_tlds(bad); err == nil {
+			t.Errorf("parse_clear_tlds(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestObfuscateQueryConcurrent(t *testing.T) {
+	defer func(secret []byte) { obfuscate_secret = secret }(obfuscate_secret)
+	obfuscate_secret = nil
+
+	// many goroutines needing the secret at once should all use the
+	// same one, so get the same obfuscated name
+	const n = 50
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = obfuscate_query("www.example.com.")
+		}(i)
+	}
+	wg.Wait()
+	secret := get_obfuscate_secret()
+	if len(secret) == 0 {
+		t.Fatalf("no obfuscation secret generated")
+	}
+	for i, obf := range results {
+		if obf != results[0] {
+			t.Errorf("obfuscate_query() result %d == %q, expected %q", i, obf, results[0])
+		}
+	}
+	if !bytes.Equal(get_obfuscate_secret(), secret) {
+		t.Errorf("obfuscation secret changed after it was generated")
+	}
+	if obf := obfuscate_query("www.example.com."); obf != results[0] {
+		t.Errorf("obfuscate_query() == %q after goroutines, expected %q", obf, results[0])
+	}
+}
+
 func count_opt(msg *dns.Msg) int {
 	count := 0
 	for _, rr := range msg.Extra {
@@ -128,7 +326,7 @@ func TestSetOrChangeUDPSize(t *testing.T) {
 	}
 
 	// try our function without any EDNS message
-	SetOrChangeUDPSize(msg, 1234)
+	SetOrChangeUDPSize(msg, 1234, "capture")
 	if count_opt(msg) != 1 {
 		t.Errorf("%d OPT records, expected 1", count_opt(msg))
 	}
@@ -144,7 +342,7 @@ func TestSetOrChangeUDPSize(t *testing.T) {
 	}
 
 	// try our function with the EDNS message
-	SetOrChangeUDPSize(msg, 4321)
+	SetOrChangeUDPSize(msg, 4321, "capture")
 	if count_opt(msg) != 1 {
 		t.Errorf("%d OPT records, expected 1", count_opt(msg))
 	}
@@ -156,3 +354,2173 @@ func TestSetOrChangeUDPSize(t *testing.T) {
 		t.Errorf("EDNS buffer size is %d, should be 4321", e.UDPSize())
 	}
 }
+
+func TestSetDoBit(t *testing.T) {
+	cases := []struct {
+		// DO bit of the OPT record we start with, or -1 for none
+		orig_do int
+		do_mode string
+		want_do bool
+	}{
+		{-1, "capture", false},
+		{-1, "on", true},
+		{-1, "off", false},
+		{0, "capture", false},
+		{0, "on", true},
+		{0, "off", false},
+		{1, "capture", true},
+		{1, "on", true},
+		{1, "off", false},
+	}
+	for _, c := range cases {
+		new_msg := func() *dns.Msg {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.", dns.TypeDS)
+			if c.orig_do >= 0 {
+				msg.SetEdns0(512, c.orig_do == 1)
+			}
+			return msg
+		}
+
+		// adding or changing the OPT record along with the buffer size
+		msg := SetOrChangeUDPSize(new_msg(), 1234, c.do_mode)
+		e := msg.IsEdns0()
+		if (count_opt(msg) != 1) || (e.UDPSize() != 1234) || (e.Do() != c.want_do) {
+			t.Errorf("SetOrChangeUDPSize() starting with DO %d, mode %s gave %s, want DO %t",
+				c.orig_do, c.do_mode, e, c.want_do)
+		}
+
+		// or on its own
+		msg = SetDoBit(new_msg(), c.do_mode)
+		e = msg.IsEdns0()
+		if e == nil {
+			// only asking for DO adds an OPT record
+			if c.want_do || (c.orig_do >= 0) {
+				t.Errorf("SetDoBit() starting with DO %d, mode %s removed OPT", c.orig_do, c.do_mode)
+			}
+			continue
+		}
+		want_size := uint16(512)
+		if c.orig_do < 0 {
+			want_size = dns.DefaultMsgSize
+		}
+		if (count_opt(msg) != 1) || (e.UDPSize() != want_size) || (e.Do() != c.want_do) {
+			t.Errorf("SetDoBit() starting with DO %d, mode %s gave %s, want DO %t",
+				c.orig_do, c.do_mode, e, c.want_do)
+		}
+	}
+}
+
+// Start a DNS server on the loopback address using the given handler,
+// returning the address to send queries to.
+func start_mock_server(t *testing.T, handler dns.HandlerFunc) (addr string, server *dns.Server) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening for mock server: %s", err)
+	}
+	started := make(chan bool)
+	server = &dns.Server{PacketConn: pc, Handler: handler,
+		NotifyStartedFunc: func() { started <- true }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), server
+}
+
+// mock server handler that echoes back any EDNS options in the query
+func echo_opt_handler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	e := r.IsEdns0()
+	if e != nil {
+		m.SetEdns0(e.UDPSize(), e.Do())
+		m.IsEdns0().Option = e.Option
+	}
+	w.WriteMsg(m)
+}
+
+// mock server handler that answers with EDNS but without any options
+func drop_opt_handler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.IsEdns0() != nil {
+		m.SetEdns0(r.IsEdns0().UDPSize(), false)
+	}
+	w.WriteMsg(m)
+}
+
+func TestParseEdnsOpt(t *testing.T) {
+	opt, err := parse_edns_opt("65001:cafe")
+	if err != nil {
+		t.Fatalf("parse_edns_opt(\"65001:cafe\") error: %s", err)
+	}
+	if (opt.Code != 65001) || (hex.EncodeToString(opt.Data) != "cafe") {
+		t.Errorf("parse_edns_opt(\"65001:cafe\") == %d:%x", opt.Code, opt.Data)
+	}
+	for _, bad := range []string{"65001", "x:cafe", "70000:cafe", "65001:xyz", "3:cafe"} {
+		_, err = parse_edns_opt(bad)
+		if err == nil {
+			t.Errorf("parse_edns_opt(%q) should fail", bad)
+		}
+	}
+}
+
+func TestAddEdnsOption(t *testing.T) {
+	opt := &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2}}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.", dns.TypeA)
+	AddEdnsOption(msg, opt)
+	AddEdnsOption(msg, opt)
+	e := msg.IsEdns0()
+	if e == nil {
+		t.Fatalf("Missing OPT record on message")
+	}
+	if len(e.Option) != 1 {
+		t.Errorf("%d EDNS options, expected 1", len(e.Option))
+	}
+}
+
+func TestEdnsOptHandling(t *testing.T) {
+	echo_addr, echo_server := start_mock_server(t, echo_opt_handler)
+	defer echo_server.Shutdown()
+	drop_addr, drop_server := start_mock_server(t, drop_opt_handler)
+	defer drop_server.Shutdown()
+
+	opt := &dns.EDNS0_LOCAL{Code: 65001, Data: []byte("ymmv")}
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeA)
+	AddEdnsOption(query, opt)
+
+	echo_resp, _, err := dnsstub.DnsQuery(echo_addr, query)
+	if err != nil {
+		t.Fatalf("Error querying echo server: %s", err)
+	}
+	if edns_opt_handling(opt, echo_resp) != "echoed" {
+		t.Errorf("echo server handling == %q, want \"echoed\"", edns_opt_handling(opt, echo_resp))
+	}
+	drop_resp, _, err := dnsstub.DnsQuery(drop_addr, query)
+	if err != nil {
+		t.Fatalf("Error querying drop server: %s", err)
+	}
+	if edns_opt_handling(opt, drop_resp) != "dropped" {
+		t.Errorf("drop server handling == %q, want \"dropped\"", edns_opt_handling(opt, drop_resp))
+	}
+
+	// same behavior means no differences
+	if diffs := compare_edns_opt(opt, echo_resp, echo_resp); len(diffs) != 0 {
+		t.Errorf("compare_edns_opt() with same behavior gave %q", diffs)
+	}
+	diffs := compare_edns_opt(opt, drop_resp, echo_resp)
+	if len(diffs) != 1 || !strings.Contains(diffs[0], "IANA dropped vs Yeti echoed") {
+		t.Errorf("compare_edns_opt() == %q, want dropped vs echoed", diffs)
+	}
+}
+
+func TestCheckNameLimits(t *testing.T) {
+	long_label := strings.Repeat("x", MAX_LABEL_LEN)
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{".", true},
+		{"example.", true},
+		{"ymmv.0123456789abcdef." + long_label + ".", true},
+		{"ymmv.0123456789abcdef." + long_label + "x.", false},
+		{strings.Repeat(long_label+".", 4), false},
+		{strings.Repeat(long_label+".", 3), true},
+	}
+	for _, c := range cases {
+		err := check_name_limits(c.name)
+		if (err == nil) != c.valid {
+			t.Errorf("check_name_limits(%q) == %v, want valid %t", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestObfuscateQueryLimits(t *testing.T) {
+	defer func(n int) { obfuscate_hash_len = n }(obfuscate_hash_len)
+
+	// the longest hash still fits in a label
+	obfuscate_hash_len = MAX_HASH_LEN
+	long_tld := strings.Repeat("t", MAX_LABEL_LEN)
+	obf := obfuscate_query("www." + long_tld)
+	labels := dns.SplitDomainName(obf)
+	if len(labels[1]) != MAX_HASH_LEN {
+		t.Errorf("obfuscate_query() hash label is %d octets, want %d", len(labels[1]), MAX_HASH_LEN)
+	}
+	if err := check_name_limits(obf); err != nil {
+		t.Errorf("obfuscate_query() == %q, invalid: %s", obf, err)
+	}
+
+	// a pathologically long TLD produces a name that fails the check
+	obf = obfuscate_query("www." + long_tld + "t")
+	if err := check_name_limits(obf); err == nil {
+		t.Errorf("obfuscate_query() == %q, should be invalid", obf)
+	}
+}
+
+func TestObfuscateName(t *testing.T) {
+	long_label := strings.Repeat("x", MAX_LABEL_LEN)
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"www.example.", true},
+		{"www.example", true},
+		{"www.example..com.", false},
+		{".example.", false},
+		{"www..", false},
+		{"www." + long_label + ".", true},
+		{"www." + long_label + "x.", false},
+		{strings.Repeat(long_label+".", 4), false},
+	}
+	for _, c := range cases {
+		obf, err := obfuscate_name(c.name)
+		if (err == nil) != c.valid {
+			t.Errorf("obfuscate_name(%q) == %q, %v, want valid %t", c.name, obf, err, c.valid)
+		}
+		if (err == nil) && (check_name_limits(obf) != nil) {
+			t.Errorf("obfuscate_name(%q) == %q, which is invalid", c.name, obf)
+		}
+	}
+
+	// a name that is fine until the hash is added to it
+	defer func(n int) { obfuscate_keep_labels = n }(obfuscate_keep_labels)
+	obfuscate_keep_labels = 4
+	name := "a." + strings.Repeat(long_label+".", 3) + strings.Repeat("y", 58) + "."
+	if check_query_name(name) != nil {
+		t.Fatalf("check_query_name(%q) should be valid", name)
+	}
+	if obf, err := obfuscate_name(name); err == nil {
+		t.Errorf("obfuscate_name(%q) with -L 4 == %q, want an error", name, obf)
+	}
+	obfuscate_keep_labels = 1
+
+	// an escaped dot is part of a label, not between labels
+	obf, err := obfuscate_name("www\\.example.com.")
+	if (err != nil) || !strings.HasSuffix(obf, ".com.") || (dns.CountLabel(obf) != 3) {
+		t.Errorf("obfuscate_name() with an escaped dot == %q, %v", obf, err)
+	}
+
+	// a query for a name with a double dot is skipped, rather than sent
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+	query := new(dns.Msg)
+	query.SetQuestion("www.example..com.", dns.TypeA)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	yeti_query(done, new(report_conf), srvs, &query_conf{}, nil, nil, query, empty_answer("", query),
+		time.Millisecond, &addr)
+	<-done
+	if (len(*sent) != 0) || (srvs.skips[SKIP_INVALID_NAME] != 1) {
+		t.Errorf("query for a double dot name sent %d queries, skips %v", len(*sent), srvs.skips)
+	}
+}
+
+func TestCompareCacheTTL(t *testing.T) {
+	positive := func(ttls ...uint32) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.", dns.TypeNS)
+		for _, ttl := range ttls {
+			rr, _ := dns.NewRR(fmt.Sprintf("example. %d IN NS ns.example.", ttl))
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+	negative := func(ttl uint32, minttl uint32) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("nonexistent.", dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		rr, _ := dns.NewRR(fmt.Sprintf(". %d IN SOA a.root. nstld. 1 1800 900 604800 %d", ttl, minttl))
+		m.Ns = append(m.Ns, rr)
+		return m
+	}
+
+	cases := []struct {
+		iana      *dns.Msg
+		yeti      *dns.Msg
+		min_delta uint32
+		ndiffs    int
+	}{
+		// positive responses use the lowest TTL in the answer
+		{positive(172800, 3600), positive(3600), 0, 0},
+		{positive(172800, 3600), positive(172800), 0, 1},
+		{positive(172800, 3600), positive(3700), 300, 0},
+		{positive(172800, 3600), positive(3700), 100, 1},
+		// negative responses use min(SOA TTL, SOA minimum)
+		{negative(86400, 86400), negative(86400, 3600), 0, 1},
+		{negative(3600, 86400), negative(86400, 3600), 0, 0},
+		// a negative answer without an SOA is not cacheable
+		{negative(86400, 86400), new(dns.Msg), 0, 1},
+	}
+	for n, c := range cases {
+		diffs := compare_cache_ttl(c.iana, c.yeti, c.min_delta)
+		if len(diffs) != c.ndiffs {
+			t.Errorf("case %d: compare_cache_ttl() == %q, want %d differences", n, diffs, c.ndiffs)
+		}
+	}
+
+	diffs := compare_cache_ttl(negative(86400, 86400), negative(86400, 3600), 0)
+	if (len(diffs) != 1) || !strings.Contains(diffs[0], "IANA 86400 vs Yeti 3600 (delta 82800)") {
+		t.Errorf("compare_cache_ttl() == %q, want TTLs and delta", diffs)
+	}
+}
+
+// Replace the function used to query the Yeti servers with one that
+// records the queries sent and answers them via the given function.
+// Returns the recorded queries and a function to restore the original.
+func mock_dns_query(answer func(server string, query *dns.Msg) *dns.Msg) (sent *[]*dns.Msg, restore func()) {
+	sent = new([]*dns.Msg)
+	var lock sync.Mutex
+	orig := dns_query
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		lock.Lock()
+		*sent = append(*sent, query.Copy())
+		lock.Unlock()
+		return answer(server, query), time.Millisecond, nil
+	}
+	return sent, func() { dns_query = orig }
+}
+
+// answer a query with an empty response
+func empty_answer(server string, query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	return resp
+}
+
+// run yeti_query for a single captured query against the given servers
+func run_yeti_query(qcfg *query_conf, query *dns.Msg, answer *dns.Msg, ips ...string) {
+	var addrs []net.IP
+	for _, ip := range ips {
+		addrs = append(addrs, net.ParseIP(ip))
+	}
+	srvs := init_yeti_server_set(addrs, "all")
+	var report report_conf
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	yeti_query(done, &report, srvs, qcfg, nil, nil, query, answer, time.Millisecond, &addr)
+	<-done
+}
+
+func TestQueryCheckingDisabled(t *testing.T) {
+	cases := []struct {
+		cd_mode  string
+		captured bool
+		want     bool
+	}{
+		{"capture", false, false},
+		{"capture", true, true},
+		{"on", false, true},
+		{"on", true, true},
+		{"off", true, false},
+	}
+	for _, c := range cases {
+		sent, restore := mock_dns_query(empty_answer)
+		query := new(dns.Msg)
+		query.SetQuestion("example.", dns.TypeNS)
+		query.CheckingDisabled = c.captured
+		answer := empty_answer("", query)
+		qcfg := query_conf{clear_names: true, cd_mode: c.cd_mode}
+		run_yeti_query(&qcfg, query, answer, "2001:db8::1")
+		restore()
+		if len(*sent) != 1 {
+			t.Fatalf("%d queries sent, expected 1", len(*sent))
+		}
+		if (*sent)[0].CheckingDisabled != c.want {
+			t.Errorf("cd_mode %s with captured CD %t sent CD %t, want %t",
+				c.cd_mode, c.captured, (*sent)[0].CheckingDisabled, c.want)
+		}
+	}
+}
+
+// Run a query with glog logging everything to stderr, returning what
+// was logged.
+func logged_yeti_query(t *testing.T, qcfg *query_conf, query *dns.Msg, answer *dns.Msg) string {
+	flag.Set("logtostderr", "true")
+	flag.Set("v", "1")
+	defer flag.Set("logtostderr", "false")
+	defer flag.Set("v", "0")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe() error: %s", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	run_yeti_query(qcfg, query, answer, "2001:db8::1")
+	os.Stderr = stderr
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestReportRtt(t *testing.T) {
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		resp := empty_answer(server, query)
+		resp.Authoritative = true
+		return resp, 12345 * time.Microsecond, nil
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	var out bytes.Buffer
+	qcfg := query_conf{clear_names: true, json_out: new_json_writer(&out)}
+	logged := logged_yeti_query(t, &qcfg, query, empty_answer("", query))
+	for _, want := range []string{
+		"answer from  @ [2001:db8::1]:53 in 12.3ms\n",
+		"Differences in response for example. NS from  @ [2001:db8::1]:53, RTT 12.3ms\n",
+	} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("log missing %q:\n%s", want, logged)
+		}
+	}
+	if !strings.Contains(out.String(), `"rtt_ms":12.345,`) {
+		t.Errorf("JSON result missing the RTT: %s", out.String())
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	_, restore := mock_dns_query(empty_answer)
+	defer restore()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+
+	// make sure we actually catch the logging of each query
+	qcfg := query_conf{clear_names: true}
+	if out := logged_yeti_query(t, &qcfg, query, answer); out == "" {
+		t.Fatalf("nothing logged for a query without -q")
+	}
+
+	// equivalent answers log nothing in quiet mode
+	qcfg.quiet = true
+	if out := logged_yeti_query(t, &qcfg, query, answer); out != "" {
+		t.Errorf("equivalent answers with -q logged %q", out)
+	}
+
+	// neither do skipped queries
+	skipped := new(dns.Msg)
+	skipped.SetQuestion(".", dns.TypeSOA)
+	if out := logged_yeti_query(t, &qcfg, skipped, empty_answer("", skipped)); out != "" {
+		t.Errorf("skipped query with -q logged %q", out)
+	}
+
+	// but differences do
+	different := empty_answer("", query)
+	different.Rcode = dns.RcodeNameError
+	if out := logged_yeti_query(t, &qcfg, query, different); !strings.Contains(out, "Differences") {
+		t.Errorf("different answers with -q logged %q", out)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+	defer func(secret []byte) { obfuscate_secret = secret }(obfuscate_secret)
+	obfuscate_secret = []byte("dry run secret")
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	query.CheckingDisabled = true
+	query.SetEdns0(1232, true)
+	answer := empty_answer("", query)
+
+	var out bytes.Buffer
+	qcfg := query_conf{dry_run: &out, edns_size: 4093}
+	run_yeti_query(&qcfg, query, answer, "2001:db8::1", "192.0.2.1")
+	if len(*sent) != 0 {
+		t.Fatalf("%d queries sent in a dry run", len(*sent))
+	}
+	obf := obfuscate_query("www.example.com.")
+	want := "dry run: 'www.example.com.' A as '" + obf + "' to  @ [2001:db8::1]:53, flags rd cd, EDNS size 4093 do\n" +
+		"dry run: 'www.example.com.' A as '" + obf + "' to  @ 192.0.2.1:53, flags rd cd, EDNS size 4093 do\n"
+	if out.String() != want {
+		t.Errorf("dry run wrote:\n%s\nexpected:\n%s", out.String(), want)
+	}
+}
+
+func TestQueryRate(t *testing.T) {
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+
+	// 5 queries at 20 per second takes at least 200ms after the first
+	qcfg := query_conf{clear_names: true, limiter: rate.NewLimiter(20, 1)}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for n := 0; n < 5; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run_yeti_query(&qcfg, query, answer, "2001:db8::1")
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if len(*sent) != 5 {
+		t.Fatalf("%d queries sent, expected 5", len(*sent))
+	}
+	if elapsed < 180*time.Millisecond {
+		t.Errorf("5 queries at 20 per second took only %s", elapsed)
+	}
+}
+
+func TestQueryFlagsPreserved(t *testing.T) {
+	for n := 0; n < 16; n++ {
+		rd, cd, ad, do := (n&1) != 0, (n&2) != 0, (n&4) != 0, (n&8) != 0
+		sent, restore := mock_dns_query(empty_answer)
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		query.RecursionDesired = rd
+		query.CheckingDisabled = cd
+		query.AuthenticatedData = ad
+		query.SetEdns0(1232, do)
+		// changing the EDNS buffer size keeps the DO bit
+		qcfg := query_conf{clear_names: true, edns_size: 4093}
+		run_yeti_query(&qcfg, query, empty_answer("", query), "2001:db8::1")
+		restore()
+		if len(*sent) != 1 {
+			t.Fatalf("%d queries sent, expected 1", len(*sent))
+		}
+		out := (*sent)[0]
+		e := out.IsEdns0()
+		if (out.RecursionDesired != rd) || (out.CheckingDisabled != cd) ||
+			(out.AuthenticatedData != ad) || (e == nil) || (e.Do() != do) {
+			t.Errorf("captured RD %t CD %t AD %t DO %t, sent:\n%s", rd, cd, ad, do, out)
+		}
+	}
+}
+
+func TestYetiQueryMultipleTargets(t *testing.T) {
+	// the first server agrees with IANA, the second adds an extra NS
+	extra_ns, _ := dns.NewRR("example. 172800 IN NS ns.other.")
+	answer := func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		rr, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+		resp.Ns = append(resp.Ns, rr)
+		if server == "[2001:db8::2]:53" {
+			resp.Ns = append(resp.Ns, extra_ns)
+		}
+		return resp
+	}
+	sent, restore := mock_dns_query(answer)
+	defer restore()
+
+	df, err := open_daily_file(t.TempDir()+"/diff", "")
+	if err != nil {
+		t.Fatalf("Error opening differences file: %s", err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	iana_resp := answer("", query)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, "all")
+	if len(srvs.next()) != 2 {
+		t.Fatalf("next() returned %d targets, expected 2", len(srvs.next()))
+	}
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	qcfg := query_conf{clear_names: false, edns_size: 4093}
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, df, query, iana_resp, time.Millisecond, &addr)
+	<-done
+
+	// each target got an identical query, and the original is untouched
+	if len(*sent) != 2 {
+		t.Fatalf("%d queries sent, expected 2", len(*sent))
+	}
+	if (*sent)[0].String() != (*sent)[1].String() {
+		t.Errorf("queries differ between targets:\n%s\n%s", (*sent)[0], (*sent)[1])
+	}
+	if (query.Question[0].Name != "www.example.") || (query.IsEdns0() != nil) {
+		t.Errorf("original query modified: %s", query)
+	}
+	// the obfuscated name is made from the original name for every
+	// target, rather than obfuscating an already obfuscated name
+	obf := obfuscate_query("www.example.")
+	for n, sent_query := range *sent {
+		if sent_query.Question[0].Name != obf {
+			t.Errorf("query %d sent for %s, want %s", n, sent_query.Question[0].Name, obf)
+		}
+	}
+	if iana_resp.Question[0].Name != "www.example." {
+		t.Errorf("captured answer modified: %s", iana_resp)
+	}
+
+	// only the second target is reported as different
+	contents, err := os.ReadFile(df.cur_name)
+	if err != nil {
+		t.Fatalf("Error reading differences file: %s", err)
+	}
+	if strings.Count(string(contents), "Yeti IP:") != 1 {
+		t.Errorf("expected one set of differences, got:\n%s", contents)
+	}
+	if !strings.Contains(string(contents), "Yeti IP: 2001:db8::2\n") ||
+		!strings.Contains(string(contents), "Authority section, Yeti only: "+extra_ns.String()) {
+		t.Errorf("differences not attributed to second target:\n%s", contents)
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	resp := new(dns.Msg)
+	dname, _ := dns.NewRR("old. 86400 IN DNAME new.")
+	resp.Answer = append(resp.Answer, dname)
+	cases := []struct {
+		qname  string
+		target string
+		ok     bool
+	}{
+		{"www.old.", "www.new.", true},
+		{"a.b.OLD.", "a.b.new.", true},
+		// a DNAME does not redirect its own name
+		{"old.", "", false},
+		{"www.other.", "", false},
+	}
+	for _, c := range cases {
+		target, ok := redirect_target(resp, c.qname)
+		if (target != c.target) || (ok != c.ok) {
+			t.Errorf("redirect_target(%q) == %q, %t, want %q, %t", c.qname, target, ok, c.target, c.ok)
+		}
+	}
+	// a CNAME takes priority over the DNAME
+	cname, _ := dns.NewRR("www.old. 86400 IN CNAME www.cname.")
+	resp.Answer = append(resp.Answer, cname)
+	target, _ := redirect_target(resp, "www.old.")
+	if target != "www.cname." {
+		t.Errorf("redirect_target(\"www.old.\") == %q, want \"www.cname.\"", target)
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	// the root has a DNAME from old. to new., and the Yeti server gives a
+	// different delegation for new. than the IANA server
+	answer := func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		qname := query.Question[0].Name
+		if qname == "www.old." {
+			dname, _ := dns.NewRR("old. 86400 IN DNAME new.")
+			cname, _ := dns.NewRR("www.old. 86400 IN CNAME www.new.")
+			resp.Answer = append(resp.Answer, dname, cname)
+		} else if qname == "www.new." {
+			ns, _ := dns.NewRR("new. 172800 IN NS ns.new.")
+			if server == "[2001:db8::1]:53" {
+				ns, _ = dns.NewRR("new. 172800 IN NS ns.elsewhere.")
+			}
+			resp.Ns = append(resp.Ns, ns)
+		}
+		return resp
+	}
+	sent, restore := mock_dns_query(answer)
+	defer restore()
+
+	df, err := open_daily_file(t.TempDir()+"/diff", "")
+	if err != nil {
+		t.Fatalf("Error opening differences file: %s", err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.old.", dns.TypeA)
+	iana_resp := answer("[192.0.2.1]:53", query)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	qcfg := query_conf{clear_names: true, follow_redirects: true}
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, df, query, iana_resp, time.Millisecond, &addr)
+	<-done
+
+	// the original query, plus a follow-up to each of IANA and Yeti
+	if len(*sent) != 3 {
+		t.Fatalf("%d queries sent, expected 3", len(*sent))
+	}
+	contents, err := os.ReadFile(df.cur_name)
+	if err != nil {
+		t.Fatalf("Error reading differences file: %s", err)
+	}
+	if !strings.Contains(string(contents), "Redirection step 1 (www.new.): Authority section, Yeti only:") {
+		t.Errorf("redirection difference not reported:\n%s", contents)
+	}
+
+	// without the flag we only compare the DNAME answer, which matches
+	sent, restore = mock_dns_query(answer)
+	defer restore()
+	qcfg.follow_redirects = false
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, iana_resp, time.Millisecond, &addr)
+	<-done
+	if len(*sent) != 1 {
+		t.Errorf("%d queries sent without following, expected 1", len(*sent))
+	}
+
+	// with -6 we cannot query the IPv4 address the query was captured
+	// from, so we do not follow
+	sent, restore = mock_dns_query(answer)
+	defer restore()
+	qcfg.follow_redirects = true
+	qcfg.iana_opts.Family = 6
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, iana_resp, time.Millisecond, &addr)
+	<-done
+	if len(*sent) != 1 {
+		t.Errorf("%d queries sent following from an IPv4 address with -6, expected 1", len(*sent))
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+	rr, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+	answer.Ns = append(answer.Ns, rr)
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		addr := net.ParseIP(ip)
+		y := &ymmv_message{ip_family: 6, ip_protocol: 'u', addr: &addr,
+			query_time: time.Unix(1476000000, 1234), query: query,
+			answer_time: time.Unix(1476000001, 5678), answer: answer}
+		if addr.To4() != nil {
+			y.ip_family = 4
+		}
+		var buf bytes.Buffer
+		err := WriteMessage(&buf, y)
+		if err != nil {
+			t.Fatalf("WriteMessage() error: %s", err)
+		}
+		got, err := read_next_message(&buf)
+		if err != nil {
+			t.Fatalf("read_next_message() error: %s", err)
+		}
+		if (got.ip_family != y.ip_family) || !got.addr.Equal(addr) || (got.ip_protocol != 'u') {
+			t.Errorf("read back IPv%d %s %c, want IPv%d %s u",
+				got.ip_family, got.addr, got.ip_protocol, y.ip_family, addr)
+		}
+		if !got.query_time.Equal(y.query_time) || !got.answer_time.Equal(y.answer_time) {
+			t.Errorf("read back times %s, %s", got.query_time, got.answer_time)
+		}
+		if (got.query.String() != query.String()) || (got.answer.String() != answer.String()) {
+			t.Errorf("read back messages differ:\n%s\n%s", got.query, got.answer)
+		}
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	// the DNS library reports an answer with TC=1 as truncated when
+	// unpacking it, but we still want to compare it
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+	answer.Truncated = true
+	addr := net.ParseIP("192.0.2.1")
+	y := &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+		query_time: time.Unix(1476000000, 0), query: query,
+		answer_time: time.Unix(1476000001, 0), answer: answer}
+	var buf bytes.Buffer
+	err := WriteMessage(&buf, y)
+	if err != nil {
+		t.Fatalf("WriteMessage() error: %s", err)
+	}
+	got, err := read_next_message(&buf)
+	if err != nil {
+		t.Fatalf("read_next_message() of a truncated answer error: %s", err)
+	}
+	if !got.answer.Truncated || (got.answer.String() != answer.String()) {
+		t.Errorf("read back answer differs:\n%s", got.answer)
+	}
+}
+
+func TestReadMessageChecksum(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+	rr, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+	answer.Ns = append(answer.Ns, rr)
+	addr := net.ParseIP("192.0.2.1")
+	y := &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+		query_time: time.Unix(1476000000, 1234), query: query,
+		answer_time: time.Unix(1476000001, 5678), answer: answer}
+
+	// a message with a checksum, then one without, can both be read
+	var buf bytes.Buffer
+	WriteMessageChecksum(&buf, y)
+	checksummed := buf.Len()
+	WriteMessage(&buf, y)
+	if checksummed != buf.Len()-checksummed+5 {
+		t.Errorf("message with checksum is %d bytes, expected 5 more than %d",
+			checksummed, buf.Len()-checksummed)
+	}
+	in := &offset_reader{r: bytes.NewReader(buf.Bytes())}
+	for n := 0; n < 2; n++ {
+		got, err := read_next_message(in)
+		if err != nil {
+			t.Fatalf("read_next_message() error: %s", err)
+		}
+		if got.answer.String() != answer.String() {
+			t.Errorf("read back answer %s", got.answer)
+		}
+	}
+
+	// corrupt the TTL of the NS record in the answer of the second of
+	// three messages with checksums, which still unpacks fine
+	buf.Reset()
+	for n := 0; n < 3; n++ {
+		WriteMessageChecksum(&buf, y)
+	}
+	stream := buf.Bytes()
+	stream[2*checksummed-20] ^= 0x01
+	in = &offset_reader{r: bytes.NewReader(stream)}
+	if _, err := read_next_message(in); err != nil {
+		t.Fatalf("read_next_message() of the first message error: %s", err)
+	}
+	_, err := read_next_message(in)
+	if _, ok := err.(*checksum_error); !ok || !strings.HasPrefix(err.Error(),
+		fmt.Sprintf("checksum mismatch at message 2 (offset %d): ", checksummed)) {
+		t.Errorf("read_next_message() of a corrupted message returned %v", err)
+	}
+	if _, err := read_next_message(in); err != nil {
+		t.Errorf("read_next_message() after a corrupted message error: %s", err)
+	}
+}
+
+func TestReadNextMessageShortReads(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	answer := empty_answer("", query)
+	rr, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+	answer.Ns = append(answer.Ns, rr)
+	addr := net.ParseIP("2001:db8::1")
+	y := &ymmv_message{ip_family: 6, ip_protocol: 't', addr: &addr,
+		query_time: time.Unix(1476000000, 1234), query: query,
+		answer_time: time.Unix(1476000001, 5678), answer: answer}
+	var buf bytes.Buffer
+	WriteMessage(&buf, y)
+	WriteMessage(&buf, y)
+	// a pipe may give us as little as one byte for each read
+	r := iotest.OneByteReader(&buf)
+	for n := 0; n < 2; n++ {
+		got, err := read_next_message(r)
+		if err != nil {
+			t.Fatalf("read_next_message() error: %s", err)
+		}
+		if !got.addr.Equal(addr) || (got.answer.String() != answer.String()) {
+			t.Errorf("read back IPv%d %s %s", got.ip_family, got.addr, got.answer)
+		}
+	}
+	_, err := read_next_message(r)
+	if err != io.EOF {
+		t.Errorf("read_next_message() at end of stream returned %v, want EOF", err)
+	}
+	// errors other than the end of the stream say which field failed
+	_, err = read_next_message(io.MultiReader(strings.NewReader("ymmv"), iotest.ErrReader(iotest.ErrTimeout)))
+	if (err == nil) || (err.Error() != "offset 4: Error reading format version or IP family: timeout") {
+		t.Errorf("read_next_message() with a failing reader returned %v", err)
+	}
+}
+
+func TestReadNextMessageOffset(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1}
+	// a 25 byte DNS message, so each record is 80 bytes, and the answer
+	// starts at offset 55
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	msg, _ := query.Pack()
+	cases := []struct {
+		stream []byte
+		err    string
+	}{
+		{append(raw_record('4', 'u', v4, msg, msg), raw_record('5', 'u', v4, msg, msg)...),
+			"offset 84: Unsupported ymmv format version 53"},
+		{append(raw_record('4', 'u', v4, msg, msg), []byte("yxmv")...),
+			"offset 80: Magic 'yxmv' instead of 'ymmv'"},
+		{raw_record('4', 'u', v4, msg, msg)[:57],
+			"offset 55: Only read 2 of 25 bytes of answer message"},
+	}
+	for _, c := range cases {
+		in := &offset_reader{r: bytes.NewReader(c.stream)}
+		var err error
+		for err == nil {
+			_, err = read_next_message(in)
+		}
+		if (err == io.EOF) || (err.Error() != c.err) {
+			t.Errorf("read_next_message() error %q, want %q", err, c.err)
+		}
+	}
+	// the end of the stream between messages is not an error
+	in := &offset_reader{r: bytes.NewReader(raw_record('4', 'u', v4, msg, msg))}
+	read_next_message(in)
+	_, err := read_next_message(in)
+	if err != io.EOF {
+		t.Errorf("read_next_message() at end of stream returned %v, want EOF", err)
+	}
+}
+
+func TestReadNextMessageUnpackError(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1}
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeNS)
+	msg, _ := query.Pack()
+	// the question is cut off partway through
+	truncated := msg[:len(msg)-3]
+	stream := append(raw_record('4', 'u', v4, truncated, msg), raw_record('4', 'u', v4, msg, msg)...)
+	in := &offset_reader{r: bytes.NewReader(stream)}
+	_, err := read_next_message(in)
+	_, ok := err.(*unpack_error)
+	if !ok || !strings.HasPrefix(err.Error(), "offset 20: failed to unpack query message: ") {
+		t.Fatalf("read_next_message() for truncated query returned %v", err)
+	}
+	// we can go on to the next message
+	_, err = read_next_message(in)
+	if err != nil {
+		t.Errorf("read_next_message() after a bad message returned %v", err)
+	}
+}
+
+func TestRRSort(t *testing.T) {
+	sorted := func(rrs ...string) (result []string) {
+		var a []dns.RR
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("Error parsing RR '%s': %s", s, err)
+			}
+			a = append(a, rr)
+		}
+		sort.Sort(rr_sort(a))
+		for _, rr := range a {
+			result = append(result, rr.String())
+		}
+		return result
+	}
+	got := sorted("b.example. 300 IN A 192.0.2.2", "a.example. 300 IN A 192.0.2.1", "c.example. 300 IN A 192.0.2.3")
+	for n, name := range []string{"a.example.", "b.example.", "c.example."} {
+		if !strings.HasPrefix(got[n], name) {
+			t.Errorf("sorted by name == %q", got)
+			break
+		}
+	}
+	// the same name is ordered by type, TTL, then RDATA
+	got = sorted("a.example. 300 IN AAAA 2001:db8::1", "a.example. 600 IN A 192.0.2.1",
+		"a.example. 300 IN A 192.0.2.9", "A.example. 300 IN A 192.0.2.2")
+	want := []string{"a.example.\t300\tIN\tA\t192.0.2.2", "a.example.\t300\tIN\tA\t192.0.2.9",
+		"a.example.\t600\tIN\tA\t192.0.2.1", "a.example.\t300\tIN\tAAAA\t2001:db8::1"}
+	for n := range want {
+		if !strings.EqualFold(got[n], want[n]) {
+			t.Errorf("sorted with the same name == %q, want %q", got, want)
+			break
+		}
+	}
+}
+
+func TestCompareSectionDuplicates(t *testing.T) {
+	a, _ := dns.NewRR("example. 172800 IN NS a.example.")
+	b, _ := dns.NewRR("example. 172800 IN NS b.example.")
+	strs := func(rrs []dns.RR) (result []string) {
+		for _, rr := range rrs {
+			result = append(result, rr.String())
+		}
+		return result
+	}
+	cases := []struct {
+		iana      []dns.RR
+		yeti      []dns.RR
+		iana_only []dns.RR
+		yeti_only []dns.RR
+	}{
+		{[]dns.RR{a, a}, []dns.RR{a, a}, nil, nil},
+		{[]dns.RR{a, b, a}, []dns.RR{b, a, a}, nil, nil},
+		{[]dns.RR{a, a}, []dns.RR{a}, []dns.RR{a}, nil},
+		{[]dns.RR{a}, []dns.RR{a, a}, nil, []dns.RR{a}},
+		{[]dns.RR{a, a, b}, []dns.RR{a, b, b}, []dns.RR{a}, []dns.RR{b}},
+	}
+	for _, c := range cases {
+		yeti := append([]dns.RR{}, c.yeti...)
+		iana_only, yeti_only, _, _ := compare_section(c.iana, yeti, new(compare_conf))
+		got := fmt.Sprintf("%q %q", strs(iana_only), strs(yeti_only))
+		want := fmt.Sprintf("%q %q", strs(c.iana_only), strs(c.yeti_only))
+		if got != want {
+			t.Errorf("compare_section(%q, %q) == %s, want %s", strs(c.iana), strs(c.yeti), got, want)
+		}
+		// the section itself is left alone
+		if fmt.Sprint(strs(yeti)) != fmt.Sprint(strs(c.yeti)) {
+			t.Errorf("compare_section() changed the Yeti section to %q", strs(yeti))
+		}
+	}
+}
+
+func TestCompareDenial(t *testing.T) {
+	nxdomain := func(rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("nonexistent.", dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("Error parsing %q: %s", s, err)
+			}
+			m.Ns = append(m.Ns, rr)
+		}
+		return m
+	}
+	nsec3 := "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 %d %s 2t7b4g4vsa5smi47k61mv5bv1a22bojr NS SOA RRSIG DNSKEY NSEC3PARAM"
+
+	// identical proofs have no differences
+	diffs := compare_resp(nxdomain(fmt.Sprintf(nsec3, 12, "aabbccdd")), nxdomain(fmt.Sprintf(nsec3, 12, "AABBCCDD")), new(compare_conf)).Diffs()
+	if len(diffs) != 0 {
+		t.Errorf("compare_resp() with the same NSEC3 == %q", diffs)
+	}
+
+	// differing NSEC3 parameters are reported specifically
+	diffs = compare_resp(nxdomain(fmt.Sprintf(nsec3, 12, "aabbccdd")), nxdomain(fmt.Sprintf(nsec3, 0, "-")), new(compare_conf)).Diffs()
+	want := []string{
+		"NSEC3 proof mismatch for 0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.: IANA iterations 12 vs Yeti 0",
+		"NSEC3 proof mismatch for 0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.: IANA salt 'aabbccdd' vs Yeti '-'",
+	}
+	for _, w := range want {
+		found := false
+		for _, diff := range diffs {
+			found = found || (diff == w)
+		}
+		if !found {
+			t.Errorf("compare_resp() == %q, missing %q", diffs, w)
+		}
+	}
+
+	// NSEC bitmaps are compared regardless of order
+	iana := nxdomain("example. 86400 IN NSEC next.example. NS RRSIG NSEC")
+	yeti := nxdomain("example. 86400 IN NSEC next.example. NS RRSIG NSEC")
+	bitmap := yeti.Ns[0].(*dns.NSEC).TypeBitMap
+	bitmap[0], bitmap[2] = bitmap[2], bitmap[0]
+	if diffs := compare_resp(iana, yeti, new(compare_conf)).Diffs(); len(diffs) != 0 {
+		t.Errorf("compare_resp() with reordered NSEC bitmap == %q", diffs)
+	}
+	yeti = nxdomain("example. 86400 IN NSEC next.example. NS DS RRSIG NSEC")
+	diffs = compare_resp(iana, yeti, new(compare_conf)).Diffs()
+	if (len(diffs) != 3) || (diffs[2] != "NSEC proof mismatch for example.: IANA types [NS RRSIG NSEC] vs Yeti [NS DS RRSIG NSEC]") {
+		t.Errorf("compare_resp() with different NSEC types == %q", diffs)
+	}
+}
+
+func TestCompareDenialProof(t *testing.T) {
+	nxdomain := func(qname string, rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		rrs = append([]string{"example. 3600 IN SOA ns.example. hostmaster.example. 1 3600 900 604800 3600"}, rrs...)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("Error parsing %q: %s", s, err)
+			}
+			m.Ns = append(m.Ns, rr)
+		}
+		return m
+	}
+	// a signed NSEC3 chain for the names, with the given salt
+	nsec3_chain := func(salt string, names ...string) (rrs []string) {
+		var hashes []string
+		for _, name := range names {
+			hashes = append(hashes, strings.ToLower(dns.HashName(name, dns.SHA1, 1, salt)))
+		}
+		sort.Strings(hashes)
+		for n, hash := range hashes {
+			rrs = append(rrs,
+				fmt.Sprintf("%s.example. 3600 IN NSEC3 1 0 1 %s %s A RRSIG", hash, salt, hashes[(n+1)%len(hashes)]),
+				fmt.Sprintf("%s.example. 3600 IN RRSIG NSEC3 8 2 3600 20170701000000 20170601000000 12345 example. AAAA", hash))
+		}
+		return rrs
+	}
+	dnssec := &compare_conf{dnssec: true}
+
+	// different NSEC records that prove the same thing
+	iana := nxdomain("c.example.",
+		"b.example. 3600 IN NSEC d.example. A RRSIG NSEC",
+		"example. 3600 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY")
+	yeti := nxdomain("c.example.",
+		"bb.example. 3600 IN NSEC cc.example. A RRSIG NSEC",
+		"example. 3600 IN NSEC aa.example. NS SOA RRSIG NSEC DNSKEY")
+	if diffs := compare_resp(iana.Copy(), yeti.Copy(), dnssec).Diffs(); len(diffs) != 0 {
+		t.Errorf("compare_resp() with equivalent NSEC proofs == %q", diffs)
+	}
+	if diffs := compare_resp(iana.Copy(), yeti.Copy(), new(compare_conf)).Diffs(); len(diffs) == 0 {
+		t.Errorf("compare_resp() without -dnssec found no differences in the NSEC records")
+	}
+
+	// NSEC3 chains with different salts, and so different hashes
+	iana = nxdomain("nx.example.", nsec3_chain("aabbccdd", "example.", "a.example.")...)
+	yeti = nxdomain("nx.example.", nsec3_chain("1234", "example.", "a.example.")...)
+	if diffs := compare_resp(iana.Copy(), yeti.Copy(), dnssec).Diffs(); len(diffs) != 0 {
+		t.Errorf("compare_resp() with equivalent NSEC3 proofs == %q", diffs)
+	}
+
+	// each side proves it for its own name, which may be obfuscated
+	yeti = nxdomain("ymmv.0123456789abcdef.example.", nsec3_chain("1234", "example.", "a.example.")...)
+	if diffs := compare_resp(iana.Copy(), yeti.Copy(), dnssec).Diffs(); len(diffs) != 0 {
+		t.Errorf("compare_resp() with an obfuscated name == %q", diffs)
+	}
+
+	// a proof that leaves out the wildcard is not the same
+	iana = nxdomain("c.example.",
+		"b.example. 3600 IN NSEC d.example. A RRSIG NSEC",
+		"example. 3600 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY")
+	yeti = nxdomain("c.example.", "b.example. 3600 IN NSEC d.example. A RRSIG NSEC")
+	diffs := compare_resp(iana.Copy(), yeti.Copy(), dnssec).Diffs()
+	want := "Denial of existence mismatch: IANA proves no name below example., and no wildcard" +
+		" vs Yeti proves no name below example., but not that there is no wildcard"
+	found := false
+	for _, diff := range diffs {
+		found = found || (diff == want)
+	}
+	if !found {
+		t.Errorf("compare_resp() with a missing wildcard proof == %q, missing %q", diffs, want)
+	}
+
+	// NODATA proofs say whether the name has the type
+	rr, _ := dns.NewRR("c.example. 3600 IN NSEC d.example. TXT RRSIG NSEC")
+	if proof := denial_proof("c.example.", dns.TypeA, []dns.RR{rr}); proof != "the name exists without A" {
+		t.Errorf("denial_proof() for NODATA == %q", proof)
+	}
+	if proof := denial_proof("c.example.", dns.TypeTXT, []dns.RR{rr}); proof != "the name has TXT" {
+		t.Errorf("denial_proof() for a type in the bitmap == %q", proof)
+	}
+
+	// the last NSEC in the zone covers the names after it
+	last := &dns.NSEC{Hdr: dns.RR_Header{Name: "z.example."}, NextDomain: "example."}
+	if !nsec_covers(last, "zz.example.") || nsec_covers(last, "a.example.") {
+		t.Errorf("nsec_covers() wrong for the last NSEC in the zone")
+	}
+}
+
+func TestCompareRcodeOnly(t *testing.T) {
+	ns1, _ := dns.NewRR("example. 172800 IN NS ns1.example.")
+	ns2, _ := dns.NewRR("example. 172800 IN NS ns2.example.")
+	make_resp := func(rcode int, aa bool, ns dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.", dns.TypeA)
+		m.Response = true
+		m.Rcode = rcode
+		m.Authoritative = aa
+		m.Ns = append(m.Ns, ns)
+		return m
+	}
+	rcode_only := &compare_conf{rcode_only: true}
+
+	// same rcode but different contents: only a difference normally
+	iana := make_resp(dns.RcodeSuccess, false, ns1)
+	yeti := make_resp(dns.RcodeSuccess, true, ns2)
+	if diffs := compare_resp(iana.Copy(), yeti.Copy(), new(compare_conf)).Diffs(); len(diffs) == 0 {
+		t.Errorf("compare_resp() found no differences in contents")
+	}
+	if diffs := compare_resp(iana.Copy(), yeti.Copy(), rcode_only).Diffs(); len(diffs) != 0 {
+		t.Errorf("compare_resp() in rcode-only mode == %q, want none", diffs)
+	}
+
+	// same contents but different rcode: reported in both modes
+	iana = make_resp(dns.RcodeSuccess, false, ns1)
+	yeti = make_resp(dns.RcodeServerFailure, false, ns1)
+	want := "Rcode mismatch: IANA NOERROR vs Yeti SERVFAIL"
+	for _, ccfg := range []*compare_conf{new(compare_conf), rcode_only} {
+		diffs := compare_resp(iana.Copy(), yeti.Copy(), ccfg).Diffs()
+		if (len(diffs) != 1) || (diffs[0] != want) {
+			t.Errorf("compare_resp(%+v) == %q, want %q", *ccfg, diffs, want)
+		}
+	}
+}
+
+func TestLoadOrCreateSecret(t *testing.T) {
+	defer func(secret []byte) { obfuscate_secret = secret }(obfuscate_secret)
+
+	fname := t.TempDir() + "/secret"
+	secret, created, err := load_or_create_secret(fname)
+	if err != nil {
+		t.Fatalf("load_or_create_secret() error: %s", err)
+	}
+	if !created || (len(secret) != 8) {
+		t.Errorf("load_or_create_secret() == %x, %t, want new 8-byte secret", secret, created)
+	}
+	obfuscate_secret = secret
+	obf := obfuscate_query("www.example.")
+
+	// a later run loads the same secret and gets the same names
+	obfuscate_secret = nil
+	loaded, created, err := load_or_create_secret(fname)
+	if err != nil {
+		t.Fatalf("load_or_create_secret() error: %s", err)
+	}
+	if created || !bytes.Equal(loaded, secret) {
+		t.Errorf("load_or_create_secret() == %x, %t, want %x loaded", loaded, created, secret)
+	}
+	obfuscate_secret = loaded
+	if obfuscate_query("www.example.") != obf {
+		t.Errorf("obfuscate_query() with loaded secret == %q, want %q", obfuscate_query("www.example."), obf)
+	}
+
+	// a file with garbage is an error
+	os.WriteFile(fname, []byte("not hex\n"), 0600)
+	_, _, err = load_or_create_secret(fname)
+	if err == nil {
+		t.Errorf("load_or_create_secret() should fail for a bad secret")
+	}
+}
+
+func TestYetiQueryShowFull(t *testing.T) {
+	// the first server agrees with IANA, the second adds an extra NS
+	answer := func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		rr, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+		resp.Ns = append(resp.Ns, rr)
+		if server == "[2001:db8::2]:53" {
+			rr, _ = dns.NewRR("example. 172800 IN NS ns.other.")
+			resp.Ns = append(resp.Ns, rr)
+		}
+		return resp
+	}
+	_, restore := mock_dns_query(answer)
+	defer restore()
+
+	for _, show_full := range []bool{false, true} {
+		df, err := open_daily_file(t.TempDir()+"/diff", "")
+		if err != nil {
+			t.Fatalf("Error opening differences file: %s", err)
+		}
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, "all")
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		qcfg := query_conf{clear_names: true, show_full: show_full}
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, df, query, answer("", query), time.Millisecond, &addr)
+		<-done
+
+		contents, err := os.ReadFile(df.cur_name)
+		if err != nil {
+			t.Fatalf("Error reading differences file: %s", err)
+		}
+		// only the mismatched answer gets the full messages
+		want := 0
+		if show_full {
+			want = 1
+		}
+		if (strings.Count(string(contents), "---[ IANA ]---\n") != want) ||
+			(strings.Count(string(contents), "---[ Yeti ]---\n") != want) {
+			t.Errorf("show_full=%t, expected %d full dumps, got:\n%s", show_full, want, contents)
+		}
+		if show_full && (strings.Count(string(contents), ";; AUTHORITY SECTION:") != 2) {
+			t.Errorf("full dump missing complete answers:\n%s", contents)
+		}
+	}
+}
+
+func TestYetiQueryWrongID(t *testing.T) {
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		resp.Id = query.Id + 1
+		return resp
+	})
+	defer restore()
+
+	df, err := open_daily_file(t.TempDir()+"/diff", "")
+	if err != nil {
+		t.Fatalf("Error opening differences file: %s", err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	qcfg := query_conf{clear_names: true}
+	yeti_query(done, new(report_conf), srvs, &qcfg, nil, df, query, empty_answer("", query), time.Millisecond, &addr)
+	<-done
+
+	contents, err := os.ReadFile(df.cur_name)
+	if err != nil {
+		t.Fatalf("Error reading differences file: %s", err)
+	}
+	if !strings.Contains(string(contents), "Yeti response ID mismatch") {
+		t.Errorf("wrong response ID not reported:\n%s", contents)
+	}
+
+	// the right ID is fine
+	resp := empty_answer("", query)
+	if len(check_response_id(query, resp)) != 0 {
+		t.Errorf("check_response_id() reported matching IDs")
+	}
+}
+
+func TestCompareRule(t *testing.T) {
+	defer func(rules []CompareRule) { compare_rules = rules }(compare_rules)
+
+	iana_ns, _ := dns.NewRR("example. 172800 IN NS ns1.example.")
+	yeti_ns, _ := dns.NewRR("example. 172800 IN NS ns1.example.net.")
+	other_iana, _ := dns.NewRR("other. 172800 IN NS ns1.other.")
+	other_yeti, _ := dns.NewRR("other. 172800 IN NS ns2.other.")
+	iana := []dns.RR{iana_ns, other_iana}
+	yeti := []dns.RR{yeti_ns, other_yeti}
+
+	iana_only, yeti_only, _, _ := compare_section(iana, yeti, new(compare_conf))
+	if (len(iana_only) != 2) || (len(yeti_only) != 2) {
+		t.Fatalf("compare_section() without rules found %d IANA only and %d Yeti only, expected 2 each",
+			len(iana_only), len(yeti_only))
+	}
+
+	// a rule that says any NS for example. is fine, and has no opinion otherwise
+	RegisterCompareRule(CompareRuleFunc(func(iana_rr dns.RR, yeti_rr dns.RR) (bool, bool) {
+		if (iana_rr.Header().Name != "example.") || (iana_rr.Header().Rrtype != dns.TypeNS) {
+			return false, false
+		}
+		return iana_rr.Header().Name == yeti_rr.Header().Name, true
+	}))
+	iana_only, yeti_only, _, _ = compare_section(iana, yeti, new(compare_conf))
+	if (len(iana_only) != 1) || (len(yeti_only) != 1) {
+		t.Fatalf("compare_section() with rule found %d IANA only and %d Yeti only, expected 1 each",
+			len(iana_only), len(yeti_only))
+	}
+	if (iana_only[0] != other_iana) || (yeti_only[0] != other_yeti) {
+		t.Errorf("compare_section() with rule found wrong differences: %s, %s", iana_only[0], yeti_only[0])
+	}
+}
+
+func TestEdnsDependence(t *testing.T) {
+	// the server only gives glue when the query uses EDNS
+	answer := func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		ns, _ := dns.NewRR("example. 172800 IN NS ns.example.")
+		resp.Ns = append(resp.Ns, ns)
+		if query.IsEdns0() != nil {
+			glue, _ := dns.NewRR("ns.example. 172800 IN A 192.0.2.53")
+			resp.Answer = append(resp.Answer, glue)
+		}
+		return resp
+	}
+	sent, restore := mock_dns_query(answer)
+	defer restore()
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	query.SetEdns0(4096, false)
+	qcfg := query_conf{clear_names: true, edns_compare: true}
+	diffs := compare_edns_dependence(&qcfg, "[2001:db8::1]:53", query, answer("", query))
+	if len(*sent) != 1 {
+		t.Fatalf("%d queries sent, expected 1", len(*sent))
+	}
+	if (*sent)[0].IsEdns0() != nil {
+		t.Errorf("query sent with EDNS: %s", (*sent)[0])
+	}
+	if query.IsEdns0() == nil {
+		t.Errorf("original query lost EDNS")
+	}
+	if (len(diffs) != 2) ||
+		(diffs[0] != "Yeti with vs without EDNS: Answer section count mismatch: IANA 1 vs Yeti 0") ||
+		!strings.HasPrefix(diffs[1], "Yeti with vs without EDNS: Answer section, IANA only: ns.example.") {
+		t.Errorf("compare_edns_dependence() == %q", diffs)
+	}
+
+	// a server that ignores EDNS has no differences
+	_, restore2 := mock_dns_query(empty_answer)
+	defer restore2()
+	diffs = compare_edns_dependence(&qcfg, "[2001:db8::1]:53", query, empty_answer("", query))
+	if len(diffs) != 0 {
+		t.Errorf("compare_edns_dependence() for server ignoring EDNS == %q", diffs)
+	}
+}
+
+func TestStripEdns(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.", dns.TypeNS)
+	glue, _ := dns.NewRR("ns.example. 172800 IN A 192.0.2.53")
+	msg.Extra = append(msg.Extra, glue)
+	msg.SetEdns0(4096, true)
+	StripEdns(msg)
+	if (msg.IsEdns0() != nil) || (len(msg.Extra) != 1) {
+		t.Errorf("StripEdns() left %s", msg)
+	}
+}
+
+func TestSkipComparison(t *testing.T) {
+	cases := []struct {
+		qname  string
+		reason string
+	}{
+		{".", SKIP_ROOT_ZONE},
+		{"id.server.", SKIP_SERVER_INFO},
+		{"VERSION.SERVER.", SKIP_SERVER_INFO},
+		{"version.bind.", SKIP_SERVER_INFO},
+		{"hostname.bind.", SKIP_SERVER_INFO},
+		{"root-servers.net.", SKIP_ROOT_SERVERS},
+		{"a.root-servers.net.", SKIP_ROOT_SERVERS},
+		{"arpa.", SKIP_ARPA},
+		{"1.0.0.127.in-addr.arpa.", SKIP_ARPA},
+		{"www.example.", ""},
+		{"xroot-servers.net.", ""},
+	}
+	for _, c := range cases {
+		query := new(dns.Msg)
+		query.SetQuestion(c.qname, dns.TypeA)
+		reason := skip_comparison(query)
+		if reason != c.reason {
+			t.Errorf("skip_comparison(%s) == %q, want %q", c.qname, reason, c.reason)
+		}
+	}
+}
+
+func TestSkipPatterns(t *testing.T) {
+	defer func(rules []skip_rule) { skip_rules = rules }(skip_rules)
+
+	user_rules, err := parse_skip_patterns("Example.COM, *.test.,*.in-addr.arpa")
+	if err != nil {
+		t.Fatalf("parse_skip_patterns() error: %s", err)
+	}
+	cases := []struct {
+		qname         string
+		with_defaults string
+		no_defaults   string
+	}{
+		{"example.com.", SKIP_PATTERN, SKIP_PATTERN},
+		{"www.example.com.", "", ""},
+		{"test.", "", ""},
+		{"www.TEST.", SKIP_PATTERN, SKIP_PATTERN},
+		{"a.b.test.", SKIP_PATTERN, SKIP_PATTERN},
+		{"xtest.", "", ""},
+		{"1.0.0.127.in-addr.arpa.", SKIP_ARPA, SKIP_PATTERN},
+		{"ip6.arpa.", SKIP_ARPA, ""},
+		{"id.server.", SKIP_SERVER_INFO, ""},
+		{".", SKIP_ROOT_ZONE, ""},
+		{"www.example.", "", ""},
+	}
+	for _, no_defaults := range []bool{false, true} {
+		skip_rules = default_skip_rules()
+		if no_defaults {
+			skip_rules = nil
+		}
+		skip_rules = append(skip_rules, user_rules...)
+		for _, c := range cases {
+			want := c.with_defaults
+			if no_defaults {
+				want = c.no_defaults
+			}
+			query := new(dns.Msg)
+			query.SetQuestion(c.qname, dns.TypeA)
+			if reason := skip_comparison(query); reason != want {
+				t.Errorf("skip_comparison(%s) without defaults %t == %q, want %q",
+					c.qname, no_defaults, reason, want)
+			}
+		}
+		// no question is never compared
+		if skip_comparison(new(dns.Msg)) != SKIP_NO_QUESTION {
+			t.Errorf("skip_comparison() without a question == %q", skip_comparison(new(dns.Msg)))
+		}
+	}
+
+	for _, bad := range []string{"*", "*.", "a.*.example", "a..example"} {
+		if _, err := parse_skip_patterns(bad); err == nil {
+			t.Errorf("parse_skip_patterns(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestCompareArpa(t *testing.T) {
+	defer func(rules []skip_rule) { skip_rules = rules }(skip_rules)
+
+	cases := []struct {
+		qname   string
+		skipped string
+		arpa    string
+	}{
+		{"arpa.", SKIP_ARPA, ""},
+		{"1.0.0.127.in-addr.arpa.", SKIP_ARPA, ""},
+		{"b.d.0.1.0.0.2.ip6.arpa.", SKIP_ARPA, ""},
+		{"1.0.0.10.in-addr.arpa.", SKIP_ARPA, SKIP_PATTERN},
+		{".", SKIP_ROOT_ZONE, SKIP_ROOT_ZONE},
+		{"id.server.", SKIP_SERVER_INFO, SKIP_SERVER_INFO},
+		{"a.root-servers.net.", SKIP_ROOT_SERVERS, SKIP_ROOT_SERVERS},
+		{"www.example.", "", ""},
+	}
+	for _, compare_arpa := range []bool{false, true} {
+		var err error
+		// names given with -skip are skipped even with -compare-arpa
+		skip_rules, err = configure_skip_rules(false, compare_arpa, "*.10.in-addr.arpa")
+		if err != nil {
+			t.Fatalf("configure_skip_rules() error: %s", err)
+		}
+		for _, c := range cases {
+			want := c.skipped
+			if compare_arpa {
+				want = c.arpa
+			}
+			query := new(dns.Msg)
+			query.SetQuestion(c.qname, dns.TypePTR)
+			if reason := skip_comparison(query); reason != want {
+				t.Errorf("skip_comparison(%s) with -compare-arpa %t == %q, want %q",
+					c.qname, compare_arpa, reason, want)
+			}
+		}
+	}
+}
+
+func TestNoQuestion(t *testing.T) {
+	if skip_comparison(new(dns.Msg)) != SKIP_NO_QUESTION {
+		t.Errorf("skip_comparison() without a question == %q", skip_comparison(new(dns.Msg)))
+	}
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("www.example.", dns.TypeA)
+	formerr := new(dns.Msg)
+	formerr.Response = true
+	formerr.Rcode = dns.RcodeFormatError
+	want := "No question present, skipping comparison"
+	for _, ccfg := range []*compare_conf{new(compare_conf), {rcode_only: true}} {
+		diffs := compare_resp(resp, formerr, ccfg).Diffs()
+		if (len(diffs) != 1) || (diffs[0] != want) {
+			t.Errorf("compare_resp() without a question == %q", diffs)
+		}
+		diffs = compare_resp(formerr, resp, ccfg).Diffs()
+		if (len(diffs) != 1) || (diffs[0] != want) {
+			t.Errorf("compare_resp() without a question == %q", diffs)
+		}
+	}
+
+	// a captured query without a question is skipped, not sent
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	addr := net.ParseIP("192.0.2.1")
+	yeti_query(done, new(report_conf), srvs, &query_conf{clear_names: true}, nil, nil,
+		new(dns.Msg), formerr, time.Millisecond, &addr)
+	<-done
+	if len(*sent) != 0 {
+		t.Errorf("%d queries sent without a question", len(*sent))
+	}
+	if srvs.skips[SKIP_NO_QUESTION] != 1 {
+		t.Errorf("query without a question not counted as skipped: %v", srvs.skips)
+	}
+}
+
+func TestMissingAnswerData(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+
+	// a capture with just the header of the answer reads back as an
+	// answer with no question and no records
+	header := new(dns.Msg)
+	header.Id = query.Id
+	header.Response = true
+	addr := net.ParseIP("192.0.2.1")
+	var buf bytes.Buffer
+	err := WriteMessage(&buf, &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+		query_time: time.Unix(1476000000, 0), query: query,
+		answer_time: time.Unix(1476000001, 0), answer: header})
+	if err != nil {
+		t.Fatalf("WriteMessage() error: %s", err)
+	}
+	y, err := read_next_message(&buf)
+	if err != nil {
+		t.Fatalf("read_next_message() error: %s", err)
+	}
+	if !missing_answer_data(y.answer) {
+		t.Errorf("missing_answer_data() false for a header-only answer:\n%s", y.answer)
+	}
+
+	// real answers, even without records, are fine
+	nodata := empty_answer("", query)
+	truncated := new(dns.Msg)
+	truncated.Response = true
+	truncated.Truncated = true
+	formerr := new(dns.Msg)
+	formerr.Response = true
+	formerr.Rcode = dns.RcodeFormatError
+	for _, answer := range []*dns.Msg{nodata, truncated, formerr} {
+		if missing_answer_data(answer) {
+			t.Errorf("missing_answer_data() true for:\n%s", answer)
+		}
+	}
+
+	// the query is skipped, rather than reporting every Yeti record
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	done := make(chan bool, 1)
+	yeti_query(done, new(report_conf), srvs, &query_conf{clear_names: true, quiet: true}, nil, nil,
+		y.query, y.answer, time.Millisecond, &addr)
+	<-done
+	if len(*sent) != 0 {
+		t.Errorf("%d queries sent for a capture missing answer data", len(*sent))
+	}
+	if srvs.skips[SKIP_NO_ANSWER] != 1 {
+		t.Errorf("capture missing answer data not counted as skipped: %v", srvs.skips)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := new_sampler(0.1, 42)
+	count := 0
+	var picks []bool
+	for n := 0; n < 10000; n++ {
+		pick := s.sample()
+		picks = append(picks, pick)
+		if pick {
+			count += 1
+		}
+	}
+	if (count < 900) || (count > 1100) {
+		t.Errorf("sample of 0.1 picked %d of 10000 messages", count)
+	}
+	// the same seed picks the same messages
+	s = new_sampler(0.1, 42)
+	for n, pick := range picks {
+		if s.sample() != pick {
+			t.Fatalf("sampler with the same seed differs at message %d", n)
+		}
+	}
+	// everything is picked when sampling is off
+	s = new_sampler(1, 0)
+	for n := 0; n < 100; n++ {
+		if !s.sample() {
+			t.Fatalf("sample of 1 skipped a message")
+		}
+	}
+}
+
+func TestDiffDirFileName(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	cases := []struct {
+		qname string
+		qtype string
+		want  string
+	}{
+		{"www.Example.", "A", "www.example_a_2001_db8__1.diff"},
+		{".", "SOA", "root_soa_2001_db8__1.diff"},
+		{"a/b\\c d.", "TXT", "a_b_c_d_txt_2001_db8__1.diff"},
+		{"../../etc/passwd.", "A", "_.._etc_passwd_a_2001_db8__1.diff"},
+	}
+	for _, c := range cases {
+		got := diff_dir_file_name(c.qname, c.qtype, ip)
+		if got != c.want {
+			t.Errorf("diff_dir_file_name(%q, %s) == %q, want %q", c.qname, c.qtype, got, c.want)
+		}
+	}
+
+	// long names are cut short, and keep apart with a hash of the name
+	label := strings.Repeat("a", 63)
+	long1 := `\000` + label + "." + label + "." + label + "." + label + "."
+	long2 := `\001` + label + "." + label + "." + label + "." + label + "."
+	name1 := diff_dir_file_name(long1, "TYPE65535", net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	name2 := diff_dir_file_name(long2, "TYPE65535", net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	if name1 == name2 {
+		t.Errorf("diff_dir_file_name() == %q for two different long names", name1)
+	}
+	dump_name := dump_file_base(long1, "TYPE65535", net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), time.Now()) + "_query.bin"
+	if (len(name1) > 255) || (len(dump_name) > 255) {
+		t.Errorf("file names %q and %q longer than 255 characters", name1, dump_name)
+	}
+}
+
+func TestYetiQueryDiffDir(t *testing.T) {
+	// the first server agrees with IANA, the second adds an extra NS
+	answer := func(server string, query *dns.Msg) *dns.Msg {
+		resp := empty_answer(server, query)
+		if server == "[2001:db8::2]:53" {
+			rr, _ := dns.NewRR("example. 172800 IN NS ns.other.")
+			resp.Ns = append(resp.Ns, rr)
+		}
+		return resp
+	}
+	_, restore := mock_dns_query(answer)
+	defer restore()
+
+	dir := t.TempDir() + "/diffs"
+	dd, err := open_diff_dir(dir)
+	if err != nil {
+		t.Fatalf("open_diff_dir() error: %s", err)
+	}
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, "all")
+	qcfg := query_conf{clear_names: true, diff_dir: dd}
+	// several copies of the same query at once all get written
+	done := make(chan bool, 5)
+	for n := 0; n < 5; n++ {
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.", dns.TypeA)
+		addr := net.ParseIP("192.0.2.1")
+		go yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+	}
+	for n := 0; n < 5; n++ {
+		<-done
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading differences directory: %s", err)
+	}
+	if (len(files) != 1) || (files[0].Name() != "www.example_a_2001_db8__2.diff") {
+		t.Fatalf("expected only a file for the second server, got %v", files)
+	}
+	contents, err := os.ReadFile(dir + "/" + files[0].Name())
+	if err != nil {
+		t.Fatalf("Error reading differences file: %s", err)
+	}
+	if strings.Count(string(contents), "Authority section, Yeti only:") != 5 {
+		t.Errorf("expected 5 sets of differences, got:\n%s", contents)
+	}
+}
+
+func TestCompareMessagesEOF(t *testing.T) {
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		// make sure the comparison is still running when the input ends
+		time.Sleep(20 * time.Millisecond)
+		return empty_answer(server, query)
+	})
+	defer restore()
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	addr := net.ParseIP("192.0.2.1")
+	messages := make(chan *ymmv_message)
+	go func() {
+		messages <- &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+			query: query, answer: empty_answer("", query)}
+		messages <- nil
+	}()
+
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	qcfg := query_conf{clear_names: true}
+	finished := make(chan bool)
+	go func() {
+		compare_messages(messages, 0, new_sampler(1, 0), new(report_conf), srvs, &qcfg, nil, nil)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("compare_messages() did not return at the end of input")
+	}
+	// the comparison in progress finished before we returned
+	srvs.lock.Lock()
+	defer srvs.lock.Unlock()
+	if srvs.outcomes[outcome_equivalent] != 1 {
+		t.Errorf("%d equivalent answers after end of input, expected 1", srvs.outcomes[outcome_equivalent])
+	}
+}
+
+func TestCompareMessagesQtype(t *testing.T) {
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+
+	qtypes, err := parse_qtypes("ns, dnskey")
+	if err != nil {
+		t.Fatalf("parse_qtypes() error: %s", err)
+	}
+	if _, err := parse_qtypes("NS,NOTATYPE"); err == nil {
+		t.Errorf("parse_qtypes() with an unknown type should fail")
+	}
+
+	addr := net.ParseIP("192.0.2.1")
+	messages := make(chan *ymmv_message)
+	go func() {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeNS, dns.TypeAAAA, dns.TypeDNSKEY, dns.TypeNS} {
+			query := new(dns.Msg)
+			query.SetQuestion("example.", qtype)
+			messages <- &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+				query: query, answer: empty_answer("", query)}
+		}
+		messages <- nil
+	}()
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	qcfg := query_conf{clear_names: true, qtypes: qtypes}
+	compare_messages(messages, 0, new_sampler(1, 0), new(report_conf), srvs, &qcfg, nil, nil)
+
+	if srvs.skips[SKIP_QTYPE] != 2 {
+		t.Errorf("%d messages skipped for their query type, expected 2", srvs.skips[SKIP_QTYPE])
+	}
+	if len(*sent) != 3 {
+		t.Fatalf("%d queries sent, expected 3", len(*sent))
+	}
+	for _, query := range *sent {
+		if !qtypes[query.Question[0].Qtype] {
+			t.Errorf("query for type %s sent", dns.TypeToString[query.Question[0].Qtype])
+		}
+	}
+}
+
+func TestCompareMessagesName(t *testing.T) {
+	sent, restore := mock_dns_query(empty_answer)
+	defer restore()
+
+	names, err := parse_name_patterns("Example.COM, *.test")
+	if err != nil {
+		t.Fatalf("parse_name_patterns() error: %s", err)
+	}
+	qcfg := query_conf{clear_names: true, names: names}
+	cases := []struct {
+		qname    string
+		selected bool
+	}{
+		{"example.com.", true},
+		{"EXAMPLE.com", true},
+		{"www.example.com.", false},
+		{"a.test.", true},
+		{"www.A.Test.", true},
+		{"test.", false},
+		{"example.org.", false},
+	}
+	addr := net.ParseIP("192.0.2.1")
+	messages := make(chan *ymmv_message)
+	go func() {
+		for _, c := range cases {
+			query := new(dns.Msg)
+			query.SetQuestion(c.qname, dns.TypeA)
+			if qcfg.select_name(query) != c.selected {
+				t.Errorf("select_name(%q) == %t, want %t", c.qname, !c.selected, c.selected)
+			}
+			messages <- &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+				query: query, answer: empty_answer("", query)}
+		}
+		messages <- nil
+	}()
+	srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+	compare_messages(messages, 0, new_sampler(1, 0), new(report_conf), srvs, &qcfg, nil, nil)
+
+	if srvs.skips[SKIP_NAME] != 3 {
+		t.Errorf("%d messages skipped for their name, expected 3", srvs.skips[SKIP_NAME])
+	}
+	if len(*sent) != 4 {
+		t.Errorf("%d queries sent, expected 4", len(*sent))
+	}
+}
+
+func TestCompareMessagesMaxOutstanding(t *testing.T) {
+	var lock sync.Mutex
+	running, most := 0, 0
+	_, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+		lock.Lock()
+		running += 1
+		if running > most {
+			most = running
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		running -= 1
+		lock.Unlock()
+		return empty_answer(server, query)
+	})
+	defer restore()
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	addr := net.ParseIP("192.0.2.1")
+	for _, limit := range []int{1, 3} {
+		messages := make(chan *ymmv_message)
+		go func() {
+			for n := 0; n < 10; n++ {
+				messages <- &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+					query: query, answer: empty_answer("", query)}
+			}
+			messages <- nil
+		}()
+		most = 0
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+		qcfg := query_conf{clear_names: true}
+		compare_messages(messages, limit, new_sampler(1, 0), new(report_conf), srvs, &qcfg, nil, nil)
+		if (most < 1) || (most > limit) {
+			t.Errorf("%d comparisons at once with a limit of %d", most, limit)
+		}
+		if srvs.outcomes[outcome_equivalent] != 10 {
+			t.Errorf("%d comparisons done with a limit of %d, expected 10",
+				srvs.outcomes[outcome_equivalent], limit)
+		}
+	}
+}
+
+func TestMessageReaderFiles(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for _, qname := range []string{"one.example.", "two.example."} {
+		query := new(dns.Msg)
+		query.SetQuestion(qname, dns.TypeA)
+		addr := net.ParseIP("192.0.2.1")
+		var buf bytes.Buffer
+		for n := 0; n < 2; n++ {
+			WriteMessage(&buf, &ymmv_message{ip_family: 4, ip_protocol: 'u', addr: &addr,
+				query_time: time.Unix(1476000000, 0), query: query,
+				answer_time: time.Unix(1476000001, 0), answer: empty_answer("", query)})
+		}
+		name := dir + "/" + qname + "ymmv"
+		os.WriteFile(name, buf.Bytes(), 0644)
+		names = append(names, name)
+	}
+
+	messages := make(chan *ymmv_message)
+	go message_reader(names, messages)
+	var got []string
+	for y := range messages {
+		if y == nil {
+			break
+		}
+		got = append(got, y.query.Question[0].Name)
+	}
+	want := []string{"one.example.", "one.example.", "two.example.", "two.example."}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("read %q from the files, want %q", got, want)
+	}
+}
+
+// A message as captured before the format had a version: a query for
+// example. NS to 192.0.2.1 over UDP, and an NXDOMAIN answer.
+const unversioned_message = "796d6d76" + "3475" + "c0000201" +
+	"57f9f900" + "00000000" + "0019" + "123401000001000000000000076578616d706c650000020001" +
+	"57f9f900" + "00000000" + "0019" + "123481030001000000000000076578616d706c650000020001"
+
+func TestReadNextMessageVersion(t *testing.T) {
+	unversioned, _ := hex.DecodeString(unversioned_message)
+	// the same message, with a version 0 byte after the magic
+	version_0 := append([]byte("ymmv\x00"), unversioned[4:]...)
+	for _, raw := range [][]byte{unversioned, version_0} {
+		y, err := read_next_message(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("read_next_message() error: %s", err)
+		}
+		if (y.ip_family != 4) || (y.ip_protocol != 'u') || !y.addr.Equal(net.ParseIP("192.0.2.1")) ||
+			!y.query_time.Equal(time.Unix(1476000000, 0)) {
+			t.Errorf("read IPv%d %c %s at %s", y.ip_family, y.ip_protocol, y.addr, y.query_time)
+		}
+		if (y.query.Question[0].Name != "example.") || (y.answer.Rcode != dns.RcodeNameError) {
+			t.Errorf("read query %s and answer %s", y.query, y.answer)
+		}
+		records, problems := validate_framing(bytes.NewReader(raw), new(bytes.Buffer))
+		if (records != 1) || (problems != 0) {
+			t.Errorf("validate_framing() found %d records and %d problems", records, problems)
+		}
+	}
+
+	// a version we don't know is an error
+	version_2 := append([]byte("ymmv\x02"), unversioned[4:]...)
+	_, err := read_next_message(bytes.NewReader(version_2))
+	if (err == nil) || (err.Error() != "offset 4: Unsupported ymmv format version 2") {
+		t.Errorf("read_next_message() for version 2 returned %v", err)
+	}
+}
+
+func TestCompareRRSIG(t *testing.T) {
+	rrsig := func(algorithm int, signer string, sig string) dns.RR {
+		rr, err := dns.NewRR(fmt.Sprintf("example. 86400 IN RRSIG DS %d 1 86400 "+
+			"20171201000000 20171101000000 12345 %s %s", algorithm, signer, sig))
+		if err != nil {
+			t.Fatalf("Error making RRSIG: %s", err)
+		}
+		return rr
+	}
+	ds, _ := dns.NewRR("example. 86400 IN DS 12345 8 2 0123456789abcdef")
+	resp := func(sig dns.RR) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.", dns.TypeA)
+		msg.Ns = []dns.RR{ds, sig}
+		msg.Extra = []dns.RR{dns.Copy(sig)}
+		return msg
+	}
+	iana := resp(rrsig(8, ".", "aWFuYQ=="))
+	dnssec := &compare_conf{dnssec: true}
+	cases := []struct {
+		desc  string
+		yeti  *dns.Msg
+		ccfg  *compare_conf
+		diffs int
+	}{
+		{"only the signature differs", resp(rrsig(8, ".", "eWV0aQ==")), dnssec, 0},
+		{"the algorithm differs", resp(rrsig(13, ".", "aWFuYQ==")), dnssec, 4},
+		{"the signer differs", resp(rrsig(8, "example.", "aWFuYQ==")), dnssec, 4},
+		{"the algorithm differs without -dnssec", resp(rrsig(13, ".", "aWFuYQ==")), new(compare_conf), 0},
+	}
+	for _, c := range cases {
+		diffs := compare_resp(iana.Copy(), c.yeti.Copy(), c.ccfg).Diffs()
+		if len(diffs) != c.diffs {
+			t.Errorf("compare_resp() when %s == %q, expected %d differences", c.desc, diffs, c.diffs)
+		}
+	}
+
+	// a missing signature is a difference too
+	yeti := iana.Copy()
+	yeti.Ns = yeti.Ns[:1]
+	result := compare_resp(iana.Copy(), yeti, dnssec)
+	if (len(result.Authority.IanaOnly) != 1) || (len(result.Authority.YetiOnly) != 0) {
+		t.Errorf("compare_resp() with a missing RRSIG == %q", result.Diffs())
+	}
+}
+
+func TestTTLTolerance(t *testing.T) {
+	resp := func(ttl int) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.", dns.TypeA)
+		ns, _ := dns.NewRR(fmt.Sprintf("example. %d IN NS ns.example.", ttl))
+		glue, _ := dns.NewRR(fmt.Sprintf("ns.example. %d IN A 192.0.2.1", ttl))
+		msg.Ns = []dns.RR{ns}
+		msg.Extra = []dns.RR{glue}
+		return msg
+	}
+	cases := []struct {
+		iana_ttl  int
+		yeti_ttl  int
+		tolerance uint32
+		diffs     int
+	}{
+		// exact matching by default
+		{172800, 172800, 0, 0},
+		{172800, 172790, 0, 4},
+		// within the tolerance, either way
+		{172800, 172790, 10, 0},
+		{172790, 172800, 10, 0},
+		// outside the tolerance
+		{172800, 172789, 10, 4},
+		{172789, 172800, 10, 4},
+		// no overflow with a huge tolerance
+		{4294967295, 0, 4294967295, 0},
+	}
+	for _, c := range cases {
+		ccfg := &compare_conf{ttl_tolerance: c.tolerance}
+		diffs := compare_resp(resp(c.iana_ttl), resp(c.yeti_ttl), ccfg).Diffs()
+		if len(diffs) != c.diffs {
+			t.Errorf("compare_resp() with TTLs %d and %d, tolerance %d == %q, expected %d differences",
+				c.iana_ttl, c.yeti_ttl, c.tolerance, diffs, c.diffs)
+		}
+	}
+
+	// records in an additional RRset sort by TTL, so the TTLs within the
+	// tolerance can put them in a different order on each side
+	glue := func(ttls map[string]int) *dns.Msg {
+		msg := resp(172800)
+		msg.Extra = nil
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+			rr, _ := dns.NewRR(fmt.Sprintf("ns.example. %d IN A %s", ttls[ip], ip))
+			msg.Extra = append(msg.Extra, rr)
+		}
+		return msg
+	}
+	iana := glue(map[string]int{"192.0.2.1": 172800, "192.0.2.2": 172790})
+	yeti := glue(map[string]int{"192.0.2.1": 172795, "192.0.2.2": 172800})
+	diffs := compare_resp(iana, yeti, &compare_conf{ttl_tolerance: 10}).Diffs()
+	if len(diffs) != 0 {
+		t.Errorf("compare_resp() with glue in a different TTL order == %q, expected no differences", diffs)
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	var delays []time.Duration
+	orig_sleep := recheck_sleep
+	defer func() { recheck_sleep = orig_sleep }()
+	recheck_sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	cases := []struct {
+		// number of answers that differ before the server agrees
+		bad     int
+		recheck int
+		want    outcome
+		sent    int
+	}{
+		// the difference goes away on the first recheck
+		{1, 3, outcome_transient, 2},
+		// or on the last one
+		{3, 3, outcome_transient, 4},
+		// but not if we run out of rechecks
+		{3, 2, outcome_different, 3},
+		// nor if we don't recheck at all
+		{1, 0, outcome_different, 1},
+		// and an answer that agrees is never rechecked
+		{0, 3, outcome_equivalent, 1},
+	}
+	for _, c := range cases {
+		bad := c.bad
+		sent, restore := mock_dns_query(func(server string, query *dns.Msg) *dns.Msg {
+			resp := empty_answer(server, query)
+			if bad > 0 {
+				resp.Authoritative = true
+				bad -= 1
+			}
+			return resp
+		})
+		delays = nil
+		query := new(dns.Msg)
+		query.SetQuestion("example.", dns.TypeNS)
+		var out bytes.Buffer
+		qcfg := query_conf{clear_names: true, recheck: c.recheck, json_out: new_json_writer(&out)}
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, empty_answer("", query),
+			time.Millisecond, &addr)
+		<-done
+		restore()
+
+		if (len(*sent) != c.sent) || (len(delays) != c.sent-1) {
+			t.Errorf("%d bad answers, %d rechecks: %d queries sent after %d delays, expected %d",
+				c.bad, c.recheck, len(*sent), len(delays), c.sent)
+		}
+		if srvs.outcomes[c.want] != 1 {
+			t.Errorf("%d bad answers, %d rechecks: outcomes %v, expected %s",
+				c.bad, c.recheck, srvs.outcomes, c.want)
+		}
+		// the differences are still in the JSON, marked as transient
+		transient := c.want == outcome_transient
+		if !strings.Contains(out.String(), fmt.Sprintf(`"transient":%t`, transient)) ||
+			(strings.Contains(out.String(), "Authoritative flag mismatch") != (c.bad > 0)) {
+			t.Errorf("%d bad answers, %d rechecks: JSON %s", c.bad, c.recheck, out.String())
+		}
+	}
+}
+
+func TestRefreshIana(t *testing.T) {
+	// the zone has a new NS record since the capture, which both IANA
+	// and Yeti now have
+	new_ns, _ := dns.NewRR("example. 172800 IN NS ns2.example.")
+	var fail_iana bool
+	var sent []*dns.Msg
+	orig := dns_query
+	defer func() { dns_query = orig }()
+	dns_query = func(server string, query *dns.Msg, opts *dnsstub.DnsQueryOpts) (*dns.Msg, time.Duration, error) {
+		sent = append(sent, query.Copy())
+		if fail_iana && (server == "198.51.100.53:5353") {
+			return nil, 0, errors.New("i/o timeout")
+		}
+		resp := empty_answer(server, query)
+		resp.Ns = append(resp.Ns, new_ns)
+		return resp, time.Millisecond, nil
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	captured := empty_answer("", query)
+	for _, c := range []struct {
+		iana_server net.IP
+		fail_iana   bool
+		sent        int
+		want        outcome
+	}{
+		// the captured answer is out of date
+		{nil, false, 1, outcome_different},
+		// but the fresh one is the same
+		{net.ParseIP("198.51.100.53"), false, 2, outcome_equivalent},
+		// and without a fresh answer there is nothing to compare, though
+		// Yeti is still asked
+		{net.ParseIP("198.51.100.53"), true, 2, outcome_iana_error},
+	} {
+		fail_iana = c.fail_iana
+		sent = nil
+		qcfg := query_conf{clear_names: true, iana_server: c.iana_server, iana_port: 5353, edns_size: 1232}
+		srvs := init_yeti_server_set([]net.IP{net.ParseIP("2001:db8::1")}, "all")
+		done := make(chan bool, 1)
+		addr := net.ParseIP("192.0.2.1")
+		yeti_query(done, new(report_conf), srvs, &qcfg, nil, nil, query, captured, time.Millisecond, &addr)
+		<-done
+
+		if (len(sent) != c.sent) || (srvs.outcomes[c.want] != 1) {
+			t.Errorf("IANA server %v: %d queries sent, outcomes %v, expected %d and %s",
+				c.iana_server, len(sent), srvs.outcomes, c.sent, c.want)
+		}
+		// IANA gets the same query as Yeti
+		if (c.iana_server != nil) && !c.fail_iana {
+			if sent[0].String() != sent[1].String() {
+				t.Errorf("IANA query differs from Yeti query:\n%s\n%s", sent[0], sent[1])
+			}
+			if opt := sent[0].IsEdns0(); (opt == nil) || (opt.UDPSize() != 1232) {
+				t.Errorf("IANA query has OPT %v, expected buffer size 1232", opt)
+			}
+		}
+	}
+}